@@ -35,6 +35,7 @@ func TestAzure(t *testing.T) {
 	layerUrl := "http://localhost:19898/datasets"
 	var plainContainerURL azblob.ContainerURL
 	var parquetContainerURL azblob.ContainerURL
+	var csvContainerURL azblob.ContainerURL
 
 	g.Describe("The azure storage", func() {
 		var endpoint string
@@ -92,9 +93,11 @@ func TestAzure(t *testing.T) {
 			//ctx := context.Background()
 			plainContainerURL = serviceURL.NewContainerURL("azure-plain")
 			parquetContainerURL = serviceURL.NewContainerURL("azure-parquet")
+			csvContainerURL = serviceURL.NewContainerURL("azure-csv")
 			// Create the container on the service (with no metadata and public access)
 			plainContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
 			parquetContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
+			csvContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
 		})
 		g.After(func() {
 			if azureContainer != nil {
@@ -114,6 +117,8 @@ func TestAzure(t *testing.T) {
 			_, _ = plainContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
 			_, _ = parquetContainerURL.Delete(ctx, azblob.ContainerAccessConditions{})
 			_, _ = parquetContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
+			_, _ = csvContainerURL.Delete(ctx, azblob.ContainerAccessConditions{})
+			_, _ = csvContainerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessContainer)
 
 			stdErr := os.Stderr
 			stdOut := os.Stdout
@@ -136,18 +141,55 @@ func TestAzure(t *testing.T) {
 			g.Assert(strings.Contains(body, "{\"name\":\"azure-plain\",\"type\":[\"POST\"]}")).IsTrue()
 		})
 
-		g.It("Should reject attempts to upload fullsyncs", func() {
+		g.It("Should only publish fullsyncs when the sync ends", func() {
+			g.Timeout(1 * time.Minute)
 			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
 			g.Assert(err).IsNil()
-			req, _ := http.NewRequest("POST", layerUrl+"/azure-plain/entities", strings.NewReader(string(fileBytes)))
+			req, _ := http.NewRequest("POST", layerUrl+"/azure-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
 			req.Header.Add("universal-data-api-full-sync-start", "true")
 			req.Header.Add("universal-data-api-full-sync-id", "42")
 			res, err := http.DefaultClient.Do(req)
 			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			req, _ = http.NewRequest("POST", layerUrl+"/azure-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+			g.Assert(len(GetBlobItems(plainContainerURL, ""))).Eql(0, "nothing committed before end")
+
+			req, _ = http.NewRequest("POST", layerUrl+"/azure-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-end", "true")
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			items := GetBlobItems(plainContainerURL, "")
+			g.Assert(len(items)).Eql(1)
+			content := ReadBlobContents(plainContainerURL, items[0].Name, uint64(*items[0].Properties.ContentLength))
+			var entities []map[string]interface{}
+			err = json.Unmarshal(content, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(9)
+		})
+
+		g.It("Should reject fullsync batches with unknown fullsync id", func() {
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			req, _ := http.NewRequest("POST", layerUrl+"/azure-plain/entities", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-start", "true")
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err := http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			req, _ = http.NewRequest("POST", layerUrl+"/azure-plain/entities", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-id", "43")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
 			g.Assert(res.StatusCode).Eql(400)
-			bodyBytes, _ := ioutil.ReadAll(res.Body)
-			body := string(bodyBytes)
-			g.Assert(body).Eql("{\"message\":\"full sync not supported on dataset type\"}\n")
 		})
 
 		g.It("Should accept incremental file uploads", func() {
@@ -196,6 +238,44 @@ func TestAzure(t *testing.T) {
 			g.Assert(string(row["id"].([]byte))).Eql("a:1")
 			g.Assert(string(row["firstname"].([]byte))).Eql("Frank")
 		})
+
+		g.It("Should return changes from incremental csv uploads", func() {
+			g.Timeout(10 * time.Second)
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			res, err := http.DefaultClient.Post(layerUrl+"/azure-csv/entities",
+				"application/json", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+			time.Sleep(1 * time.Second) //need 1 second to get different blob timestamps
+			fileBytes, err = ioutil.ReadFile("./resources/test/data/changes-1.json")
+			g.Assert(err).IsNil()
+			res, err = http.DefaultClient.Post(layerUrl+"/azure-csv/entities",
+				"application/json", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			resp, err := http.Get(layerUrl + "/azure-csv/changes")
+			g.Assert(err).IsNil()
+			g.Assert(resp.StatusCode).Eql(200)
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+			var entities []map[string]interface{}
+			err = json.Unmarshal(bodyBytes, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(6, "context, continuation and 4 changes")
+			g.Assert(entities[1]["id"]).Eql("a:1")
+			g.Assert(entities[1]["props"].(map[string]interface{})["a:firstname"]).Eql("Frank")
+			continuationToken := entities[5]["token"].(string)
+
+			resp, err = http.Get(fmt.Sprintf("%s/azure-csv/changes?since=%s", layerUrl, continuationToken))
+			g.Assert(err).IsNil()
+			g.Assert(resp.StatusCode).Eql(200)
+			bodyBytes, _ = ioutil.ReadAll(resp.Body)
+			err = json.Unmarshal(bodyBytes, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(2, "context and continuation")
+			g.Assert(entities[1]["token"]).Eql(continuationToken)
+		})
 	})
 }
 
@@ -0,0 +1,241 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/docker/go-connections/nat"
+	"github.com/franela/goblin"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.uber.org/fx"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/app"
+)
+
+func TestGCS(t *testing.T) {
+	g := goblin.Goblin(t)
+	var fxApp *fx.App
+	layerUrl := "http://localhost:19897/datasets"
+	var bucket *storage.BucketHandle
+
+	g.Describe("The gcs storage", func() {
+		var endpoint string
+		ctx, cancel := context.WithCancel(context.Background())
+		var gcsContainer testcontainers.Container
+		g.Before(func() {
+			os.Setenv("SERVER_PORT", "19897")
+			os.Setenv("AUTHORIZATION_MIDDLEWARE", "noop")
+
+			req := testcontainers.ContainerRequest{
+				Image:        "fsouza/fake-gcs-server",
+				ExposedPorts: []string{"4443"},
+				Cmd:          []string{"-scheme", "http", "-port", "4443"},
+				WaitingFor:   wait.ForLog("server started"),
+			}
+			var err error
+			gcsContainer, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+				ContainerRequest: req,
+				Started:          true,
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			actualPort, _ := gcsContainer.MappedPort(ctx, nat.Port("4443/tcp"))
+			ip, _ := gcsContainer.Host(ctx)
+			endpoint = ip + ":" + actualPort.Port()
+
+			client, err := storage.NewClient(ctx,
+				option.WithEndpoint("http://"+endpoint+"/storage/v1/"), option.WithoutAuthentication())
+			if err != nil {
+				t.Error(err)
+			}
+			bucket = client.Bucket("gcs-test-bucket")
+			_ = bucket.Create(ctx, "local", nil)
+		})
+		g.After(func() {
+			if gcsContainer != nil {
+				_ = gcsContainer.Terminate(ctx)
+			}
+			if fxApp != nil {
+				fxApp.Stop(ctx)
+			}
+			cancel()
+		})
+		g.BeforeEach(func() {
+			if fxApp != nil {
+				fxApp.Stop(ctx)
+			}
+			//reset bucket
+			for _, attrs := range GetObjects(t, bucket, "") {
+				_ = bucket.Object(attrs.Name).Delete(ctx)
+			}
+
+			stdErr := os.Stderr
+			stdOut := os.Stdout
+			devNull, _ := os.Open("/dev/null")
+			os.Stderr = devNull
+			os.Stdout = devNull
+			testConf := replaceTestConf("./resources/test/gcs-test-config.json", endpoint, t)
+			defer os.Remove(testConf.Name())
+			os.Setenv("CONFIG_LOCATION", "file://"+testConf.Name())
+			fxApp, _ = app.Start(ctx)
+			os.Stderr = stdErr
+			os.Stdout = stdOut
+		})
+
+		g.It("Should accept incremental file uploads", func() {
+			g.Timeout(1 * time.Minute)
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			res, err := http.DefaultClient.Post(layerUrl+"/gcs-plain/entities",
+				"application/json", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			objects := GetObjects(t, bucket, "datasets/gcs-plain/changes/")
+			g.Assert(len(objects)).Eql(1)
+			var entities []map[string]interface{}
+			err = json.Unmarshal(ReadObjectContents(t, bucket, objects[0].Name), &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(3)
+		})
+
+		g.It("Should only publish fullsyncs when the sync ends", func() {
+			g.Timeout(1 * time.Minute)
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			req, _ := http.NewRequest("POST", layerUrl+"/gcs-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-start", "true")
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err := http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			req, _ = http.NewRequest("POST", layerUrl+"/gcs-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+			g.Assert(len(GetObjects(t, bucket, "datasets/gcs-plain/"))).Eql(0, "nothing published before end")
+
+			req, _ = http.NewRequest("POST", layerUrl+"/gcs-plain/entities?batchSize=1", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-end", "true")
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			objects := GetObjects(t, bucket, "datasets/gcs-plain/entities/")
+			g.Assert(len(objects)).Eql(1)
+			var entities []map[string]interface{}
+			err = json.Unmarshal(ReadObjectContents(t, bucket, objects[0].Name), &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(9)
+
+			resp, err := http.Get(layerUrl + "/gcs-plain/entities")
+			g.Assert(err).IsNil()
+			g.Assert(resp.StatusCode).Eql(200)
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+			err = json.Unmarshal(bodyBytes, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(11, "context, continuation and 9 entities")
+		})
+
+		g.It("Should reject fullsync batches with unknown fullsync id", func() {
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			req, _ := http.NewRequest("POST", layerUrl+"/gcs-plain/entities", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-start", "true")
+			req.Header.Add("universal-data-api-full-sync-id", "42")
+			res, err := http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			req, _ = http.NewRequest("POST", layerUrl+"/gcs-plain/entities", bytes.NewReader(fileBytes))
+			req.Header.Add("universal-data-api-full-sync-id", "43")
+			res, err = http.DefaultClient.Do(req)
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(400)
+		})
+
+		g.It("Should return changes from incremental csv uploads", func() {
+			g.Timeout(10 * time.Second)
+			fileBytes, err := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			g.Assert(err).IsNil()
+			res, err := http.DefaultClient.Post(layerUrl+"/gcs-csv/entities",
+				"application/json", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+			time.Sleep(1 * time.Second) //need 1 second to get different object timestamps
+			fileBytes, err = ioutil.ReadFile("./resources/test/data/changes-1.json")
+			g.Assert(err).IsNil()
+			res, err = http.DefaultClient.Post(layerUrl+"/gcs-csv/entities",
+				"application/json", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+			g.Assert(res.StatusCode).Eql(200)
+
+			resp, err := http.Get(layerUrl + "/gcs-csv/changes")
+			g.Assert(err).IsNil()
+			g.Assert(resp.StatusCode).Eql(200)
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+			var entities []map[string]interface{}
+			err = json.Unmarshal(bodyBytes, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(6, "context, continuation and 4 changes")
+			g.Assert(entities[1]["id"]).Eql("a:1")
+			continuationToken := entities[5]["token"].(string)
+
+			resp, err = http.Get(fmt.Sprintf("%s/gcs-csv/changes?since=%s", layerUrl, continuationToken))
+			g.Assert(err).IsNil()
+			g.Assert(resp.StatusCode).Eql(200)
+			bodyBytes, _ = ioutil.ReadAll(resp.Body)
+			err = json.Unmarshal(bodyBytes, &entities)
+			g.Assert(err).IsNil()
+			g.Assert(len(entities)).Eql(2, "context and continuation")
+			g.Assert(entities[1]["token"]).Eql(continuationToken)
+		})
+	})
+}
+
+// GetObjects returns the attributes of all objects below prefix in the bucket
+func GetObjects(t *testing.T, bucket *storage.BucketHandle, prefix string) []*storage.ObjectAttrs {
+	var result []*storage.ObjectAttrs
+	it := bucket.Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return result
+		}
+		if err != nil {
+			t.Errorf("failed to list objects below %q: %v", prefix, err)
+			return result
+		}
+		result = append(result, attrs)
+	}
+}
+
+// ReadObjectContents returns the content of the named object in the bucket
+func ReadObjectContents(t *testing.T, bucket *storage.BucketHandle, name string) []byte {
+	r, err := bucket.Object(name).NewReader(context.Background())
+	if err != nil {
+		t.Errorf("failed to read object %s: %v", name, err)
+		return nil
+	}
+	defer r.Close()
+	content, _ := ioutil.ReadAll(r)
+	return content
+}
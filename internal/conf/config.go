@@ -23,14 +23,15 @@ func NewEnv() *Env {
 	logger.Infof("Config location: %s", viper.GetString("CONFIG_LOCATION"))
 
 	return &Env{
-		Logger:             logger,
-		Env:                profile,
-		Port:               viper.GetString("SERVER_PORT"),
-		ConfigLocation:     viper.GetString("CONFIG_LOCATION"),
-		RefreshInterval:    viper.GetString("CONFIG_REFRESH_INTERVAL"),
-		ServiceName:        viper.GetString("SERVICE_NAME"),
-		FullsyncTempFolder: viper.GetString("FULLSYNC_TEMP_FOLDER"),
-		FullsyncChunkSize:  viper.GetInt64("FULLSYNC_CHUNK_SIZE"),
+		Logger:                 logger,
+		Env:                    profile,
+		Port:                   viper.GetString("SERVER_PORT"),
+		ConfigLocation:         viper.GetString("CONFIG_LOCATION"),
+		RefreshInterval:        viper.GetString("CONFIG_REFRESH_INTERVAL"),
+		ServiceName:            viper.GetString("SERVICE_NAME"),
+		FullsyncTempFolder:     viper.GetString("FULLSYNC_TEMP_FOLDER"),
+		FullsyncChunkSize:      viper.GetInt64("FULLSYNC_CHUNK_SIZE"),
+		FullsyncMaxRequestSize: viper.GetInt64("FULLSYNC_MAX_REQUEST_SIZE"),
 		Auth: &AuthConfig{
 			WellKnown:     viper.GetString("TOKEN_WELL_KNOWN"),
 			Audience:      viper.GetString("TOKEN_AUDIENCE"),
@@ -49,7 +50,8 @@ func parseEnv(env string, logger *zap.SugaredLogger) {
 	viper.SetDefault("LOG_LEVEL", "INFO")
 	viper.SetDefault("CONFIG_REFRESH_INTERVAL", "@every 60s")
 	viper.SetDefault("SERVICE_NAME", "objectstorage-datalayer")
-	viper.SetDefault("FullsyncChunkSize", 5242880) //5242880  5MB is min value on chunk multipart s3
+	viper.SetDefault("FULLSYNC_CHUNK_SIZE", 5242880)         //5242880  5MB is min value on chunk multipart s3
+	viper.SetDefault("FULLSYNC_MAX_REQUEST_SIZE", 104857600) // 100MB
 
 	viper.AutomaticEnv()
 
@@ -17,6 +17,10 @@ type StorageBackend struct {
 	CsvConfig         *CsvConfig        `json:"csv"`
 	FlatFileConfig    *FlatFileConfig   `json:"flatFile"`
 	ParquetConfig     *ParquetConfig    `json:"parquet"`
+	AvroConfig        *AvroConfig       `json:"avro"`
+	XlsxConfig        *XlsxConfig       `json:"xlsx"`
+	XmlConfig         *XmlConfig        `json:"xml"`
+	RdfConfig         *RdfConfig        `json:"rdf"`
 	Properties        PropertiesMapping `json:"props"`
 	DecodeConfig      *DecodeConfig     `json:"decode"`
 	LocalFileConfig   *LocalFileConfig  `json:"localfileconfig"`
@@ -24,6 +28,19 @@ type StorageBackend struct {
 	OrderBy           [][]int           `json:"orderBy"`
 	DeliverOnceConfig DeliverOnceConfig `json:"deliverOnceConfig"`
 	OrderType         string            `json:"orderType"`
+	Compression       string            `json:"compression"`
+	FullSync          *FullSyncConfig   `json:"fullSync"`
+}
+
+// FullSyncConfig controls how fullsyncs staged in s3 are published
+type FullSyncConfig struct {
+	History     int `json:"history"`
+	MinEntities int `json:"minEntities"`
+	// Persistent keeps the state of fullsyncs in the bucket, so they can continue on any instance
+	Persistent bool `json:"persistent"`
+	// MaxPartitions is the number of partitions a fullsync of a partitioned dataset may write to, each with a writer
+	// and upload of its own
+	MaxPartitions int `json:"maxPartitions"`
 }
 
 type DecodeConfig struct {
@@ -64,6 +81,12 @@ type PropertiesMapping struct {
 	Endpoint           string  `json:"endpoint"`
 	Key                *string `json:"key,omitempty"`
 	Secret             *string `json:"secret,omitempty"` //Note, need to be called secret to be injected in injectSecrets in manager.go
+	HostKey            *string `json:"hostKey,omitempty"`
+	// InsecureSkipHostKeyCheck connects to sftp servers without verifying their identity
+	InsecureSkipHostKeyCheck *bool   `json:"insecureSkipHostKeyCheck,omitempty"`
+	RoleArn                  *string `json:"roleArn,omitempty"`
+	ExternalId               *string `json:"externalId,omitempty"`
+	WebIdentityTokenFile     *string `json:"webIdentityTokenFile,omitempty"`
 }
 
 type CsvConfig struct {
@@ -74,20 +97,74 @@ type CsvConfig struct {
 	SkipRows       int      `json:"skiprows"`
 	ValidateFields bool     `json:"validatefields"`
 	CustomFileName string   `json:"customFileName"`
+	// Columns, Quote and LineEnding format written csv files
+	Columns    map[string]CsvColumn `json:"columns"`
+	Quote      string               `json:"quote"`
+	LineEnding string               `json:"lineEnding"`
+}
+
+// CsvColumn formats the values of a column in written csv files
+type CsvColumn struct {
+	Decimals      *int   `json:"decimals"`
+	DateLayout    string `json:"dateLayout"`
+	ListSeparator string `json:"listSeparator"`
+	Ref           bool   `json:"ref"`
+	KeepNamespace bool   `json:"keepNamespace"`
+}
+
+type XlsxConfig struct {
+	Sheet          string   `json:"sheet"`
+	SheetIndex     int      `json:"sheetIndex"`
+	Header         bool     `json:"header"`
+	Order          []string `json:"order"`
+	SkipRows       int      `json:"skiprows"`
+	CustomFileName string   `json:"customFileName"`
+}
+
+type XmlConfig struct {
+	RecordPath     string            `json:"recordPath"`
+	Attributes     []string          `json:"attributes"`
+	Namespaces     map[string]string `json:"namespaces"`
+	Order          []string          `json:"order"`
+	CustomFileName string            `json:"customFileName"`
+}
+
+type RdfConfig struct {
+	Format         string            `json:"format"`
+	Graph          string            `json:"graph"`
+	Prefixes       map[string]string `json:"prefixes"`
+	DeletedMarkers bool              `json:"deletedMarkers"`
+	CustomFileName string            `json:"customFileName"`
 }
 
 type ParquetConfig struct {
-	SchemaDefinition string   `json:"schema"`
-	FlushThreshold   int64    `json:"flushThreshold"`
-	Partitioning     []string `json:"partitioning"`
+	SchemaDefinition string                  `json:"schema"`
+	FlushThreshold   int64                   `json:"flushThreshold"`
+	Partitioning     []string                `json:"partitioning"`
+	InferSchema      *ParquetSchemaInference `json:"inferSchema"`
+}
+
+// ParquetSchemaInference derives the parquet schema from the first entities of a batch or fullsync, when no
+// schema is given
+type ParquetSchemaInference struct {
+	SampleSize     int  `json:"sampleSize"`
+	KeepNamespaces bool `json:"keepNamespaces"`
+}
+
+type AvroConfig struct {
+	SchemaDefinition string `json:"schema"`
 }
 
 type FlatFileConfig struct {
-	Fields               map[string]FlatFileField `json:"fields"`
-	FieldOrder           []string                 `json:"fieldOrder"`
-	ContinueOnParseError bool                     `json:"continueOnParseError"`
-	CustomFileName       string                   `json:"customFileName"`
-	RawRecord            bool                     `json:"rawRecord"`
+	Fields               map[string]FlatFileField  `json:"fields"`
+	FieldOrder           []string                  `json:"fieldOrder"`
+	ContinueOnParseError bool                      `json:"continueOnParseError"`
+	CustomFileName       string                    `json:"customFileName"`
+	RawRecord            bool                      `json:"rawRecord"`
+	RecordType           *FlatFileField            `json:"recordType"`
+	Records              map[string]FlatFileRecord `json:"records"`
+	Encoding             string                    `json:"encoding"`
+	RecordLength         int                       `json:"recordLength"`
 }
 
 type FlatFileField struct {
@@ -95,6 +172,19 @@ type FlatFileField struct {
 	Type       string  `json:"type"`
 	Decimals   int     `json:"decimals"`
 	DateLayout string  `json:"dateLayout"`
+	Value      string  `json:"value"`
+	Aggregate  string  `json:"aggregate"`
+	Field      string  `json:"field"`
+}
+
+// FlatFileRecord is the field layout of lines with the record type code Code, in flat files mixing record types
+type FlatFileRecord struct {
+	Code       string                   `json:"code"`
+	Role       string                   `json:"role"`
+	Fields     map[string]FlatFileField `json:"fields"`
+	Emit       bool                     `json:"emit"`
+	Prefix     string                   `json:"prefix"`
+	IdProperty string                   `json:"idProperty"`
 }
 
 type DatahubAuthConfig struct {
@@ -13,7 +13,9 @@ type Env struct {
 	ServiceName        string
 	FullsyncChunkSize  int64
 	FullsyncTempFolder string
-	Auth               *AuthConfig
+	// FullsyncMaxRequestSize limits the size of requests to fullsyncs storing whole requests, 0 for no limit
+	FullsyncMaxRequestSize int64
+	Auth                   *AuthConfig
 }
 
 type AuthConfig struct {
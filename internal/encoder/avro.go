@@ -0,0 +1,611 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+var avroMagic = []byte("Obj\x01")
+
+// avroSchema is the parsed json form of an avro schema, used to map entity values to the declared field types.
+// named types are collected so that fields can refer to them by name.
+type avroSchema struct {
+	fields    []avroField
+	named     map[string]interface{}
+	fullNames map[uintptr]string
+}
+
+type avroField struct {
+	name   string
+	schema interface{}
+}
+
+func parseAvroSchema(definition string) (*avroSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal([]byte(definition), &root); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %w", err)
+	}
+	record, ok := root.(map[string]interface{})
+	if !ok || record["type"] != "record" {
+		return nil, errors.New("avro schema must be a record")
+	}
+	s := &avroSchema{named: map[string]interface{}{}, fullNames: map[uintptr]string{}}
+	s.collectNamed(root, "")
+	fields, _ := record["fields"].([]interface{})
+	for _, f := range fields {
+		field, _ := f.(map[string]interface{})
+		name, _ := field["name"].(string)
+		s.fields = append(s.fields, avroField{name: name, schema: field["type"]})
+	}
+	return s, nil
+}
+
+func (s *avroSchema) collectNamed(schema interface{}, namespace string) {
+	switch t := schema.(type) {
+	case []interface{}:
+		for _, branch := range t {
+			s.collectNamed(branch, namespace)
+		}
+	case map[string]interface{}:
+		if ns, ok := t["namespace"].(string); ok {
+			namespace = ns
+		}
+		if name, ok := t["name"].(string); ok {
+			fullName := name
+			if namespace != "" && !strings.Contains(name, ".") {
+				fullName = namespace + "." + name
+			}
+			s.named[name] = t
+			s.named[fullName] = t
+			s.fullNames[reflect.ValueOf(t).Pointer()] = fullName
+		}
+		if fields, ok := t["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if field, ok := f.(map[string]interface{}); ok {
+					s.collectNamed(field["type"], namespace)
+				}
+			}
+		}
+		s.collectNamed(t["items"], namespace)
+		s.collectNamed(t["values"], namespace)
+		if _, ok := t["type"].(string); !ok {
+			s.collectNamed(t["type"], namespace)
+		}
+	}
+}
+
+// resolve returns the schema of a named type reference, or the schema itself
+func (s *avroSchema) resolve(schema interface{}) interface{} {
+	if name, ok := schema.(string); ok {
+		if named, ok := s.named[name]; ok {
+			return named
+		}
+	}
+	return schema
+}
+
+// typeName returns the name goavro uses for a union branch
+func (s *avroSchema) typeName(schema interface{}) string {
+	switch t := schema.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		if fullName, ok := s.fullNames[reflect.ValueOf(t).Pointer()]; ok {
+			return fullName
+		}
+		typ, _ := t["type"].(string)
+		if logicalType, ok := t["logicalType"].(string); ok {
+			return typ + "." + logicalType
+		}
+		return typ
+	}
+	return ""
+}
+
+// toNative converts an entity value to the goavro native representation of the given schema
+func (s *avroSchema) toNative(value interface{}, schema interface{}) (interface{}, error) {
+	schema = s.resolve(schema)
+	if union, ok := schema.([]interface{}); ok {
+		if value == nil {
+			return nil, nil
+		}
+		var lastErr error
+		for _, branch := range union {
+			if branch == "null" {
+				continue
+			}
+			native, err := s.toNative(value, branch)
+			if err == nil {
+				return goavro.Union(s.typeName(s.resolve(branch)), native), nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+
+	typ := schema
+	var logicalType string
+	definition, isComplex := schema.(map[string]interface{})
+	if isComplex {
+		typ = definition["type"]
+		logicalType, _ = definition["logicalType"].(string)
+	}
+	switch typ {
+	case "null":
+		if value != nil {
+			return nil, fmt.Errorf("expected null, got %v", value)
+		}
+		return nil, nil
+	case "string", "enum":
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		if typ == "enum" {
+			return nil, fmt.Errorf("expected enum symbol, got %v", value)
+		}
+		return fmt.Sprintf("%v", value), nil
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case "int", "long":
+		if strings.HasPrefix(logicalType, "timestamp") || logicalType == "date" {
+			if v, ok := value.(string); ok {
+				if logicalType == "date" {
+					if t, err := time.Parse(dateLayout, v); err == nil {
+						return t, nil
+					}
+				}
+				return time.Parse(time.RFC3339, v)
+			}
+		}
+		i, err := toInt64(value)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "int" {
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return nil, fmt.Errorf("%v is out of range for avro int", value)
+			}
+			return int32(i), nil
+		}
+		return i, nil
+	case "float", "double":
+		f, err := toFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	case "bytes", "fixed":
+		if logicalType == "decimal" {
+			r, ok := new(big.Rat).SetString(fmt.Sprintf("%v", value))
+			if !ok {
+				return nil, fmt.Errorf("cannot convert %v to decimal", value)
+			}
+			return r, nil
+		}
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+	case "array":
+		var items []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			items = v
+		case []string:
+			for _, item := range v {
+				items = append(items, item)
+			}
+		default:
+			items = []interface{}{v}
+		}
+		result := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			native, err := s.toNative(item, definition["items"])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, native)
+		}
+		return result, nil
+	case "map", "record":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			break
+		}
+		result := make(map[string]interface{}, len(m))
+		if typ == "map" {
+			for k, v := range m {
+				native, err := s.toNative(v, definition["values"])
+				if err != nil {
+					return nil, err
+				}
+				result[k] = native
+			}
+			return result, nil
+		}
+		fields, _ := definition["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			v, ok := m[name]
+			if !ok {
+				continue
+			}
+			native, err := s.toNative(v, field["type"])
+			if err != nil {
+				return nil, err
+			}
+			result[name] = native
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("cannot convert %v of type %T to avro type %v", value, value, typ)
+}
+
+// fromNative unwraps union values of goavro native data, and turns logical types into json friendly values
+func (s *avroSchema) fromNative(value interface{}, schema interface{}) interface{} {
+	schema = s.resolve(schema)
+	if union, ok := schema.([]interface{}); ok {
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return value
+		}
+		for name, v := range wrapped {
+			for _, branch := range union {
+				if s.typeName(s.resolve(branch)) == name {
+					return s.fromNative(v, branch)
+				}
+			}
+			return v
+		}
+	}
+	definition, _ := schema.(map[string]interface{})
+	switch v := value.(type) {
+	case *big.Rat:
+		f, _ := v.Float64()
+		return f
+	case time.Time:
+		if definition["logicalType"] == "date" {
+			return v.Format(dateLayout)
+		}
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case []interface{}:
+		for i, item := range v {
+			v[i] = s.fromNative(item, definition["items"])
+		}
+		return v
+	case map[string]interface{}:
+		if definition["type"] == "map" {
+			for k, item := range v {
+				v[k] = s.fromNative(item, definition["values"])
+			}
+			return v
+		}
+		fields, _ := definition["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if item, ok := v[name]; ok {
+				v[name] = s.fromNative(item, field["type"])
+			}
+		}
+		return v
+	}
+	return value
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("cannot convert %v to integer without losing its fraction", value)
+		}
+		return int64(v), nil
+	case json.Number:
+		return v.Int64()
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v of type %T to integer", value, value)
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v of type %T to float", value, value)
+}
+
+// avroCompressionCodec returns the block compression of avro files. gzip is mapped to the deflate codec, which
+// is the same compression.
+func avroCompressionCodec(backend conf.StorageBackend) string {
+	if backend.Compression == CompressionGzip {
+		return goavro.CompressionDeflateLabel
+	}
+	return goavro.CompressionNullLabel
+}
+
+// AvroEncoder ********************** ENCODER ****************************************/
+
+// AvroEncoder writes avro object container files. Each written batch becomes one block of the file.
+type AvroEncoder struct {
+	backend conf.StorageBackend
+	writer  *io.PipeWriter
+	logger  *zap.SugaredLogger
+	open    bool
+	schema  *avroSchema
+	ocf     *goavro.OCFWriter
+}
+
+func (enc *AvroEncoder) Open() error {
+	schema, err := parseAvroSchema(enc.backend.AvroConfig.SchemaDefinition)
+	if err != nil {
+		enc.logger.Errorf("Failed to parse avro schema: %s", err)
+		return err
+	}
+	enc.schema = schema
+	enc.ocf, err = goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               enc.writer,
+		Schema:          enc.backend.AvroConfig.SchemaDefinition,
+		CompressionName: avroCompressionCodec(enc.backend),
+	})
+	if err != nil {
+		enc.logger.Errorf("Failed to create avro writer: %s", err)
+		return err
+	}
+	enc.open = true
+	return nil
+}
+
+func (enc *AvroEncoder) Write(entities []*uda.Entity) (int, error) {
+	if len(entities) == 0 {
+		return 0, nil
+	}
+	if !enc.open {
+		if err := enc.Open(); err != nil {
+			return 0, err
+		}
+	}
+
+	records := make([]interface{}, 0, len(entities))
+	for _, e := range entities {
+		props := uda.StripProps(e)
+		refs := uda.StripRefs(e)
+		record := make(map[string]interface{})
+		for _, f := range enc.schema.fields {
+			var val interface{}
+			ok := false
+			switch f.name {
+			case "deleted":
+				val, ok = e.IsDeleted, true
+			case "recorded":
+				val, ok = e.Recorded, true
+			}
+			if v, found := props[f.name]; found && v != nil {
+				val, ok = v, true
+			} else if v, found := refs[f.name]; found && v != nil {
+				val, ok = v, true
+			}
+			if !ok && f.name == "id" { // Allows for overriding entity id with id in props
+				val, ok = e.ID, true
+			}
+			if !ok {
+				continue
+			}
+			native, err := enc.schema.toNative(val, f.schema)
+			if err != nil {
+				return 0, fmt.Errorf("avro field %s: %w", f.name, err)
+			}
+			record[f.name] = native
+		}
+		records = append(records, record)
+	}
+	if err := enc.ocf.Append(records); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func (enc *AvroEncoder) Close() error {
+	if !enc.open {
+		// an empty container file still carries the schema
+		if err := enc.Open(); err != nil {
+			_ = enc.writer.CloseWithError(err)
+			return err
+		}
+	}
+	return enc.writer.Close()
+}
+
+func (enc *AvroEncoder) CloseWithError(err error) error {
+	return enc.writer.CloseWithError(err)
+}
+
+// AvroDecoder ********************** DECODER ****************************************/
+
+// AvroDecoder reads avro object container files into entities. Storage backends may stream several files into the
+// same reader, a new file is detected by its header after the last block of the previous one.
+type AvroDecoder struct {
+	backend  conf.StorageBackend
+	logger   *zap.SugaredLogger
+	reader   *io.PipeReader
+	br       *bufio.Reader
+	ocf      *goavro.OCFReader
+	schema   *avroSchema
+	open     bool
+	closed   bool
+	overhang []byte
+	since    string
+	fullSync bool
+}
+
+func (d *AvroDecoder) Read(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p))
+	var done bool
+	if len(d.overhang) > 0 {
+		buf = append(buf, d.overhang...)
+		d.overhang = nil
+	}
+
+	if !d.open {
+		d.open = true
+		d.br = bufio.NewReader(d.reader)
+		//start json array and add context as first entity
+		buf = append(buf, []byte("[")...)
+		buf = append(buf, []byte(buildContext(d.backend.DecodeConfig.Namespaces))...)
+		if n, err, done = d.flush(p, buf); done {
+			return
+		}
+	}
+
+	// append one entity per record, comma separated
+	for !d.closed {
+		var record map[string]interface{}
+		record, err = d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		var entityBytes []byte
+		entityBytes, err = toEntityBytes(record, d.backend)
+		if err != nil {
+			return
+		}
+		if entityBytes == nil {
+			continue
+		}
+		buf = append(buf, append([]byte(","), entityBytes...)...)
+		if n, err, done = d.flush(p, buf); done {
+			return
+		}
+	}
+
+	// add continuation token and close json array
+	if !d.closed {
+		d.closed = true
+		token := d.since
+		if d.fullSync {
+			token = ""
+		}
+		var sinceBytes []byte
+		sinceBytes, err = json.Marshal(map[string]interface{}{"id": "@continuation", "token": token})
+		if err != nil {
+			return
+		}
+		buf = append(buf, append([]byte(","), sinceBytes...)...)
+		buf = append(buf, []byte("]")...)
+	}
+	if n, err, done = d.flush(p, buf); done {
+		return
+	}
+	n = copy(p, buf)
+	return n, io.EOF
+}
+
+// next returns the next record of the stream, or io.EOF when all files are consumed
+func (d *AvroDecoder) next() (map[string]interface{}, error) {
+	for {
+		if d.ocf == nil || d.ocf.RemainingBlockItems() == 0 {
+			magic, _ := d.br.Peek(len(avroMagic))
+			if len(magic) == 0 {
+				return nil, io.EOF
+			}
+			if bytes.Equal(magic, avroMagic) {
+				ocf, err := goavro.NewOCFReader(d.br)
+				if err != nil {
+					return nil, err
+				}
+				schema, err := parseAvroSchema(ocf.Codec().Schema())
+				if err != nil {
+					return nil, err
+				}
+				d.ocf, d.schema = ocf, schema
+			}
+			if d.ocf == nil {
+				return nil, errors.New("not an avro object container file")
+			}
+		}
+		if !d.ocf.Scan() {
+			if err := d.ocf.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		datum, err := d.ocf.Read()
+		if err != nil {
+			return nil, err
+		}
+		record, ok := datum.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected avro record, got %T", datum)
+		}
+		for _, f := range d.schema.fields {
+			if v, ok := record[f.name]; ok {
+				record[f.name] = d.schema.fromNative(v, f.schema)
+			}
+		}
+		return record, nil
+	}
+}
+
+func (d *AvroDecoder) flush(p []byte, buf []byte) (int, error, bool) {
+	if len(buf) >= len(p) {
+		n := copy(p, buf)
+		d.overhang = buf[n:]
+		return n, nil, true
+	}
+	return 0, nil, false
+}
+
+func (d *AvroDecoder) Close() error {
+	return d.reader.Close()
+}
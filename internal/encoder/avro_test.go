@@ -0,0 +1,141 @@
+package encoder_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestAvro(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("The Avro Encoder", func() {
+		schema := `{
+			"type": "record", "name": "person", "namespace": "io.mimiro",
+			"fields": [
+				{"name": "id", "type": "string"},
+				{"name": "age", "type": ["null", "int"], "default": null},
+				{"name": "born", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+				{"name": "friends", "type": {"type": "array", "items": "string"}, "default": []},
+				{"name": "address", "type": ["null", {"type": "record", "name": "address", "fields": [
+					{"name": "city", "type": "string"}
+				]}], "default": null},
+				{"name": "deleted", "type": "boolean"}
+			]
+		}`
+		backend := conf.StorageBackend{
+			AvroConfig: &conf.AvroConfig{SchemaDefinition: schema},
+			DecodeConfig: &conf.DecodeConfig{
+				Namespaces:       map[string]string{"a": "http://example.io/a/"},
+				DefaultNamespace: "a",
+				PropertyPrefixes: map[string]string{"id": "a:a"},
+				Refs:             []string{"friends"},
+				IdProperty:       "id",
+			},
+		}
+		entities := []*uda.Entity{
+			{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:age": 42,
+				"a:born": "1980-02-03T04:05:06Z", "a:address": map[string]interface{}{"city": "Oslo"}},
+				References: map[string]interface{}{"a:friends": []interface{}{"a:2", "a:3"}}},
+			{ID: "a:2", Properties: map[string]interface{}{"a:id": "2"}},
+		}
+		entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+
+		g.It("Should produce avro container files mapping props and refs to schema fields", func() {
+			result, err := encodeTwice(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			ocf, err := goavro.NewOCFReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			var records []map[string]interface{}
+			for ocf.Scan() {
+				datum, err := ocf.Read()
+				g.Assert(err).IsNil()
+				records = append(records, datum.(map[string]interface{}))
+			}
+			g.Assert(ocf.Err()).IsNil()
+			g.Assert(len(records)).Eql(4)
+			g.Assert(records[0]["id"]).Eql("1")
+			g.Assert(records[0]["age"]).Eql(map[string]interface{}{"int": int32(42)})
+			g.Assert(records[0]["born"]).Eql(map[string]interface{}{
+				"long.timestamp-millis": time.Date(1980, 2, 3, 4, 5, 6, 0, time.UTC)})
+			g.Assert(records[0]["friends"]).Eql([]interface{}{"a:2", "a:3"})
+			g.Assert(records[0]["address"]).Eql(map[string]interface{}{
+				"io.mimiro.address": map[string]interface{}{"city": "Oslo"}})
+			g.Assert(records[1]["age"]).IsNil()
+			g.Assert(records[1]["deleted"]).Eql(false)
+		})
+
+		g.It("Should fail on values that do not match the schema", func() {
+			invalid := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:age": "forty"}}}
+			_, err := encodeOnce(backend, invalid, &entityContext)
+			g.Assert(err == nil).IsFalse()
+			fraction := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:age": 42.5}}}
+			_, err = encodeOnce(backend, fraction, &entityContext)
+			g.Assert(err == nil).IsFalse("integers are not truncated")
+			overflow := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:age": 3e9}}}
+			_, err = encodeOnce(backend, overflow, &entityContext)
+			g.Assert(err == nil).IsFalse("integers out of range are not wrapped")
+		})
+
+		g.It("Should accept plain dates and RFC3339 timestamps for date fields", func() {
+			dated := conf.StorageBackend{AvroConfig: &conf.AvroConfig{SchemaDefinition: `{
+				"type": "record", "name": "event",
+				"fields": [{"name": "day", "type": {"type": "int", "logicalType": "date"}}]
+			}`}}
+			result, err := encodeOnce(dated, []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:day": "2024-03-09"}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:day": "2024-03-10T00:00:00Z"}},
+			}, &entityContext)
+			g.Assert(err).IsNil()
+			ocf, err := goavro.NewOCFReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			var days []interface{}
+			for ocf.Scan() {
+				datum, err := ocf.Read()
+				g.Assert(err).IsNil()
+				days = append(days, datum.(map[string]interface{})["day"])
+			}
+			g.Assert(days).Eql([]interface{}{
+				time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)})
+		})
+
+		g.It("Should decode records of consecutive files into entities", func() {
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			// storage backends concatenate the files of a dataset
+			result = append(result, result...)
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			all, err := io.ReadAll(reader)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(all, &m)).IsNil()
+			g.Assert(len(m)).Eql(6, "context, continuation and 4 entities")
+			g.Assert(m[1]["id"]).Eql("a:1")
+			props := m[1]["props"].(map[string]interface{})
+			g.Assert(props["a:age"]).Eql(float64(42))
+			g.Assert(props["a:born"]).Eql("1980-02-03T04:05:06Z")
+			g.Assert(props["a:address"]).Eql(map[string]interface{}{"city": "Oslo"})
+			g.Assert(m[1]["refs"].(map[string]interface{})["a:friends"]).Eql([]interface{}{"a:2", "a:3"})
+			g.Assert(m[4]["id"]).Eql("a:2")
+			g.Assert(m[4]["props"].(map[string]interface{})["a:age"]).IsNil()
+		})
+
+		g.It("Should use the deflate codec for gzip compression", func() {
+			compressed := backend
+			compressed.Compression = "gzip"
+			result, err := encodeOnce(compressed, entities, &entityContext)
+			g.Assert(err).IsNil()
+			ocf, err := goavro.NewOCFReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			g.Assert(ocf.CompressionName()).Eql("deflate")
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// textEncoding returns the character encoding with the given name, or nil for utf-8. Names are charmap names like
+// "ISO 8859-1" and "IBM Code Page 037", or IANA names and aliases like "ISO-8859-1", "windows-1252" and "IBM037".
+func textEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.ReplaceAll(name, "-", "")) {
+	case "", "utf8":
+		return nil, nil
+	}
+	for _, enc := range charmap.All {
+		if cmap, ok := enc.(*charmap.Charmap); ok && cmap.String() == name {
+			return cmap, nil
+		}
+	}
+	if enc, err := ianaindex.IANA.Encoding(name); err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", name)
+}
+
+// encodeText encodes utf-8 text, replacing characters missing in the encoding
+func encodeText(enc encoding.Encoding, text string) []byte {
+	if enc == nil {
+		return []byte(strings.ToValidUTF8(text, "_"))
+	}
+	encoded, _ := encoding.ReplaceUnsupported(enc.NewEncoder()).Bytes([]byte(text))
+	return encoded
+}
+
+// decodeText decodes encoded text to utf-8
+func decodeText(enc encoding.Encoding, data []byte) string {
+	if enc == nil {
+		return string(data)
+	}
+	decoded, _ := enc.NewDecoder().Bytes(data)
+	return string(decoded)
+}
+
+// fitText cuts or pads encoded text to size bytes. Integers are padded with leading zeros, other values with
+// trailing spaces. Utf-8 text is cut before the first character not fitting.
+func fitText(enc encoding.Encoding, data []byte, size int, integer bool) []byte {
+	if len(data) > size {
+		data = data[:size]
+		if enc == nil {
+			for len(data) > 0 && !utf8.Valid(data) {
+				data = data[:len(data)-1]
+			}
+		}
+	}
+	if len(data) == size {
+		return data
+	}
+	if integer {
+		return append(bytes.Repeat(encodeText(enc, "0"), size-len(data)), data...)
+	}
+	return append(data, bytes.Repeat(encodeText(enc, " "), size-len(data))...)
+}
+
+// flatFileSplit returns the split function of flat file records: lines ending with the encoded newline, or records of
+// a fixed number of bytes if recordLength is set
+func flatFileSplit(enc encoding.Encoding, recordLength int) bufio.SplitFunc {
+	if recordLength > 0 {
+		return func(data []byte, atEOF bool) (int, []byte, error) {
+			if len(data) >= recordLength {
+				return recordLength, data[:recordLength], nil
+			}
+			if atEOF && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		}
+	}
+	if enc == nil {
+		return bufio.ScanLines
+	}
+	newline := encodeText(enc, "\n")
+	carriageReturn := encodeText(enc, "\r")
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, newline); i >= 0 {
+			return i + len(newline), bytes.TrimSuffix(data[:i], carriageReturn), nil
+		}
+		if atEOF {
+			return len(data), bytes.TrimSuffix(data, carriageReturn), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// packDecimal encodes a number as packed decimal (COMP-3) of size bytes: two digits per byte, with the sign in the
+// last half byte, C for positive and D for negative numbers
+func packDecimal(value float64, decimals int, size int) ([]byte, error) {
+	scaled := math.Round(math.Abs(value) * math.Pow10(decimals))
+	digits := strconv.FormatFloat(scaled, 'f', 0, 64)
+	if len(digits) > size*2-1 {
+		return nil, fmt.Errorf("%v does not fit a packed decimal of %v bytes", value, size)
+	}
+	digits = strings.Repeat("0", size*2-1-len(digits)) + digits
+	sign := byte(0x0C)
+	if value < 0 && scaled != 0 {
+		sign = 0x0D
+	}
+	packed := make([]byte, size)
+	for i := 0; i < size; i++ {
+		high := digits[i*2] - '0'
+		low := sign
+		if i*2+1 < len(digits) {
+			low = digits[i*2+1] - '0'
+		}
+		packed[i] = high<<4 | low
+	}
+	return packed, nil
+}
+
+// unpackDecimal reads a packed decimal (COMP-3), as integer or as float if it has decimals
+func unpackDecimal(data []byte, decimals int) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty packed decimal")
+	}
+	var sign string
+	var digits []byte
+	for i, b := range data {
+		high, low := b>>4, b&0x0F
+		if high > 9 {
+			return nil, fmt.Errorf("invalid packed decimal %X", data)
+		}
+		digits = append(digits, '0'+high)
+		if i < len(data)-1 {
+			if low > 9 {
+				return nil, fmt.Errorf("invalid packed decimal %X", data)
+			}
+			digits = append(digits, '0'+low)
+			continue
+		}
+		switch low {
+		case 0x0D, 0x0B:
+			sign = "-"
+		case 0x0C, 0x0A, 0x0E, 0x0F:
+		default:
+			return nil, fmt.Errorf("invalid packed decimal sign %X", data)
+		}
+	}
+	if decimals == 0 {
+		return strconv.Atoi(sign + string(digits))
+	}
+	for len(digits) <= decimals {
+		digits = append([]byte{'0'}, digits...)
+	}
+	point := len(digits) - decimals
+	return strconv.ParseFloat(sign+string(digits[:point])+"."+string(digits[point:]), 64)
+}
@@ -0,0 +1,183 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func init() {
+	// parquet-go only ships gzip and snappy
+	goparquet.RegisterBlockCompressor(parquet.CompressionCodec_ZSTD, zstdBlockCompressor{})
+}
+
+// ValidateCompression returns an error if the dataset declares an unsupported compression
+func ValidateCompression(backend conf.StorageBackend) error {
+	if backend.XlsxConfig != nil && backend.ParquetConfig == nil && backend.AvroConfig == nil &&
+		backend.Compression != "" && backend.Compression != "none" {
+		return errors.New("xlsx files are zip archives and cannot be compressed")
+	}
+	switch backend.Compression {
+	case "", "none", CompressionGzip:
+		return nil
+	case CompressionZstd:
+		if backend.AvroConfig != nil && backend.ParquetConfig == nil {
+			return errors.New("avro files only support gzip compression")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %s, use %s or %s", backend.Compression, CompressionGzip, CompressionZstd)
+}
+
+// streamCompression returns the compression applied to the whole object stream. Parquet and avro files compress
+// their pages and blocks instead, so they remain readable by athena, spark and hadoop. xlsx files are zip archives.
+func streamCompression(backend conf.StorageBackend) string {
+	if backend.ParquetConfig != nil || backend.AvroConfig != nil || backend.XlsxConfig != nil ||
+		backend.Compression == "none" {
+		return ""
+	}
+	return backend.Compression
+}
+
+// CompressionExtension returns the file extension to append to object keys of the dataset, e.g. `.gz`
+func CompressionExtension(backend conf.StorageBackend) string {
+	switch streamCompression(backend) {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// ContentEncoding returns the http Content-Encoding of objects of the dataset, or an empty string
+func ContentEncoding(backend conf.StorageBackend) string {
+	return streamCompression(backend)
+}
+
+// Compress compresses a complete object according to the dataset compression
+func Compress(backend conf.StorageBackend, content []byte) ([]byte, error) {
+	compression := streamCompression(backend)
+	if compression == "" {
+		return content, nil
+	}
+	var buf bytes.Buffer
+	w, err := newCompressingWriter(compression, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(content); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewCompressingPipe returns a pipe writer that compresses everything written to it into writer, or writer itself
+// if the dataset is not compressed. Errors are passed on in both directions, so a failing upload also fails the
+// encoder writing into the pipe.
+func NewCompressingPipe(backend conf.StorageBackend, writer *io.PipeWriter) *io.PipeWriter {
+	compression := streamCompression(backend)
+	if compression == "" {
+		return writer
+	}
+	reader, pipeWriter := io.Pipe()
+	go func() {
+		w, err := newCompressingWriter(compression, writer)
+		if err != nil {
+			_ = reader.CloseWithError(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		if _, err = io.Copy(w, reader); err != nil {
+			_ = reader.CloseWithError(err)
+			_ = w.Close()
+			_ = writer.CloseWithError(err)
+			return
+		}
+		if err = w.Close(); err != nil {
+			_ = writer.CloseWithError(err)
+			return
+		}
+		_ = writer.Close()
+	}()
+	return pipeWriter
+}
+
+func newCompressingWriter(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
+
+// NewDecompressingReader detects gzip and zstd compressed objects by their magic bytes and decompresses them. Other
+// objects are returned unchanged, so datasets can contain both.
+func NewDecompressingReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return gzip.NewReader(br)
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		d, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// zstdBlockCompressor compresses parquet pages, encoders and decoders are shared as EncodeAll and DecodeAll
+// are safe for concurrent use
+type zstdBlockCompressor struct{}
+
+var (
+	zstdBlockEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdBlockDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+)
+
+func (zstdBlockCompressor) CompressBlock(block []byte) ([]byte, error) {
+	return zstdBlockEncoder.EncodeAll(block, nil), nil
+}
+
+func (zstdBlockCompressor) DecompressBlock(block []byte) ([]byte, error) {
+	return zstdBlockDecoder.DecodeAll(block, nil)
+}
+
+// parquetCompressionCodec returns the page compression of parquet files, snappy unless the dataset asks for
+// gzip or zstd
+func parquetCompressionCodec(backend conf.StorageBackend) parquet.CompressionCodec {
+	switch backend.Compression {
+	case CompressionGzip:
+		return parquet.CompressionCodec_GZIP
+	case CompressionZstd:
+		return parquet.CompressionCodec_ZSTD
+	}
+	return parquet.CompressionCodec_SNAPPY
+}
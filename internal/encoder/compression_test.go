@@ -0,0 +1,104 @@
+package encoder_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/franela/goblin"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+func TestCompression(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("Compression", func() {
+		entities := []*uda.Entity{
+			{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}},
+			{ID: "a:2", Properties: map[string]interface{}{"a:key": "value 2"}},
+		}
+		encode := func(backend conf.StorageBackend) []byte {
+			reader, writer := io.Pipe()
+			enc := encoder.NewEntityEncoder(backend, encoder.NewCompressingPipe(backend, writer), zap.NewNop().Sugar())
+			go func() {
+				_, _ = enc.Write(entities)
+				_ = enc.Close()
+			}()
+			result, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			return result
+		}
+		decompress := func(content []byte) []byte {
+			r, err := encoder.NewDecompressingReader(bytes.NewReader(content))
+			g.Assert(err).IsNil()
+			defer r.Close()
+			result, err := ioutil.ReadAll(r)
+			g.Assert(err).IsNil()
+			return result
+		}
+
+		g.It("Should compress encoder streams with gzip and zstd", func() {
+			for _, compression := range []string{"gzip", "zstd"} {
+				backend := conf.StorageBackend{Compression: compression}
+				content := encode(backend)
+				var m []map[string]interface{}
+				g.Assert(json.Unmarshal(content, &m) == nil).IsFalse("expected compressed content")
+				g.Assert(json.Unmarshal(decompress(content), &m)).IsNil()
+				g.Assert(len(m)).Eql(2)
+				g.Assert(m[1]["id"]).Eql("a:2")
+			}
+			_, err := gzip.NewReader(bytes.NewReader(encode(conf.StorageBackend{Compression: "gzip"})))
+			g.Assert(err).IsNil()
+		})
+
+		g.It("Should pass uncompressed objects through", func() {
+			content := encode(conf.StorageBackend{Compression: "none"})
+			g.Assert(decompress(content)).Eql(content)
+			g.Assert(decompress([]byte{})).Eql([]byte{})
+		})
+
+		g.It("Should compress complete objects", func() {
+			backend := conf.StorageBackend{Compression: "zstd", AthenaCompatible: true}
+			content := []byte("{\"id\":\"a:1\"}\n")
+			compressed, err := encoder.Compress(backend, content)
+			g.Assert(err).IsNil()
+			g.Assert(bytes.Equal(compressed, content)).IsFalse()
+			g.Assert(decompress(compressed)).Eql(content)
+		})
+
+		g.It("Should name extensions and content encodings", func() {
+			g.Assert(encoder.CompressionExtension(conf.StorageBackend{Compression: "gzip"})).Eql(".gz")
+			g.Assert(encoder.CompressionExtension(conf.StorageBackend{Compression: "zstd"})).Eql(".zst")
+			g.Assert(encoder.CompressionExtension(conf.StorageBackend{})).Eql("")
+			g.Assert(encoder.ContentEncoding(conf.StorageBackend{Compression: "gzip"})).Eql("gzip")
+			g.Assert(encoder.ValidateCompression(conf.StorageBackend{Compression: "lz4"}) == nil).IsFalse()
+			g.Assert(encoder.ValidateCompression(conf.StorageBackend{Compression: "gzip", XlsxConfig: &conf.XlsxConfig{}}) == nil).IsFalse()
+		})
+
+		g.It("Should compress parquet pages instead of the file", func() {
+			backend := conf.StorageBackend{Compression: "zstd", ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					required binary key (STRING);
+				}`,
+			}}
+			g.Assert(encoder.CompressionExtension(backend)).Eql("")
+			g.Assert(encoder.ContentEncoding(backend)).Eql("")
+			content := encode(backend)
+			pqReader, err := goparquet.NewFileReader(bytes.NewReader(content), "id", "key")
+			g.Assert(err).IsNil()
+			row, err := pqReader.NextRow()
+			g.Assert(err).IsNil()
+			g.Assert(row["key"]).Eql([]byte("value 1"))
+			g.Assert(pqReader.CurrentRowGroup().Columns[0].MetaData.Codec).Eql(parquet.CompressionCodec_ZSTD)
+		})
+	})
+}
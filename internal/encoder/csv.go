@@ -1,14 +1,21 @@
 package encoder
 
 import (
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
 	"go.uber.org/zap"
-	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 	"io"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // CsvFileEncoder ********************** ENCODER ****************************************/
@@ -17,9 +24,23 @@ type CsvEncoder struct {
 	writer  *io.PipeWriter
 	logger  *zap.SugaredLogger
 	open    bool
+	// out writes to the pipe, through charsetWriter for other encodings than utf-8
+	out           io.Writer
+	charsetWriter io.WriteCloser
+	continued     bool
+}
+
+// segment leaves out the header when continuing a stream, the stream has nothing to end
+func (enc *CsvEncoder) segment(continued bool, _ bool) {
+	enc.continued = continued
 }
 
 func (enc *CsvEncoder) Close() error {
+	if enc.charsetWriter != nil {
+		if err := enc.charsetWriter.Close(); err != nil {
+			return enc.writer.CloseWithError(err)
+		}
+	}
 	return enc.writer.Close()
 }
 
@@ -47,21 +68,35 @@ func (enc *CsvEncoder) Open() error {
 	enc.open = true
 	config := enc.backend.CsvConfig // we come here, this should never be nil
 
-	if config.Header {
-		writer := csv.NewWriter(enc.writer)
-		if enc.backend.CsvConfig.Separator != "" {
-			writer.Comma = rune(enc.backend.CsvConfig.Separator[0])
-		}
-
-		var headerLine []string
-		headerLine = append(headerLine, config.Order...)
+	charset, err := textEncoding(config.Encoding)
+	if err != nil {
+		return err
+	}
+	enc.out = enc.writer
+	if charset != nil {
+		enc.charsetWriter = transform.NewWriter(enc.writer, encoding.ReplaceUnsupported(charset.NewEncoder()))
+		enc.out = enc.charsetWriter
+	}
+	switch config.Quote {
+	case "", csvQuoteMinimal, csvQuoteAll, csvQuoteNonNumeric, csvQuoteNone:
+	default:
+		return fmt.Errorf("unsupported csv quote mode %s, use minimal, all, nonnumeric or none", config.Quote)
+	}
+	switch config.LineEnding {
+	case "", "lf", "crlf":
+	default:
+		return fmt.Errorf("unsupported csv line ending %s, use lf or crlf", config.LineEnding)
+	}
 
-		err := writer.Write(headerLine)
+	if config.Header && !enc.continued {
+		var header []csvField
+		for _, column := range config.Order {
+			header = append(header, csvField{value: column})
+		}
+		_, err := enc.out.Write(enc.csvLine(header))
 		if err != nil {
 			return err
 		}
-
-		writer.Flush()
 	}
 
 	return nil
@@ -72,47 +107,179 @@ func (enc *CsvEncoder) CloseWithError(err error) error {
 }
 
 func (enc *CsvEncoder) encode(entities []*uda.Entity) (int, error) {
-	writer := csv.NewWriter(enc.writer)
 	config := enc.backend.CsvConfig // we come here, this should never be nil
 
-	if enc.backend.CsvConfig.Separator != "" {
-		writer.Comma = rune(enc.backend.CsvConfig.Separator[0])
-	}
-
+	buf := new(bytes.Buffer)
 	written := 0
 	for _, ent := range entities {
-		var r []string
+		var r []csvField
 
 		row := propStripper(ent)
 
 		for _, h := range config.Order {
-			if _, ok := row[h]; ok {
-				switch v := row[h].(type) {
-				case float64:
-					r = append(r, strconv.FormatFloat(v, 'f', 0, 64))
-				case string:
-					r = append(r, v)
-				case bool:
-					r = append(r, strconv.FormatBool(v))
-				}
+			column := config.Columns[h]
+			var value interface{}
+			if column.Ref {
+				value = csvRef(ent, h, column.KeepNamespace)
 			} else {
-				r = append(r, "")
+				value = row[h]
+			}
+			field, err := csvValue(value, column)
+			if err != nil {
+				return 0, fmt.Errorf("column %s of entity %s: %w", h, ent.ID, err)
 			}
+			r = append(r, field)
 		}
 		for _, col := range r {
-			written += len([]byte(col))
-		}
-		err := writer.Write(r)
-		if err != nil {
-			return 0, err
+			written += len([]byte(col.value))
 		}
+		buf.Write(enc.csvLine(r))
 	}
 
-	writer.Flush()
+	_, err := enc.out.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
 
 	return written, nil
 }
 
+// csv quote modes: quote fields only when needed, all fields, all but numbers, or no fields
+const (
+	csvQuoteMinimal    = "minimal"
+	csvQuoteAll        = "all"
+	csvQuoteNonNumeric = "nonnumeric"
+	csvQuoteNone       = "none"
+)
+
+// csvField is a formatted csv value, numeric if formatted from a number
+type csvField struct {
+	value   string
+	numeric bool
+}
+
+// csvLine joins the fields with the separator, quoted by the quote mode of the dataset, and ends the line
+func (enc *CsvEncoder) csvLine(fields []csvField) []byte {
+	config := enc.backend.CsvConfig
+	comma := ','
+	if config.Separator != "" {
+		comma = rune(config.Separator[0])
+	}
+	var line strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			line.WriteRune(comma)
+		}
+		quote := csvFieldNeedsQuotes(field.value, comma)
+		switch config.Quote {
+		case csvQuoteAll:
+			quote = true
+		case csvQuoteNonNumeric:
+			quote = !field.numeric
+		case csvQuoteNone:
+			quote = false
+		}
+		if quote {
+			line.WriteString(`"` + strings.ReplaceAll(field.value, `"`, `""`) + `"`)
+		} else {
+			line.WriteString(field.value)
+		}
+	}
+	if config.LineEnding == "crlf" {
+		line.WriteString("\r\n")
+	} else {
+		line.WriteString("\n")
+	}
+	return []byte(line.String())
+}
+
+// csvFieldNeedsQuotes tells if a field must be quoted, by the rules of encoding/csv
+func csvFieldNeedsQuotes(field string, comma rune) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsRune(field, comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+// csvRef returns the ref with the given name without namespace, with or without namespaces in its values
+func csvRef(ent *uda.Entity, name string, keepNamespace bool) interface{} {
+	for key, value := range ent.References {
+		if stripNamespace(key) != name {
+			continue
+		}
+		if keepNamespace {
+			return value
+		}
+		switch v := value.(type) {
+		case string:
+			return stripNamespace(v)
+		case []interface{}:
+			var stripped []interface{}
+			for _, ref := range v {
+				if s, ok := ref.(string); ok {
+					ref = stripNamespace(s)
+				}
+				stripped = append(stripped, ref)
+			}
+			return stripped
+		}
+		return value
+	}
+	return nil
+}
+
+// csvValue formats a value by the column config. Lists are joined by the list separator of the column, or written
+// as json like objects if the column has none.
+func csvValue(value interface{}, column conf.CsvColumn) (csvField, error) {
+	switch v := value.(type) {
+	case nil:
+		return csvField{}, nil
+	case float64:
+		decimals := -1
+		if column.Decimals != nil {
+			decimals = *column.Decimals
+		}
+		return csvField{value: strconv.FormatFloat(v, 'f', decimals, 64), numeric: true}, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return csvField{}, err
+		}
+		return csvValue(f, column)
+	case string:
+		if column.DateLayout != "" {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return csvField{value: t.Format(column.DateLayout)}, nil
+			}
+		}
+		return csvField{value: v}, nil
+	case bool:
+		return csvField{value: strconv.FormatBool(v)}, nil
+	case []interface{}:
+		if column.ListSeparator == "" {
+			break
+		}
+		var values []string
+		for _, item := range v {
+			field, err := csvValue(item, column)
+			if err != nil {
+				return csvField{}, err
+			}
+			values = append(values, field.value)
+		}
+		return csvField{value: strings.Join(values, column.ListSeparator)}, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return csvField{}, err
+	}
+	return csvField{value: string(data)}, nil
+}
+
 // CsvFileDecoder ********************** DECODER ****************************************/
 
 type CsvDecoder struct {
@@ -126,6 +293,7 @@ type CsvDecoder struct {
 	since      string
 	overhang   []byte
 	fullSync   bool
+	charset    encoding.Encoding
 }
 
 func (dec *CsvDecoder) Read(p []byte) (n int, err error) {
@@ -138,14 +306,8 @@ func (dec *CsvDecoder) Read(p []byte) (n int, err error) {
 	if !dec.open {
 		dec.open = true
 		dec.csvreader = csv.NewReader(dec.reader)
-		// set charmap from config
-		encoding := dec.backend.CsvConfig.Encoding
-		for _, enc := range charmap.All {
-			cmap, ok := enc.(*charmap.Charmap)
-			if ok && cmap.String() == encoding {
-				// encode based on user's input
-				dec.csvreader = csv.NewReader(cmap.NewDecoder().Reader(dec.reader))
-			}
+		if dec.charset != nil {
+			dec.csvreader = csv.NewReader(dec.charset.NewDecoder().Reader(dec.reader))
 		}
 
 		buf = append(buf, []byte("[")...)
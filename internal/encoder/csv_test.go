@@ -10,6 +10,75 @@ import (
 func TestCSV(t *testing.T) {
 	g := goblin.Goblin(t)
 	g.Describe("The CSV encoder", func() {
+		g.It("Should format numbers, dates, lists and refs by column", func() {
+			two := 2
+			backend := conf.StorageBackend{CsvConfig: &conf.CsvConfig{
+				Header: true,
+				Order:  []string{"id", "price", "count", "born", "tags", "meta", "owner", "friends", "missing"},
+				Columns: map[string]conf.CsvColumn{
+					"price":   {Decimals: &two},
+					"born":    {DateLayout: "02.01.2006"},
+					"tags":    {ListSeparator: "|"},
+					"owner":   {Ref: true},
+					"friends": {Ref: true, KeepNamespace: true, ListSeparator: " "},
+				},
+			}}
+			entities := []*uda.Entity{{ID: "a:1",
+				Properties: map[string]interface{}{"b:id": "1", "a:price": 12.5, "a:count": 12.5,
+					"a:born": "2001-02-03T00:00:00Z", "a:tags": []interface{}{"x", 1.5}, "a:meta": map[string]interface{}{"k": "v"},
+					"a:owner": "not a ref"},
+				References: map[string]interface{}{"a:owner": "ns1:42", "a:friends": []interface{}{"ns1:2", "ns1:3"}},
+			}}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql("id,price,count,born,tags,meta,owner,friends,missing\n" +
+				`1,12.50,12.5,03.02.2001,x|1.5,"{""k"":""v""}",42,ns1:2 ns1:3,` + "\n")
+		})
+
+		g.It("Should quote and end lines as configured", func() {
+			backend := conf.StorageBackend{CsvConfig: &conf.CsvConfig{
+				Separator:  ";",
+				Order:      []string{"id", "key", "n"},
+				Quote:      "nonnumeric",
+				LineEnding: "crlf",
+			}}
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"b:id": "1", "a:key": `say "hi"`, "a:n": float64(3)}}}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`"1";"say ""hi""";3` + "\r\n")
+
+			backend.CsvConfig.Quote = "none"
+			backend.CsvConfig.LineEnding = ""
+			result, err = encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`1;say "hi";3` + "\n")
+
+			backend.CsvConfig.Quote = "always"
+			_, err = encodeOnce(backend, entities, &entityContext)
+			g.Assert(err.Error()).Eql("unsupported csv quote mode always, use minimal, all, nonnumeric or none")
+		})
+
+		g.It("Should write csv in the configured encoding", func() {
+			backend := conf.StorageBackend{CsvConfig: &conf.CsvConfig{
+				Header:   true,
+				Encoding: "windows-1252",
+				Order:    []string{"id", "key"},
+			}}
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"b:id": "1", "a:key": "blå €"}}}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(result).Eql([]byte("id,key\n1,bl\xe5 \x80\n"))
+
+			backend.DecodeConfig = &conf.DecodeConfig{IdProperty: "id", Namespaces: map[string]string{}}
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			decoded := decodeEntities(g, reader)
+			g.Assert(decoded[0]["props"].(map[string]interface{})["key"]).Eql("blå €")
+		})
+
 		g.It("Should produce csv from single batch", func() {
 			backend := conf.StorageBackend{CsvConfig: &conf.CsvConfig{
 				Header:    true,
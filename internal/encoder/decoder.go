@@ -24,15 +24,50 @@ func NewEntityDecoder(backend conf.StorageBackend, reader *io.PipeReader, since
 	}
 
 	if backend.FlatFileConfig != nil {
-		return &FlatFileDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
+		charset, err := textEncoding(backend.FlatFileConfig.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		return &FlatFileDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync, charset: charset}, nil
+	}
+	if backend.XlsxConfig != nil {
+		if backend.DecodeConfig == nil {
+			return nil, errors.New("decode configuration required for xlsx datasets")
+		}
+		return &XlsxDecoder{backend: backend, files: storedFiles{reader: reader}, logger: logger, since: since, fullSync: fullSync}, nil
+	}
+	if backend.XmlConfig != nil {
+		if backend.DecodeConfig == nil {
+			return nil, errors.New("decode configuration required for xml datasets")
+		}
+		return &XmlDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
+	}
+	if backend.RdfConfig != nil {
+		if format, err := rdfFormat(backend.RdfConfig); err != nil || format == rdfTurtle {
+			return nil, errors.New("rdf datasets can only be read as ntriples or nquads")
+		}
+		return &RdfDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
 	}
 	if backend.CsvConfig != nil {
-		return &CsvDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
+		charset, err := textEncoding(backend.CsvConfig.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		return &CsvDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync, charset: charset}, nil
 	}
 	if backend.ParquetConfig != nil {
-		return &ParquetDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
+		return &ParquetDecoder{backend: backend, files: storedFiles{reader: reader}, logger: logger, since: since, fullSync: fullSync}, nil
 	}
-	return nil, errors.New("this dataset has no decoder")
+	if backend.AvroConfig != nil {
+		if backend.DecodeConfig == nil {
+			return nil, errors.New("decode configuration required for avro datasets")
+		}
+		return &AvroDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
+	}
+	if backend.StripProps && backend.DecodeConfig == nil {
+		return nil, errors.New("decode configuration required for stripped json datasets")
+	}
+	return &JSONDecoder{backend: backend, reader: reader, logger: logger, since: since, fullSync: fullSync}, nil
 }
 
 func toEntityBytes(line map[string]interface{}, backend conf.StorageBackend) ([]byte, error) {
@@ -65,7 +100,7 @@ func toEntityBytes(line map[string]interface{}, backend conf.StorageBackend) ([]
 						sb.WriteString(",")
 					}
 					first = false
-					sb.WriteString(val.(string))
+					sb.WriteString(stringValue(val))
 				}
 			}
 			line[k] = sb.String()
@@ -127,7 +162,7 @@ func withPrefix(m map[string]interface{}, backend conf.StorageBackend, k string,
 		isMultiValue := false
 		if backend.DecodeConfig.ListValueColumns != nil {
 			if mapped, ok := backend.DecodeConfig.ListValueColumns[k]; ok {
-				sv := v.(string)
+				sv := stringValue(v)
 				if sv != "" {
 					tv := strings.Split(sv, mapped)
 					vs := make([]string, 0)
@@ -170,7 +205,7 @@ func withPrefix(m map[string]interface{}, backend conf.StorageBackend, k string,
 						return "", errors.New(fmt.Sprintf("Unsupported type %v for column %v", mapped, k))
 					}
 				} else {
-					sv := v.(string)
+					sv := stringValue(v)
 					switch mapped {
 					case "int":
 						v, _ = strconv.Atoi(sv)
@@ -197,10 +232,28 @@ func withPrefix(m map[string]interface{}, backend conf.StorageBackend, k string,
 	return k, nil
 }
 
+// stringValue returns string values as is, and other values of typed formats like xlsx in their text form
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", value)
+}
+
 func wrap(value interface{}, prefix string) interface{} {
 	if prefix == "" {
 		return value
 	}
+	if values, ok := value.([]interface{}); ok {
+		wrapped := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			wrapped = append(wrapped, wrap(v, prefix))
+		}
+		return wrapped
+	}
 	return fmt.Sprintf("%v:%v", prefix, value)
 }
 
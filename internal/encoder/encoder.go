@@ -20,6 +20,22 @@ func NewEntityEncoder(backend conf.StorageBackend, writer *io.PipeWriter, logger
 		return &ParquetEncoder{backend: backend, writer: writer, logger: logger}
 	}
 
+	if backend.AvroConfig != nil {
+		return &AvroEncoder{backend: backend, writer: writer, logger: logger}
+	}
+
+	if backend.XlsxConfig != nil {
+		return &XlsxEncoder{backend: backend, writer: writer, logger: logger}
+	}
+
+	if backend.XmlConfig != nil {
+		return &XmlEncoder{backend: backend, writer: writer, logger: logger}
+	}
+
+	if backend.RdfConfig != nil {
+		return &RdfEncoder{backend: backend, writer: writer, logger: logger}
+	}
+
 	if backend.CsvConfig != nil {
 		return &CsvEncoder{backend: backend, writer: writer, logger: logger}
 	}
@@ -1,6 +1,9 @@
 package encoder_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"github.com/franela/goblin"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
@@ -68,3 +71,25 @@ func decodeOnce(backend conf.StorageBackend, fileContent []byte) (io.Reader, err
 	}()
 	return dec, err
 }
+
+// decodeEntities returns the decoded entities without context and continuation, with numbers as json numbers
+func decodeEntities(g *goblin.G, reader io.Reader) []map[string]interface{} {
+	all, err := io.ReadAll(reader)
+	g.Assert(err).IsNil()
+	decoder := json.NewDecoder(bytes.NewReader(all))
+	decoder.UseNumber()
+	var result []map[string]interface{}
+	g.Assert(decoder.Decode(&result)).IsNil()
+	return result[1 : len(result)-1]
+}
+
+// memoryFile is a stored file served from memory that records when it is closed
+type memoryFile struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (o *memoryFile) Close() error {
+	o.closed = true
+	return nil
+}
@@ -0,0 +1,97 @@
+package encoder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// StoredFile is a stored file that is read with ranged reads, e.g. ranged GETs on object storage
+type StoredFile interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// StoredFileOpener opens the file stored at key for ranged reads
+type StoredFileOpener func(key string) (StoredFile, error)
+
+// UsesFileDecoder returns true if entities of the dataset are read from self-contained files that cannot be
+// concatenated, like parquet files and xlsx workbooks. Stores read those with NewFileDecoder instead of streaming
+// all files into NewEntityDecoder.
+func UsesFileDecoder(backend conf.StorageBackend) bool {
+	switch {
+	case backend.AthenaCompatible, backend.FlatFileConfig != nil:
+		return false
+	case backend.XlsxConfig != nil:
+		return true
+	case backend.XmlConfig != nil, backend.RdfConfig != nil, backend.CsvConfig != nil:
+		return false
+	}
+	return backend.ParquetConfig != nil
+}
+
+// NewFileDecoder returns a decoder that reads the files at keys one after the other, opening them with open
+func NewFileDecoder(backend conf.StorageBackend, keys []string, open StoredFileOpener, since string, logger *zap.SugaredLogger, fullSync bool) (EncodingEntityReader, error) {
+	if backend.DecodeConfig == nil {
+		return nil, errors.New("decode configuration required for parquet and xlsx datasets")
+	}
+	files := storedFiles{keys: keys, open: open, logger: logger}
+	if backend.XlsxConfig != nil {
+		return &XlsxDecoder{backend: backend, files: files, logger: logger, since: since, fullSync: fullSync}, nil
+	}
+	return &ParquetDecoder{backend: backend, files: files, logger: logger, since: since, fullSync: fullSync}, nil
+}
+
+// storedFiles hands out the files of a decoder one at a time, either opened by key or as a single file buffered
+// from the pipe given to NewEntityDecoder
+type storedFiles struct {
+	reader *io.PipeReader
+	keys   []string
+	open   StoredFileOpener
+	logger *zap.SugaredLogger
+}
+
+// next returns the next file, or nil when all files are read
+func (f *storedFiles) next() (StoredFile, error) {
+	if f.reader != nil {
+		// entities streamed through a pipe can only be read by buffering the whole file
+		allBytes, err := io.ReadAll(f.reader)
+		if err != nil {
+			return nil, err
+		}
+		_ = f.reader.Close()
+		f.reader = nil
+		return bytesFile{bytes.NewReader(allBytes)}, nil
+	}
+	if len(f.keys) == 0 {
+		return nil, nil
+	}
+	key := f.keys[0]
+	f.keys = f.keys[1:]
+	file, err := f.open(key)
+	if err != nil {
+		return nil, err
+	}
+	f.logger.Debugf("reading file %s of %v bytes", key, file.Size())
+	return file, nil
+}
+
+func (f *storedFiles) close() {
+	if f.reader != nil {
+		_ = f.reader.Close()
+	}
+}
+
+// bytesFile is a file held in memory
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (f bytesFile) Close() error {
+	return nil
+}
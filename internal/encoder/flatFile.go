@@ -15,6 +15,7 @@ import (
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
 )
 
 // FlatFileEncoder ********************** ENCODER ****************************************/
@@ -22,6 +23,8 @@ type FlatFileEncoder struct {
 	backend conf.StorageBackend
 	writer  *io.PipeWriter
 	logger  *zap.SugaredLogger
+	open    bool
+	charset encoding.Encoding
 }
 
 func (enc *FlatFileEncoder) Write(entities []*uda.Entity) (int, error) {
@@ -29,7 +32,20 @@ func (enc *FlatFileEncoder) Write(entities []*uda.Entity) (int, error) {
 		return 0, nil
 	}
 
-	data, err := enc.encode(entities)
+	if !enc.open {
+		charset, err := textEncoding(enc.backend.FlatFileConfig.Encoding)
+		if err != nil {
+			return 0, err
+		}
+		enc.charset = charset
+		enc.open = true
+	}
+
+	encode := enc.encode
+	if enc.backend.FlatFileConfig.RecordType != nil {
+		encode = enc.encodeRecords
+	}
+	data, err := encode(entities)
 	if err != nil {
 		return 0, err
 	}
@@ -37,6 +53,9 @@ func (enc *FlatFileEncoder) Write(entities []*uda.Entity) (int, error) {
 	return enc.writer.Write(data)
 }
 
+// segment does nothing, as lines are written the same way in all segments
+func (enc *FlatFileEncoder) segment(bool, bool) {}
+
 func (enc *FlatFileEncoder) Close() error {
 	return enc.writer.Close()
 }
@@ -56,98 +75,95 @@ func (enc *FlatFileEncoder) encode(entities []*uda.Entity) ([]byte, error) {
 		return nil, fmt.Errorf("missing fieldOrder config for flat file write operation")
 	}
 	for _, e := range entities {
-		var line []string
+		var line []byte
 		fieldsWithData := 0
 		for _, fieldName := range fieldOrder {
 			fieldConfig, exist := fields[fieldName]
 			if exist == false {
 				return nil, fmt.Errorf("missing fieldConfig for required field in fieldOrder")
 			}
-			var preppedValue string
-			var fieldValue interface{}
-			for key, val := range e.Properties {
-				if stripNamespace(key) == fieldName {
-					fieldValue = val
-					break
-				}
-			}
-			for key, val := range e.References {
-				if stripNamespace(key) == fieldName {
-					fieldValue = stripNamespace(val.(string))
-					break
-				}
-			}
-			fieldSize := 0
-			for _, sub := range fieldConfig.Substring {
-				fieldSize += sub[1] - sub[0]
-			}
-			if fieldValue == nil {
-				//	Need to add spaces according to field substring config
-				preppedValue = appendSpaces(preppedValue, fieldSize)
-			} else {
-				//	cast to string, then cut or append spaces to value according to substring config
-				var value string
-				var valueLength int
-				var runes []rune
-				switch fieldConfig.Type {
-				case "date":
-					dt, _ := time.Parse(time.RFC3339, fieldValue.(string))
-					value = dt.Format(fieldConfig.DateLayout)
-					valueLength = len(value)
-				case "float":
-					f := strconv.FormatFloat(fieldValue.(float64), 'f', fieldConfig.Decimals, 64)
-					value = strings.Replace(f, ".", "", -1)
-					valueLength = len(value)
-				case "integer":
-					value = fmt.Sprintf("%d", int(fieldValue.(float64)))
-					valueLength = len(value)
-				default:
-					value = fmt.Sprintf("%s", fieldValue)
-					runes = []rune(strings.ToValidUTF8(value, "_"))
-					valueLength = len(runes)
-				}
-				if valueLength < fieldSize {
-					diff := fieldSize - valueLength
-					if fieldConfig.Type == "integer" {
-						preppedValue = prependZeros(value, diff)
-					} else {
-						preppedValue = appendSpaces(value, diff)
-					}
-				} else if valueLength > fieldSize {
-					if fieldConfig.Type == "string" || fieldConfig.Type == "" {
-						preppedValue = string(runes[:fieldSize])
-					} else {
-						preppedValue = value[:fieldSize]
-					}
-				} else {
-					preppedValue = value
-				}
+			fieldValue := flatFileValue(e, fieldName)
+			if fieldValue != nil {
 				fieldsWithData += 1
-
 			}
-			line = append(line, preppedValue)
+			value, err := formatFlatFileField(fieldConfig, fieldValue, enc.charset)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of entity %s: %w", fieldName, e.ID, err)
+			}
+			line = append(line, value...)
 		}
 		if fieldsWithData != 0 {
-			buf.WriteString(fmt.Sprintf("%s\n", strings.Join(line, "")))
+			buf.Write(enc.endRecord(line))
 		}
 	}
 
 	return buf.Bytes(), nil
 }
 
-func appendSpaces(value string, amount int) string {
-	for i := 0; i < amount; i++ {
-		value += " "
+// endRecord ends a line with the encoded newline, or pads it to the record length of files with fixed length records
+func (enc *FlatFileEncoder) endRecord(line []byte) []byte {
+	if recordLength := enc.backend.FlatFileConfig.RecordLength; recordLength > 0 {
+		return fitText(enc.charset, line, recordLength, false)
 	}
-	return value
+	return append(line, encodeText(enc.charset, "\n")...)
 }
 
-func prependZeros(value string, amount int) string {
-	prefix := ""
-	for i := 0; i < amount; i++ {
-		prefix += "0"
+// flatFileValue returns the value of the prop or ref with the given name, without namespace
+func flatFileValue(e *uda.Entity, fieldName string) interface{} {
+	var fieldValue interface{}
+	for key, val := range e.Properties {
+		if stripNamespace(key) == fieldName {
+			fieldValue = val
+			break
+		}
+	}
+	for key, val := range e.References {
+		if stripNamespace(key) == fieldName {
+			fieldValue = stripNamespace(val.(string))
+			break
+		}
 	}
-	return prefix + value
+	return fieldValue
+}
+
+// formatFlatFileField formats the value by the field config, encoded and cut or padded to the size of the field in
+// bytes
+func formatFlatFileField(fieldConfig conf.FlatFileField, fieldValue interface{}, charset encoding.Encoding) ([]byte, error) {
+	fieldSize := flatFileFieldSize(fieldConfig)
+	if fieldConfig.Type == "packed" {
+		number, err := flatFileNumber(fieldValue)
+		if err != nil {
+			return nil, err
+		}
+		return packDecimal(number, fieldConfig.Decimals, fieldSize)
+	}
+	if fieldValue == nil {
+		//	Need to add spaces according to field substring config
+		return fitText(charset, nil, fieldSize, false), nil
+	}
+	//	cast to string, then cut or append spaces to value according to substring config
+	var value string
+	switch fieldConfig.Type {
+	case "date":
+		dt, _ := time.Parse(time.RFC3339, fieldValue.(string))
+		value = dt.Format(fieldConfig.DateLayout)
+	case "float":
+		f := strconv.FormatFloat(fieldValue.(float64), 'f', fieldConfig.Decimals, 64)
+		value = strings.Replace(f, ".", "", -1)
+	case "integer":
+		value = fmt.Sprintf("%d", int(fieldValue.(float64)))
+	default:
+		value = fmt.Sprintf("%s", fieldValue)
+	}
+	return fitText(charset, encodeText(charset, value), fieldSize, fieldConfig.Type == "integer"), nil
+}
+
+func flatFileFieldSize(fieldConfig conf.FlatFileField) int {
+	fieldSize := 0
+	for _, sub := range fieldConfig.Substring {
+		fieldSize += sub[1] - sub[0]
+	}
+	return fieldSize
 }
 
 func stripNamespace(prop string) string {
@@ -169,6 +185,9 @@ type FlatFileDecoder struct {
 	overhang []byte
 	since    string
 	fullSync bool
+	header   map[string]interface{}
+	details  []map[string]interface{}
+	charset  encoding.Encoding
 }
 
 func (d *FlatFileDecoder) Read(p []byte) (n int, err error) {
@@ -182,6 +201,7 @@ func (d *FlatFileDecoder) Read(p []byte) (n int, err error) {
 	if !d.open {
 		d.open = true
 		d.scanner = bufio.NewScanner(d.reader)
+		d.scanner.Split(flatFileSplit(d.charset, d.backend.FlatFileConfig.RecordLength))
 		// start json array and add context as first entity
 		buf = append(buf, []byte("[")...)
 		if n, err, done = d.flush(p, buf); done {
@@ -195,12 +215,30 @@ func (d *FlatFileDecoder) Read(p []byte) (n int, err error) {
 	// append one entity per line, comma separated
 	for d.scanner.Scan() {
 
-		line := d.scanner.Text()
+		line := d.scanner.Bytes()
 		// d.logger.Debugf("Got line : '%s'", line)
+		if d.backend.FlatFileConfig.RecordType != nil {
+			var entities [][]byte
+			entities, err = d.parseRecord(line)
+			if err != nil {
+				d.logger.Errorf("Failed to parse line: '%s'", decodeText(d.charset, line))
+				if d.backend.FlatFileConfig.ContinueOnParseError {
+					continue
+				} else {
+					return
+				}
+			}
+			buf = appendEntities(buf, entities)
+			if n, err, done = d.flush(p, buf); done {
+				return
+			}
+			continue
+		}
 		var entityProps map[string]interface{}
-		entityProps, err = d.ParseLine(line, d.backend.FlatFileConfig)
+		config := d.backend.FlatFileConfig
+		entityProps, err = d.parseFields(line, config.Fields, config.RawRecord)
 		if err != nil {
-			d.logger.Errorf("Failed to parse line: '%s'", line)
+			d.logger.Errorf("Failed to parse line: '%s'", decodeText(d.charset, line))
 			if d.backend.FlatFileConfig.ContinueOnParseError {
 				continue
 			} else {
@@ -218,6 +256,19 @@ func (d *FlatFileDecoder) Read(p []byte) (n int, err error) {
 			return
 		}
 	}
+	if len(d.details) > 0 {
+		// details of a file ending without trailer
+		d.logger.Warnf("Missing trailer after %v flat file records", len(d.details))
+		var entities [][]byte
+		entities, err = d.releaseDetails(nil)
+		if err != nil {
+			return
+		}
+		buf = appendEntities(buf, entities)
+		if n, err, done = d.flush(p, buf); done {
+			return
+		}
+	}
 	var token string
 	if d.fullSync {
 		token = ""
@@ -245,6 +296,16 @@ func (d *FlatFileDecoder) Read(p []byte) (n int, err error) {
 	return n, io.EOF
 }
 
+// appendEntities appends comma separated entities, skipping entities without id
+func appendEntities(buf []byte, entities [][]byte) []byte {
+	for _, entityBytes := range entities {
+		if entityBytes != nil {
+			buf = append(buf, append([]byte(","), entityBytes...)...)
+		}
+	}
+	return buf
+}
+
 func (d *FlatFileDecoder) flush(p []byte, buf []byte) (int, error, bool) {
 	if len(buf) >= len(p) {
 		n := copy(p, buf)
@@ -304,24 +365,35 @@ func (d *FlatFileDecoder) convertType(value string, fieldConfig conf.FlatFileFie
 }
 
 func (d *FlatFileDecoder) ParseLine(line string, config *conf.FlatFileConfig) (map[string]interface{}, error) {
+	return d.parseFields(encodeText(d.charset, line), config.Fields, config.RawRecord)
+}
+
+// parseFields reads the fields at their byte positions in the line, decoding text fields from the configured encoding
+func (d *FlatFileDecoder) parseFields(line []byte, fields map[string]conf.FlatFileField, rawRecord bool) (map[string]interface{}, error) {
 	entityProps := make(map[string]interface{}, 0)
-	for key, field := range config.Fields {
-		value := ""
+	for key, field := range fields {
+		var value []byte
 		for _, sub := range field.Substring {
 			if sub[1] > len(line) {
-				return nil, errors.New(fmt.Sprintf("substring out of bounds: %+v (line: %v)", field, line))
+				return nil, errors.New(fmt.Sprintf("substring out of bounds: %+v (line: %v)", field, decodeText(d.charset, line)))
 			}
-			value += line[sub[0]:sub[1]]
+			value = append(value, line[sub[0]:sub[1]]...)
+		}
+		var valueWithType interface{}
+		var err error
+		if field.Type == "packed" {
+			valueWithType, err = unpackDecimal(value, field.Decimals)
+		} else {
+			valueWithType, err = d.convertType(decodeText(d.charset, value), field)
 		}
-		valueWithType, err := d.convertType(value, field)
 		if err != nil {
 			return nil, err
 		}
 		entityProps[key] = valueWithType
 
-		if config.RawRecord {
+		if rawRecord {
 			// If raw record is enabled, we just return the whole line as a string
-			entityProps["data"] = line
+			entityProps["data"] = decodeText(d.charset, line)
 			continue
 		}
 	}
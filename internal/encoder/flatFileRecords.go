@@ -0,0 +1,319 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"golang.org/x/text/encoding"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// roles of record types in flat files mixing record types
+const (
+	flatFileHeader  = "header"
+	flatFileDetail  = "detail"
+	flatFileTrailer = "trailer"
+
+	// flatFileRecordTypeProperty names the record type of entities read from files mixing record types
+	flatFileRecordTypeProperty = "recordType"
+)
+
+// recordRole returns the role of a record type, detail if none is given
+func recordRole(record conf.FlatFileRecord) string {
+	if record.Role == "" {
+		return flatFileDetail
+	}
+	return record.Role
+}
+
+// sortedRecords returns the names of the record types with the given role in name order
+func sortedRecords(config *conf.FlatFileConfig, role string) []string {
+	var names []string
+	for name, record := range config.Records {
+		if recordRole(record) == role {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encodeRecords writes each batch as header lines, one detail line per entity and trailer lines. Header and
+// trailer fields are constant values or aggregates over the details of the batch. The lines are laid out by the
+// substring positions of the fields, with the record type code at the position of the record type.
+func (enc *FlatFileEncoder) encodeRecords(entities []*uda.Entity) ([]byte, error) {
+	config := enc.backend.FlatFileConfig
+	details := sortedRecords(config, flatFileDetail)
+	if len(details) == 0 {
+		return nil, errors.New("missing detail record type for flat file write operation")
+	}
+
+	buf := new(bytes.Buffer)
+	var detailLines [][]byte
+	var written []*uda.Entity
+	for _, e := range entities {
+		name := details[0]
+		if recordType, ok := flatFileValue(e, flatFileRecordTypeProperty).(string); ok {
+			name = recordType
+		} else if len(details) > 1 {
+			return nil, fmt.Errorf("entity %s has no %s to choose between detail records", e.ID, flatFileRecordTypeProperty)
+		}
+		record, ok := config.Records[name]
+		if !ok || recordRole(record) != flatFileDetail {
+			return nil, fmt.Errorf("unknown detail record type %s of entity %s", name, e.ID)
+		}
+		values := make(map[string]interface{}, len(record.Fields))
+		for fieldName, field := range record.Fields {
+			if field.Value == "" {
+				values[fieldName] = flatFileValue(e, fieldName)
+				continue
+			}
+			value, err := flatFileConstant(field)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of %s record: %w", fieldName, name, err)
+			}
+			values[fieldName] = value
+		}
+		line, err := flatFileRecordLine(config.RecordType, record, values, enc.charset)
+		if err != nil {
+			return nil, fmt.Errorf("entity %s: %w", e.ID, err)
+		}
+		detailLines = append(detailLines, line)
+		written = append(written, e)
+	}
+
+	summaryLines := func(role string) error {
+		for _, name := range sortedRecords(config, role) {
+			record := config.Records[name]
+			values := make(map[string]interface{}, len(record.Fields))
+			for fieldName, field := range record.Fields {
+				value, err := summaryValue(field, written)
+				if err != nil {
+					return fmt.Errorf("field %s of %s record: %w", fieldName, name, err)
+				}
+				values[fieldName] = value
+			}
+			line, err := flatFileRecordLine(config.RecordType, record, values, enc.charset)
+			if err != nil {
+				return fmt.Errorf("%s record: %w", name, err)
+			}
+			buf.Write(enc.endRecord(line))
+		}
+		return nil
+	}
+	if err := summaryLines(flatFileHeader); err != nil {
+		return nil, err
+	}
+	for _, line := range detailLines {
+		buf.Write(enc.endRecord(line))
+	}
+	if err := summaryLines(flatFileTrailer); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// summaryValue returns the value of a header or trailer field: a constant value, the number of details, the sum
+// of a detail field or the time of writing
+func summaryValue(field conf.FlatFileField, details []*uda.Entity) (interface{}, error) {
+	switch field.Aggregate {
+	case "":
+		if field.Value == "" {
+			return nil, nil
+		}
+		return flatFileConstant(field)
+	case "count":
+		return float64(len(details)), nil
+	case "sum":
+		if field.Field == "" {
+			return nil, errors.New("sum aggregate needs a field to sum")
+		}
+		sum := 0.0
+		for _, e := range details {
+			value, err := flatFileNumber(flatFileValue(e, field.Field))
+			if err != nil {
+				return nil, fmt.Errorf("%s of entity %s: %w", field.Field, e.ID, err)
+			}
+			sum += value
+		}
+		return sum, nil
+	case "timestamp":
+		return time.Now().UTC().Format(time.RFC3339), nil
+	}
+	return nil, fmt.Errorf("unknown aggregate %s", field.Aggregate)
+}
+
+// flatFileConstant returns the constant value of a field, as number for numeric fields
+func flatFileConstant(field conf.FlatFileField) (interface{}, error) {
+	switch field.Type {
+	case "integer", "float":
+		return strconv.ParseFloat(field.Value, 64)
+	}
+	return field.Value, nil
+}
+
+func flatFileNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// flatFileRecordLine places the formatted values and the record type code at their byte positions
+func flatFileRecordLine(recordType *conf.FlatFileField, record conf.FlatFileRecord, values map[string]interface{}, charset encoding.Encoding) ([]byte, error) {
+	var line []byte
+	space := encodeText(charset, " ")
+	place := func(field conf.FlatFileField, value interface{}) error {
+		formatted, err := formatFlatFileField(field, value, charset)
+		if err != nil {
+			return err
+		}
+		for _, sub := range field.Substring {
+			for len(line) < sub[1] {
+				line = append(line, space...)
+			}
+			n := copy(line[sub[0]:sub[1]], formatted)
+			formatted = formatted[n:]
+		}
+		return nil
+	}
+	if err := place(conf.FlatFileField{Substring: recordType.Substring}, record.Code); err != nil {
+		return nil, err
+	}
+	for fieldName, field := range record.Fields {
+		if err := place(field, values[fieldName]); err != nil {
+			return nil, fmt.Errorf("field %s: %w", fieldName, err)
+		}
+	}
+	return line, nil
+}
+
+// parseRecord reads a line of a file mixing record types. Details are returned as entities, with the fields of
+// the current header attached. Headers and trailers are returned as entities of their own if emitted, otherwise
+// trailer fields are attached to the details since the last header, which are held back until the trailer.
+func (d *FlatFileDecoder) parseRecord(line []byte) ([][]byte, error) {
+	config := d.backend.FlatFileConfig
+	var code []byte
+	for _, sub := range config.RecordType.Substring {
+		if sub[1] > len(line) {
+			return nil, fmt.Errorf("record type out of bounds (line: %v)", decodeText(d.charset, line))
+		}
+		code = append(code, line[sub[0]:sub[1]]...)
+	}
+	name, record, err := recordByCode(config, strings.TrimSpace(decodeText(d.charset, code)))
+	if err != nil {
+		return nil, err
+	}
+	props, err := d.parseFields(line, record.Fields, config.RawRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	switch recordRole(record) {
+	case flatFileHeader:
+		d.header = nil
+		if record.Emit {
+			entity, err := d.recordEntity(name, record, props)
+			return [][]byte{entity}, err
+		}
+		d.header = withFieldPrefix(props, record.Prefix)
+		return nil, nil
+	case flatFileTrailer:
+		d.header = nil
+		if record.Emit {
+			entities, err := d.releaseDetails(nil)
+			if err != nil {
+				return nil, err
+			}
+			entity, err := d.recordEntity(name, record, props)
+			return append(entities, entity), err
+		}
+		return d.releaseDetails(withFieldPrefix(props, record.Prefix))
+	}
+
+	for k, v := range d.header {
+		if _, ok := props[k]; !ok {
+			props[k] = v
+		}
+	}
+	props[flatFileRecordTypeProperty] = name
+	if d.holdDetails() {
+		d.details = append(d.details, props)
+		return nil, nil
+	}
+	entity, err := toEntityBytes(props, d.backend)
+	return [][]byte{entity}, err
+}
+
+// releaseDetails returns the held back details with the trailer fields attached
+func (d *FlatFileDecoder) releaseDetails(trailer map[string]interface{}) ([][]byte, error) {
+	var entities [][]byte
+	for _, props := range d.details {
+		for k, v := range trailer {
+			if _, ok := props[k]; !ok {
+				props[k] = v
+			}
+		}
+		entity, err := toEntityBytes(props, d.backend)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	d.details = nil
+	return entities, nil
+}
+
+// holdDetails tells if details are held back to attach the fields of a trailer
+func (d *FlatFileDecoder) holdDetails() bool {
+	for _, record := range d.backend.FlatFileConfig.Records {
+		if recordRole(record) == flatFileTrailer && !record.Emit {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEntity returns a header or trailer as entity of its own, with its own id property if configured
+func (d *FlatFileDecoder) recordEntity(name string, record conf.FlatFileRecord, props map[string]interface{}) ([]byte, error) {
+	props[flatFileRecordTypeProperty] = name
+	backend := d.backend
+	if record.IdProperty != "" {
+		decode := *backend.DecodeConfig
+		decode.IdProperty = record.IdProperty
+		backend.DecodeConfig = &decode
+	}
+	return toEntityBytes(props, backend)
+}
+
+func recordByCode(config *conf.FlatFileConfig, code string) (string, conf.FlatFileRecord, error) {
+	for name, record := range config.Records {
+		if record.Code == code {
+			return name, record, nil
+		}
+	}
+	return "", conf.FlatFileRecord{}, fmt.Errorf("unknown record type %s", code)
+}
+
+func withFieldPrefix(props map[string]interface{}, prefix string) map[string]interface{} {
+	prefixed := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		prefixed[prefix+k] = v
+	}
+	return prefixed
+}
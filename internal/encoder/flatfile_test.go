@@ -2,12 +2,14 @@ package encoder_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"testing"
 
 	"github.com/franela/goblin"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"golang.org/x/text/encoding/charmap"
 )
 
 func TestFlatFile(t *testing.T) {
@@ -61,13 +63,13 @@ func TestFlatFile(t *testing.T) {
 			g.Assert(err).IsNil()
 			g.Assert(string(readResult)).Eql(string(expected))
 		})
-		g.It("Should count number of utf8 characters in string fields", func() {
+		g.It("Should count bytes of utf8 characters in string fields, without splitting characters", func() {
 			entities := []*uda.Entity{
 				{ID: "a:1", Properties: map[string]interface{}{"a:foo": "99", "a:bår": "aååå"}},
 				{ID: "a:2", Properties: map[string]interface{}{"a:foo": "88", "a:bår": "Ñ¢a"}},
 				{ID: "a:3", Properties: map[string]interface{}{"a:foo": "77", "a:bår": "§"}},
 			}
-			expected := "99aå\n88Ñ¢\n77§ \n"
+			expected := "99a \n88Ñ\n77§\n"
 
 			config := `{"flatFile":{"fieldOrder":["foo","bår"],"fields":{"foo":{"substring":[[0,2]]},"bår":{"substring":[[2,4]]}}}}`
 			var backend conf.StorageBackend
@@ -226,4 +228,146 @@ func TestFlatFile(t *testing.T) {
 			g.Assert(string(all)).Eql(expected)
 		})
 	})
+
+	g.Describe("Flat files mixing record types", func() {
+		records := `"recordType":{"substring":[[0,1]]},
+			"records":{
+				"batch":{"code":"H","role":"header","prefix":"batch","fields":{"Date":{"substring":[[1,9]]}}},
+				"payment":{"code":"D","fields":{"id":{"substring":[[1,3]]},"amount":{"substring":[[3,7]],"type":"integer"}}},
+				"total":{"code":"T","role":"trailer","prefix":"total","emit":%v,"idProperty":"Count",
+					"fields":{"Count":{"substring":[[1,4]],"type":"integer","aggregate":"count"},
+						"Sum":{"substring":[[4,10]],"type":"integer","aggregate":"sum","field":"amount"}}}
+			}`
+		decode := `"decode":{"defaultNamespace":"_","namespaces":{"_":"http://example.io/foo/"},
+			"propertyPrefixes":{},"refs":[],"idProperty":"id"}`
+		content := []byte("H20240101\n" +
+			"D010100\n" +
+			"D020250\n" +
+			"T002000350\n")
+
+		g.It("Should attach header and trailer fields to the details", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(fmt.Sprintf(`{"flatFile":{`+records+`},`+decode+`}`, false)), &backend)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, content)
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			g.Assert(len(entities)).Eql(2)
+			g.Assert(entities[0]["id"]).Eql("01")
+			g.Assert(entities[0]["props"]).Eql(map[string]interface{}{"_:id": "01", "_:amount": json.Number("100"),
+				"_:recordType": "payment", "_:batchDate": "20240101", "_:totalCount": json.Number("2"),
+				"_:totalSum": json.Number("350")})
+			g.Assert(entities[1]["props"].(map[string]interface{})["_:amount"]).Eql(json.Number("250"))
+		})
+
+		g.It("Should emit trailers as entities of their own", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(fmt.Sprintf(`{"flatFile":{`+records+`},`+decode+`}`, true)), &backend)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, content)
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			g.Assert(len(entities)).Eql(3)
+			g.Assert(entities[1]["props"]).Eql(map[string]interface{}{"_:id": "02", "_:amount": json.Number("250"),
+				"_:recordType": "payment", "_:batchDate": "20240101"})
+			g.Assert(entities[2]["id"]).Eql("2")
+			g.Assert(entities[2]["props"]).Eql(map[string]interface{}{"_:Count": json.Number("2"),
+				"_:Sum": json.Number("350"), "_:recordType": "total"})
+		})
+
+		g.It("Should fail on unknown record types", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(fmt.Sprintf(`{"flatFile":{`+records+`},`+decode+`}`, false)), &backend)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, []byte("X0101\n"))
+			g.Assert(err).IsNil()
+			_, err = ioutil.ReadAll(reader)
+			g.Assert(err.Error()).Eql("unknown record type X")
+		})
+
+		g.It("Should write header and trailer lines with counts and totals of each batch", func() {
+			var backend conf.StorageBackend
+			config := `{"flatFile":{"recordType":{"substring":[[0,1]]},"records":{
+				"batch":{"code":"H","role":"header","fields":{"kind":{"substring":[[1,4]],"value":"PAY"}}},
+				"payment":{"code":"D","fields":{"id":{"substring":[[1,3]]},"amount":{"substring":[[3,7]],"type":"integer"}}},
+				"total":{"code":"T","role":"trailer","fields":{
+					"count":{"substring":[[1,4]],"type":"integer","aggregate":"count"},
+					"sum":{"substring":[[4,10]],"type":"integer","aggregate":"sum","field":"amount"}}}}}}`
+			err := json.Unmarshal([]byte(config), &backend)
+			g.Assert(err).IsNil()
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "01", "a:amount": float64(100)}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "02", "a:amount": float64(250)}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql("HPAY\nD010100\nD020250\nT002000350\n")
+		})
+	})
+
+	g.Describe("Flat file encodings", func() {
+		decode := `"decode":{"defaultNamespace":"_","namespaces":{"_":"http://example.io/foo/"},
+			"propertyPrefixes":{},"refs":[],"idProperty":"id"}`
+		entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+
+		g.It("Should write and read ebcdic with packed decimals", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(`{"flatFile":{"encoding":"IBM037","fieldOrder":["id","name","amount"],"fields":{
+				"id":{"substring":[[0,2]]},
+				"name":{"substring":[[2,6]]},
+				"amount":{"substring":[[6,9]],"type":"packed","decimals":2}}},`+decode+`}`), &backend)
+			g.Assert(err).IsNil()
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "01", "a:name": "Bø", "a:amount": -123.45}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "02", "a:name": "Ål", "a:amount": float64(7)}},
+			}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			text, _ := charmap.CodePage037.NewEncoder().Bytes([]byte("01Bø  "))
+			expected := append(text, 0x12, 0x34, 0x5D, 0x25)
+			text, _ = charmap.CodePage037.NewEncoder().Bytes([]byte("02Ål  "))
+			expected = append(append(expected, text...), 0x00, 0x70, 0x0C, 0x25)
+			g.Assert(result).Eql(expected)
+
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			decoded := decodeEntities(g, reader)
+			g.Assert(len(decoded)).Eql(2)
+			g.Assert(decoded[0]["props"]).Eql(map[string]interface{}{"_:id": "01", "_:name": "Bø  ", "_:amount": json.Number("-123.45")})
+			g.Assert(decoded[1]["props"]).Eql(map[string]interface{}{"_:id": "02", "_:name": "Ål  ", "_:amount": json.Number("7")})
+		})
+
+		g.It("Should compute field widths in bytes of the target encoding", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(`{"flatFile":{"encoding":"ISO-8859-1","fieldOrder":["id","name"],"fields":{
+				"id":{"substring":[[0,2]]},"name":{"substring":[[2,5]]}}}}`), &backend)
+			g.Assert(err).IsNil()
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:id": "01", "a:name": "æøåx"}}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(result).Eql([]byte{'0', '1', 0xE6, 0xF8, 0xE5, '\n'})
+		})
+
+		g.It("Should read fixed length records without line breaks", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(`{"flatFile":{"encoding":"windows-1252","recordLength":4,"fields":{
+				"id":{"substring":[[0,2]]},"amount":{"substring":[[2,4]],"type":"packed"}}},`+decode+`}`), &backend)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, []byte{'0', '1', 0x04, 0x2C, '0', '2', 0x00, 0x5D})
+			g.Assert(err).IsNil()
+			decoded := decodeEntities(g, reader)
+			g.Assert(len(decoded)).Eql(2)
+			g.Assert(decoded[0]["props"]).Eql(map[string]interface{}{"_:id": "01", "_:amount": json.Number("42")})
+			g.Assert(decoded[1]["props"]).Eql(map[string]interface{}{"_:id": "02", "_:amount": json.Number("-5")})
+		})
+
+		g.It("Should fail for unknown encodings", func() {
+			var backend conf.StorageBackend
+			err := json.Unmarshal([]byte(`{"flatFile":{"encoding":"EBCDIC-XX","fields":{}},`+decode+`}`), &backend)
+			g.Assert(err).IsNil()
+			_, err = decodeOnce(backend, nil)
+			g.Assert(err.Error()).Eql("unsupported encoding EBCDIC-XX")
+		})
+	})
 }
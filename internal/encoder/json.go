@@ -2,6 +2,7 @@ package encoder
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
 	"go.uber.org/zap"
@@ -14,10 +15,25 @@ type JSONEncoder struct {
 	logger             *zap.SugaredLogger
 	open               bool
 	firstEntityWritten bool
+	leaveOpen          bool
+}
+
+func (enc *JSONEncoder) segment(continued bool, leaveOpen bool) {
+	enc.open = continued
+	enc.firstEntityWritten = continued
+	enc.leaveOpen = leaveOpen
 }
 
 func (enc *JSONEncoder) Close() error {
-	_, err := enc.writer.Write([]byte("]"))
+	if enc.leaveOpen {
+		return enc.writer.Close()
+	}
+	end := "]"
+	if !enc.open {
+		// empty datasets are written as empty arrays
+		end = "[]"
+	}
+	_, err := enc.writer.Write([]byte(end))
 	if err != nil {
 		return err
 	}
@@ -91,3 +107,139 @@ func (enc *JSONEncoder) Open() error {
 
 	return nil
 }
+
+// JSONDecoder ********************** DECODER ****************************************/
+
+// JSONDecoder reads the json arrays written by JSONEncoder. Storage backends may stream several files into the
+// same reader, so any number of consecutive arrays is accepted. Entities are decoded one at a time.
+type JSONDecoder struct {
+	backend  conf.StorageBackend
+	logger   *zap.SugaredLogger
+	reader   *io.PipeReader
+	decoder  *json.Decoder
+	inArray  bool
+	open     bool
+	closed   bool
+	since    string
+	fullSync bool
+	overhang []byte
+}
+
+func (d *JSONDecoder) Read(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p))
+	var done bool
+	if len(d.overhang) > 0 {
+		buf = append(buf, d.overhang...)
+		d.overhang = nil
+	}
+
+	if !d.open {
+		d.open = true
+		d.decoder = json.NewDecoder(d.reader)
+		d.decoder.UseNumber()
+		//start json array and add context as first entity
+		var namespaces map[string]string
+		if d.backend.DecodeConfig != nil {
+			namespaces = d.backend.DecodeConfig.Namespaces
+		}
+		buf = append(buf, []byte("[")...)
+		buf = append(buf, []byte(buildContext(namespaces))...)
+		if n, err, done = d.flush(p, buf); done {
+			return
+		}
+	}
+
+	// append one entity per array element, comma separated
+	for !d.closed {
+		var entityBytes []byte
+		entityBytes, err = d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		buf = append(buf, append([]byte(","), entityBytes...)...)
+		if n, err, done = d.flush(p, buf); done {
+			return
+		}
+	}
+
+	// add continuation token and close json array
+	if !d.closed {
+		d.closed = true
+		token := d.since
+		if d.fullSync {
+			token = ""
+		}
+		var sinceBytes []byte
+		sinceBytes, err = json.Marshal(map[string]interface{}{"id": "@continuation", "token": token})
+		if err != nil {
+			return
+		}
+		buf = append(buf, append([]byte(","), sinceBytes...)...)
+		buf = append(buf, []byte("]")...)
+	}
+	if n, err, done = d.flush(p, buf); done {
+		return
+	}
+	n = copy(p, buf)
+	return n, io.EOF
+}
+
+// next returns the next entity of the stream, or io.EOF when all arrays are consumed
+func (d *JSONDecoder) next() ([]byte, error) {
+	for {
+		if !d.inArray {
+			t, err := d.decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			if delim, ok := t.(json.Delim); !ok || delim != '[' {
+				return nil, fmt.Errorf("expected start of json array, got %v", t)
+			}
+			d.inArray = true
+		}
+		if !d.decoder.More() {
+			// consume end of array
+			if _, err := d.decoder.Token(); err != nil {
+				return nil, err
+			}
+			d.inArray = false
+			continue
+		}
+
+		if !d.backend.StripProps {
+			var raw json.RawMessage
+			if err := d.decoder.Decode(&raw); err != nil {
+				return nil, err
+			}
+			return raw, nil
+		}
+		var line map[string]interface{}
+		if err := d.decoder.Decode(&line); err != nil {
+			return nil, err
+		}
+		entityBytes, err := toEntityBytes(line, d.backend)
+		if err != nil {
+			return nil, err
+		}
+		if entityBytes == nil {
+			continue
+		}
+		return entityBytes, nil
+	}
+}
+
+func (d *JSONDecoder) flush(p []byte, buf []byte) (int, error, bool) {
+	if len(buf) >= len(p) {
+		n := copy(p, buf)
+		d.overhang = buf[n:]
+		return n, nil, true
+	}
+	return 0, nil, false
+}
+
+func (d *JSONDecoder) Close() error {
+	return d.reader.Close()
+}
@@ -2,9 +2,11 @@ package encoder_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/franela/goblin"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"io/ioutil"
 	"testing"
 )
 
@@ -61,5 +63,72 @@ func TestJson(t *testing.T) {
 			g.Assert(m[1]["id"]).Eql("a:2")
 			g.Assert(m[2]["props"].(map[string]interface{})["a:key"]).Eql("v1")
 		})
+
+		g.It("Should decode complete entities", func() {
+			backend := conf.StorageBackend{DecodeConfig: &conf.DecodeConfig{
+				Namespaces: map[string]string{"a": "http://example.io/a/"},
+			}}
+			var entities []*uda.Entity
+			for i := 0; i < 100; i++ {
+				entities = append(entities, &uda.Entity{
+					ID:         fmt.Sprintf("a:%v", i),
+					Properties: map[string]interface{}{"a:key": fmt.Sprintf("value %v", i), "a:n": i},
+					References: map[string]interface{}{"a:friend": "a:0"},
+				})
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			all, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(all, &m)).IsNil()
+			g.Assert(len(m)).Eql(102, "context, continuation and 100 entities")
+			g.Assert(m[0]["namespaces"].(map[string]interface{})["a"]).Eql("http://example.io/a/")
+			g.Assert(m[100]["id"]).Eql("a:99")
+			g.Assert(m[100]["props"].(map[string]interface{})["a:n"]).Eql(float64(99))
+			g.Assert(m[100]["refs"].(map[string]interface{})["a:friend"]).Eql("a:0")
+			g.Assert(m[101]["id"]).Eql("@continuation")
+		})
+
+		g.It("Should decode stripped entities from consecutive files", func() {
+			backend := conf.StorageBackend{StripProps: true, DecodeConfig: &conf.DecodeConfig{
+				Namespaces:       map[string]string{"a": "http://example.io/a/"},
+				DefaultNamespace: "a",
+				PropertyPrefixes: map[string]string{"id": "a:a"},
+				IdProperty:       "id",
+			}}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:key": "v1"}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "2", "a:key": "v2", "a:n": 12345678901}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			// storage backends concatenate the files of a dataset
+			result = append(result, result...)
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			all, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(all, &m)).IsNil()
+			g.Assert(len(m)).Eql(6, "context, continuation and 4 entities")
+			g.Assert(m[2]["id"]).Eql("a:2")
+			g.Assert(m[2]["props"].(map[string]interface{})["a:key"]).Eql("v2")
+			g.Assert(m[4]["id"]).Eql("a:2")
+			var raw []map[string]json.RawMessage
+			g.Assert(json.Unmarshal(all, &raw)).IsNil()
+			var props map[string]json.RawMessage
+			g.Assert(json.Unmarshal(raw[2]["props"], &props)).IsNil()
+			g.Assert(string(props["a:n"])).Eql("12345678901", "numbers are kept as written")
+		})
+
+		g.It("Should require a decode config for stripped entities", func() {
+			_, err := decodeOnce(conf.StorageBackend{StripProps: true}, []byte("[]"))
+			g.Assert(err == nil).IsFalse()
+		})
 	})
 }
@@ -30,6 +30,9 @@ func (enc *NDJsonEncoder) Write(entities []*uda.Entity) (int, error) {
 	return enc.writer.Write(data)
 }
 
+// segment does nothing, as lines are written the same way in all segments
+func (enc *NDJsonEncoder) segment(bool, bool) {}
+
 func (enc *NDJsonEncoder) Close() error {
 	return enc.writer.Close()
 }
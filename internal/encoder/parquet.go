@@ -2,14 +2,14 @@ package encoder
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
-	"time"
 
 	goparquet "github.com/fraugster/parquet-go"
 	"github.com/fraugster/parquet-go/parquet"
@@ -25,6 +25,7 @@ type ParquetEncoder struct {
 	open           bool
 	pqWriter       *goparquet.FileWriter
 	schemaDef      *parquetschema.SchemaDefinition
+	inferredSchema string
 	flushThreshold int64
 	logger         *zap.SugaredLogger
 }
@@ -50,6 +51,15 @@ func (enc *ParquetEncoder) Close() error {
 
 func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 	if !enc.open {
+		inference := enc.backend.ParquetConfig.InferSchema
+		if enc.backend.ParquetConfig.SchemaDefinition == "" && inference != nil {
+			schema, err := InferParquetSchema(entities, inference)
+			if err != nil {
+				return 0, err
+			}
+			enc.logger.Debugf("inferred parquet schema %s", schema)
+			enc.inferredSchema = schema
+		}
 		err := enc.Open()
 		if err != nil {
 			return 0, err
@@ -57,12 +67,11 @@ func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 	}
 
 	for _, e := range entities {
-		props := uda.StripProps(e)
-		refs := uda.StripRefs(e)
+		props, refs := enc.columnValues(e)
 		row := make(map[string]interface{})
 		for _, c := range enc.schemaDef.RootColumn.Children {
 			if c.SchemaElement.Name == "deleted" {
-				i, err := convertType(e.IsDeleted, c.SchemaElement.Type, c.SchemaElement.LogicalType)
+				i, err := convertType(e.IsDeleted, c.SchemaElement)
 				if err != nil {
 					return 0, err
 				}
@@ -70,7 +79,7 @@ func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 			}
 
 			if c.SchemaElement.Name == "recorded" {
-				i, err := convertType(e.Recorded, c.SchemaElement.Type, c.SchemaElement.LogicalType)
+				i, err := convertType(e.Recorded, c.SchemaElement)
 				if err != nil {
 					return 0, err
 				}
@@ -80,12 +89,12 @@ func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 			val, ok := props[c.SchemaElement.Name]
 			if !ok {
 				val, ok = refs[c.SchemaElement.Name]
-				if ok && val != nil {
+				if ok && val != nil && !isParquetMultiValued(c) {
 					val, _ = concatStringSlice(val)
 				}
 			}
 			if ok && val != nil {
-				i, err := convertType(val, c.SchemaElement.Type, c.SchemaElement.LogicalType)
+				i, err := toParquetValue(val, c)
 				if err != nil {
 					return 0, err
 				}
@@ -94,7 +103,7 @@ func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 
 			_, ok = row[c.SchemaElement.Name]
 			if c.SchemaElement.Name == "id" && !ok { // Allows for overriding entity id with id in props
-				i, err := convertType(e.ID, c.SchemaElement.Type, c.SchemaElement.LogicalType)
+				i, err := convertType(e.ID, c.SchemaElement)
 				if err != nil {
 					return 0, err
 				}
@@ -118,6 +127,15 @@ func (enc *ParquetEncoder) Write(entities []*uda.Entity) (int, error) {
 	return 0, nil
 }
 
+// columnValues returns props and refs of the entity by column name
+func (enc *ParquetEncoder) columnValues(e *uda.Entity) (map[string]interface{}, map[string]interface{}) {
+	if enc.inferredSchema == "" {
+		return uda.StripProps(e), uda.StripRefs(e)
+	}
+	keepNamespaces := enc.backend.ParquetConfig.InferSchema.KeepNamespaces
+	return parquetColumnValues(e.Properties, keepNamespaces), parquetColumnValues(e.References, keepNamespaces)
+}
+
 func concatStringSlice(value any) (string, bool) {
 	var output string
 	success := true
@@ -139,57 +157,211 @@ func concatStringSlice(value any) (string, bool) {
 	return output, success
 }
 
-func convertType(val interface{}, t *parquet.Type, logicalType *parquet.LogicalType) (interface{}, error) {
-	switch *t {
-	case parquet.Type_BOOLEAN:
-		r, ok := val.(bool)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("could not convert %+v to bool", val))
+func isParquetList(c *parquetschema.ColumnDefinition) bool {
+	return (c.SchemaElement.LogicalType != nil && c.SchemaElement.LogicalType.IsSetLIST()) ||
+		c.SchemaElement.GetConvertedType() == parquet.ConvertedType_LIST
+}
+
+func isParquetMap(c *parquetschema.ColumnDefinition) bool {
+	return (c.SchemaElement.LogicalType != nil && c.SchemaElement.LogicalType.IsSetMAP()) ||
+		c.SchemaElement.GetConvertedType() == parquet.ConvertedType_MAP ||
+		c.SchemaElement.GetConvertedType() == parquet.ConvertedType_MAP_KEY_VALUE
+}
+
+func isParquetRepeated(c *parquetschema.ColumnDefinition) bool {
+	return c.SchemaElement.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED
+}
+
+// isParquetMultiValued returns true for columns that can hold all values of a multi-valued property or reference
+func isParquetMultiValued(c *parquetschema.ColumnDefinition) bool {
+	return isParquetList(c) || isParquetRepeated(c)
+}
+
+// listElement returns the repeated field inside a LIST group, and whether its values are wrapped in a single
+// element field, like in the standard `repeated group list { optional binary element; }` layout
+func listElement(c *parquetschema.ColumnDefinition) (*parquetschema.ColumnDefinition, bool) {
+	repeated := c.Children[0]
+	return repeated, len(repeated.Children) == 1
+}
+
+// toParquetValue converts an entity value into the shape the parquet writer expects for the column. LIST columns
+// take single values or slices, MAP and STRUCT columns take nested objects, with or without namespace prefixes.
+func toParquetValue(val interface{}, c *parquetschema.ColumnDefinition) (interface{}, error) {
+	if isParquetRepeated(c) {
+		return toParquetRepeated(asValueList(val), c)
+	}
+	if len(c.Children) == 0 {
+		return convertType(val, c.SchemaElement)
+	}
+	if isParquetList(c) {
+		repeated, wrapped := listElement(c)
+		items := asValueList(val)
+		if wrapped {
+			element := repeated.Children[0]
+			for i, item := range items {
+				items[i] = map[string]interface{}{element.SchemaElement.Name: item}
+			}
 		}
-		return r, nil
-	case parquet.Type_INT32:
-		if logicalType == nil {
-			return int32(val.(int)), nil
+		list, err := toParquetRepeated(items, repeated)
+		if err != nil {
+			return nil, err
 		}
-		if logicalType.IsSetDATE() {
-			d := val.(time.Time)
-			duration := d.Sub(time.Unix(0, 0))
-			return int32(duration.Hours() / 24), nil
+		return map[string]interface{}{repeated.SchemaElement.Name: list}, nil
+	}
+	fields, ok := nestedFields(val)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("could not convert %+v to group %s", val, c.SchemaElement.Name))
+	}
+	if isParquetMap(c) {
+		keyValue := c.Children[0]
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
 		}
-		return nil, errors.New(fmt.Sprintf("unsupported logical type for base type %+v: %+v", t, logicalType))
-	case parquet.Type_INT64:
-		if logicalType == nil {
-			switch val.(type) {
-			case float64:
-				return int64(val.(float64)), nil
-			default:
-				return int64(val.(int)), nil
-			}
+		sort.Strings(keys)
+		items := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			items = append(items, map[string]interface{}{"key": k, "value": fields[k]})
 		}
-		if logicalType.IsSetTIME() {
-			d := val.(time.Time)
-			return d.UnixNano(), nil
+		list, err := toParquetRepeated(items, keyValue)
+		if err != nil {
+			return nil, err
 		}
-		return nil, errors.New(fmt.Sprintf("unsupported logical type for base type %+v: %+v", t, logicalType))
-	case parquet.Type_FLOAT:
-		return float32(val.(float64)), nil
-	case parquet.Type_DOUBLE:
-		return val.(float64), nil
-	case parquet.Type_BYTE_ARRAY:
-		if logicalType == nil {
-			return val.([]byte), nil
+		return map[string]interface{}{keyValue.SchemaElement.Name: list}, nil
+	}
+	return toParquetGroup(fields, c)
+}
+
+func toParquetGroup(fields map[string]interface{}, c *parquetschema.ColumnDefinition) (map[string]interface{}, error) {
+	group := make(map[string]interface{})
+	for _, child := range c.Children {
+		v, ok := fields[child.SchemaElement.Name]
+		if !ok || v == nil {
+			continue
 		}
-		if logicalType.IsSetSTRING() {
-			r, ok := concatStringSlice(val)
+		i, err := toParquetValue(v, child)
+		if err != nil {
+			return nil, err
+		}
+		group[child.SchemaElement.Name] = i
+	}
+	return group, nil
+}
+
+// toParquetRepeated converts the values of a repeated column, groups become a slice of maps and primitives a typed
+// slice. nil values cannot be stored in repeated fields and are skipped.
+func toParquetRepeated(items []interface{}, c *parquetschema.ColumnDefinition) (interface{}, error) {
+	if len(c.Children) > 0 {
+		groups := make([]map[string]interface{}, 0, len(items))
+		for _, item := range items {
+			fields, ok := nestedFields(item)
 			if !ok {
-				return nil, errors.New(fmt.Sprintf("could not convert %+v to string", val))
+				return nil, errors.New(fmt.Sprintf("could not convert %+v to group %s", item, c.SchemaElement.Name))
+			}
+			group, err := toParquetGroup(fields, c)
+			if err != nil {
+				return nil, err
 			}
-			return []byte(r), nil
+			groups = append(groups, group)
 		}
-		return nil, errors.New(fmt.Sprintf("unsupported logical type for base type %+v: %+v", t, logicalType))
+		return groups, nil
+	}
+
+	var values []interface{}
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		i, err := convertType(item, c.SchemaElement)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, i)
+	}
+	switch *c.SchemaElement.Type {
+	case parquet.Type_BOOLEAN:
+		return typedSlice[bool](values), nil
+	case parquet.Type_INT32:
+		return typedSlice[int32](values), nil
+	case parquet.Type_INT64:
+		return typedSlice[int64](values), nil
+	case parquet.Type_FLOAT:
+		return typedSlice[float32](values), nil
+	case parquet.Type_DOUBLE:
+		return typedSlice[float64](values), nil
+	case parquet.Type_INT96:
+		return typedSlice[[12]byte](values), nil
+	default:
+		return typedSlice[[]byte](values), nil
+	}
+}
+
+func typedSlice[T any](values []interface{}) []T {
+	result := make([]T, 0, len(values))
+	for _, v := range values {
+		result = append(result, v.(T))
+	}
+	return result
+}
+
+// asValueList returns the values of a multi-valued property, single values become a list of one
+func asValueList(val interface{}) []interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		return append([]interface{}{}, v...)
+	case []byte:
+		return []interface{}{v}
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice {
+		return []interface{}{val}
+	}
+	result := make([]interface{}, rv.Len())
+	for i := range result {
+		result[i] = rv.Index(i).Interface()
+	}
+	return result
+}
+
+// nestedFields returns the fields of a nested object with namespace prefixes removed from its keys. Nested entities
+// contribute their id, props and refs.
+func nestedFields(val interface{}) (map[string]interface{}, bool) {
+	var m map[string]interface{}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m = v
+	case *uda.Entity:
+		m = map[string]interface{}{"id": v.ID, "props": v.Properties, "refs": v.References}
 	default:
-		return nil, errors.New(fmt.Sprintf("unsupported datatype: %+v", t))
+		return nil, false
+	}
+	fields := make(map[string]interface{}, len(m))
+	props, isEntity := m["props"].(map[string]interface{})
+	if !isEntity {
+		for k, v := range m {
+			fields[parquetColumnName(k, false)] = v
+		}
+		return fields, true
 	}
+	if refs, ok := m["refs"].(map[string]interface{}); ok {
+		for k, v := range refs {
+			fields[parquetColumnName(k, false)] = v
+		}
+	}
+	for k, v := range props {
+		fields[parquetColumnName(k, false)] = v
+	}
+	if _, ok := fields["id"]; !ok && m["id"] != nil {
+		fields["id"] = m["id"]
+	}
+	return fields, true
+}
+
+func stripPrefix(key string) string {
+	if _, local, found := strings.Cut(key, ":"); found {
+		return local
+	}
+	return key
 }
 
 func (enc *ParquetEncoder) CloseWithError(err error) error {
@@ -200,7 +372,11 @@ func (enc *ParquetEncoder) CloseWithError(err error) error {
 }
 
 func (enc *ParquetEncoder) Open() error {
-	schemaDef, err := parquetschema.ParseSchemaDefinition(enc.backend.ParquetConfig.SchemaDefinition)
+	definition := enc.backend.ParquetConfig.SchemaDefinition
+	if enc.inferredSchema != "" {
+		definition = enc.inferredSchema
+	}
+	schemaDef, err := parquetschema.ParseSchemaDefinition(definition)
 	if err != nil {
 		enc.logger.Errorf("Failed to parse parquet schema: %s", err)
 		return err
@@ -213,7 +389,7 @@ func (enc *ParquetEncoder) Open() error {
 	enc.logger.Debugf("writing parquet files with flushThreshold %v", enc.flushThreshold)
 	enc.schemaDef = schemaDef
 
-	enc.pqWriter = goparquet.NewFileWriter(enc.writer, goparquet.WithCompressionCodec(parquet.CompressionCodec_SNAPPY), goparquet.WithSchemaDefinition(schemaDef), goparquet.WithCreator("objectstorage-datalayer"))
+	enc.pqWriter = goparquet.NewFileWriter(enc.writer, goparquet.WithCompressionCodec(parquetCompressionCodec(enc.backend)), goparquet.WithSchemaDefinition(schemaDef), goparquet.WithCreator("objectstorage-datalayer"))
 
 	enc.open = true
 
@@ -228,7 +404,8 @@ func (enc *ParquetEncoder) Open() error {
 type ParquetDecoder struct {
 	backend  conf.StorageBackend
 	logger   *zap.SugaredLogger
-	reader   *io.PipeReader
+	files    storedFiles
+	object   StoredFile
 	scanner  *bufio.Scanner
 	open     bool
 	closed   bool
@@ -248,15 +425,6 @@ func (d *ParquetDecoder) Read(p []byte) (n int, err error) {
 
 	if !d.open {
 		d.open = true
-		allBytes, err := io.ReadAll(d.reader)
-		if err != nil {
-			return n, err
-		}
-		readSeeker := bytes.NewReader(allBytes)
-		d.pqReader, err = goparquet.NewFileReader(readSeeker)
-		if err != nil {
-			return n, err
-		}
 		//start json array and add context as first entity
 		buf = append(buf, []byte("[")...)
 		if n, err, done = d.flush(p, buf); done {
@@ -270,13 +438,25 @@ func (d *ParquetDecoder) Read(p []byte) (n int, err error) {
 
 	// append one entity per line, comma separated
 	count := 0
-	for {
+	for !d.closed {
+		if d.pqReader == nil {
+			more, err := d.nextFile()
+			if err != nil {
+				return n, err
+			}
+			if !more {
+				break
+			}
+		}
 		row, err := d.pqReader.NextRow()
 		var entityProps = row
 
 		if err != nil {
 			if err.Error() == "EOF" {
-				break
+				if err = d.closeFile(); err != nil {
+					return n, err
+				}
+				continue
 			}
 			return n, err
 
@@ -332,7 +512,8 @@ func (d *ParquetDecoder) flush(p []byte, buf []byte) (int, error, bool) {
 }
 
 func (d *ParquetDecoder) Close() error {
-	return d.reader.Close()
+	d.files.close()
+	return d.closeFile()
 }
 
 func (d *ParquetDecoder) ParseLine(line map[string]interface{}) (map[string]interface{}, error) {
@@ -340,15 +521,64 @@ func (d *ParquetDecoder) ParseLine(line map[string]interface{}) (map[string]inte
 	for key, field := range line {
 		for _, v := range d.pqReader.GetSchemaDefinition().RootColumn.Children {
 			if key == v.SchemaElement.Name {
-				if v.SchemaElement.LogicalType != nil {
-					value := fmt.Sprintf("%s", field)
-					entityProps[key] = value
-				} else {
-					value := field
-					entityProps[key] = value
-				}
+				entityProps[key] = fromParquetValue(field, v)
 			}
 		}
 	}
 	return entityProps, nil
 }
+
+// fromParquetValue turns a value read from the column back into an entity value. LIST and repeated columns become
+// lists, MAP and STRUCT columns become nested objects.
+func fromParquetValue(value interface{}, c *parquetschema.ColumnDefinition) interface{} {
+	if value == nil {
+		return nil
+	}
+	if isParquetRepeated(c) {
+		items := asValueList(value)
+		for i, item := range items {
+			items[i] = fromParquetSingleValue(item, c)
+		}
+		return items
+	}
+	return fromParquetSingleValue(value, c)
+}
+
+func fromParquetSingleValue(value interface{}, c *parquetschema.ColumnDefinition) interface{} {
+	if len(c.Children) == 0 {
+		return fromParquetPrimitive(value, c.SchemaElement)
+	}
+	group, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	switch {
+	case isParquetList(c):
+		repeated, wrapped := listElement(c)
+		items, _ := fromParquetValue(group[repeated.SchemaElement.Name], repeated).([]interface{})
+		list := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			if wrapped {
+				item = item.(map[string]interface{})[repeated.Children[0].SchemaElement.Name]
+			}
+			list = append(list, item)
+		}
+		return list
+	case isParquetMap(c):
+		keyValue := c.Children[0]
+		items, _ := fromParquetValue(group[keyValue.SchemaElement.Name], keyValue).([]interface{})
+		result := make(map[string]interface{}, len(items))
+		for _, item := range items {
+			entry := item.(map[string]interface{})
+			result[fmt.Sprintf("%v", entry["key"])] = entry["value"]
+		}
+		return result
+	}
+	result := make(map[string]interface{}, len(c.Children))
+	for _, child := range c.Children {
+		if v, ok := group[child.SchemaElement.Name]; ok {
+			result[child.SchemaElement.Name] = fromParquetValue(v, child)
+		}
+	}
+	return result
+}
@@ -0,0 +1,264 @@
+package encoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fraugster/parquet-go/parquetschema"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+const defaultInferenceSampleSize = 100
+
+const (
+	inferredNull      = "null"
+	inferredBoolean   = "boolean"
+	inferredInt       = "int64"
+	inferredDouble    = "double"
+	inferredString    = "string"
+	inferredDate      = "date"
+	inferredTimestamp = "timestamp"
+	inferredJSON      = "json"
+	inferredList      = "list"
+	inferredStruct    = "struct"
+)
+
+type inferredType struct {
+	kind    string
+	element *inferredType
+	fields  map[string]*inferredType
+}
+
+// InferParquetSchema derives a parquet schema from the properties and references of the first entities. All
+// columns are optional, numbers become int64 or double, RFC3339 strings timestamps, lists LIST columns and nested
+// objects groups. Columns that only had null values are written as strings.
+func InferParquetSchema(entities []*uda.Entity, inference *conf.ParquetSchemaInference) (string, error) {
+	sampleSize := defaultInferenceSampleSize
+	if inference.SampleSize > 0 {
+		sampleSize = inference.SampleSize
+	}
+	if len(entities) > sampleSize {
+		entities = entities[:sampleSize]
+	}
+
+	columns := map[string]*inferredType{}
+	for _, e := range entities {
+		for k, v := range e.References {
+			name := parquetColumnName(k, inference.KeepNamespaces)
+			columns[name] = mergeInferred(columns[name], inferValue(v))
+		}
+	}
+	// props take precedence over refs with the same name, like in the encoder
+	props := map[string]*inferredType{}
+	for _, e := range entities {
+		for k, v := range e.Properties {
+			name := parquetColumnName(k, inference.KeepNamespaces)
+			props[name] = mergeInferred(props[name], inferValue(v))
+		}
+	}
+	for name, t := range props {
+		columns[name] = t
+	}
+	if _, ok := columns["id"]; !ok {
+		columns["id"] = &inferredType{kind: inferredString}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("message entity {\n")
+	writeInferredField(&sb, "id", columns["id"], "  ")
+	for _, name := range sortedKeys(columns) {
+		if name != "id" {
+			writeInferredField(&sb, name, columns[name], "  ")
+		}
+	}
+	sb.WriteString("}\n")
+
+	schema := sb.String()
+	if _, err := parquetschema.ParseSchemaDefinition(schema); err != nil {
+		return "", fmt.Errorf("inferred invalid parquet schema: %w", err)
+	}
+	return schema, nil
+}
+
+// UninferredColumns returns the columns of the props and refs of entities that are not in an inferred schema, in
+// name order. The encoder leaves these values out of the files.
+func UninferredColumns(definition string, entities []*uda.Entity, inference *conf.ParquetSchemaInference) []string {
+	schema, err := parquetschema.ParseSchemaDefinition(definition)
+	if err != nil {
+		return nil
+	}
+	known := map[string]bool{}
+	for _, column := range schema.RootColumn.Children {
+		known[column.SchemaElement.GetName()] = true
+	}
+	var missing []string
+	for _, e := range entities {
+		for _, values := range []map[string]interface{}{e.Properties, e.References} {
+			for k := range values {
+				if name := parquetColumnName(k, inference.KeepNamespaces); !known[name] {
+					known[name] = true
+					missing = append(missing, name)
+				}
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func inferValue(value interface{}) *inferredType {
+	switch v := value.(type) {
+	case nil:
+		return &inferredType{kind: inferredNull}
+	case bool:
+		return &inferredType{kind: inferredBoolean}
+	case int, int32, int64:
+		return &inferredType{kind: inferredInt}
+	case float32, float64:
+		f, _ := toFloat64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return &inferredType{kind: inferredInt}
+		}
+		return &inferredType{kind: inferredDouble}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return &inferredType{kind: inferredInt}
+		}
+		return &inferredType{kind: inferredDouble}
+	case string:
+		if _, err := time.Parse(dateLayout, v); err == nil {
+			return &inferredType{kind: inferredDate}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return &inferredType{kind: inferredTimestamp}
+		}
+		return &inferredType{kind: inferredString}
+	case []byte:
+		return &inferredType{kind: inferredString}
+	}
+	if fields, ok := nestedFields(value); ok {
+		t := &inferredType{kind: inferredStruct, fields: map[string]*inferredType{}}
+		for k, v := range fields {
+			t.fields[k] = mergeInferred(t.fields[k], inferValue(v))
+		}
+		return t
+	}
+	if reflect.ValueOf(value).Kind() == reflect.Slice {
+		t := &inferredType{kind: inferredList}
+		for _, item := range asValueList(value) {
+			t.element = mergeInferred(t.element, inferValue(item))
+		}
+		return t
+	}
+	return &inferredType{kind: inferredString}
+}
+
+// mergeInferred returns a type that can hold values of both types. Single values merge into lists, as the encoder
+// writes them as lists of one.
+func mergeInferred(a, b *inferredType) *inferredType {
+	switch {
+	case a == nil || a.kind == inferredNull:
+		return b
+	case b == nil || b.kind == inferredNull:
+		return a
+	case a.kind == inferredList && b.kind == inferredList:
+		return &inferredType{kind: inferredList, element: mergeInferred(a.element, b.element)}
+	case a.kind == inferredList:
+		return &inferredType{kind: inferredList, element: mergeInferred(a.element, b)}
+	case b.kind == inferredList:
+		return &inferredType{kind: inferredList, element: mergeInferred(a, b.element)}
+	case a.kind == inferredStruct && b.kind == inferredStruct:
+		t := &inferredType{kind: inferredStruct, fields: map[string]*inferredType{}}
+		for k, v := range a.fields {
+			t.fields[k] = v
+		}
+		for k, v := range b.fields {
+			t.fields[k] = mergeInferred(t.fields[k], v)
+		}
+		return t
+	case a.kind == b.kind:
+		return a
+	case a.kind == inferredStruct || b.kind == inferredStruct || a.kind == inferredJSON || b.kind == inferredJSON:
+		return &inferredType{kind: inferredJSON}
+	case (a.kind == inferredInt || a.kind == inferredDouble) && (b.kind == inferredInt || b.kind == inferredDouble):
+		return &inferredType{kind: inferredDouble}
+	}
+	return &inferredType{kind: inferredString}
+}
+
+func writeInferredField(sb *strings.Builder, name string, t *inferredType, indent string) {
+	if t == nil {
+		t = &inferredType{kind: inferredNull}
+	}
+	switch t.kind {
+	case inferredBoolean:
+		_, _ = fmt.Fprintf(sb, "%soptional boolean %s;\n", indent, name)
+	case inferredInt:
+		_, _ = fmt.Fprintf(sb, "%soptional int64 %s;\n", indent, name)
+	case inferredDouble:
+		_, _ = fmt.Fprintf(sb, "%soptional double %s;\n", indent, name)
+	case inferredDate:
+		_, _ = fmt.Fprintf(sb, "%soptional int32 %s (DATE);\n", indent, name)
+	case inferredTimestamp:
+		_, _ = fmt.Fprintf(sb, "%soptional int64 %s (TIMESTAMP(MILLIS, true));\n", indent, name)
+	case inferredJSON:
+		_, _ = fmt.Fprintf(sb, "%soptional binary %s (JSON);\n", indent, name)
+	case inferredList:
+		_, _ = fmt.Fprintf(sb, "%soptional group %s (LIST) {\n", indent, name)
+		_, _ = fmt.Fprintf(sb, "%s  repeated group list {\n", indent)
+		writeInferredField(sb, "element", t.element, indent+"    ")
+		_, _ = fmt.Fprintf(sb, "%s  }\n%s}\n", indent, indent)
+	case inferredStruct:
+		if len(t.fields) == 0 {
+			_, _ = fmt.Fprintf(sb, "%soptional binary %s (JSON);\n", indent, name)
+			return
+		}
+		_, _ = fmt.Fprintf(sb, "%soptional group %s {\n", indent, name)
+		for _, field := range sortedKeys(t.fields) {
+			writeInferredField(sb, field, t.fields[field], indent+"  ")
+		}
+		_, _ = fmt.Fprintf(sb, "%s}\n", indent)
+	default:
+		_, _ = fmt.Fprintf(sb, "%soptional binary %s (STRING);\n", indent, name)
+	}
+}
+
+func sortedKeys(m map[string]*inferredType) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parquetColumnName returns the column of a property or reference key in inferred schemas, and of nested object
+// keys. Characters the schema language uses as delimiters are replaced with `_`.
+func parquetColumnName(key string, keepNamespace bool) string {
+	if !keepNamespace {
+		key = stripPrefix(key)
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', ';', '{', '}', '(', ')', '=', ',':
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// parquetColumnValues returns the props or refs of an entity by the column names of inferred schemas
+func parquetColumnValues(values map[string]interface{}, keepNamespace bool) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		result[parquetColumnName(k, keepNamespace)] = v
+	}
+	return result
+}
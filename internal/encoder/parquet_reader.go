@@ -0,0 +1,144 @@
+package encoder
+
+import (
+	"errors"
+	"io"
+	"slices"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquetschema"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// parquetReadBlockSize is the minimum number of bytes fetched per ranged read. Parquet footers and page headers are
+// read in many small pieces, without a read block every one of them would be a separate request.
+const parquetReadBlockSize = 4 * 1024 * 1024
+
+// nextFile opens the next parquet file, returning false when all files are read
+func (d *ParquetDecoder) nextFile() (bool, error) {
+	object, err := d.files.next()
+	if err != nil || object == nil {
+		return false, err
+	}
+
+	pqReader, err := goparquet.NewFileReader(newRangeReadSeeker(object, parquetReadBlockSize))
+	if err != nil {
+		_ = object.Close()
+		return false, err
+	}
+	if columns := d.selectedColumns(pqReader.GetSchemaDefinition()); columns != nil {
+		pqReader.SetSelectedColumnsByPath(columns...)
+	}
+	d.object = object
+	d.pqReader = pqReader
+	return true, nil
+}
+
+// closeFile closes the current parquet file
+func (d *ParquetDecoder) closeFile() error {
+	d.pqReader = nil
+	if d.object == nil {
+		return nil
+	}
+	err := d.object.Close()
+	d.object = nil
+	return err
+}
+
+// selectedColumns returns the top level columns the decode configuration needs, or nil if all are needed. Ignored
+// columns are skipped unless they hold the id or are concatenated into other columns.
+func (d *ParquetDecoder) selectedColumns(schemaDef *parquetschema.SchemaDefinition) []goparquet.ColumnPath {
+	decode := d.backend.DecodeConfig
+	if decode == nil || len(decode.IgnoreColumns) == 0 {
+		return nil
+	}
+	var columns []goparquet.ColumnPath
+	skipped := false
+	for _, c := range schemaDef.RootColumn.Children {
+		name := c.SchemaElement.Name
+		if slices.Contains(decode.IgnoreColumns, name) && name != decode.IdProperty && !isConcatColumn(decode, name) {
+			skipped = true
+			continue
+		}
+		columns = append(columns, goparquet.ColumnPath{name})
+	}
+	if !skipped {
+		return nil
+	}
+	return columns
+}
+
+func isConcatColumn(decode *conf.DecodeConfig, name string) bool {
+	for _, columns := range decode.ConcatColumns {
+		if slices.Contains(columns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeReadSeeker turns the ranged reads of a parquet object into the io.ReadSeeker parquet-go reads files with.
+// Reads are served from a block of at least blockSize bytes, larger reads go straight to the object.
+type rangeReadSeeker struct {
+	object    StoredFile
+	blockSize int
+	offset    int64
+	block     []byte
+	blockOff  int64
+}
+
+func newRangeReadSeeker(object StoredFile, blockSize int) *rangeReadSeeker {
+	return &rangeReadSeeker{object: object, blockSize: blockSize}
+}
+
+func (r *rangeReadSeeker) Read(p []byte) (int, error) {
+	size := r.object.Size()
+	if r.offset >= size {
+		return 0, io.EOF
+	}
+	if r.offset < r.blockOff || r.offset >= r.blockOff+int64(len(r.block)) {
+		if len(p) >= r.blockSize {
+			n, err := r.object.ReadAt(p, r.offset)
+			r.offset += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		length := int64(r.blockSize)
+		if r.offset+length > size {
+			length = size - r.offset
+		}
+		if int64(cap(r.block)) < length {
+			r.block = make([]byte, length)
+		}
+		r.block = r.block[:length]
+		n, err := r.object.ReadAt(r.block, r.offset)
+		r.block = r.block[:n]
+		r.blockOff = r.offset
+		if n == 0 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, r.block[r.offset-r.blockOff:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.object.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of parquet file")
+	}
+	r.offset = offset
+	return offset, nil
+}
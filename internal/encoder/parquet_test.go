@@ -2,10 +2,13 @@ package encoder_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/franela/goblin"
 	goparquet "github.com/fraugster/parquet-go"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+	"go.uber.org/zap"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -372,6 +375,245 @@ func TestParquet(t *testing.T) {
 			g.Assert(row["key"]).Eql([]byte("value 2"))
 			g.Assert(row["recorded"]).Eql([]byte("1660804179145791488"))
 		})
+
+		g.It("Should write LIST, MAP and STRUCT columns", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					optional group friends (LIST) {
+						repeated group list {
+							optional binary element (STRING);
+						}
+					}
+					repeated int64 scores;
+					optional group address {
+						optional binary city (STRING);
+						optional int32 zip;
+					}
+					optional group labels (MAP) {
+						repeated group key_value {
+							required binary key (STRING);
+							optional binary value (STRING);
+						}
+					}
+					optional group pets (LIST) {
+						repeated group list {
+							optional group element {
+								optional binary name (STRING);
+							}
+						}
+					}
+				}`,
+			}}
+			entities := []*uda.Entity{
+				{ID: "a:1",
+					Properties: map[string]interface{}{
+						"a:scores":  []interface{}{float64(3), float64(4)},
+						"a:address": map[string]interface{}{"a:city": "Oslo", "a:zip": 150},
+						"a:labels":  map[string]interface{}{"b": "two", "a": "one"},
+						"a:pets": []interface{}{
+							map[string]interface{}{"a:name": "Fido"},
+							map[string]interface{}{"id": "a:cat", "props": map[string]interface{}{"a:name": "Tom"}},
+						},
+					},
+					References: map[string]interface{}{"a:friends": []interface{}{"a:2", "a:3"}}},
+				{ID: "a:2",
+					Properties: map[string]interface{}{"a:scores": float64(5)},
+					References: map[string]interface{}{"a:friends": "a:1"}},
+				{ID: "a:3", Properties: map[string]interface{}{}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			pqReader, err := goparquet.NewFileReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			g.Assert(pqReader.NumRows()).Eql(int64(3))
+
+			row, _ := pqReader.NextRow()
+			g.Assert(row["friends"]).Eql(map[string]interface{}{"list": []map[string]interface{}{
+				{"element": []byte("a:2")}, {"element": []byte("a:3")}}})
+			g.Assert(row["scores"]).Eql([]int64{3, 4})
+			g.Assert(row["address"]).Eql(map[string]interface{}{"city": []byte("Oslo"), "zip": int32(150)})
+			g.Assert(row["labels"]).Eql(map[string]interface{}{"key_value": []map[string]interface{}{
+				{"key": []byte("a"), "value": []byte("one")}, {"key": []byte("b"), "value": []byte("two")}}})
+			g.Assert(row["pets"]).Eql(map[string]interface{}{"list": []map[string]interface{}{
+				{"element": map[string]interface{}{"name": []byte("Fido")}},
+				{"element": map[string]interface{}{"name": []byte("Tom")}}}})
+
+			row, _ = pqReader.NextRow()
+			g.Assert(row["friends"]).Eql(map[string]interface{}{"list": []map[string]interface{}{
+				{"element": []byte("a:1")}}})
+			g.Assert(row["scores"]).Eql([]int64{5})
+
+			row, _ = pqReader.NextRow()
+			_, ok := row["friends"]
+			g.Assert(ok).IsFalse()
+			_, ok = row["address"]
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("Should convert json values to parquet logical types", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					optional int64 created (TIMESTAMP(MILLIS, true));
+					optional int64 local (TIMESTAMP(MICROS, false));
+					optional int64 nanos (TIMESTAMP(NANOS, true));
+					optional int32 day (DATE);
+					optional int32 price (DECIMAL(9, 2));
+					optional int64 amount (DECIMAL(18, 3));
+					optional fixed_len_byte_array(9) balance (DECIMAL(20, 4));
+					optional binary big (DECIMAL(30, 2));
+					optional fixed_len_byte_array(16) uuid (UUID);
+					optional binary doc (JSON);
+					optional binary kind (ENUM);
+					optional int32 small (INT(8, true));
+					optional int32 count (INT(32, false));
+					optional int96 legacy;
+				}`,
+			}}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{
+					"a:created": "2021-12-31T23:30:59.5+01:00",
+					"a:local":   "2021-12-31T23:30:59.5+01:00",
+					"a:nanos":   "1640989859500000001",
+					"a:day":     "2021-12-31",
+					"a:price":   "12.345",
+					"a:amount":  19.99,
+					"a:balance": -1.5,
+					"a:big":     "123456789012345678901234567.89",
+					"a:uuid":    "ef346158-c858-11eb-b8bc-0242ac130003",
+					"a:doc":     map[string]interface{}{"key": []interface{}{"val"}},
+					"a:kind":    "person",
+					"a:small":   float64(-128),
+					"a:count":   float64(4000000000),
+					"a:legacy":  "2021-12-31T22:30:59Z",
+				}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			pqReader, err := goparquet.NewFileReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			row, _ := pqReader.NextRow()
+			g.Assert(row["created"]).Eql(int64(1640989859500))
+			g.Assert(row["local"]).Eql(time.Date(2021, 12, 31, 23, 30, 59, 500000000, time.UTC).UnixMicro())
+			g.Assert(row["nanos"]).Eql(int64(1640989859500000001))
+			g.Assert(row["day"]).Eql(int32(18992))
+			g.Assert(row["price"]).Eql(int32(1235))
+			g.Assert(row["amount"]).Eql(int64(19990))
+			g.Assert(row["balance"]).Eql([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xc5, 0x68})
+			g.Assert(row["uuid"]).Eql([]byte{0xef, 0x34, 0x61, 0x58, 0xc8, 0x58, 0x11, 0xeb, 0xb8, 0xbc, 0x02, 0x42, 0xac, 0x13, 0x00, 0x03})
+			g.Assert(row["doc"]).Eql([]byte(`{"key":["val"]}`))
+			g.Assert(row["kind"]).Eql([]byte("person"))
+			g.Assert(row["small"]).Eql(int32(-128))
+			g.Assert(row["count"]).Eql(int32(-294967296))
+			g.Assert(row["legacy"]).Eql(goparquet.TimeToInt96(time.Date(2021, 12, 31, 22, 30, 59, 0, time.UTC)))
+		})
+
+		g.It("Should reject values outside the range of the column", func() {
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			for _, column := range []string{
+				"optional int32 v (INT(8, true));",
+				"optional int32 v (DECIMAL(4, 2));",
+				"optional int32 v (INT(16, false));",
+			} {
+				backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+					SchemaDefinition: "message test_schema { " + column + " }",
+				}}
+				entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:v": -300}}}
+				_, err := encodeOnce(backend, entities, &entityContext)
+				g.Assert(err == nil).IsFalse(column)
+			}
+		})
+
+		g.It("Should infer the schema from the first entities", func() {
+			inference := &conf.ParquetSchemaInference{SampleSize: 2}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{
+					"a:name":    "Frank",
+					"a:age":     float64(41),
+					"a:born":    "1980-02-03T04:05:06Z",
+					"a:day":     "1980-02-03",
+					"a:tags":    []interface{}{"x", "y"},
+					"a:address": map[string]interface{}{"a:city": "Oslo", "a:zip": float64(150)},
+					"a:empty":   nil,
+				}, References: map[string]interface{}{"b:friend": "a:2"}},
+				{ID: "a:2", Properties: map[string]interface{}{
+					"a:age":     41.5,
+					"a:tags":    "z",
+					"a:active":  true,
+					"a:address": map[string]interface{}{"a:street": "Main"},
+				}, References: map[string]interface{}{"b:friend": []interface{}{"a:1", "a:3"}}},
+				{ID: "a:3", Properties: map[string]interface{}{"a:ignored": "beyond sample size"}},
+			}
+			schema, err := encoder.InferParquetSchema(entities, inference)
+			g.Assert(err).IsNil()
+			g.Assert(schema).Eql(`message entity {
+  optional binary id (STRING);
+  optional boolean active;
+  optional group address {
+    optional binary city (STRING);
+    optional binary street (STRING);
+    optional int64 zip;
+  }
+  optional double age;
+  optional int64 born (TIMESTAMP(MILLIS, true));
+  optional int32 day (DATE);
+  optional binary empty (STRING);
+  optional group friend (LIST) {
+    repeated group list {
+      optional binary element (STRING);
+    }
+  }
+  optional binary name (STRING);
+  optional group tags (LIST) {
+    repeated group list {
+      optional binary element (STRING);
+    }
+  }
+}
+`)
+
+			inference.KeepNamespaces = true
+			schema, err = encoder.InferParquetSchema(entities[2:], inference)
+			g.Assert(err).IsNil()
+			g.Assert(schema).Eql("message entity {\n  optional binary id (STRING);\n  optional binary a:ignored (STRING);\n}\n")
+		})
+
+		g.It("Should find columns that are not in an inferred schema", func() {
+			inference := &conf.ParquetSchemaInference{}
+			schema, err := encoder.InferParquetSchema([]*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:name": "Frank"}}}, inference)
+			g.Assert(err).IsNil()
+			g.Assert(encoder.UninferredColumns(schema, []*uda.Entity{
+				{ID: "a:2", Properties: map[string]interface{}{"a:name": "Bob", "b:city": "Oslo"},
+					References: map[string]interface{}{"a:friend": "a:1"}},
+				{ID: "a:3", Properties: map[string]interface{}{"a:city": "Bergen"}},
+			}, inference)).Eql([]string{"city", "friend"})
+			g.Assert(encoder.UninferredColumns(schema, []*uda.Entity{
+				{ID: "a:2", Properties: map[string]interface{}{"a:name": "Bob"}}}, inference)).Eql([]string(nil))
+		})
+
+		g.It("Should write parquet files with an inferred schema", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				InferSchema: &conf.ParquetSchemaInference{KeepNamespaces: true},
+			}}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:name": "Frank", "a:age": float64(41)}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:name": "Bob", "b:city": "Oslo"}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			pqReader, err := goparquet.NewFileReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			g.Assert(pqReader.NumRows()).Eql(int64(2))
+			row, _ := pqReader.NextRow()
+			g.Assert(row).Eql(map[string]interface{}{"id": []byte("a:1"), "a:name": []byte("Frank"), "a:age": int64(41)})
+			row, _ = pqReader.NextRow()
+			g.Assert(row).Eql(map[string]interface{}{"id": []byte("a:2"), "a:name": []byte("Bob"), "b:city": []byte("Oslo")})
+		})
 	})
 	g.Describe("The Parquet Decoder", func() {
 		g.It("Should produce a complete fixed width parquet", func() {
@@ -400,5 +642,189 @@ func TestParquet(t *testing.T) {
 			g.Assert(len(all)).Eql(249)
 			g.Assert(string(all)).Eql(expected)
 		})
+
+		g.It("Should read LIST, MAP and STRUCT columns back into lists and objects", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					optional group friends (LIST) {
+						repeated group list {
+							optional binary element (STRING);
+						}
+					}
+					repeated int64 scores;
+					optional group address {
+						optional binary city (STRING);
+						optional int32 zip;
+					}
+					optional group labels (MAP) {
+						repeated group key_value {
+							required binary key (STRING);
+							optional binary value (STRING);
+						}
+					}
+					optional group pets (LIST) {
+						repeated group list {
+							optional group element {
+								optional binary name (STRING);
+							}
+						}
+					}
+				}`,
+			},
+				DecodeConfig: &conf.DecodeConfig{
+					IdProperty:       "id",
+					DefaultNamespace: "_",
+					Namespaces:       map[string]string{"_": "http://example.io/foo/"},
+					PropertyPrefixes: map[string]string{"friends": "_:_"},
+					Refs:             []string{"friends"}}}
+
+			entities := []*uda.Entity{
+				{ID: "_:1",
+					Properties: map[string]interface{}{
+						"_:id":      "1",
+						"_:scores":  []interface{}{float64(3), float64(4)},
+						"_:address": map[string]interface{}{"city": "Oslo"},
+						"_:labels":  map[string]interface{}{"a": "one"},
+						"_:pets":    []interface{}{map[string]interface{}{"name": "Fido"}},
+					},
+					References: map[string]interface{}{"_:friends": []interface{}{"2", "3"}}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			all, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(all, &m)).IsNil()
+			g.Assert(len(m)).Eql(3)
+			g.Assert(m[1]["refs"]).Eql(map[string]interface{}{"_:friends": []interface{}{"_:2", "_:3"}})
+			props := m[1]["props"].(map[string]interface{})
+			g.Assert(props["_:scores"]).Eql([]interface{}{float64(3), float64(4)})
+			g.Assert(props["_:address"]).Eql(map[string]interface{}{"city": "Oslo"})
+			g.Assert(props["_:labels"]).Eql(map[string]interface{}{"a": "one"})
+			g.Assert(props["_:pets"]).Eql([]interface{}{map[string]interface{}{"name": "Fido"}})
+		})
+
+		g.It("Should read parquet logical types as json values", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					optional int64 created (TIMESTAMP(MILLIS, true));
+					optional int64 local (TIMESTAMP(MICROS, false));
+					optional int64 nanos (TIMESTAMP(NANOS, true));
+					optional int32 day (DATE);
+					optional int32 price (DECIMAL(9, 2));
+					optional int64 amount (DECIMAL(18, 3));
+					optional fixed_len_byte_array(9) balance (DECIMAL(20, 4));
+					optional binary big (DECIMAL(30, 2));
+					optional fixed_len_byte_array(16) uuid (UUID);
+					optional binary doc (JSON);
+					optional binary kind (ENUM);
+					optional int32 small (INT(8, true));
+					optional int32 count (INT(32, false));
+					optional int96 legacy;
+				}`,
+			},
+				DecodeConfig: &conf.DecodeConfig{
+					IdProperty:       "id",
+					DefaultNamespace: "_",
+					Namespaces:       map[string]string{"_": "http://example.io/foo/"}}}
+			entities := []*uda.Entity{
+				{ID: "_:1", Properties: map[string]interface{}{
+					"_:id":      "1",
+					"_:created": "2021-12-31T23:30:59.5+01:00",
+					"_:local":   "2021-12-31T23:30:59.5+01:00",
+					"_:day":     "2021-12-31",
+					"_:price":   "12.345",
+					"_:balance": -1.5,
+					"_:big":     "123456789012345678901234567.89",
+					"_:uuid":    "ef346158-c858-11eb-b8bc-0242ac130003",
+					"_:doc":     map[string]interface{}{"key": []interface{}{"val"}},
+					"_:kind":    "person",
+					"_:count":   float64(4000000000),
+					"_:legacy":  "2021-12-31T22:30:59Z",
+				}},
+			}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			all, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			decoder := json.NewDecoder(bytes.NewReader(all))
+			decoder.UseNumber()
+			var m []map[string]interface{}
+			g.Assert(decoder.Decode(&m)).IsNil()
+			props := m[1]["props"].(map[string]interface{})
+			g.Assert(props["_:created"]).Eql("2021-12-31T22:30:59.5Z")
+			g.Assert(props["_:local"]).Eql("2021-12-31T23:30:59.5")
+			g.Assert(props["_:day"]).Eql("2021-12-31")
+			g.Assert(props["_:price"]).Eql(json.Number("12.35"))
+			g.Assert(props["_:balance"]).Eql(json.Number("-1.5000"))
+			g.Assert(props["_:big"]).Eql(json.Number("123456789012345678901234567.89"))
+			g.Assert(props["_:uuid"]).Eql("ef346158-c858-11eb-b8bc-0242ac130003")
+			g.Assert(props["_:doc"]).Eql(map[string]interface{}{"key": []interface{}{"val"}})
+			g.Assert(props["_:kind"]).Eql("person")
+			g.Assert(props["_:count"]).Eql(json.Number("4000000000"))
+			g.Assert(props["_:legacy"]).Eql("2021-12-31T22:30:59Z")
+			g.Assert(props["_:amount"]).IsNil()
+		})
+
+		g.It("Should read parquet files one row group at a time with ranged reads", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					required binary key (STRING);
+					optional binary blob (STRING);
+				}`,
+				FlushThreshold: 1,
+			},
+				DecodeConfig: &conf.DecodeConfig{
+					IdProperty:       "id",
+					DefaultNamespace: "_",
+					IgnoreColumns:    []string{"blob"},
+					Namespaces:       map[string]string{"_": "http://example.io/foo/"}}}
+			entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+			first, err := encodeTwice(backend, []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:key": "value 1", "a:blob": "big"}},
+			}, &entityContext)
+			g.Assert(err).IsNil()
+			pqReader, err := goparquet.NewFileReader(bytes.NewReader(first))
+			g.Assert(err).IsNil()
+			g.Assert(pqReader.RowGroupCount()).Eql(2)
+			second, err := encodeOnce(backend, []*uda.Entity{
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "2", "a:key": "value 2", "a:blob": "big"}},
+			}, &entityContext)
+			g.Assert(err).IsNil()
+
+			objects := map[string]*memoryFile{
+				"first":  {Reader: bytes.NewReader(first)},
+				"second": {Reader: bytes.NewReader(second)},
+			}
+			open := func(key string) (encoder.StoredFile, error) {
+				return objects[key], nil
+			}
+			reader, err := encoder.NewFileDecoder(backend, []string{"first", "second"}, open, "", zap.NewNop().Sugar(), true)
+			g.Assert(err).IsNil()
+			all, err := ioutil.ReadAll(reader)
+			g.Assert(err).IsNil()
+			g.Assert(reader.Close()).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(all, &m)).IsNil()
+			g.Assert(len(m)).Eql(5)
+			var ids []interface{}
+			for _, e := range m[1:4] {
+				ids = append(ids, e["id"])
+				g.Assert(e["props"].(map[string]interface{})["_:blob"]).IsNil()
+			}
+			g.Assert(ids).Eql([]interface{}{"1", "1", "2"})
+			g.Assert(m[4]["id"]).Eql("@continuation")
+			g.Assert(objects["first"].closed).IsTrue()
+			g.Assert(objects["second"].closed).IsTrue()
+		})
 	})
 }
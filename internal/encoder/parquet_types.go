@@ -0,0 +1,469 @@
+package encoder
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+)
+
+const (
+	parquetMillis = "MILLIS"
+	parquetMicros = "MICROS"
+	parquetNanos  = "NANOS"
+	dateLayout    = "2006-01-02"
+	timeOfDay     = "15:04:05.999999999"
+	localDateTime = "2006-01-02T15:04:05.999999999"
+)
+
+// convertType converts an entity value into the physical value of a parquet column. Values are accepted the way they
+// come out of json decoded entities: numbers, RFC3339 strings for dates and timestamps and strings holding numbers.
+func convertType(val interface{}, se *parquet.SchemaElement) (interface{}, error) {
+	switch se.GetType() {
+	case parquet.Type_BOOLEAN:
+		switch v := val.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("could not convert %+v to bool", val))
+	case parquet.Type_INT32:
+		i, err := toParquetInt(val, se)
+		if err != nil {
+			return nil, err
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, errors.New(fmt.Sprintf("%+v is out of range for int32 column %s", val, se.Name))
+		}
+		return int32(i), nil
+	case parquet.Type_INT64:
+		return toParquetInt(val, se)
+	case parquet.Type_INT96:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		return goparquet.TimeToInt96(t), nil
+	case parquet.Type_FLOAT:
+		f, err := toFloat64(val)
+		if err != nil {
+			return nil, err
+		}
+		return float32(f), nil
+	case parquet.Type_DOUBLE:
+		return toFloat64(val)
+	case parquet.Type_BYTE_ARRAY, parquet.Type_FIXED_LEN_BYTE_ARRAY:
+		b, err := toParquetBytes(val, se)
+		if err != nil {
+			return nil, err
+		}
+		if se.GetType() == parquet.Type_FIXED_LEN_BYTE_ARRAY && len(b) != int(se.GetTypeLength()) {
+			return nil, errors.New(fmt.Sprintf("%+v does not have the length %v of column %s", val, se.GetTypeLength(), se.Name))
+		}
+		return b, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported datatype: %+v", se.Type))
+	}
+}
+
+// toParquetInt converts values of INT32 and INT64 columns, including dates, times, timestamps, decimals and sized
+// integers
+func toParquetInt(val interface{}, se *parquet.SchemaElement) (int64, error) {
+	if isParquetDate(se) {
+		if t, err := toTime(val); err == nil {
+			return floorDiv(t.Unix(), 24*60*60), nil
+		}
+		return toInt64(val)
+	}
+	if unit, utc, ok := parquetTimestamp(se); ok {
+		if t, err := toTime(val); err == nil {
+			if !utc {
+				// local timestamps store the wall clock time as if it was utc
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+			}
+			return toEpoch(t, unit), nil
+		}
+		return toInt64(val)
+	}
+	if unit, ok := parquetTime(se); ok {
+		if s, isString := val.(string); isString {
+			if t, err := time.Parse(timeOfDay, s); err == nil {
+				return toUnit(t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)), unit), nil
+			}
+		}
+		// full timestamps are stored as time since epoch, athena reads TIME columns as timestamps
+		if t, err := toTime(val); err == nil {
+			return toEpoch(t, unit), nil
+		}
+		return toInt64(val)
+	}
+	if scale, precision, ok := parquetDecimal(se); ok {
+		unscaled, err := toUnscaledDecimal(val, scale, precision)
+		if err != nil {
+			return 0, err
+		}
+		if !unscaled.IsInt64() {
+			return 0, errors.New(fmt.Sprintf("%+v is out of range for decimal column %s", val, se.Name))
+		}
+		return unscaled.Int64(), nil
+	}
+
+	i, err := toInt64(val)
+	if err != nil {
+		return 0, err
+	}
+	if bits, signed, ok := parquetIntWidth(se); ok {
+		if signed && bits < 64 && (i < -(1<<(bits-1)) || i > 1<<(bits-1)-1) {
+			return 0, errors.New(fmt.Sprintf("%+v is out of range for INT(%v, true) column %s", val, bits, se.Name))
+		}
+		if !signed && (i < 0 || bits < 64 && i > 1<<bits-1) {
+			return 0, errors.New(fmt.Sprintf("%+v is out of range for INT(%v, false) column %s", val, bits, se.Name))
+		}
+		if !signed && bits == 32 {
+			// unsigned values are stored in the bits of the signed physical type
+			return int64(int32(uint32(i))), nil
+		}
+	}
+	return i, nil
+}
+
+func toParquetBytes(val interface{}, se *parquet.SchemaElement) ([]byte, error) {
+	lt := se.LogicalType
+	switch {
+	case isParquetString(se):
+		r, ok := concatStringSlice(val)
+		if !ok {
+			switch val.(type) {
+			case bool, int, int32, int64, float32, float64, json.Number:
+				r = fmt.Sprintf("%v", val)
+			default:
+				return nil, errors.New(fmt.Sprintf("could not convert %+v to string", val))
+			}
+		}
+		return []byte(r), nil
+	case lt != nil && lt.IsSetJSON() || hasConvertedType(se, parquet.ConvertedType_JSON):
+		return json.Marshal(val)
+	case lt != nil && lt.IsSetUUID():
+		s, ok := val.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("could not convert %+v to uuid", val))
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+		if err != nil || len(b) != 16 {
+			return nil, errors.New(fmt.Sprintf("could not convert %+v to uuid", val))
+		}
+		return b, nil
+	}
+	if scale, precision, ok := parquetDecimal(se); ok {
+		unscaled, err := toUnscaledDecimal(val, scale, precision)
+		if err != nil {
+			return nil, err
+		}
+		return decimalBytes(unscaled, int(se.GetTypeLength()))
+	}
+	if lt != nil || se.ConvertedType != nil {
+		return nil, errors.New(fmt.Sprintf("unsupported logical type for base type %+v: %+v", se.Type, lt))
+	}
+	switch v := val.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, errors.New(fmt.Sprintf("could not convert %+v to bytes", val))
+}
+
+// fromParquetPrimitive turns a value of a primitive parquet column into a json friendly entity value. Dates and
+// timestamps become RFC3339 strings, decimals exact json numbers.
+func fromParquetPrimitive(value interface{}, se *parquet.SchemaElement) interface{} {
+	if value == nil {
+		return nil
+	}
+	lt := se.LogicalType
+	switch {
+	case isParquetString(se):
+		return fmt.Sprintf("%s", value)
+	case lt != nil && lt.IsSetJSON() || hasConvertedType(se, parquet.ConvertedType_JSON):
+		b, _ := value.([]byte)
+		decoder := json.NewDecoder(strings.NewReader(string(b)))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil {
+			return string(b)
+		}
+		return v
+	case lt != nil && lt.IsSetUUID():
+		b, _ := value.([]byte)
+		s := hex.EncodeToString(b)
+		if len(s) != 32 {
+			return s
+		}
+		return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+	case isParquetDate(se):
+		if days, ok := value.(int32); ok {
+			return time.Unix(int64(days)*24*60*60, 0).UTC().Format(dateLayout)
+		}
+	}
+	if v, ok := value.([12]byte); ok {
+		return goparquet.Int96ToTime(v).UTC().Format(time.RFC3339Nano)
+	}
+	if unit, utc, ok := parquetTimestamp(se); ok {
+		if i, isInt := value.(int64); isInt {
+			t := fromEpoch(i, unit).UTC()
+			if utc {
+				return t.Format(time.RFC3339Nano)
+			}
+			return t.Format(localDateTime)
+		}
+	}
+	if unit, ok := parquetTime(se); ok {
+		i, err := toInt64(value)
+		if err == nil {
+			return time.Unix(0, 0).UTC().Add(fromUnit(i, unit) % (24 * time.Hour)).Format(timeOfDay)
+		}
+	}
+	if scale, _, ok := parquetDecimal(se); ok {
+		unscaled := new(big.Int)
+		switch v := value.(type) {
+		case int32:
+			unscaled.SetInt64(int64(v))
+		case int64:
+			unscaled.SetInt64(v)
+		case []byte:
+			unscaled.SetBytes(v)
+			if len(v) > 0 && v[0]&0x80 != 0 {
+				unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(8*len(v))))
+			}
+		}
+		r := new(big.Rat).SetFrac(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil))
+		return json.Number(r.FloatString(int(scale)))
+	}
+	if bits, signed, ok := parquetIntWidth(se); ok && !signed {
+		switch v := value.(type) {
+		case int32:
+			return int64(uint32(v))
+		case int64:
+			if bits == 64 {
+				return uint64(v)
+			}
+		}
+	}
+	if lt != nil {
+		return fmt.Sprintf("%s", value)
+	}
+	return value
+}
+
+// hasConvertedType checks the legacy annotation, GetConvertedType returns UTF8 for columns without one
+func hasConvertedType(se *parquet.SchemaElement, ct parquet.ConvertedType) bool {
+	return se.ConvertedType != nil && *se.ConvertedType == ct
+}
+
+func isParquetString(se *parquet.SchemaElement) bool {
+	lt := se.LogicalType
+	return lt != nil && (lt.IsSetSTRING() || lt.IsSetENUM()) ||
+		hasConvertedType(se, parquet.ConvertedType_UTF8) || hasConvertedType(se, parquet.ConvertedType_ENUM)
+}
+
+func isParquetDate(se *parquet.SchemaElement) bool {
+	return se.LogicalType != nil && se.LogicalType.IsSetDATE() || hasConvertedType(se, parquet.ConvertedType_DATE)
+}
+
+// parquetTimestamp returns the unit of TIMESTAMP columns, and whether they are adjusted to utc
+func parquetTimestamp(se *parquet.SchemaElement) (string, bool, bool) {
+	if lt := se.LogicalType; lt != nil && lt.IsSetTIMESTAMP() {
+		return timeUnitName(lt.TIMESTAMP.Unit), lt.TIMESTAMP.IsAdjustedToUTC, true
+	}
+	switch se.GetConvertedType() {
+	case parquet.ConvertedType_TIMESTAMP_MILLIS:
+		return parquetMillis, true, true
+	case parquet.ConvertedType_TIMESTAMP_MICROS:
+		return parquetMicros, true, true
+	}
+	return "", false, false
+}
+
+func parquetTime(se *parquet.SchemaElement) (string, bool) {
+	if lt := se.LogicalType; lt != nil && lt.IsSetTIME() {
+		return timeUnitName(lt.TIME.Unit), true
+	}
+	switch se.GetConvertedType() {
+	case parquet.ConvertedType_TIME_MILLIS:
+		return parquetMillis, true
+	case parquet.ConvertedType_TIME_MICROS:
+		return parquetMicros, true
+	}
+	return "", false
+}
+
+func timeUnitName(unit *parquet.TimeUnit) string {
+	switch {
+	case unit.IsSetMILLIS():
+		return parquetMillis
+	case unit.IsSetMICROS():
+		return parquetMicros
+	}
+	return parquetNanos
+}
+
+// parquetDecimal returns scale and precision of DECIMAL columns
+func parquetDecimal(se *parquet.SchemaElement) (int32, int32, bool) {
+	if lt := se.LogicalType; lt != nil && lt.IsSetDECIMAL() {
+		return lt.DECIMAL.Scale, lt.DECIMAL.Precision, true
+	}
+	if hasConvertedType(se, parquet.ConvertedType_DECIMAL) {
+		return se.GetScale(), se.GetPrecision(), true
+	}
+	return 0, 0, false
+}
+
+// parquetIntWidth returns bit width and signedness of INT columns
+func parquetIntWidth(se *parquet.SchemaElement) (int, bool, bool) {
+	if lt := se.LogicalType; lt != nil && lt.IsSetINTEGER() {
+		return int(lt.INTEGER.BitWidth), lt.INTEGER.IsSigned, true
+	}
+	switch se.GetConvertedType() {
+	case parquet.ConvertedType_INT_8:
+		return 8, true, true
+	case parquet.ConvertedType_INT_16:
+		return 16, true, true
+	case parquet.ConvertedType_INT_32:
+		return 32, true, true
+	case parquet.ConvertedType_INT_64:
+		return 64, true, true
+	case parquet.ConvertedType_UINT_8:
+		return 8, false, true
+	case parquet.ConvertedType_UINT_16:
+		return 16, false, true
+	case parquet.ConvertedType_UINT_32:
+		return 32, false, true
+	case parquet.ConvertedType_UINT_64:
+		return 64, false, true
+	}
+	return 0, false, false
+}
+
+// toTime accepts time.Time values and RFC3339 strings. Strings without zone are read as utc.
+func toTime(val interface{}) (time.Time, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, localDateTime, dateLayout} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %v of type %T to time", val, val)
+}
+
+func toUnit(d time.Duration, unit string) int64 {
+	switch unit {
+	case parquetMillis:
+		return d.Milliseconds()
+	case parquetMicros:
+		return d.Microseconds()
+	}
+	return d.Nanoseconds()
+}
+
+func fromUnit(i int64, unit string) time.Duration {
+	switch unit {
+	case parquetMillis:
+		return time.Duration(i) * time.Millisecond
+	case parquetMicros:
+		return time.Duration(i) * time.Microsecond
+	}
+	return time.Duration(i)
+}
+
+func toEpoch(t time.Time, unit string) int64 {
+	switch unit {
+	case parquetMillis:
+		return t.UnixMilli()
+	case parquetMicros:
+		return t.UnixMicro()
+	}
+	return t.UnixNano()
+}
+
+func fromEpoch(i int64, unit string) time.Time {
+	switch unit {
+	case parquetMillis:
+		return time.UnixMilli(i)
+	case parquetMicros:
+		return time.UnixMicro(i)
+	}
+	return time.Unix(0, i)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// toUnscaledDecimal returns the value multiplied by 10^scale, rounded half away from zero
+func toUnscaledDecimal(val interface{}, scale, precision int32) (*big.Int, error) {
+	var s string
+	switch v := val.(type) {
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case string, int, int32, int64, json.Number:
+		s = fmt.Sprintf("%v", v)
+	default:
+		return nil, fmt.Errorf("cannot convert %v of type %T to decimal", val, val)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert %v to decimal", val)
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	num := new(big.Int).Abs(r.Num())
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Lsh(rem, 1).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if precision > 0 && len(q.String()) > int(precision) {
+		return nil, fmt.Errorf("%v does not fit decimal(%v,%v)", val, precision, scale)
+	}
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q, nil
+}
+
+// decimalBytes returns the big-endian two's complement of the unscaled value, padded to size if given
+func decimalBytes(unscaled *big.Int, size int) ([]byte, error) {
+	n := unscaled.BitLen()/8 + 1
+	if size == 0 {
+		size = n
+	}
+	if n > size {
+		return nil, fmt.Errorf("decimal %v does not fit %v bytes", unscaled, size)
+	}
+	b := make([]byte, size)
+	if unscaled.Sign() >= 0 {
+		unscaled.FillBytes(b)
+		return b, nil
+	}
+	complement := new(big.Int).Lsh(big.NewInt(1), uint(8*size))
+	complement.Add(complement, unscaled).FillBytes(b)
+	return b, nil
+}
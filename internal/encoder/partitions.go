@@ -0,0 +1,236 @@
+package encoder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// hiveDefaultPartition is the partition of entities without a value for a partition column, as named by hive
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// ParquetPartition is a partition column of a parquet dataset. Partitions are either the time of writing, like the
+// entries `year`, `month`, `day` and `hour`, the value of an entity property, like `country`, or a date part of a timestamp
+// property, like `year(created)`. Entries can name their column, like `created_year=year(created)`.
+type ParquetPartition struct {
+	Column string
+	// Property is the entity property of the partition, or empty for the date of writing
+	Property string
+	// DatePart is year, month, day or hour for date partitions, or empty for property values
+	DatePart string
+}
+
+var datePartRanges = map[string]string{
+	"year":  "1970,2100",
+	"month": "1,12",
+	"day":   "1,31",
+	"hour":  "0,23",
+}
+
+// ParquetPartitions returns the partition columns of the dataset, in the configured order
+func ParquetPartitions(backend conf.StorageBackend) ([]ParquetPartition, error) {
+	if backend.ParquetConfig == nil {
+		return nil, nil
+	}
+	var partitions []ParquetPartition
+	columns := make(map[string]bool)
+	for _, entry := range backend.ParquetConfig.Partitioning {
+		partition, err := parseParquetPartition(entry)
+		if err != nil {
+			return nil, err
+		}
+		if columns[partition.Column] {
+			return nil, fmt.Errorf("duplicate partition column %s", partition.Column)
+		}
+		columns[partition.Column] = true
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+func parseParquetPartition(entry string) (ParquetPartition, error) {
+	column, expression, named := strings.Cut(strings.TrimSpace(entry), "=")
+	if !named {
+		expression = column
+	}
+	column, expression = strings.TrimSpace(column), strings.TrimSpace(expression)
+	partition := ParquetPartition{Column: column, Property: expression}
+	if part, property, ok := strings.Cut(expression, "("); ok {
+		property, ok = strings.CutSuffix(property, ")")
+		if _, known := datePartRanges[part]; !ok || !known || strings.TrimSpace(property) == "" {
+			return partition, fmt.Errorf("invalid partition %s, use year, month, day or hour of a property", entry)
+		}
+		partition.DatePart, partition.Property = part, strings.TrimSpace(property)
+		if !named {
+			partition.Column = part
+		}
+	} else if _, known := datePartRanges[expression]; known {
+		partition.DatePart, partition.Property = expression, ""
+	}
+	if partition.Column == "" || partition.Property == "" && partition.DatePart == "" ||
+		strings.ContainsAny(partition.Column, "/=() ") {
+		return partition, fmt.Errorf("invalid partition %s", entry)
+	}
+	return partition, nil
+}
+
+// ValidatePartitioning returns an error if the partitioning of a parquet dataset can not be parsed
+func ValidatePartitioning(backend conf.StorageBackend) error {
+	_, err := ParquetPartitions(backend)
+	return err
+}
+
+// HasEntityPartitions tells if files of the dataset are partitioned by entity properties. Only these partitions apply
+// to fullsyncs, which are not written at a date of their own.
+func HasEntityPartitions(backend conf.StorageBackend) bool {
+	partitions, _ := ParquetPartitions(backend)
+	for _, partition := range partitions {
+		if partition.Property != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectionRange is the range of values of a date partition, as used by athena partition projection. Property value
+// partitions have no range.
+func (partition ParquetPartition) ProjectionRange() string {
+	if partition.DatePart == "" {
+		return ""
+	}
+	return datePartRanges[partition.DatePart]
+}
+
+// Partition is the path of a partition, like `country=no/year=2024`, with the entities that belong to it
+type Partition struct {
+	Path     string
+	Entities []*uda.Entity
+}
+
+// PartitionEntities splits entities into their partitions, in order of the first entity of each partition. Date of
+// writing partitions use now, and are left out of fullsyncs. Entities without a value for a partition column go to
+// the hive default partition.
+func PartitionEntities(backend conf.StorageBackend, entities []*uda.Entity, fullSync bool, now time.Time) ([]Partition, error) {
+	partitions, err := ParquetPartitions(backend)
+	if err != nil {
+		return nil, err
+	}
+	var result []Partition
+	index := make(map[string]int)
+	for _, entity := range entities {
+		var segments []string
+		for _, partition := range partitions {
+			if partition.Property == "" && fullSync {
+				continue
+			}
+			segments = append(segments, partition.Column+"="+escapePartitionValue(partition.value(entity, now)))
+		}
+		p := strings.Join(segments, "/")
+		i, ok := index[p]
+		if !ok {
+			i = len(result)
+			index[p] = i
+			result = append(result, Partition{Path: p})
+		}
+		result[i].Entities = append(result[i].Entities, entity)
+	}
+	return result, nil
+}
+
+// value returns the partition value of an entity, or an empty string if it has none
+func (partition ParquetPartition) value(entity *uda.Entity, now time.Time) string {
+	if partition.Property == "" {
+		return datePart(now, partition.DatePart)
+	}
+	value, ok := propertyValue(entity, partition.Property)
+	if !ok || value == nil {
+		return ""
+	}
+	if partition.DatePart != "" {
+		t, ok := timestampValue(value)
+		if !ok {
+			return ""
+		}
+		return datePart(t.UTC(), partition.DatePart)
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// propertyValue finds a property or reference of an entity by its key, or by its key without namespace prefix
+func propertyValue(entity *uda.Entity, name string) (interface{}, bool) {
+	for _, values := range []map[string]interface{}{entity.Properties, entity.References} {
+		if value, ok := values[name]; ok {
+			return value, true
+		}
+	}
+	for _, values := range []map[string]interface{}{entity.Properties, entity.References} {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if parquetColumnName(key, false) == name {
+				return values[key], true
+			}
+		}
+	}
+	return nil, false
+}
+
+func timestampValue(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func datePart(t time.Time, part string) string {
+	switch part {
+	case "year":
+		return strconv.Itoa(t.Year())
+	case "month":
+		return strconv.Itoa(int(t.Month()))
+	case "day":
+		return strconv.Itoa(t.Day())
+	case "hour":
+		return strconv.Itoa(t.Hour())
+	}
+	return ""
+}
+
+// escapePartitionValue escapes the characters hive escapes in partition paths
+func escapePartitionValue(value string) string {
+	if value == "" {
+		return hiveDefaultPartition
+	}
+	var sb strings.Builder
+	for _, r := range value {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune("\"#%'*/:=?\\{[]^", r) {
+			_, _ = fmt.Fprintf(&sb, "%%%02X", r)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,83 @@
+package encoder_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+func TestPartitions(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("Parquet partitioning", func() {
+		backend := func(partitioning ...string) conf.StorageBackend {
+			return conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{Partitioning: partitioning}}
+		}
+		now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+		entities := []*uda.Entity{
+			{ID: "a:1", Properties: map[string]interface{}{"a:country": "no", "a:created": "2023-12-31T23:30:00-02:00"}},
+			{ID: "a:2", Properties: map[string]interface{}{"a:country": "se", "a:created": "2024-01-02"}},
+			{ID: "a:3", Properties: map[string]interface{}{"a:country": "no", "a:created": "2024-01-05T10:00:00Z"}},
+			{ID: "a:4", Properties: map[string]interface{}{"a:created": "not a date"}},
+		}
+		paths := func(partitions []encoder.Partition) []string {
+			var result []string
+			for _, p := range partitions {
+				result = append(result, p.Path)
+			}
+			return result
+		}
+
+		g.It("Should split entities by property values and date parts of timestamps", func() {
+			partitions, err := encoder.PartitionEntities(backend("country", "year(created)", "created_month=month(a:created)"), entities, false, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{
+				"country=no/year=2024/created_month=1",
+				"country=se/year=2024/created_month=1",
+				"country=__HIVE_DEFAULT_PARTITION__/year=__HIVE_DEFAULT_PARTITION__/created_month=__HIVE_DEFAULT_PARTITION__",
+			})
+			g.Assert(len(partitions[0].Entities)).Eql(2)
+			g.Assert(partitions[0].Entities[1].ID).Eql("a:3")
+		})
+
+		g.It("Should use the date of writing for year, month and day, except in fullsyncs", func() {
+			partitions, err := encoder.PartitionEntities(backend("year", "month", "day", "country"), entities[:1], false, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{"year=2024/month=3/day=9/country=no"})
+			partitions, err = encoder.PartitionEntities(backend("year", "month", "day", "country"), entities[:1], true, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{"country=no"})
+		})
+
+		g.It("Should use the hour of writing for hour", func() {
+			partitions, err := encoder.PartitionEntities(backend("day", "hour", "country"), entities[:1], false, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{"day=9/hour=12/country=no"})
+			partitions, err = encoder.PartitionEntities(backend("hour"), entities[:1], true, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{""})
+			g.Assert(encoder.HasEntityPartitions(backend("year", "hour"))).IsFalse()
+		})
+
+		g.It("Should escape values like hive", func() {
+			odd := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:code": "a/b=c 1", "a:size": 1.5}}}
+			partitions, err := encoder.PartitionEntities(backend("code", "size"), odd, false, now)
+			g.Assert(err).IsNil()
+			g.Assert(paths(partitions)).Eql([]string{"code=a%2Fb%3Dc 1/size=1.5"})
+		})
+
+		g.It("Should reject invalid partitions", func() {
+			g.Assert(encoder.ValidatePartitioning(backend("week(created)")).Error()).
+				Eql("invalid partition week(created), use year, month, day or hour of a property")
+			g.Assert(encoder.ValidatePartitioning(backend("year", "year(created)")).Error()).
+				Eql("duplicate partition column year")
+			g.Assert(encoder.ValidatePartitioning(backend("year", "created_year=year(created)", "country"))).IsNil()
+			g.Assert(encoder.HasEntityPartitions(backend("year", "month"))).IsFalse()
+			g.Assert(encoder.HasEntityPartitions(backend("year", "country"))).IsTrue()
+		})
+	})
+}
@@ -0,0 +1,745 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+const (
+	rdfNTriples = "ntriples"
+	rdfNQuads   = "nquads"
+	rdfTurtle   = "turtle"
+
+	xsdNamespace        = "http://www.w3.org/2001/XMLSchema#"
+	rdfJSON             = "http://www.w3.org/1999/02/22-rdf-syntax-ns#JSON"
+	rdfDeletedPredicate = "http://data.mimiro.io/core/deleted"
+)
+
+// rdfFormat returns the configured rdf serialization, n-triples if none is given
+func rdfFormat(config *conf.RdfConfig) (string, error) {
+	switch strings.ToLower(config.Format) {
+	case "", rdfNTriples:
+		return rdfNTriples, nil
+	case rdfNQuads:
+		return rdfNQuads, nil
+	case rdfTurtle:
+		return rdfTurtle, nil
+	}
+	return "", fmt.Errorf("unsupported rdf format %s, use ntriples, nquads or turtle", config.Format)
+}
+
+// RdfFileExtension returns the file extension of the configured rdf serialization
+func RdfFileExtension(config *conf.RdfConfig) string {
+	switch format, _ := rdfFormat(config); format {
+	case rdfNQuads:
+		return "nq"
+	case rdfTurtle:
+		return "ttl"
+	}
+	return "nt"
+}
+
+// RdfEncoder ********************** ENCODER ****************************************/
+
+// RdfEncoder writes the props and refs of entities as statements about the entity id. Refs are written as iri
+// objects, props as literals typed by their json type. Entities need full uris, which the dataset handler resolves
+// for rdf datasets.
+type RdfEncoder struct {
+	backend conf.StorageBackend
+	writer  *io.PipeWriter
+	logger  *zap.SugaredLogger
+	open    bool
+	format  string
+	graph   string
+	// continued streams have their turtle prefixes written already
+	continued bool
+}
+
+func (enc *RdfEncoder) segment(continued bool, _ bool) {
+	enc.continued = continued
+}
+
+func (enc *RdfEncoder) Open() error {
+	enc.open = true
+	config := enc.backend.RdfConfig
+	format, err := rdfFormat(config)
+	if err != nil {
+		return err
+	}
+	enc.format = format
+	if format == rdfNQuads && config.Graph != "" {
+		enc.graph = enc.iri(config.Graph)
+	}
+	if format != rdfTurtle || len(config.Prefixes) == 0 || enc.continued {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	prefixes := make([]string, 0, len(config.Prefixes))
+	for prefix := range config.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		buf.WriteString("@prefix " + prefix + ": <" + rdfEscapeIri(config.Prefixes[prefix]) + "> .\n")
+	}
+	buf.WriteString("\n")
+	_, err = enc.writer.Write(buf.Bytes())
+	return err
+}
+
+func (enc *RdfEncoder) Write(entities []*uda.Entity) (int, error) {
+	if len(entities) == 0 {
+		return 0, nil
+	}
+	if !enc.open {
+		if err := enc.Open(); err != nil {
+			return 0, err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, ent := range entities {
+		if err := enc.writeEntity(&buf, ent.ID, ent.IsDeleted, ent.Properties, ent.References); err != nil {
+			return 0, fmt.Errorf("entity %s: %w", ent.ID, err)
+		}
+	}
+	return enc.writer.Write(buf.Bytes())
+}
+
+// writeEntity writes the statements of an entity sorted by predicate, followed by those of its nested entities.
+// Deleted entities are only written as deletion marker, if configured.
+func (enc *RdfEncoder) writeEntity(buf *bytes.Buffer, id string, deleted bool, props map[string]interface{}, refs map[string]interface{}) error {
+	objects := map[string][]string{}
+	var nested []map[string]interface{}
+	if deleted {
+		if !enc.backend.RdfConfig.DeletedMarkers {
+			return nil
+		}
+		objects[rdfDeletedPredicate] = []string{enc.literal("true", xsdNamespace+"boolean")}
+	} else {
+		for k, v := range refs {
+			for _, ref := range refValues(v) {
+				objects[k] = append(objects[k], enc.iri(ref))
+			}
+		}
+		for k, v := range props {
+			terms, entities, err := enc.objects(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			objects[k] = append(objects[k], terms...)
+			nested = append(nested, entities...)
+		}
+	}
+
+	predicates := make([]string, 0, len(objects))
+	for p, terms := range objects {
+		if len(terms) > 0 {
+			predicates = append(predicates, p)
+		}
+	}
+	sort.Strings(predicates)
+
+	subject := enc.iri(id)
+	for i, p := range predicates {
+		terms := objects[p]
+		if enc.format == rdfTurtle {
+			if i == 0 {
+				buf.WriteString(subject + " ")
+			} else {
+				buf.WriteString(" ;\n    ")
+			}
+			buf.WriteString(enc.iri(p) + " " + strings.Join(terms, ", "))
+			continue
+		}
+		for _, term := range terms {
+			buf.WriteString(subject + " " + enc.iri(p) + " " + term)
+			if enc.graph != "" {
+				buf.WriteString(" " + enc.graph)
+			}
+			buf.WriteString(" .\n")
+		}
+	}
+	if enc.format == rdfTurtle && len(predicates) > 0 {
+		buf.WriteString(" .\n\n")
+	}
+
+	for _, n := range nested {
+		props, _ := n["props"].(map[string]interface{})
+		refs, _ := n["refs"].(map[string]interface{})
+		deleted, _ := n["deleted"].(bool)
+		if err := enc.writeEntity(buf, n["id"].(string), deleted, props, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects returns the object terms of a property value, and the nested entities it refers to
+func (enc *RdfEncoder) objects(value interface{}) ([]string, []map[string]interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil, nil
+	case []interface{}:
+		var terms []string
+		var nested []map[string]interface{}
+		for _, item := range v {
+			t, n, err := enc.objects(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			terms = append(terms, t...)
+			nested = append(nested, n...)
+		}
+		return terms, nested, nil
+	case []string:
+		terms := make([]string, 0, len(v))
+		for _, item := range v {
+			terms = append(terms, enc.literal(item, ""))
+		}
+		return terms, nil, nil
+	case map[string]interface{}:
+		if _, isEntity := v["props"].(map[string]interface{}); isEntity {
+			if id, ok := v["id"].(string); ok && id != "" {
+				return []string{enc.iri(id)}, []map[string]interface{}{v}, nil
+			}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{enc.literal(string(b), rdfJSON)}, nil, nil
+	case string:
+		return []string{enc.literal(v, "")}, nil, nil
+	case bool:
+		return []string{enc.literal(strconv.FormatBool(v), xsdNamespace+"boolean")}, nil, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return []string{enc.literal(strconv.FormatFloat(v, 'f', -1, 64), xsdNamespace+"integer")}, nil, nil
+		}
+		return []string{enc.literal(strconv.FormatFloat(v, 'f', -1, 64), xsdNamespace+"decimal")}, nil, nil
+	case int:
+		return []string{enc.literal(strconv.Itoa(v), xsdNamespace+"integer")}, nil, nil
+	case int64:
+		return []string{enc.literal(strconv.FormatInt(v, 10), xsdNamespace+"integer")}, nil, nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return []string{enc.literal(v.String(), xsdNamespace+"integer")}, nil, nil
+		}
+		if strings.ContainsAny(v.String(), "eE") {
+			return []string{enc.literal(v.String(), xsdNamespace+"double")}, nil, nil
+		}
+		return []string{enc.literal(v.String(), xsdNamespace+"decimal")}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// refValues returns the ids a reference points to
+func refValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// iri returns the term of an iri or blank node. Turtle iris are shortened with the configured prefixes.
+func (enc *RdfEncoder) iri(value string) string {
+	if strings.HasPrefix(value, "_:") {
+		return value
+	}
+	if enc.format == rdfTurtle {
+		if name, ok := compactIri(enc.backend.RdfConfig.Prefixes, value); ok && isTurtleLocalName(name[strings.Index(name, ":")+1:]) {
+			return name
+		}
+	}
+	return "<" + rdfEscapeIri(value) + ">"
+}
+
+func (enc *RdfEncoder) literal(value string, datatype string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	if datatype != "" {
+		sb.WriteString("^^" + enc.iri(datatype))
+	}
+	return sb.String()
+}
+
+// rdfEscapeIri percent encodes the characters iris can not hold
+func rdfEscapeIri(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || strings.IndexByte(`<>"{}|^`+"`\\", c) >= 0 {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// compactIri returns the iri as prefix:name with the longest matching namespace
+func compactIri(prefixes map[string]string, value string) (string, bool) {
+	match, namespace := "", ""
+	for prefix, ns := range prefixes {
+		if ns != "" && strings.HasPrefix(value, ns) && (len(ns) > len(namespace) || (len(ns) == len(namespace) && prefix < match)) {
+			match, namespace = prefix, ns
+		}
+	}
+	if namespace == "" {
+		return value, false
+	}
+	return match + ":" + strings.TrimPrefix(value, namespace), true
+}
+
+// isTurtleLocalName tells if name can be written after a prefix in turtle, keeping to a safe subset of characters
+func isTurtleLocalName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (enc *RdfEncoder) Close() error {
+	return enc.writer.Close()
+}
+
+func (enc *RdfEncoder) CloseWithError(err error) error {
+	return enc.writer.CloseWithError(err)
+}
+
+// RdfDecoder ********************** DECODER ****************************************/
+
+// RdfDecoder reads n-triples and n-quads, and groups all statements about the same subject into an entity. Iri
+// objects become refs and literals props, graphs are ignored. Statements are collected until the input ends, as the
+// statements of a subject may be spread over the input.
+type RdfDecoder struct {
+	backend  conf.StorageBackend
+	reader   *io.PipeReader
+	logger   *zap.SugaredLogger
+	lines    *bufio.Reader
+	line     int
+	entities map[string]*rdfEntity
+	// subjects are the ids of the entities not returned yet, in order of their first statement
+	subjects []string
+	read     bool
+	open     bool
+	closed   bool
+	overhang []byte
+	since    string
+	fullSync bool
+}
+
+type rdfEntity struct {
+	ID      string                 `json:"id"`
+	Deleted bool                   `json:"deleted"`
+	Props   map[string]interface{} `json:"props"`
+	Refs    map[string]interface{} `json:"refs"`
+}
+
+func (d *RdfDecoder) Read(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p))
+	var done bool
+	if len(d.overhang) > 0 {
+		buf = append(buf, d.overhang...)
+		d.overhang = nil
+	}
+
+	if !d.open {
+		d.open = true
+		d.lines = bufio.NewReader(d.reader)
+		//start json array and add context as first entity
+		buf = append(buf, []byte("[")...)
+		buf = append(buf, []byte(buildContext(d.backend.RdfConfig.Prefixes))...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// collect the statements of each subject
+	for !d.read {
+		line, err := d.lines.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		d.read = err == io.EOF
+		d.line++
+		subject, predicate, object, ok, err := parseRdfStatement(line)
+		if err != nil {
+			return n, fmt.Errorf("line %v: %w", d.line, err)
+		}
+		if ok {
+			d.entity(d.compact(subject.value)).add(d.compact(predicate.value), object, d.compact)
+		}
+	}
+
+	// append one entity per subject, comma separated
+	for len(d.subjects) > 0 {
+		entity := d.entities[d.subjects[0]]
+		d.subjects = d.subjects[1:]
+		delete(d.entities, entity.ID)
+		entityBytes, err := json.Marshal(entity)
+		if err != nil {
+			return n, err
+		}
+		buf = append(buf, append([]byte(","), entityBytes...)...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// close json array
+	if !d.closed {
+		token := d.since
+		if d.fullSync {
+			token = ""
+		}
+		continueEntity := map[string]interface{}{
+			"id":    "@continuation",
+			"token": token,
+		}
+		sinceBytes, _ := json.Marshal(continueEntity)
+		buf = append(buf, append([]byte(","), sinceBytes...)...)
+		buf = append(buf, []byte("]")...)
+		d.closed = true
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+	n = copy(p, buf)
+	return n, io.EOF
+}
+
+// entity returns the entity of a subject, which is started at the first statement of the subject
+func (d *RdfDecoder) entity(id string) *rdfEntity {
+	if d.entities == nil {
+		d.entities = map[string]*rdfEntity{}
+	}
+	entity, ok := d.entities[id]
+	if !ok {
+		entity = &rdfEntity{ID: id, Props: map[string]interface{}{}, Refs: map[string]interface{}{}}
+		d.entities[id] = entity
+		d.subjects = append(d.subjects, id)
+	}
+	return entity
+}
+
+// add adds the object of a statement, iris as refs and literals as props. Repeated statements are added once.
+func (e *rdfEntity) add(predicate string, object rdfTerm, compact func(string) string) {
+	if object.kind != rdfLiteral {
+		addRdfValue(e.Refs, predicate, compact(object.value))
+		return
+	}
+	value := rdfLiteralValue(object)
+	if predicate == compact(rdfDeletedPredicate) {
+		e.Deleted = value == true
+		return
+	}
+	addRdfValue(e.Props, predicate, value)
+}
+
+// addRdfValue adds a value to a field unless the field has the value already
+func addRdfValue(fields map[string]interface{}, name string, value interface{}) {
+	existing := []interface{}{fields[name]}
+	if values, ok := fields[name].([]interface{}); ok {
+		existing = values
+	}
+	for _, v := range existing {
+		if v == value {
+			return
+		}
+	}
+	addRepeatedField(fields, name, value)
+}
+
+// rdfLiteralValue returns numeric and boolean xsd literals as json numbers and booleans, all other as strings
+func rdfLiteralValue(term rdfTerm) interface{} {
+	datatype, ok := strings.CutPrefix(term.datatype, xsdNamespace)
+	if !ok {
+		return term.value
+	}
+	switch datatype {
+	case "integer", "int", "long", "short", "byte", "decimal", "double", "float", "nonNegativeInteger",
+		"positiveInteger", "negativeInteger", "nonPositiveInteger", "unsignedLong", "unsignedInt",
+		"unsignedShort", "unsignedByte":
+		if _, err := strconv.ParseFloat(term.value, 64); err == nil && json.Valid([]byte(term.value)) {
+			return json.Number(term.value)
+		}
+	case "boolean":
+		switch term.value {
+		case "true", "1":
+			return true
+		case "false", "0":
+			return false
+		}
+	}
+	return term.value
+}
+
+// compact shortens iris with the configured prefixes, which are also the namespaces of the entity context
+func (d *RdfDecoder) compact(value string) string {
+	name, _ := compactIri(d.backend.RdfConfig.Prefixes, value)
+	return name
+}
+
+func (d *RdfDecoder) flush(p []byte, buf []byte) (int, error, bool) {
+	if len(buf) >= len(p) {
+		n := copy(p, buf)
+		d.overhang = buf[n:]
+		return n, nil, true
+	}
+	return 0, nil, false
+}
+
+func (d *RdfDecoder) Close() error {
+	return d.reader.Close()
+}
+
+// kinds of rdf terms
+const (
+	rdfIri = iota
+	rdfBlank
+	rdfLiteral
+)
+
+type rdfTerm struct {
+	kind     int
+	value    string
+	datatype string
+}
+
+// parseRdfStatement parses a line of n-triples or n-quads, returning false for empty lines and comments
+func parseRdfStatement(line string) (subject rdfTerm, predicate rdfTerm, object rdfTerm, ok bool, err error) {
+	p := &rdfLineParser{line: line}
+	p.skipSpace()
+	if p.done() || p.peek() == '#' {
+		return subject, predicate, object, false, nil
+	}
+	if subject, err = p.term(); err != nil {
+		return
+	}
+	if subject.kind == rdfLiteral {
+		err = errors.New("literal as subject")
+		return
+	}
+	if predicate, err = p.term(); err != nil {
+		return
+	}
+	if predicate.kind != rdfIri {
+		err = errors.New("predicate is not an iri")
+		return
+	}
+	if object, err = p.term(); err != nil {
+		return
+	}
+	p.skipSpace()
+	if !p.done() && p.peek() != '.' {
+		// the graph of n-quads
+		var graph rdfTerm
+		if graph, err = p.term(); err != nil {
+			return
+		}
+		if graph.kind == rdfLiteral {
+			err = errors.New("literal as graph")
+			return
+		}
+		p.skipSpace()
+	}
+	if p.done() || p.peek() != '.' {
+		err = errors.New("missing . at end of statement")
+		return
+	}
+	p.pos++
+	p.skipSpace()
+	if !p.done() && p.peek() != '#' {
+		err = fmt.Errorf("unexpected %s after statement", strings.TrimSpace(p.line[p.pos:]))
+		return
+	}
+	return subject, predicate, object, true, nil
+}
+
+type rdfLineParser struct {
+	line string
+	pos  int
+}
+
+func (p *rdfLineParser) done() bool {
+	return p.pos >= len(p.line)
+}
+
+func (p *rdfLineParser) peek() byte {
+	return p.line[p.pos]
+}
+
+func (p *rdfLineParser) skipSpace() {
+	for !p.done() && strings.IndexByte(" \t\r\n", p.peek()) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *rdfLineParser) term() (rdfTerm, error) {
+	p.skipSpace()
+	if p.done() {
+		return rdfTerm{}, errors.New("unexpected end of statement")
+	}
+	switch {
+	case p.peek() == '<':
+		iri, err := p.iri()
+		return rdfTerm{kind: rdfIri, value: iri}, err
+	case strings.HasPrefix(p.line[p.pos:], "_:"):
+		start := p.pos
+		for !p.done() && strings.IndexByte(" \t\r\n", p.peek()) < 0 {
+			p.pos++
+		}
+		// blank node labels can not end with a dot, it ends the statement
+		if p.line[p.pos-1] == '.' {
+			p.pos--
+		}
+		return rdfTerm{kind: rdfBlank, value: p.line[start:p.pos]}, nil
+	case p.peek() == '"':
+		value, err := p.quoted()
+		if err != nil {
+			return rdfTerm{}, err
+		}
+		term := rdfTerm{kind: rdfLiteral, value: value}
+		switch {
+		case strings.HasPrefix(p.line[p.pos:], "^^"):
+			p.pos += 2
+			term.datatype, err = p.iri()
+		case !p.done() && p.peek() == '@':
+			// language tags are dropped, the literal is read as string
+			p.pos++
+			for !p.done() && (p.peek() == '-' || isAlphanumeric(p.peek())) {
+				p.pos++
+			}
+		}
+		return term, err
+	}
+	return rdfTerm{}, fmt.Errorf("unexpected %s", strings.TrimSpace(p.line[p.pos:]))
+}
+
+func (p *rdfLineParser) iri() (string, error) {
+	if p.done() || p.peek() != '<' {
+		return "", errors.New("missing iri")
+	}
+	end := strings.IndexByte(p.line[p.pos:], '>')
+	if end < 0 {
+		return "", errors.New("unterminated iri")
+	}
+	value, err := unescapeRdf(p.line[p.pos+1 : p.pos+end])
+	p.pos += end + 1
+	return value, err
+}
+
+func (p *rdfLineParser) quoted() (string, error) {
+	for i := p.pos + 1; i < len(p.line); i++ {
+		switch p.line[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := unescapeRdf(p.line[p.pos+1 : i])
+			p.pos = i + 1
+			return value, err
+		}
+	}
+	return "", errors.New("unterminated literal")
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// unescapeRdf replaces the escape sequences of n-triples strings and iris
+func unescapeRdf(value string) (string, error) {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(value) {
+			return "", errors.New("incomplete escape sequence")
+		}
+		switch value[i] {
+		case 't':
+			sb.WriteByte('\t')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'f':
+			sb.WriteByte('\f')
+		case '"', '\'', '\\':
+			sb.WriteByte(value[i])
+		case 'u', 'U':
+			size := 4
+			if value[i] == 'U' {
+				size = 8
+			}
+			if i+size >= len(value) {
+				return "", errors.New("incomplete escape sequence")
+			}
+			r, err := strconv.ParseUint(value[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape sequence %s", value[i-1:i+1+size])
+			}
+			sb.WriteRune(rune(r))
+			i += size
+		default:
+			return "", fmt.Errorf("invalid escape sequence \\%c", value[i])
+		}
+	}
+	return sb.String(), nil
+}
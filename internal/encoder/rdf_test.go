@@ -0,0 +1,156 @@
+package encoder_test
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestRdf(t *testing.T) {
+	g := goblin.Goblin(t)
+	entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+	person := func() *uda.Entity {
+		return &uda.Entity{ID: "http://ex.io/1",
+			Properties: map[string]interface{}{
+				"http://ex.io/name":   "Bob \"B\"\nSmith",
+				"http://ex.io/age":    float64(42),
+				"http://ex.io/score":  1.5,
+				"http://ex.io/active": true,
+				"http://ex.io/tags":   []interface{}{"x", "y"},
+				"http://ex.io/meta":   map[string]interface{}{"a": float64(1)},
+				"http://ex.io/address": map[string]interface{}{"id": "http://ex.io/a1",
+					"props": map[string]interface{}{"http://ex.io/street": "Main"}},
+				"http://ex.io/note": nil,
+			},
+			References: map[string]interface{}{
+				"http://ex.io/type":    "http://ex.io/Person",
+				"http://ex.io/friends": []interface{}{"http://ex.io/2", "http://ex.io/3"},
+			}}
+	}
+
+	g.Describe("The Rdf Encoder", func() {
+		g.It("Should write n-triples with typed literals and iri refs", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{DeletedMarkers: true}}
+			entities := []*uda.Entity{person(), {ID: "http://ex.io/4", IsDeleted: true,
+				Properties: map[string]interface{}{"http://ex.io/name": "Gone"}}}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`<http://ex.io/1> <http://ex.io/active> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .
+<http://ex.io/1> <http://ex.io/address> <http://ex.io/a1> .
+<http://ex.io/1> <http://ex.io/age> "42"^^<http://www.w3.org/2001/XMLSchema#integer> .
+<http://ex.io/1> <http://ex.io/friends> <http://ex.io/2> .
+<http://ex.io/1> <http://ex.io/friends> <http://ex.io/3> .
+<http://ex.io/1> <http://ex.io/meta> "{\"a\":1}"^^<http://www.w3.org/1999/02/22-rdf-syntax-ns#JSON> .
+<http://ex.io/1> <http://ex.io/name> "Bob \"B\"\nSmith" .
+<http://ex.io/1> <http://ex.io/score> "1.5"^^<http://www.w3.org/2001/XMLSchema#decimal> .
+<http://ex.io/1> <http://ex.io/tags> "x" .
+<http://ex.io/1> <http://ex.io/tags> "y" .
+<http://ex.io/1> <http://ex.io/type> <http://ex.io/Person> .
+<http://ex.io/a1> <http://ex.io/street> "Main" .
+<http://ex.io/4> <http://data.mimiro.io/core/deleted> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .
+`)
+		})
+
+		g.It("Should write n-quads in the configured graph and skip deleted entities without markers", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{Format: "nquads", Graph: "http://ex.io/graph"}}
+			entities := []*uda.Entity{{ID: "http://ex.io/1", Properties: map[string]interface{}{"http://ex.io/name": "Bob"}},
+				{ID: "http://ex.io/4", IsDeleted: true}}
+			result, err := encodeTwice(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			line := "<http://ex.io/1> <http://ex.io/name> \"Bob\" <http://ex.io/graph> .\n"
+			g.Assert(string(result)).Eql(line + line)
+		})
+
+		g.It("Should write turtle with the configured prefixes", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{Format: "turtle",
+				Prefixes: map[string]string{"ex": "http://ex.io/", "xsd": "http://www.w3.org/2001/XMLSchema#"}}}
+			entity := &uda.Entity{ID: "http://ex.io/1",
+				Properties: map[string]interface{}{"http://ex.io/age": float64(42), "http://ex.io/tags": []interface{}{"x", "y"}},
+				References: map[string]interface{}{"http://ex.io/type": "http://ex.io/Person", "http://ex.io/home": "http://ex.io/a b"}}
+			result, err := encodeOnce(backend, []*uda.Entity{entity}, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`@prefix ex: <http://ex.io/> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+
+ex:1 ex:age "42"^^xsd:integer ;
+    ex:home <http://ex.io/a%20b> ;
+    ex:tags "x", "y" ;
+    ex:type ex:Person .
+
+`)
+		})
+
+		g.It("Should fail for unknown formats", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{Format: "rdfxml"}}
+			_, err := encodeOnce(backend, []*uda.Entity{person()}, &entityContext)
+			g.Assert(err.Error()).Eql("unsupported rdf format rdfxml, use ntriples, nquads or turtle")
+		})
+	})
+
+	g.Describe("The Rdf Decoder", func() {
+		g.It("Should group all statements of a subject into an entity", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{Format: "nquads",
+				Prefixes: map[string]string{"ex": "http://ex.io/", "p": "http://ex.io/people/"}}}
+			content := `# exported people
+<http://ex.io/people/1> <http://ex.io/name> "Bob \"B\"å" <http://ex.io/graph> .
+<http://ex.io/people/1> <http://ex.io/age> "42"^^<http://www.w3.org/2001/XMLSchema#integer> .
+<http://ex.io/people/1> <http://ex.io/score> "1.5"^^<http://www.w3.org/2001/XMLSchema#double> .
+<http://ex.io/people/1> <http://ex.io/active> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .
+<http://ex.io/people/1> <http://ex.io/label> "hei"@nb-NO .
+<http://ex.io/people/1> <http://ex.io/friend> <http://ex.io/people/2> .
+
+
+_:b1 <http://ex.io/name> "Alice" .
+<http://ex.io/people/1> <http://ex.io/friend> _:b1 .
+<http://ex.io/people/1> <http://ex.io/friend> <http://ex.io/people/2> .
+<http://other.io/3> <http://data.mimiro.io/core/deleted> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .`
+			reader, err := decodeOnce(backend, []byte(content))
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			g.Assert(len(entities)).Eql(3)
+			g.Assert(entities[0]).Eql(map[string]interface{}{"id": "p:1", "deleted": false,
+				"props": map[string]interface{}{"ex:name": "Bob \"B\"å", "ex:age": json.Number("42"),
+					"ex:score": json.Number("1.5"), "ex:active": true, "ex:label": "hei"},
+				"refs": map[string]interface{}{"ex:friend": []interface{}{"p:2", "_:b1"}}})
+			g.Assert(entities[1]["id"]).Eql("_:b1")
+			g.Assert(entities[1]["props"]).Eql(map[string]interface{}{"ex:name": "Alice"})
+			g.Assert(entities[2]).Eql(map[string]interface{}{"id": "http://other.io/3", "deleted": true,
+				"props": map[string]interface{}{}, "refs": map[string]interface{}{}})
+		})
+
+		g.It("Should read a round trip of written n-triples", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{}}
+			result, err := encodeTwice(backend, []*uda.Entity{person()}, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			// the statements of both writes are merged into the entity and its nested address
+			g.Assert(len(entities)).Eql(2)
+			g.Assert(entities[0]["id"]).Eql("http://ex.io/1")
+			g.Assert(entities[0]["props"].(map[string]interface{})["http://ex.io/name"]).Eql("Bob \"B\"\nSmith")
+			g.Assert(entities[0]["props"].(map[string]interface{})["http://ex.io/meta"]).Eql(`{"a":1}`)
+			g.Assert(entities[0]["refs"].(map[string]interface{})["http://ex.io/address"]).Eql("http://ex.io/a1")
+			g.Assert(entities[1]["id"]).Eql("http://ex.io/a1")
+		})
+
+		g.It("Should fail for malformed statements", func() {
+			backend := conf.StorageBackend{RdfConfig: &conf.RdfConfig{}}
+			reader, err := decodeOnce(backend, []byte("<http://ex.io/1> <http://ex.io/name> \"Bob\"\n"))
+			g.Assert(err).IsNil()
+			_, err = io.ReadAll(reader)
+			g.Assert(err.Error()).Eql("line 1: missing . at end of statement")
+		})
+
+		g.It("Should not read turtle", func() {
+			reader, err := decodeOnce(conf.StorageBackend{RdfConfig: &conf.RdfConfig{Format: "turtle"}}, nil)
+			g.Assert(reader == nil).IsTrue()
+			g.Assert(err.Error()).Eql("rdf datasets can only be read as ntriples or nquads")
+		})
+	})
+}
@@ -0,0 +1,45 @@
+package encoder
+
+import (
+	"errors"
+	"io"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// segmentWriter is implemented by encoders of formats that can be written in segments, one encoder per segment
+type segmentWriter interface {
+	EncodingEntityWriter
+	// segment makes the encoder continue the stream written by earlier segments, and leave the stream open on Close
+	segment(continued bool, leaveOpen bool)
+}
+
+// SupportsSegments tells if files of the dataset can be written in segments by EncodeSegment. Parquet, avro and xlsx
+// files are containers that can only be written by a single encoder.
+func SupportsSegments(backend conf.StorageBackend) bool {
+	_, ok := NewEntityEncoder(backend, nil, zap.NewNop().Sugar()).(segmentWriter)
+	return ok
+}
+
+// EncodeSegment encodes a segment of a stream written by a sequence of encoders, like the batches of a fullsync handled
+// by different instances. The segment continues the stream if entities were written by earlier segments, and ends
+// the stream if it is the last segment. Compressed datasets get a compressed member per segment.
+func EncodeSegment(backend conf.StorageBackend, entities []*uda.Entity, continued bool, last bool, logger *zap.SugaredLogger) ([]byte, error) {
+	reader, writer := io.Pipe()
+	enc, ok := NewEntityEncoder(backend, NewCompressingPipe(backend, writer), logger).(segmentWriter)
+	if !ok {
+		return nil, errors.New("the file format of the dataset can not be written in segments")
+	}
+	enc.segment(continued, !last)
+	go func() {
+		if _, err := enc.Write(entities); err != nil {
+			_ = enc.CloseWithError(err)
+			return
+		}
+		_ = enc.Close()
+	}()
+	return io.ReadAll(reader)
+}
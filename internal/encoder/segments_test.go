@@ -0,0 +1,52 @@
+package encoder_test
+
+import (
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+func TestSegments(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("Segments", func() {
+		entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+		entities := []*uda.Entity{
+			{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:name": "Bob"}},
+			{ID: "a:2", Properties: map[string]interface{}{"a:id": "2", "a:name": "Alice"}},
+		}
+		segments := func(backend conf.StorageBackend) []byte {
+			var result []byte
+			for i, batch := range [][]*uda.Entity{entities, entities, nil} {
+				segment, err := encoder.EncodeSegment(backend, batch, i > 0, i == 2, zap.NewNop().Sugar())
+				g.Assert(err).IsNil()
+				result = append(result, segment...)
+			}
+			return result
+		}
+
+		g.It("Should write the same files as a single encoder", func() {
+			for _, backend := range []conf.StorageBackend{
+				{StripProps: true},
+				{StripProps: true, CsvConfig: &conf.CsvConfig{Header: true, Order: []string{"id", "name"}}},
+				{XmlConfig: &conf.XmlConfig{RecordPath: "people/person"}},
+			} {
+				g.Assert(encoder.SupportsSegments(backend)).IsTrue()
+				expected, err := encodeTwice(backend, entities, &entityContext)
+				g.Assert(err).IsNil()
+				g.Assert(string(segments(backend))).Eql(string(expected))
+			}
+		})
+
+		g.It("Should not write parquet files in segments", func() {
+			backend := conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{SchemaDefinition: "message test { required binary id (STRING); }"}}
+			g.Assert(encoder.SupportsSegments(backend)).IsFalse()
+			_, err := encoder.EncodeSegment(backend, entities, false, true, zap.NewNop().Sugar())
+			g.Assert(err.Error()).Eql("the file format of the dataset can not be written in segments")
+		})
+	})
+}
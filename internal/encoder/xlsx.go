@@ -0,0 +1,370 @@
+package encoder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+const (
+	xlsxDefaultSheet    = "Sheet1"
+	xlsxDateFormat      = "yyyy-mm-dd"
+	xlsxTimestampFormat = "yyyy-mm-dd hh:mm:ss"
+	xlsxMaxStringLength = 32767
+)
+
+// XlsxEncoder ********************** ENCODER ****************************************/
+
+// XlsxEncoder writes entities as rows of a single sheet, with the columns in the configured order. Workbooks are
+// zip archives that can only be written once complete, rows are kept in excelize temp files until Close.
+type XlsxEncoder struct {
+	backend        conf.StorageBackend
+	writer         *io.PipeWriter
+	logger         *zap.SugaredLogger
+	open           bool
+	file           *excelize.File
+	sheet          *excelize.StreamWriter
+	row            int
+	dateStyle      int
+	timestampStyle int
+	location       *time.Location
+}
+
+func (enc *XlsxEncoder) Open() error {
+	enc.open = true
+	config := enc.backend.XlsxConfig
+	location, err := datasetLocation(enc.backend)
+	if err != nil {
+		return err
+	}
+	enc.location = location
+
+	enc.file = excelize.NewFile()
+	sheet := config.Sheet
+	if sheet == "" {
+		sheet = xlsxDefaultSheet
+	}
+	if sheet != xlsxDefaultSheet {
+		if err = enc.file.SetSheetName(xlsxDefaultSheet, sheet); err != nil {
+			return err
+		}
+	}
+	dateFormat, timestampFormat := xlsxDateFormat, xlsxTimestampFormat
+	if enc.dateStyle, err = enc.file.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat}); err != nil {
+		return err
+	}
+	if enc.timestampStyle, err = enc.file.NewStyle(&excelize.Style{CustomNumFmt: &timestampFormat}); err != nil {
+		return err
+	}
+	if enc.sheet, err = enc.file.NewStreamWriter(sheet); err != nil {
+		return err
+	}
+
+	if config.Header {
+		header := make([]interface{}, 0, len(config.Order))
+		for _, h := range config.Order {
+			header = append(header, h)
+		}
+		return enc.writeRow(header)
+	}
+	return nil
+}
+
+func (enc *XlsxEncoder) Write(entities []*uda.Entity) (int, error) {
+	if len(entities) == 0 {
+		return 0, nil
+	}
+	if !enc.open {
+		if err := enc.Open(); err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for _, ent := range entities {
+		row := propStripper(ent)
+		cells := make([]interface{}, 0, len(enc.backend.XlsxConfig.Order))
+		for _, h := range enc.backend.XlsxConfig.Order {
+			cell, err := enc.cellValue(row[h])
+			if err != nil {
+				return 0, fmt.Errorf("column %s of entity %s: %w", h, ent.ID, err)
+			}
+			cells = append(cells, cell)
+			if row[h] != nil {
+				written += len(fmt.Sprint(row[h]))
+			}
+		}
+		if err := enc.writeRow(cells); err != nil {
+			return 0, err
+		}
+	}
+	return written, nil
+}
+
+func (enc *XlsxEncoder) writeRow(cells []interface{}) error {
+	enc.row++
+	cell, err := excelize.CoordinatesToCellName(1, enc.row)
+	if err != nil {
+		return err
+	}
+	return enc.sheet.SetRow(cell, cells)
+}
+
+// cellValue keeps numbers and booleans typed, and writes date and RFC3339 strings as dates. Lists and objects are
+// written as json.
+func (enc *XlsxEncoder) cellValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool, int, int32, int64, float32, float64:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case string:
+		if t, err := time.Parse(dateLayout, v); err == nil {
+			return excelize.Cell{StyleID: enc.dateStyle, Value: t}, nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			// excel has no zones, timestamps are written as wall clock time of the dataset timezone
+			t = t.In(enc.location)
+			wallClock := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+			return excelize.Cell{StyleID: enc.timestampStyle, Value: wallClock}, nil
+		}
+		if len(v) > xlsxMaxStringLength {
+			return nil, fmt.Errorf("text longer than the %v characters an xlsx cell can hold", xlsxMaxStringLength)
+		}
+		return v, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (enc *XlsxEncoder) Close() error {
+	if !enc.open {
+		// an empty dataset is still written as a workbook, with the header if configured
+		if err := enc.Open(); err != nil {
+			_ = enc.writer.CloseWithError(err)
+			return err
+		}
+	}
+	defer func() {
+		_ = enc.file.Close()
+	}()
+	if err := enc.sheet.Flush(); err != nil {
+		_ = enc.writer.CloseWithError(err)
+		return err
+	}
+	if _, err := enc.file.WriteTo(enc.writer); err != nil {
+		_ = enc.writer.CloseWithError(err)
+		return err
+	}
+	return enc.writer.Close()
+}
+
+func (enc *XlsxEncoder) CloseWithError(err error) error {
+	if enc.file != nil {
+		_ = enc.file.Close()
+	}
+	return enc.writer.CloseWithError(err)
+}
+
+// datasetLocation returns the timezone of the dataset, utc if none is configured
+func datasetLocation(backend conf.StorageBackend) (*time.Location, error) {
+	if backend.Timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(backend.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %w", backend.Timezone, err)
+	}
+	return location, nil
+}
+
+// XlsxDecoder ********************** DECODER ****************************************/
+
+// XlsxDecoder reads the rows of one sheet of each workbook, and turns them into entities with the decode config
+// like the csv decoder does
+type XlsxDecoder struct {
+	backend  conf.StorageBackend
+	logger   *zap.SugaredLogger
+	files    storedFiles
+	file     StoredFile
+	sheet    *xlsxSheetReader
+	header   []string
+	location *time.Location
+	open     bool
+	closed   bool
+	overhang []byte
+	since    string
+	fullSync bool
+}
+
+func (d *XlsxDecoder) Read(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p))
+	var done bool
+	if len(d.overhang) > 0 {
+		buf = append(buf, d.overhang...)
+		d.overhang = nil
+	}
+
+	if !d.open {
+		d.open = true
+		if d.location, err = datasetLocation(d.backend); err != nil {
+			return 0, err
+		}
+		//start json array and add context as first entity
+		buf = append(buf, []byte("[")...)
+		buf = append(buf, []byte(buildContext(d.backend.DecodeConfig.Namespaces))...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// append one entity per row, comma separated
+	for !d.closed {
+		if d.sheet == nil {
+			more, err := d.nextFile()
+			if err != nil {
+				return n, err
+			}
+			if !more {
+				break
+			}
+		}
+		row, values, err := d.sheet.next()
+		if err == io.EOF {
+			if err = d.closeFile(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if row <= d.backend.XlsxConfig.SkipRows || isEmptyRow(values) {
+			continue
+		}
+		if d.header == nil {
+			d.header = make([]string, 0, len(values))
+			for _, v := range values {
+				d.header = append(d.header, stringValue(v))
+			}
+			continue
+		}
+
+		line := make(map[string]interface{}, len(d.header))
+		for i, key := range d.header {
+			if i < len(values) && values[i] != nil && key != "" {
+				line[key] = values[i]
+			}
+		}
+		entityBytes, err := toEntityBytes(line, d.backend)
+		if err != nil {
+			return n, err
+		}
+		if entityBytes == nil {
+			continue
+		}
+		buf = append(buf, append([]byte(","), entityBytes...)...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// close json array
+	if !d.closed {
+		token := d.since
+		if d.fullSync {
+			token = ""
+		}
+		continueEntity := map[string]interface{}{
+			"id":    "@continuation",
+			"token": token,
+		}
+		sinceBytes, _ := json.Marshal(continueEntity)
+		buf = append(buf, append([]byte(","), sinceBytes...)...)
+		buf = append(buf, []byte("]")...)
+		d.closed = true
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+	n = copy(p, buf)
+	return n, io.EOF
+}
+
+// nextFile opens the configured sheet of the next workbook, returning false when all files are read
+func (d *XlsxDecoder) nextFile() (bool, error) {
+	file, err := d.files.next()
+	if err != nil || file == nil {
+		return false, err
+	}
+	config := d.backend.XlsxConfig
+	sheet, err := openXlsxSheet(file, config.Sheet, config.SheetIndex, d.location)
+	if err != nil {
+		_ = file.Close()
+		return false, err
+	}
+	d.file = file
+	d.sheet = sheet
+	d.header = nil
+	if !config.Header {
+		if len(config.Order) == 0 {
+			_ = d.closeFile()
+			return false, errors.New("xlsx datasets without header row need a column order")
+		}
+		d.header = config.Order
+	}
+	return true, nil
+}
+
+// closeFile closes the current workbook
+func (d *XlsxDecoder) closeFile() error {
+	if d.sheet != nil {
+		_ = d.sheet.Close()
+		d.sheet = nil
+	}
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+func (d *XlsxDecoder) flush(p []byte, buf []byte) (int, error, bool) {
+	if len(buf) >= len(p) {
+		n := copy(p, buf)
+		d.overhang = buf[n:]
+		return n, nil, true
+	}
+	return 0, nil, false
+}
+
+func (d *XlsxDecoder) Close() error {
+	d.files.close()
+	return d.closeFile()
+}
+
+func isEmptyRow(values []interface{}) bool {
+	for _, v := range values {
+		if v != nil && v != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,346 @@
+package encoder
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// date kinds of cell number formats
+const (
+	xlsxNoDate = iota
+	xlsxDate
+	xlsxTime
+	xlsxDateTime
+)
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbookPart struct {
+	Properties struct {
+		Date1904 bool `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxStylesPart struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	var sb strings.Builder
+	sb.WriteString(t.T)
+	for _, r := range t.Runs {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+type xlsxRow struct {
+	R     int `xml:"r,attr"`
+	Cells []struct {
+		R      string    `xml:"r,attr"`
+		S      int       `xml:"s,attr"`
+		T      string    `xml:"t,attr"`
+		V      string    `xml:"v"`
+		Inline *xlsxText `xml:"is"`
+	} `xml:"c"`
+}
+
+// xlsxSheetReader reads the cells of one sheet of a workbook row by row. Only shared strings and styles are held
+// in memory, the sheet is streamed from the zip archive. excelize is not used for reading, as it loads the whole
+// workbook and has no access to cell types and styles while iterating rows.
+type xlsxSheetReader struct {
+	sheet     io.ReadCloser
+	decoder   *xml.Decoder
+	strings   []string
+	dateKinds []int
+	date1904  bool
+	location  *time.Location
+	row       int
+}
+
+// openXlsxSheet opens the sheet with the given name, or the sheet at index if name is empty
+func openXlsxSheet(file StoredFile, name string, index int, location *time.Location) (*xlsxSheetReader, error) {
+	archive, err := zip.NewReader(file, file.Size())
+	if err != nil {
+		return nil, fmt.Errorf("not an xlsx file: %w", err)
+	}
+	parts := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		parts[f.Name] = f
+	}
+
+	workbookPath, err := xlsxRelationshipTarget(parts, "_rels/.rels", "/officeDocument")
+	if err != nil || workbookPath == "" {
+		return nil, errors.New("no workbook found in xlsx file")
+	}
+	workbookRels := path.Join(path.Dir(workbookPath), "_rels", path.Base(workbookPath)+".rels")
+	var workbook xlsxWorkbookPart
+	if err = readXlsxPart(parts, workbookPath, &workbook); err != nil {
+		return nil, err
+	}
+
+	var sheetID string
+	for i, s := range workbook.Sheets {
+		if (name != "" && s.Name == name) || (name == "" && i == index) {
+			sheetID = s.ID
+		}
+	}
+	if sheetID == "" {
+		if name != "" {
+			return nil, fmt.Errorf("no sheet named %s in xlsx file", name)
+		}
+		return nil, fmt.Errorf("no sheet at index %v in xlsx file", index)
+	}
+	sheetPath, err := xlsxRelationshipTarget(parts, workbookRels, sheetID)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &xlsxSheetReader{date1904: workbook.Properties.Date1904, location: location}
+	if sharedStringsPath, _ := xlsxRelationshipTarget(parts, workbookRels, "/sharedStrings"); sharedStringsPath != "" {
+		var sst struct {
+			Items []xlsxText `xml:"si"`
+		}
+		if err = readXlsxPart(parts, sharedStringsPath, &sst); err != nil {
+			return nil, err
+		}
+		for _, si := range sst.Items {
+			r.strings = append(r.strings, si.String())
+		}
+	}
+	if stylesPath, _ := xlsxRelationshipTarget(parts, workbookRels, "/styles"); stylesPath != "" {
+		var styles xlsxStylesPart
+		if err = readXlsxPart(parts, stylesPath, &styles); err != nil {
+			return nil, err
+		}
+		codes := map[int]string{}
+		for _, f := range styles.NumFmts {
+			codes[f.ID] = f.Code
+		}
+		for _, xf := range styles.CellXfs {
+			r.dateKinds = append(r.dateKinds, xlsxDateKind(xf.NumFmtID, codes[xf.NumFmtID]))
+		}
+	}
+
+	part, ok := parts[sheetPath]
+	if !ok {
+		return nil, fmt.Errorf("missing %s in xlsx file", sheetPath)
+	}
+	if r.sheet, err = part.Open(); err != nil {
+		return nil, err
+	}
+	r.decoder = xml.NewDecoder(r.sheet)
+	return r, nil
+}
+
+// next returns the number and the cell values of the next row, or io.EOF after the last row. Values are
+// positioned by column, missing cells are nil.
+func (r *xlsxSheetReader) next() (int, []interface{}, error) {
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return 0, nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		var row xlsxRow
+		if err = r.decoder.DecodeElement(&row, &start); err != nil {
+			return 0, nil, err
+		}
+		r.row++
+		if row.R > 0 {
+			r.row = row.R
+		}
+		var values []interface{}
+		for i, c := range row.Cells {
+			col := i
+			if c.R != "" {
+				if col, _, err = excelize.CellNameToCoordinates(c.R); err != nil {
+					return 0, nil, err
+				}
+				col--
+			}
+			for len(values) <= col {
+				values = append(values, nil)
+			}
+			text := c.V
+			if c.Inline != nil {
+				text = c.Inline.String()
+			}
+			if values[col], err = r.cellValue(c.T, c.S, text); err != nil {
+				return 0, nil, fmt.Errorf("cell %s: %w", c.R, err)
+			}
+		}
+		return r.row, values, nil
+	}
+}
+
+// cellValue keeps the type of cells: numbers are returned as json numbers, booleans as booleans, and numbers
+// formatted as dates as dates, times or RFC3339 timestamps
+func (r *xlsxSheetReader) cellValue(cellType string, style int, text string) (interface{}, error) {
+	switch cellType {
+	case "s":
+		i, err := strconv.Atoi(text)
+		if err != nil || i < 0 || i >= len(r.strings) {
+			return nil, fmt.Errorf("invalid shared string %s", text)
+		}
+		return r.strings[i], nil
+	case "inlineStr", "str", "e":
+		return text, nil
+	case "b":
+		return text == "1" || text == "true", nil
+	case "d":
+		t, err := toTime(text)
+		if err != nil {
+			return text, nil
+		}
+		return t.Format(time.RFC3339Nano), nil
+	}
+	if text == "" {
+		return nil, nil
+	}
+	kind := xlsxNoDate
+	if style >= 0 && style < len(r.dateKinds) {
+		kind = r.dateKinds[style]
+	}
+	if kind == xlsxNoDate {
+		return json.Number(text), nil
+	}
+	serial, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s", text)
+	}
+	t, err := excelize.ExcelDateToTime(serial, r.date1904)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case kind == xlsxDate:
+		return t.Format(dateLayout), nil
+	case kind == xlsxTime && serial < 1:
+		return t.Format(timeOfDay), nil
+	}
+	// excel times have no zone, they are read as wall clock time of the dataset timezone
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), r.location).
+		Format(time.RFC3339Nano), nil
+}
+
+func (r *xlsxSheetReader) Close() error {
+	return r.sheet.Close()
+}
+
+// xlsxDateKind tells if the number format with the given id and code formats dates, times or both
+func xlsxDateKind(id int, code string) int {
+	switch {
+	case id >= 14 && id <= 17, id >= 27 && id <= 36, id >= 50 && id <= 58:
+		return xlsxDate
+	case id >= 18 && id <= 21, id >= 45 && id <= 47:
+		return xlsxTime
+	case id == 22:
+		return xlsxDateTime
+	case code == "":
+		return xlsxNoDate
+	}
+	// ignore quoted literals, escaped characters and sections like colors
+	var sb strings.Builder
+	quoted, bracket := false, false
+	for i := 0; i < len(code); i++ {
+		switch c := code[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '\\':
+			i++
+		case c == '[':
+			bracket = true
+		case c == ']':
+			bracket = false
+		case bracket:
+		case c == ';':
+			// only the first section formats positive numbers
+			i = len(code)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	format := strings.ToLower(sb.String())
+	hasDate := strings.ContainsAny(format, "yd")
+	hasTime := strings.ContainsAny(format, "hs")
+	switch {
+	case hasDate && hasTime:
+		return xlsxDateTime
+	case hasTime:
+		return xlsxTime
+	case hasDate || strings.Contains(format, "m"):
+		return xlsxDate
+	}
+	return xlsxNoDate
+}
+
+// xlsxRelationshipTarget returns the part path of the relationship in rels with the given id, or with a type
+// ending with the id if it starts with a slash
+func xlsxRelationshipTarget(parts map[string]*zip.File, rels string, id string) (string, error) {
+	var relationships xlsxRelationships
+	if err := readXlsxPart(parts, rels, &relationships); err != nil {
+		return "", err
+	}
+	for _, rel := range relationships.Relationships {
+		if rel.ID == id || (strings.HasPrefix(id, "/") && strings.HasSuffix(rel.Type, id)) {
+			if strings.HasPrefix(rel.Target, "/") {
+				return strings.TrimPrefix(rel.Target, "/"), nil
+			}
+			return path.Join(path.Dir(path.Dir(rels)), rel.Target), nil
+		}
+	}
+	return "", nil
+}
+
+func readXlsxPart(parts map[string]*zip.File, name string, v interface{}) error {
+	part, ok := parts[name]
+	if !ok {
+		return fmt.Errorf("missing %s in xlsx file", name)
+	}
+	r, err := part.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return xml.NewDecoder(r).Decode(v)
+}
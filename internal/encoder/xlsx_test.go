@@ -0,0 +1,161 @@
+package encoder_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+func TestXlsx(t *testing.T) {
+	g := goblin.Goblin(t)
+	decodeConfig := &conf.DecodeConfig{
+		Namespaces:       map[string]string{"a": "http://example.io/a/"},
+		DefaultNamespace: "a",
+		IdProperty:       "id",
+	}
+	entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+
+	g.Describe("The Xlsx Encoder", func() {
+		g.It("Should write typed cells in column order", func() {
+			backend := conf.StorageBackend{
+				Timezone: "Europe/Oslo",
+				XlsxConfig: &conf.XlsxConfig{
+					Sheet:  "people",
+					Header: true,
+					Order:  []string{"id", "name", "age", "score", "active", "born", "updated", "tags"},
+				},
+			}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:name": "Bob", "a:age": float64(42),
+					"a:score": 1.5, "a:active": true, "a:born": "1980-02-03", "a:updated": "2021-12-31T22:30:00Z",
+					"a:tags": []interface{}{"x", "y"}}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "2"}},
+			}
+			result, err := encodeTwice(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			f, err := excelize.OpenReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			g.Assert(f.GetSheetList()).Eql([]string{"people"})
+			rows, err := f.GetRows("people")
+			g.Assert(err).IsNil()
+			g.Assert(len(rows)).Eql(5)
+			g.Assert(rows[0]).Eql(backend.XlsxConfig.Order)
+			g.Assert(rows[1]).Eql([]string{"1", "Bob", "42", "1.5", "TRUE", "1980-02-03", "2021-12-31 23:30:00", `["x","y"]`})
+			g.Assert(rows[2]).Eql([]string{"2"})
+
+			ageType, _ := f.GetCellType("people", "C2")
+			g.Assert(ageType).Eql(excelize.CellTypeUnset)
+			raw, _ := f.GetCellValue("people", "C2", excelize.Options{RawCellValue: true})
+			g.Assert(raw).Eql("42")
+			activeType, _ := f.GetCellType("people", "E2")
+			g.Assert(activeType).Eql(excelize.CellTypeBool)
+			raw, _ = f.GetCellValue("people", "F2", excelize.Options{RawCellValue: true})
+			g.Assert(raw).Eql("29254")
+		})
+
+		g.It("Should write an empty workbook with header when there are no entities", func() {
+			backend := conf.StorageBackend{XlsxConfig: &conf.XlsxConfig{Header: true, Order: []string{"id"}}}
+			result, err := encodeOnce(backend, nil, &entityContext)
+			g.Assert(err).IsNil()
+			f, err := excelize.OpenReader(bytes.NewReader(result))
+			g.Assert(err).IsNil()
+			rows, _ := f.GetRows("Sheet1")
+			g.Assert(rows).Eql([][]string{{"id"}})
+		})
+	})
+
+	g.Describe("The Xlsx Decoder", func() {
+		g.It("Should read a round trip of typed cells", func() {
+			backend := conf.StorageBackend{
+				Timezone: "Europe/Oslo",
+				XlsxConfig: &conf.XlsxConfig{
+					Header: true,
+					Order:  []string{"id", "age", "score", "active", "born", "updated"},
+				},
+				DecodeConfig: decodeConfig,
+			}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:age": float64(42), "a:score": 1.5,
+					"a:active": true, "a:born": "1980-02-03", "a:updated": "2021-12-31T22:30:00Z"}},
+			}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			props := decodeXlsxEntities(g, reader)[0]
+			g.Assert(props).Eql(map[string]interface{}{"a:id": "1", "a:age": json.Number("42"),
+				"a:score": json.Number("1.5"), "a:active": true, "a:born": "1980-02-03",
+				"a:updated": "2021-12-31T23:30:00+01:00"})
+		})
+
+		g.It("Should read the configured sheet of every workbook after the skipped rows", func() {
+			backend := conf.StorageBackend{
+				XlsxConfig: &conf.XlsxConfig{
+					Sheet:    "data",
+					SkipRows: 1,
+					Order:    []string{"id", "amount", "due", "note"},
+				},
+				DecodeConfig: decodeConfig,
+			}
+			workbook := func(id string) *memoryFile {
+				f := excelize.NewFile()
+				_, _ = f.NewSheet("data")
+				_ = f.SetCellValue("data", "A1", "exported by finance")
+				_ = f.SetCellValue("data", "A2", id)
+				_ = f.SetCellValue("data", "B2", 12.25)
+				dateStyle, _ := f.NewStyle(&excelize.Style{NumFmt: 14})
+				_ = f.SetCellValue("data", "C2", time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC))
+				_ = f.SetCellStyle("data", "C2", "C2", dateStyle)
+				_ = f.SetCellValue("data", "D2", "paid")
+				buf, _ := f.WriteToBuffer()
+				return &memoryFile{Reader: bytes.NewReader(buf.Bytes())}
+			}
+			files := map[string]*memoryFile{"first": workbook("1"), "second": workbook("2")}
+			open := func(key string) (encoder.StoredFile, error) {
+				return files[key], nil
+			}
+			reader, err := encoder.NewFileDecoder(backend, []string{"first", "second"}, open, "token", zap.NewNop().Sugar(), false)
+			g.Assert(err).IsNil()
+			entities := decodeXlsxEntities(g, reader)
+			g.Assert(len(entities)).Eql(2)
+			g.Assert(entities[0]).Eql(map[string]interface{}{"a:id": "1", "a:amount": json.Number("12.25"),
+				"a:due": "2022-03-04", "a:note": "paid"})
+			g.Assert(entities[1]["a:id"]).Eql("2")
+			g.Assert(files["first"].closed).IsTrue()
+			g.Assert(files["second"].closed).IsTrue()
+		})
+
+		g.It("Should fail for missing sheets", func() {
+			backend := conf.StorageBackend{
+				XlsxConfig:   &conf.XlsxConfig{Sheet: "missing", Header: true},
+				DecodeConfig: decodeConfig,
+			}
+			result, err := encodeOnce(conf.StorageBackend{XlsxConfig: &conf.XlsxConfig{Order: []string{"id"}}},
+				[]*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:id": "1"}}}, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			_, err = io.ReadAll(reader)
+			g.Assert(err.Error()).Eql("no sheet named missing in xlsx file")
+		})
+	})
+}
+
+// decodeXlsxEntities returns the props of the decoded entities, without context and continuation
+func decodeXlsxEntities(g *goblin.G, reader io.Reader) []map[string]interface{} {
+	var props []map[string]interface{}
+	for _, e := range decodeEntities(g, reader) {
+		props = append(props, e["props"].(map[string]interface{}))
+	}
+	return props
+}
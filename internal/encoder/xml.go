@@ -0,0 +1,515 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+const (
+	xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+	xmlTextField   = "value"
+	xsiNamespace   = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// XmlEncoder ********************** ENCODER ****************************************/
+
+// XmlEncoder writes one record element per entity at the configured record path. The elements around the records
+// are opened with the first write and closed on Close, records are streamed in between.
+type XmlEncoder struct {
+	backend conf.StorageBackend
+	writer  *io.PipeWriter
+	logger  *zap.SugaredLogger
+	open    bool
+	path    []string
+	// segments of a stream write the declaration and root elements in the first segment, and close them in the last
+	continued bool
+	leaveOpen bool
+}
+
+func (enc *XmlEncoder) segment(continued bool, leaveOpen bool) {
+	enc.continued = continued
+	enc.leaveOpen = leaveOpen
+}
+
+func (enc *XmlEncoder) Open() error {
+	enc.open = true
+	config := enc.backend.XmlConfig
+	path, err := xmlRecordPath(config)
+	if err != nil {
+		return err
+	}
+	enc.path = path
+	if enc.continued {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xmlDeclaration)
+	for i, name := range path[:len(path)-1] {
+		buf.WriteString("<" + name)
+		if i == 0 {
+			prefixes := make([]string, 0, len(config.Namespaces))
+			for prefix := range config.Namespaces {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			for _, prefix := range prefixes {
+				attribute := "xmlns"
+				if prefix != "" {
+					attribute = "xmlns:" + prefix
+				}
+				writeXmlAttribute(&buf, attribute, config.Namespaces[prefix])
+			}
+		}
+		buf.WriteString(">")
+	}
+	buf.WriteString("\n")
+	_, err = enc.writer.Write(buf.Bytes())
+	return err
+}
+
+func (enc *XmlEncoder) Write(entities []*uda.Entity) (int, error) {
+	if len(entities) == 0 {
+		return 0, nil
+	}
+	if !enc.open {
+		if err := enc.Open(); err != nil {
+			return 0, err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, ent := range entities {
+		fields := uda.StripRefs(ent)
+		for k, v := range uda.StripProps(ent) {
+			fields[k] = v
+		}
+		if err := enc.writeRecord(&buf, fields); err != nil {
+			return 0, fmt.Errorf("entity %s: %w", ent.ID, err)
+		}
+	}
+	return enc.writer.Write(buf.Bytes())
+}
+
+// writeRecord writes the configured attributes on the record element, and all other fields as child elements
+func (enc *XmlEncoder) writeRecord(buf *bytes.Buffer, fields map[string]interface{}) error {
+	config := enc.backend.XmlConfig
+	record := enc.path[len(enc.path)-1]
+	buf.WriteString("<" + record)
+	for _, name := range config.Attributes {
+		value := fields[name]
+		if value == nil {
+			continue
+		}
+		text, ok := xmlText(value)
+		if !ok {
+			return fmt.Errorf("%s can not be written as an attribute", name)
+		}
+		writeXmlAttribute(buf, xmlName(name), text)
+	}
+	buf.WriteString(">")
+
+	names := config.Order
+	if len(names) == 0 {
+		names = make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if slices.Contains(config.Attributes, name) {
+			continue
+		}
+		if err := writeXmlElement(buf, name, fields[name]); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("</" + record + ">\n")
+	return nil
+}
+
+// writeXmlElement writes lists as repeated elements, and objects and nested entities as elements with a child
+// element per field
+func writeXmlElement(buf *bytes.Buffer, name string, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXmlElement(buf, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []string:
+		for _, item := range v {
+			if err := writeXmlElement(buf, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	element := xmlName(name)
+	if fields, ok := nestedFields(value); ok {
+		names := make([]string, 0, len(fields))
+		for k := range fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		buf.WriteString("<" + element + ">")
+		for _, k := range names {
+			if err := writeXmlElement(buf, k, fields[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("</" + element + ">")
+		return nil
+	}
+
+	text, ok := xmlText(value)
+	if !ok {
+		return fmt.Errorf("unsupported value %v of %s", value, name)
+	}
+	buf.WriteString("<" + element + ">")
+	_ = xml.EscapeText(buf, []byte(text))
+	buf.WriteString("</" + element + ">")
+	return nil
+}
+
+func writeXmlAttribute(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(" " + name + `="`)
+	_ = xml.EscapeText(buf, []byte(value))
+	buf.WriteString(`"`)
+}
+
+// xmlText returns the text of single values
+func xmlText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case int:
+		return strconv.Itoa(v), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// xmlName replaces characters that are not allowed in element and attribute names with underscores
+func xmlName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i == 0 && unicode.IsDigit(r):
+			sb.WriteRune('_')
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			r = '_'
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() == 0 {
+		return "_"
+	}
+	return sb.String()
+}
+
+func (enc *XmlEncoder) Close() error {
+	if enc.leaveOpen {
+		return enc.writer.Close()
+	}
+	if !enc.open {
+		// an empty dataset is still written as a document with the elements around the records
+		if err := enc.Open(); err != nil {
+			_ = enc.writer.CloseWithError(err)
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for i := len(enc.path) - 2; i >= 0; i-- {
+		buf.WriteString("</" + enc.path[i] + ">")
+	}
+	buf.WriteString("\n")
+	if _, err := enc.writer.Write(buf.Bytes()); err != nil {
+		_ = enc.writer.CloseWithError(err)
+		return err
+	}
+	return enc.writer.Close()
+}
+
+func (enc *XmlEncoder) CloseWithError(err error) error {
+	return enc.writer.CloseWithError(err)
+}
+
+// xmlRecordPath returns the element names from the root element down to the record element
+func xmlRecordPath(config *conf.XmlConfig) ([]string, error) {
+	path := strings.Split(strings.Trim(config.RecordPath, "/"), "/")
+	if len(path) < 2 || slices.Contains(path, "") {
+		return nil, errors.New("xml record path needs a root element and a record element, like people/person")
+	}
+	return path, nil
+}
+
+// XmlDecoder ********************** DECODER ****************************************/
+
+// XmlDecoder streams the elements at the configured record path, and turns them into entities with the decode
+// config. Attributes and child elements of records become fields, repeated elements lists and elements with
+// children or attributes objects.
+type XmlDecoder struct {
+	backend   conf.StorageBackend
+	reader    *io.PipeReader
+	logger    *zap.SugaredLogger
+	xmlReader *xml.Decoder
+	path      []string
+	prefixes  map[string]string
+	stack     []string
+	open      bool
+	closed    bool
+	overhang  []byte
+	since     string
+	fullSync  bool
+}
+
+func (d *XmlDecoder) Read(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p))
+	var done bool
+	if len(d.overhang) > 0 {
+		buf = append(buf, d.overhang...)
+		d.overhang = nil
+	}
+
+	if !d.open {
+		d.open = true
+		config := d.backend.XmlConfig
+		if d.path, err = xmlRecordPath(config); err != nil {
+			return 0, err
+		}
+		d.prefixes = make(map[string]string, len(config.Namespaces))
+		for prefix, uri := range config.Namespaces {
+			d.prefixes[uri] = prefix
+		}
+		d.xmlReader = xml.NewDecoder(d.reader)
+		d.xmlReader.CharsetReader = xmlCharsetReader()
+		//start json array and add context as first entity
+		buf = append(buf, []byte("[")...)
+		buf = append(buf, []byte(buildContext(d.backend.DecodeConfig.Namespaces))...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// append one entity per record, comma separated
+	for !d.closed {
+		line, err := d.nextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		entityBytes, err := toEntityBytes(line, d.backend)
+		if err != nil {
+			return n, err
+		}
+		if entityBytes == nil {
+			continue
+		}
+		buf = append(buf, append([]byte(","), entityBytes...)...)
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+
+	// close json array
+	if !d.closed {
+		token := d.since
+		if d.fullSync {
+			token = ""
+		}
+		continueEntity := map[string]interface{}{
+			"id":    "@continuation",
+			"token": token,
+		}
+		sinceBytes, _ := json.Marshal(continueEntity)
+		buf = append(buf, append([]byte(","), sinceBytes...)...)
+		buf = append(buf, []byte("]")...)
+		d.closed = true
+		if n, err, done = d.flush(p, buf); done {
+			return n, err
+		}
+	}
+	n = copy(p, buf)
+	return n, io.EOF
+}
+
+// nextRecord returns the fields of the next record element, or io.EOF after the last one. Elements outside of
+// the record path are skipped without being read into memory.
+func (d *XmlDecoder) nextRecord() (map[string]interface{}, error) {
+	for {
+		token, err := d.xmlReader.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth := len(d.stack) + 1
+			if depth > len(d.path) || d.qualifiedName(t.Name) != d.path[depth-1] {
+				if err = d.xmlReader.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if depth < len(d.path) {
+				d.stack = append(d.stack, d.path[depth-1])
+				continue
+			}
+			fields, text, nilled, err := d.readElement(t)
+			if err != nil {
+				return nil, err
+			}
+			if nilled {
+				continue
+			}
+			if s := strings.TrimSpace(text); s != "" && len(fields) == 0 {
+				fields[xmlTextField] = s
+			}
+			return fields, nil
+		case xml.EndElement:
+			d.stack = d.stack[:len(d.stack)-1]
+		}
+	}
+}
+
+// readElement reads the attributes and child elements of the element up to its end, returning them as fields
+// together with the text of the element and whether it is nil by xsi:nil
+func (d *XmlDecoder) readElement(start xml.StartElement) (map[string]interface{}, string, bool, error) {
+	fields := map[string]interface{}{}
+	nilled := false
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "xmlns", a.Name.Space == "" && a.Name.Local == "xmlns":
+		case a.Name.Space == xsiNamespace && a.Name.Local == "nil":
+			nilled = a.Value == "true" || a.Value == "1"
+		default:
+			fields[d.qualifiedName(a.Name)] = a.Value
+		}
+	}
+
+	var text strings.Builder
+	for {
+		token, err := d.xmlReader.Token()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, "", false, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			children, childText, childNil, err := d.readElement(t)
+			if err != nil {
+				return nil, "", false, err
+			}
+			var value interface{}
+			switch {
+			case childNil:
+			case len(children) == 0:
+				value = childText
+			default:
+				if s := strings.TrimSpace(childText); s != "" {
+					children[xmlTextField] = s
+				}
+				value = children
+			}
+			addRepeatedField(fields, d.qualifiedName(t.Name), value)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			return fields, text.String(), nilled, nil
+		}
+	}
+}
+
+// addRepeatedField adds a value to fields, turning the values of repeated names into a list
+func addRepeatedField(fields map[string]interface{}, name string, value interface{}) {
+	existing, ok := fields[name]
+	if !ok {
+		fields[name] = value
+		return
+	}
+	if values, ok := existing.([]interface{}); ok {
+		fields[name] = append(values, value)
+		return
+	}
+	fields[name] = []interface{}{existing, value}
+}
+
+// qualifiedName returns the local name of elements and attributes, prefixed if the namespace is declared with a
+// prefix in the xml config
+func (d *XmlDecoder) qualifiedName(name xml.Name) string {
+	if prefix := d.prefixes[name.Space]; prefix != "" {
+		return prefix + ":" + name.Local
+	}
+	return name.Local
+}
+
+// xmlCharsetReader decodes documents declaring other encodings than utf-8. All files of a dataset are streamed
+// as one document, the first declaration switches the rest of the stream, declarations of later files are ignored.
+func xmlCharsetReader() func(string, io.Reader) (io.Reader, error) {
+	switched := false
+	return func(label string, input io.Reader) (io.Reader, error) {
+		if switched {
+			return input, nil
+		}
+		encoding, err := ianaindex.IANA.Encoding(label)
+		if err != nil {
+			return nil, err
+		}
+		if encoding == nil {
+			return nil, fmt.Errorf("unsupported xml encoding %s", label)
+		}
+		switched = true
+		return encoding.NewDecoder().Reader(input), nil
+	}
+}
+
+func (d *XmlDecoder) flush(p []byte, buf []byte) (int, error, bool) {
+	if len(buf) >= len(p) {
+		n := copy(p, buf)
+		d.overhang = buf[n:]
+		return n, nil, true
+	}
+	return 0, nil, false
+}
+
+func (d *XmlDecoder) Close() error {
+	return d.reader.Close()
+}
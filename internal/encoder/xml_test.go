@@ -0,0 +1,167 @@
+package encoder_test
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestXml(t *testing.T) {
+	g := goblin.Goblin(t)
+	entityContext := uda.Context{ID: "@context", Namespaces: map[string]string{}}
+
+	g.Describe("The Xml Encoder", func() {
+		g.It("Should write records with attributes, lists and nested elements", func() {
+			backend := conf.StorageBackend{
+				XmlConfig: &conf.XmlConfig{
+					RecordPath: "export/people/person",
+					Attributes: []string{"id"},
+					Namespaces: map[string]string{"": "http://example.io/people", "o": "http://example.io/other"},
+					Order:      []string{"id", "name", "age", "tags", "address", "manager", "note"},
+				},
+			}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:name": "Bob & <Co>", "a:age": 42.5,
+					"a:tags": []interface{}{"x", "y"}, "a:address": map[string]interface{}{"zip": "0150", "street": "Main"},
+					"a:note": nil}, References: map[string]interface{}{"a:manager": "a:7"}},
+			}
+			result, err := encodeTwice(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			record := `<person id="1"><name>Bob &amp; &lt;Co&gt;</name><age>42.5</age><tags>x</tags><tags>y</tags>` +
+				`<address><street>Main</street><zip>0150</zip></address><manager>a:7</manager></person>` + "\n"
+			g.Assert(string(result)).Eql(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<export xmlns="http://example.io/people" xmlns:o="http://example.io/other"><people>` + "\n" +
+				record + record + "</people></export>\n")
+		})
+
+		g.It("Should write all fields in name order without configured order", func() {
+			backend := conf.StorageBackend{XmlConfig: &conf.XmlConfig{RecordPath: "people/person"}}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob", "a:id": "1", "a:first name": "Bob",
+					"a:active": true}},
+			}
+			result, err := encodeOnce(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<people>\n" +
+				"<person><active>true</active><first_name>Bob</first_name><id>1</id><name>Bob</name></person>\n" +
+				"</people>\n")
+		})
+
+		g.It("Should write an empty document when there are no entities", func() {
+			backend := conf.StorageBackend{XmlConfig: &conf.XmlConfig{RecordPath: "/people/person/"}}
+			result, err := encodeOnce(backend, nil, &entityContext)
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<people>\n</people>\n")
+		})
+
+		g.It("Should fail for record paths without root element", func() {
+			backend := conf.StorageBackend{XmlConfig: &conf.XmlConfig{RecordPath: "person"}}
+			_, err := encodeOnce(backend, []*uda.Entity{{ID: "a:1"}}, &entityContext)
+			g.Assert(err.Error()).Eql("xml record path needs a root element and a record element, like people/person")
+		})
+	})
+
+	g.Describe("The Xml Decoder", func() {
+		decodeConfig := &conf.DecodeConfig{
+			Namespaces:       map[string]string{"a": "http://example.io/a/"},
+			DefaultNamespace: "a",
+			IdProperty:       "id",
+			Refs:             []string{"manager"},
+			ColumnMappings:   map[string]string{"o:extra": "extra"},
+			ColumnTypes:      map[string]string{"age": "int"},
+		}
+
+		g.It("Should read the records at the record path", func() {
+			backend := conf.StorageBackend{
+				XmlConfig: &conf.XmlConfig{
+					RecordPath: "export/people/person",
+					Namespaces: map[string]string{"": "http://example.io/people", "o": "http://example.io/other"},
+				},
+				DecodeConfig: decodeConfig,
+			}
+			content := `<?xml version="1.0" encoding="UTF-8"?>
+<export xmlns="http://example.io/people" xmlns:x="http://example.io/other"
+        xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <meta><person id="ignored"/></meta>
+  <people>
+    <!-- the first person -->
+    <person id="1">
+      <name>Bob</name>
+      <age>42</age>
+      <phone>1</phone>
+      <phone>2</phone>
+      <address kind="home"><street>Main</street></address>
+      <manager>7</manager>
+      <note xsi:nil="true"/>
+      <x:extra>x</x:extra>
+    </person>
+    <person id="2"><name>Alice &amp; Co</name></person>
+    <person xsi:nil="true"/>
+  </people>
+</export>`
+			reader, err := decodeOnce(backend, []byte(content))
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			g.Assert(len(entities)).Eql(2)
+			g.Assert(entities[0]["id"]).Eql("1")
+			g.Assert(entities[0]["props"]).Eql(map[string]interface{}{"a:id": "1", "a:name": "Bob",
+				"a:age": json.Number("42"), "a:phone": []interface{}{"1", "2"},
+				"a:address": map[string]interface{}{"kind": "home", "street": "Main"}, "a:note": nil, "a:extra": "x"})
+			g.Assert(entities[0]["refs"]).Eql(map[string]interface{}{"a:manager": "7"})
+			g.Assert(entities[1]["props"]).Eql(map[string]interface{}{"a:id": "2", "a:name": "Alice & Co"})
+		})
+
+		g.It("Should read concatenated files with declared encodings", func() {
+			backend := conf.StorageBackend{
+				XmlConfig:    &conf.XmlConfig{RecordPath: "people/person"},
+				DecodeConfig: decodeConfig,
+			}
+			file, err := charmap.ISO8859_1.NewEncoder().String(`<?xml version="1.0" encoding="ISO-8859-1"?>` + "\n" +
+				`<people><person><id>1</id><name>Åse</name></person></people>` + "\n")
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, []byte(file+file))
+			g.Assert(err).IsNil()
+			entities := decodeEntities(g, reader)
+			g.Assert(len(entities)).Eql(2)
+			for _, e := range entities {
+				g.Assert(e["props"]).Eql(map[string]interface{}{"a:id": "1", "a:name": "Åse"})
+			}
+		})
+
+		g.It("Should read a round trip of written records", func() {
+			backend := conf.StorageBackend{
+				XmlConfig:    &conf.XmlConfig{RecordPath: "people/person", Attributes: []string{"id"}},
+				DecodeConfig: decodeConfig,
+			}
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:age": float64(42),
+					"a:tags": []interface{}{"x", "y"}}},
+			}
+			result, err := encodeTwice(backend, entities, &entityContext)
+			g.Assert(err).IsNil()
+			reader, err := decodeOnce(backend, result)
+			g.Assert(err).IsNil()
+			decoded := decodeEntities(g, reader)
+			g.Assert(len(decoded)).Eql(2)
+			g.Assert(decoded[1]["props"]).Eql(map[string]interface{}{"a:id": "1", "a:age": json.Number("42"),
+				"a:tags": []interface{}{"x", "y"}})
+		})
+
+		g.It("Should fail for documents ending within a record", func() {
+			backend := conf.StorageBackend{
+				XmlConfig:    &conf.XmlConfig{RecordPath: "people/person"},
+				DecodeConfig: decodeConfig,
+			}
+			reader, err := decodeOnce(backend, []byte(`<people><person><id>1</id>`))
+			g.Assert(err).IsNil()
+			_, err = io.ReadAll(reader)
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
@@ -37,6 +37,10 @@ func ParseStream(reader io.Reader, emitEntities func(entities []*uda.Entity, ent
 			}
 		}
 	}
+	if err := decoder.Err(); err != nil {
+		// a payload that is cut off is not stored as if it was complete
+		return err
+	}
 
 	if read > 0 {
 		// do stuff with leftover entities
@@ -53,6 +53,17 @@ func TestParseStream(t *testing.T) {
 			g.Assert(len(recorded)).Eql(0)
 		})
 
+		g.It("Should not emit the last batch of payloads that are cut off", func() {
+			var recorded []*uda.Entity
+			payload := `[{"id":"@context","namespaces":{}},{"id":"a:1"},{"id":"a:2"`
+			err := ParseStream(strings.NewReader(payload), func(entities []*uda.Entity, entityContext *uda.Context) error {
+				recorded = append(recorded, entities...)
+				return nil
+			}, 1000, false)
+			g.Assert(err == nil).IsFalse()
+			g.Assert(len(recorded)).Eql(0)
+		})
+
 		g.Describe("Should accept and sanitize invalid entities", func() {
 			tpl := `[ {
 				"id": "@context",
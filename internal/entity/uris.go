@@ -0,0 +1,82 @@
+package entity
+
+import (
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+)
+
+// ExpandAllUris expands namespace prefixes into full uris in ids, property and reference keys and reference
+// values. Unlike uda.ExpandUris, which leaves keys as they are, this gives every part of the entities, and of
+// their nested entities, a full uri.
+func ExpandAllUris(entities []*uda.Entity, entityContext *uda.Context) []*uda.Entity {
+	for _, e := range entities {
+		e.ID = uda.ToURI(entityContext, e.ID)
+		e.Properties = expandProps(e.Properties, entityContext)
+		e.References = expandRefs(e.References, entityContext)
+	}
+	return entities
+}
+
+func expandProps(props map[string]interface{}, entityContext *uda.Context) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+	expanded := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		expanded[uda.ToURI(entityContext, k)] = expandNested(v, entityContext)
+	}
+	return expanded
+}
+
+func expandRefs(refs map[string]interface{}, entityContext *uda.Context) map[string]interface{} {
+	if refs == nil {
+		return nil
+	}
+	expanded := make(map[string]interface{}, len(refs))
+	for k, v := range refs {
+		switch value := v.(type) {
+		case string:
+			v = uda.ToURI(entityContext, value)
+		case []interface{}:
+			values := make([]interface{}, 0, len(value))
+			for _, item := range value {
+				if s, ok := item.(string); ok {
+					item = uda.ToURI(entityContext, s)
+				}
+				values = append(values, item)
+			}
+			v = values
+		}
+		expanded[uda.ToURI(entityContext, k)] = v
+	}
+	return expanded
+}
+
+// expandNested expands nested entities, given as objects with props, and lists of them
+func expandNested(value interface{}, entityContext *uda.Context) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			values = append(values, expandNested(item, entityContext))
+		}
+		return values
+	case map[string]interface{}:
+		props, ok := v["props"].(map[string]interface{})
+		if !ok {
+			return v
+		}
+		nested := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			nested[k] = val
+		}
+		if id, ok := v["id"].(string); ok {
+			nested["id"] = uda.ToURI(entityContext, id)
+		}
+		nested["props"] = expandProps(props, entityContext)
+		if refs, ok := v["refs"].(map[string]interface{}); ok {
+			nested["refs"] = expandRefs(refs, entityContext)
+		}
+		return nested
+	}
+	return value
+}
@@ -0,0 +1,45 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+)
+
+func TestExpandAllUris(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("Expanding all uris", func() {
+		g.It("Should expand ids, keys and refs of entities and nested entities", func() {
+			entityContext := &uda.Context{Namespaces: map[string]string{"a": "http://a/", "b": "http://b/"}}
+			entities := []*uda.Entity{{
+				ID: "a:1",
+				Properties: map[string]interface{}{
+					"b:name": "a:not-a-ref",
+					"b:address": []interface{}{map[string]interface{}{
+						"id":    "a:home",
+						"props": map[string]interface{}{"b:street": "Main"},
+						"refs":  map[string]interface{}{"b:city": "a:oslo"},
+					}},
+					"b:meta": map[string]interface{}{"b:kept": "as is"},
+				},
+				References: map[string]interface{}{"b:friends": []interface{}{"a:2", "http://c/3"}, "b:type": "x:unknown"},
+			}}
+			expanded := ExpandAllUris(entities, entityContext)
+			g.Assert(expanded[0].ID).Eql("http://a/1")
+			g.Assert(expanded[0].Properties).Eql(map[string]interface{}{
+				"http://b/name": "a:not-a-ref",
+				"http://b/address": []interface{}{map[string]interface{}{
+					"id":    "http://a/home",
+					"props": map[string]interface{}{"http://b/street": "Main"},
+					"refs":  map[string]interface{}{"http://b/city": "http://a/oslo"},
+				}},
+				"http://b/meta": map[string]interface{}{"b:kept": "as is"},
+			})
+			g.Assert(expanded[0].References).Eql(map[string]interface{}{
+				"http://b/friends": []interface{}{"http://a/2", "http://c/3"},
+				"http://b/type":    "x:unknown",
+			})
+		})
+	})
+}
@@ -74,5 +74,117 @@ func TestParquetToAthena(t *testing.T) {
 			g.Assert(err).IsNil()
 			g.Assert(result).Eql(expected)
 		})
+
+		g.It("Should add partition projection and leave partition columns out of the table columns", func() {
+			expected := "CREATE EXTERNAL TABLE `a_new_table` (\n" +
+				"  `id` int )\n" +
+				"PARTITIONED BY (\n" +
+				"  country STRING,\n" +
+				"  year STRING)\n" +
+				"STORED AS PARQUET\n" +
+				"LOCATION\n" +
+				"  's3://bucket/folder/'\n" +
+				"TBLPROPERTIES (\n" +
+				"  'parquet.compression'='SNAPPY',\n" +
+				"  'projection.enabled'='true',\n" +
+				"  'projection.country.type'='injected',\n" +
+				"  'projection.year.type'='integer',\n" +
+				"  'projection.year.range'='1970,2100',\n" +
+				"  'storage.location.template'='s3://bucket/folder/country=${country}/year=${year}/')"
+
+			schemaString := `message test_schema {
+					required int32 id;
+					optional binary country (STRING);
+			}`
+			athenaGenerator, err := NewParquetAthenaSqlBuilder(
+				"a.new-table",
+				schemaString,
+				"s3://bucket/folder/")
+			g.Assert(err).IsNil()
+			result, err := athenaGenerator.
+				WithSnappyCompression().
+				WithPartitionProjection(PartitionProjection{Name: "country"}, PartitionProjection{Name: "year", Range: "1970,2100"}).
+				Build()
+			g.Assert(err).IsNil()
+			g.Assert(result).Eql(expected)
+		})
+
+		g.It("Should produce array, map and struct types for nested columns", func() {
+			expected := "CREATE EXTERNAL TABLE `nested` (\n" +
+				"  `tags` array<string>,\n" +
+				"  `scores` array<bigint>,\n" +
+				"  `address` struct<city:string,zip:int>,\n" +
+				"  `labels` map<string,string>,\n" +
+				"  `pets` array<struct<name:string>> )\n" +
+				"STORED AS PARQUET\n" +
+				"LOCATION\n" +
+				"  's3://bucket/folder/'"
+
+			schemaString := `message test_schema {
+					optional group tags (LIST) {
+						repeated group list {
+							optional binary element (STRING);
+						}
+					}
+					repeated int64 scores;
+					optional group address {
+						optional binary city (STRING);
+						optional int32 zip;
+					}
+					optional group labels (MAP) {
+						repeated group key_value {
+							required binary key (STRING);
+							optional binary value (STRING);
+						}
+					}
+					optional group pets (LIST) {
+						repeated group list {
+							optional group element {
+								optional binary name (STRING);
+							}
+						}
+					}
+			}`
+			athenaGenerator, err := NewParquetAthenaSqlBuilder("nested", schemaString, "s3://bucket/folder/")
+			g.Assert(err).IsNil()
+			result, err := athenaGenerator.Build()
+			g.Assert(err).IsNil()
+			g.Assert(result).Eql(expected)
+		})
+
+		g.It("Should map parquet logical types to athena types", func() {
+			expected := "CREATE EXTERNAL TABLE `typed` (\n" +
+				"  `created` timestamp,\n" +
+				"  `legacy` timestamp,\n" +
+				"  `price` decimal(9,2),\n" +
+				"  `balance` decimal(20,4),\n" +
+				"  `uuid` binary,\n" +
+				"  `doc` string,\n" +
+				"  `kind` string,\n" +
+				"  `small` tinyint,\n" +
+				"  `medium` smallint,\n" +
+				"  `count` bigint )\n" +
+				"STORED AS PARQUET\n" +
+				"LOCATION\n" +
+				"  's3://bucket/folder/'"
+
+			schemaString := `message test_schema {
+					optional int64 created (TIMESTAMP(MILLIS, true));
+					optional int96 legacy;
+					optional int32 price (DECIMAL(9, 2));
+					optional fixed_len_byte_array(9) balance (DECIMAL(20, 4));
+					optional fixed_len_byte_array(16) uuid (UUID);
+					optional binary doc (JSON);
+					optional binary kind (ENUM);
+					optional int32 small (INT(8, true));
+					optional int32 medium (INT_16);
+					optional int32 count (INT(32, false));
+			}`
+			athenaGenerator, err := NewParquetAthenaSqlBuilder("typed", schemaString, "s3://bucket/folder/")
+			g.Assert(err).IsNil()
+			result, err := athenaGenerator.Build()
+			g.Assert(err).IsNil()
+			g.Assert(result).Eql(expected)
+		})
 	})
 }
@@ -48,13 +48,19 @@ func (g *parquetToAthenaBuilder) Build() (result string, err error) {
 	// columns
 	if len(g.schema.RootColumn.Children) > 0 {
 		sb.WriteString(" (")
-		for i, se := range g.schema.RootColumn.Children {
-			colType, err2 := parqetTypeToAthenaType(se.SchemaElement)
+		i := 0
+		for _, se := range g.schema.RootColumn.Children {
+			colName := se.SchemaElement.Name
+			if g.isPartitionField(colName) {
+				// athena tables can not have columns with the name of a partition column
+				continue
+			}
+			colType, err2 := athenaColumnType(se)
 			if err2 != nil {
 				return "", err2
 			}
-			colName := se.SchemaElement.Name
 			_, err = fmt.Fprintf(&sb, "%v`%v` %v", delimForRow(i), colName, colType)
+			i++
 		}
 		sb.WriteString(" )")
 	}
@@ -97,41 +103,179 @@ func delimForRow(i int) string {
 	return delim
 }
 
+// athenaColumnType maps LIST and repeated columns to array, MAP columns to map and other groups to struct types
+func athenaColumnType(c *parquetschema.ColumnDefinition) (string, error) {
+	if c.SchemaElement.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED {
+		elementType, err := athenaElementType(c)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("array<%v>", elementType), nil
+	}
+	return athenaElementType(c)
+}
+
+func athenaElementType(c *parquetschema.ColumnDefinition) (string, error) {
+	if len(c.Children) == 0 {
+		return parqetTypeToAthenaType(c.SchemaElement)
+	}
+	s := c.SchemaElement
+	switch {
+	case (s.LogicalType != nil && s.LogicalType.IsSetLIST()) || s.GetConvertedType() == parquet.ConvertedType_LIST:
+		repeated := c.Children[0]
+		element := repeated
+		if len(repeated.Children) == 1 {
+			element = repeated.Children[0]
+		}
+		elementType, err := athenaElementType(element)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("array<%v>", elementType), nil
+	case (s.LogicalType != nil && s.LogicalType.IsSetMAP()) || s.GetConvertedType() == parquet.ConvertedType_MAP ||
+		s.GetConvertedType() == parquet.ConvertedType_MAP_KEY_VALUE:
+		keyValue := c.Children[0]
+		if len(keyValue.Children) != 2 {
+			return "", errors.New(fmt.Sprintf("unsupported parquet map: %+v", s))
+		}
+		keyType, err := athenaColumnType(keyValue.Children[0])
+		if err != nil {
+			return "", err
+		}
+		valueType, err := athenaColumnType(keyValue.Children[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("map<%v,%v>", keyType, valueType), nil
+	}
+	fields := make([]string, 0, len(c.Children))
+	for _, child := range c.Children {
+		fieldType, err := athenaColumnType(child)
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, fmt.Sprintf("%v:%v", child.SchemaElement.Name, fieldType))
+	}
+	return fmt.Sprintf("struct<%v>", strings.Join(fields, ",")), nil
+}
+
 func parqetTypeToAthenaType(s *parquet.SchemaElement) (string, error) {
 	if s.IsSetLogicalType() {
-		if s.LogicalType.IsSetSTRING() {
+		lt := s.LogicalType
+		switch {
+		case lt.IsSetSTRING(), lt.IsSetENUM(), lt.IsSetJSON():
 			return "string", nil
-		}
-		if s.LogicalType.IsSetDATE() {
+		case lt.IsSetDATE():
 			return "date", nil
-		}
-		if s.LogicalType.IsSetTIME() {
+		case lt.IsSetTIME(), lt.IsSetTIMESTAMP():
 			return "timestamp", nil
+		case lt.IsSetDECIMAL():
+			return fmt.Sprintf("decimal(%v,%v)", lt.DECIMAL.Precision, lt.DECIMAL.Scale), nil
+		case lt.IsSetUUID(), lt.IsSetBSON():
+			return "binary", nil
+		case lt.IsSetINTEGER():
+			return athenaIntType(int(lt.INTEGER.BitWidth), lt.INTEGER.IsSigned), nil
 		}
 		return "", errors.New(fmt.Sprintf("unsupported parquet type: %+v", s))
 	}
-	if *s.Type == parquet.Type_BOOLEAN {
-		return "boolean", nil
+	if s.ConvertedType != nil {
+		switch *s.ConvertedType {
+		case parquet.ConvertedType_UTF8, parquet.ConvertedType_ENUM, parquet.ConvertedType_JSON:
+			return "string", nil
+		case parquet.ConvertedType_DATE:
+			return "date", nil
+		case parquet.ConvertedType_TIMESTAMP_MILLIS, parquet.ConvertedType_TIMESTAMP_MICROS:
+			return "timestamp", nil
+		case parquet.ConvertedType_DECIMAL:
+			return fmt.Sprintf("decimal(%v,%v)", s.GetPrecision(), s.GetScale()), nil
+		case parquet.ConvertedType_INT_8:
+			return athenaIntType(8, true), nil
+		case parquet.ConvertedType_INT_16:
+			return athenaIntType(16, true), nil
+		case parquet.ConvertedType_UINT_8:
+			return athenaIntType(8, false), nil
+		case parquet.ConvertedType_UINT_16:
+			return athenaIntType(16, false), nil
+		case parquet.ConvertedType_UINT_32:
+			return athenaIntType(32, false), nil
+		}
 	}
-	if *s.Type == parquet.Type_INT64 {
+	switch *s.Type {
+	case parquet.Type_BOOLEAN:
+		return "boolean", nil
+	case parquet.Type_INT64:
 		return "bigint", nil
-	}
-	if *s.Type == parquet.Type_INT32 {
+	case parquet.Type_INT32:
 		return "int", nil
-	}
-	if *s.Type == parquet.Type_FLOAT {
+	case parquet.Type_INT96:
+		return "timestamp", nil
+	case parquet.Type_FLOAT:
 		return "float", nil
-	}
-	if *s.Type == parquet.Type_DOUBLE {
+	case parquet.Type_DOUBLE:
 		return "double", nil
-	}
-	if *s.Type == parquet.Type_BYTE_ARRAY {
+	case parquet.Type_BYTE_ARRAY, parquet.Type_FIXED_LEN_BYTE_ARRAY:
 		return "binary", nil
 	}
 	return "", errors.New(fmt.Sprintf("unsupported parquet type: %+v", s))
 }
 
+// athenaIntType returns the smallest athena integer type holding all values of the parquet INT type
+func athenaIntType(bitWidth int, signed bool) string {
+	if !signed {
+		bitWidth *= 2
+	}
+	switch {
+	case bitWidth <= 8:
+		return "tinyint"
+	case bitWidth <= 16:
+		return "smallint"
+	case bitWidth <= 32:
+		return "int"
+	}
+	return "bigint"
+}
+
 func (g *parquetToAthenaBuilder) WithPartitioning(partitionFields ...string) *parquetToAthenaBuilder {
 	g.PartitionFields = partitionFields
 	return g
 }
+
+func (g *parquetToAthenaBuilder) isPartitionField(name string) bool {
+	for _, pf := range g.PartitionFields {
+		if strings.EqualFold(pf, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartitionProjection is a partition column with the range of its values, like `1,12`. Columns without range are
+// injected, so queries must give their values.
+type PartitionProjection struct {
+	Name  string
+	Range string
+}
+
+// WithPartitionProjection partitions the table by the columns, and lets athena project the partitions from the
+// location instead of keeping them in the catalog
+func (g *parquetToAthenaBuilder) WithPartitionProjection(columns ...PartitionProjection) *parquetToAthenaBuilder {
+	if len(columns) == 0 {
+		return g
+	}
+	g.PartitionFields = nil
+	template := strings.TrimSuffix(g.location, "/")
+	g.TableProperties = append(g.TableProperties, "'projection.enabled'='true'")
+	for _, c := range columns {
+		g.PartitionFields = append(g.PartitionFields, c.Name)
+		if c.Range != "" {
+			g.TableProperties = append(g.TableProperties,
+				fmt.Sprintf("'projection.%v.type'='integer'", c.Name),
+				fmt.Sprintf("'projection.%v.range'='%v'", c.Name, c.Range))
+		} else {
+			g.TableProperties = append(g.TableProperties, fmt.Sprintf("'projection.%v.type'='injected'", c.Name))
+		}
+		template = fmt.Sprintf("%v/%v=${%v}", template, c.Name, c.Name)
+	}
+	g.TableProperties = append(g.TableProperties, fmt.Sprintf("'storage.location.template'='%v/'", template))
+	return g
+}
@@ -1,12 +1,16 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,16 +23,21 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
 )
 
 type AzureStorage struct {
-	logger  *zap.SugaredLogger
-	env     *conf.Env
-	config  conf.StorageBackend
-	statsd  statsd.ClientInterface
-	dataset string
+	logger    *zap.SugaredLogger
+	env       *conf.Env
+	config    conf.StorageBackend
+	statsd    statsd.ClientInterface
+	dataset   string
+	fullsyncs fullSyncSessions
 }
 
+// azureBlockSize is the size of each staged block of fullsync blobs
+const azureBlockSize = 4 * 1024 * 1024
+
 func (azStorage *AzureStorage) DeliverOnceClientInit() (datahub.Client, error) {
 	return datahub.Client{}, errors.New("DeliverOnceClientInit not supported for AzureStorage")
 }
@@ -42,11 +51,194 @@ func (azStorage *AzureStorage) DeliverOnce(entities []*uda.Entity, client datahu
 }
 
 func (azStorage *AzureStorage) GetEntities() (io.Reader, error) {
-	return nil, errors.New("GetEntities not supported for AzureStorage")
+	containerURL, prefix, err := azStorage.containerURL()
+	if err != nil {
+		return nil, err
+	}
+	files, err := azStorage.findBlobs(containerURL, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if encoder.UsesFileDecoder(azStorage.config) {
+		return encoder.NewFileDecoder(azStorage.config, objectKeys(files, ""), azStorage.blobOpener(containerURL), "", azStorage.logger, true)
+	}
+	reader, writer := io.Pipe()
+	go azStorage.streamBlobs(containerURL, files, "", writer)
+	return encoder.NewEntityDecoder(azStorage.config, reader, "", azStorage.logger, true)
 }
 
 func (azStorage *AzureStorage) GetChanges(since string) (io.Reader, error) {
-	return nil, errors.New("GetChanges not supported for AzureStorage")
+	containerURL, prefix, err := azStorage.containerURL()
+	if err != nil {
+		return nil, err
+	}
+	files, err := azStorage.findBlobs(containerURL, prefix)
+	if err != nil {
+		return nil, err
+	}
+	azStorage.logger.Debugf("Blobs found:\n%s", files)
+	latestLastModified := since
+	for _, file := range files {
+		if file.LastModified > latestLastModified {
+			latestLastModified = file.LastModified
+		}
+	}
+	if encoder.UsesFileDecoder(azStorage.config) {
+		return encoder.NewFileDecoder(azStorage.config, objectKeys(files, since), azStorage.blobOpener(containerURL), latestLastModified, azStorage.logger, false)
+	}
+	reader, writer := io.Pipe()
+	go azStorage.streamBlobs(containerURL, files, since, writer)
+	return encoder.NewEntityDecoder(azStorage.config, reader, latestLastModified, azStorage.logger, false)
+}
+
+// streamBlobs downloads all given blobs modified after since into the writer, one after the other
+func (azStorage *AzureStorage) streamBlobs(containerURL azblob.ContainerURL, files []FileObject, since string, writer *io.PipeWriter) {
+	defer func() {
+		_ = writer.Close()
+	}()
+	ctx := context.Background()
+	for _, fileObj := range files {
+		if fileObj.LastModified <= since {
+			continue
+		}
+		resp, err := containerURL.NewBlobURL(fileObj.FilePath).Download(ctx, 0, azblob.CountToEnd,
+			azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			azStorage.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+		r, err := encoder.NewDecompressingReader(body)
+		if err != nil {
+			_ = body.Close()
+			azStorage.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		readTotal, err := io.Copy(writer, r)
+		_ = r.Close()
+		_ = body.Close()
+		azStorage.logger.Infof("read %v bytes total from azure blob %v", readTotal, fileObj.FilePath)
+		if err != nil {
+			azStorage.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// blobOpener opens blobs for ranged downloads. Reads are pinned to the ETag the blob had when it was opened,
+// so a blob replaced while it is read fails the read instead of mixing two files.
+func (azStorage *AzureStorage) blobOpener(containerURL azblob.ContainerURL) encoder.StoredFileOpener {
+	return func(key string) (encoder.StoredFile, error) {
+		blobURL := containerURL.NewBlobURL(key)
+		props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &azureBlob{url: blobURL, size: props.ContentLength(), etag: props.ETag()}, nil
+	}
+}
+
+// azureBlob reads a blob with ranged downloads
+type azureBlob struct {
+	url  azblob.BlobURL
+	size int64
+	etag azblob.ETag
+}
+
+func (b *azureBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	count := int64(len(p))
+	if off+count > b.size {
+		count = b.size - off
+	}
+	resp, err := b.url.Download(context.Background(), off, count,
+		azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: b.etag}},
+		false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return 0, err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer func() {
+		_ = body.Close()
+	}()
+	n, err := io.ReadFull(body, p[:count])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *azureBlob) Size() int64 {
+	return b.size
+}
+
+func (b *azureBlob) Close() error {
+	return nil
+}
+
+// findBlobs lists all blobs below prefix, including the dated folder structure, ordered by last modified time
+func (azStorage *AzureStorage) findBlobs(containerURL azblob.ContainerURL, prefix string) ([]FileObject, error) {
+	ctx := context.Background()
+	var files []FileObject
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+		marker = resp.NextMarker
+		for _, blob := range resp.Segment.BlobItems {
+			lastModified := fmt.Sprintf("%v", blob.Properties.LastModified.UnixNano())
+			files = append(files, FileObject{
+				FilePath:     blob.Name,
+				SortKey:      fmt.Sprintf("%v-%v", lastModified, blob.Name),
+				LastModified: lastModified,
+			})
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"nothing found in folder %v of dataset %v", prefix, azStorage.dataset))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].SortKey < files[j].SortKey
+	})
+	return files, nil
+}
+
+// containerURL resolves the container of the configured root folder, and the blob name prefix of the root folder
+// within that container
+func (azStorage *AzureStorage) containerURL() (azblob.ContainerURL, string, error) {
+	credential, err := azStorage.azureBlobCredentials()
+	if err != nil {
+		return azblob.ContainerURL{}, "", err
+	}
+	u, err := azStorage.resourceURL(azStorage.rootFolder() + "/")
+	if err != nil {
+		return azblob.ContainerURL{}, "", err
+	}
+	container, prefix := splitBlobPath(*u)
+	return azblob.NewContainerURL(container, azblob.NewPipeline(credential, azblob.PipelineOptions{})), prefix, nil
+}
+
+// splitBlobPath splits a blob url into the url of its container and the blob name. Storage emulators like azurite
+// are addressed with the account name as first path element, they are recognized by ip or localhost hostnames.
+func splitBlobPath(u url.URL) (url.URL, string) {
+	path := strings.TrimPrefix(u.Path, "/")
+	account := ""
+	if net.ParseIP(u.Hostname()) != nil || u.Hostname() == "localhost" {
+		account, path, _ = strings.Cut(path, "/")
+		account = "/" + account
+	}
+	containerName, blobName, _ := strings.Cut(path, "/")
+	container := u
+	container.Path = account + "/" + containerName
+	container.RawPath = ""
+	return container, blobName
 }
 
 func NewAzureStorage(logger *zap.SugaredLogger, env *conf.Env, config conf.StorageBackend, statsd statsd.ClientInterface, dataset string) *AzureStorage {
@@ -77,7 +269,7 @@ func (azStorage *AzureStorage) StoreEntities(entities []*uda.Entity) error {
 		_ = azStorage.statsd.Timing("storage.time", timed, tags, 1)
 	}()
 
-	azUrl, err := azStorage.createURL(entities)
+	azUrl, err := azStorage.createURL(entities, false)
 	if err != nil {
 		azStorage.logger.Errorf("Unable to construct url with error: " + err.Error())
 	}
@@ -93,6 +285,11 @@ func (azStorage *AzureStorage) StoreEntities(entities []*uda.Entity) error {
 		azStorage.logger.Errorf("Unable to create stores content")
 		return err
 	}
+	content, err = encoder.Compress(azStorage.config, content)
+	if err != nil {
+		azStorage.logger.Errorf("Unable to compress content")
+		return err
+	}
 
 	err = azStorage.upload(content, azUrl, credential)
 
@@ -100,7 +297,66 @@ func (azStorage *AzureStorage) StoreEntities(entities []*uda.Entity) error {
 }
 
 func (azStorage *AzureStorage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
-	return errors.New("fullsync not supported for Azure")
+	return azStorage.fullsyncs.store(state, entities, func() (*fullSyncSession, error) {
+		azUrl, err := azStorage.createURL(entities, true)
+		if err != nil {
+			azStorage.logger.Errorf("Unable to construct url with error: " + err.Error())
+			return nil, err
+		}
+		credential, err := azStorage.azureBlobCredentials()
+		if err != nil {
+			azStorage.logger.Errorf("Invalid credentials with error: " + err.Error())
+			return nil, err
+		}
+		blobURL := azblob.NewBlockBlobURL(*azUrl, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+		// the encoded fullsync is staged as uncommitted blocks of the target blob
+		session := newFullSyncSession(state.Id, azStorage.config, azStorage.logger, func(ctx context.Context, reader *io.PipeReader) error {
+			if err := azStorage.stageBlocks(ctx, blobURL, reader); err != nil {
+				return err
+			}
+			azStorage.logger.Info("Successfully uploaded to ", blobURL.String())
+			return nil
+		})
+		session.writeTimeout = time.Minute
+		return session, nil
+	})
+}
+
+// Close abandons the ongoing fullsync
+func (azStorage *AzureStorage) Close() error {
+	azStorage.fullsyncs.close()
+	return nil
+}
+
+// stageBlocks reads the encoded fullsync stream into uncommitted blocks of the target blob. The block list is only
+// committed when the stream is closed regularly at the end of the fullsync, so abandoned syncs never become visible.
+func (azStorage *AzureStorage) stageBlocks(ctx context.Context, blobURL azblob.BlockBlobURL, reader *io.PipeReader) error {
+	var blockIds []string
+	buf := make([]byte, azureBlockSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n > 0 {
+			blockId := base64.StdEncoding.EncodeToString([]byte(uuid.New().String()))
+			_, stageErr := blobURL.StageBlock(ctx, blockId, bytes.NewReader(buf[:n]),
+				azblob.LeaseAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{})
+			if stageErr != nil {
+				_ = reader.CloseWithError(stageErr)
+				return stageErr
+			}
+			blockIds = append(blockIds, blockId)
+			azStorage.logger.Debugf("staged block %v with %v bytes", len(blockIds), n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	_, err := blobURL.CommitBlockList(ctx, blockIds, azStorage.blobHTTPHeaders(), azblob.Metadata{},
+		azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{},
+		azblob.ImmutabilityPolicyOptions{})
+	return err
 }
 
 func (azStorage *AzureStorage) azureBlobCredentials() (azblob.Credential, error) {
@@ -125,8 +381,9 @@ func (azStorage *AzureStorage) upload(content []byte, url *url.URL, credential a
 	ctx := context.Background()
 
 	_, err := azblob.UploadBufferToBlockBlob(ctx, content, blobURL, azblob.UploadToBlockBlobOptions{
-		BlockSize:   4 * 1024 * 1024,
-		Parallelism: 16})
+		BlockSize:       4 * 1024 * 1024,
+		Parallelism:     16,
+		BlobHTTPHeaders: azStorage.blobHTTPHeaders()})
 	if err != nil {
 		if serr, ok := err.(azblob.StorageError); ok { // This error is a Service-specific
 			switch serr.ServiceCode() { // Compare serviceCode to ServiceCodeXxx constants
@@ -142,45 +399,48 @@ func (azStorage *AzureStorage) upload(content []byte, url *url.URL, credential a
 	return err
 }
 
-func (azStorage *AzureStorage) createURL(entities []*uda.Entity) (*url.URL, error) {
-	config := azStorage.config.Properties
+// blobHTTPHeaders returns the headers of uploaded blobs, declaring the Content-Encoding of compressed datasets
+func (azStorage *AzureStorage) blobHTTPHeaders() azblob.BlobHTTPHeaders {
+	return azblob.BlobHTTPHeaders{ContentEncoding: encoder.ContentEncoding(azStorage.config)}
+}
 
-	var rootFolder string
+func (azStorage *AzureStorage) rootFolder() string {
+	config := azStorage.config.Properties
 	if config.RootFolder != nil && *config.RootFolder != "" {
-		rootFolder = *config.RootFolder
-	} else {
-		rootFolder = azStorage.dataset
+		return *config.RootFolder
 	}
+	return azStorage.dataset
+}
+
+// resourceURL builds the url of the given blob name below the configured endpoint and resource
+func (azStorage *AzureStorage) resourceURL(blobname string) (*url.URL, error) {
+	config := azStorage.config.Properties
+	urlString := fmt.Sprintf("%s/%s/%s", config.Endpoint, *config.ResourceName, blobname)
+	if config.AuthType != nil && *config.AuthType == "SAS" {
+		urlString = fmt.Sprintf("%s?%s", urlString, *config.Secret)
+	}
+	return url.Parse(urlString)
+}
+
+// createURL builds the url of a new blob. Batches and fullsyncs are written to the same folder, so only fullsyncs get
+// the custom file name of the format, and every batch gets a blob of its own.
+func (azStorage *AzureStorage) createURL(entities []*uda.Entity, fullSync bool) (*url.URL, error) {
+	config := azStorage.config.Properties
+	rootFolder := azStorage.rootFolder()
 
 	prefix := ""
 	if config.FilePrefix != nil && *config.FilePrefix != "" {
 		prefix = *config.FilePrefix
 	}
 
-	if entities[0].Recorded != "" {
-		prefix = prefix + entities[0].Recorded + "-"
-	}
-
-	ending := "json"
-	if azStorage.config.CsvConfig != nil {
-		ending = "csv"
-	}
-	if azStorage.config.FlatFileConfig != nil {
-		ending = "txt"
-	}
-	if azStorage.config.ParquetConfig != nil {
-		ending = "parquet"
+	filename := prefix + uniqueObjectName(azStorage.config, entities)
+	if fullSync {
+		filename = prefix + objectName(azStorage.config, entities)
 	}
-
-	filename := fmt.Sprintf("%s%s.%s", prefix, uuid.New().String(), ending)
 	blobname := fmt.Sprintf("%s/%s", rootFolder, filename)
 	if config.FolderStructure != nil && strings.ToLower(*config.FolderStructure) == "dated" {
 		year, month, day := time.Now().Date()
 		blobname = fmt.Sprintf("%s/%d/%d/%d/%s", rootFolder, year, int(month), day, filename)
 	}
-	urlString := fmt.Sprintf("%s/%s/%s", config.Endpoint, *config.ResourceName, blobname)
-	if config.AuthType != nil && *config.AuthType == "SAS" {
-		urlString = fmt.Sprintf("%s?%s", urlString, *config.Secret)
-	}
-	return url.Parse(urlString)
+	return azStorage.resourceURL(blobname)
 }
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestAzure(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("The azure backend", func() {
+		g.It("Should find container and blob prefix in account hostnames", func() {
+			u, _ := url.Parse("https://account.blob.core.windows.net/container/root/folder/")
+			container, prefix := splitBlobPath(*u)
+			g.Assert(container.String()).Eql("https://account.blob.core.windows.net/container")
+			g.Assert(prefix).Eql("root/folder/")
+		})
+		g.It("Should find container and blob prefix in emulator urls", func() {
+			u, _ := url.Parse("http://127.0.0.1:10000/devstoreaccount1/container/root/?sv=2020&sig=abc")
+			container, prefix := splitBlobPath(*u)
+			g.Assert(container.String()).Eql("http://127.0.0.1:10000/devstoreaccount1/container?sv=2020&sig=abc")
+			g.Assert(prefix).Eql("root/")
+
+			u, _ = url.Parse("http://localhost:10000/devstoreaccount1/container/")
+			container, prefix = splitBlobPath(*u)
+			g.Assert(container.String()).Eql("http://localhost:10000/devstoreaccount1/container")
+			g.Assert(prefix).Eql("")
+		})
+		g.It("Should only return blobs modified after the continuation token", func() {
+			server := newAzureServer()
+			defer server.Close()
+			azStorage := server.storage("people", conf.StorageBackend{})
+			g.Assert(azStorage.StoreEntities([]*uda.Entity{{ID: "a:1", Recorded: "1"}})).IsNil()
+			g.Assert(azStorage.StoreEntities([]*uda.Entity{{ID: "a:2", Recorded: "2"}})).IsNil()
+			g.Assert(len(server.names("people/"))).Eql(2)
+
+			changes := func(since string) []map[string]interface{} {
+				reader, err := azStorage.GetChanges(since)
+				g.Assert(err).IsNil()
+				content, _ := io.ReadAll(reader)
+				var result []map[string]interface{}
+				g.Assert(json.Unmarshal(content, &result)).IsNil(string(content))
+				return result
+			}
+			// context, entities and continuation token
+			result := changes("")
+			g.Assert(len(result)).Eql(4)
+			token := result[3]["token"].(string)
+
+			result = changes(token)
+			g.Assert(len(result)).Eql(2, "only context and continuation are returned")
+			g.Assert(result[1]["token"]).Eql(token, "token is kept when nothing changed")
+
+			g.Assert(azStorage.StoreEntities([]*uda.Entity{{ID: "a:3", Recorded: "3"}})).IsNil()
+			result = changes(token)
+			g.Assert(len(result)).Eql(3)
+			g.Assert(result[1]["id"]).Eql("a:3")
+			g.Assert(result[2]["token"] != token).IsTrue()
+
+			reader, err := azStorage.GetEntities()
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			result = nil
+			g.Assert(json.Unmarshal(content, &result)).IsNil()
+			g.Assert(len(result)).Eql(5, "context, all entities and continuation")
+		})
+		g.It("Should write every batch to a blob of its own, also with a custom file name", func() {
+			server := newAzureServer()
+			defer server.Close()
+			azStorage := server.storage("people", conf.StorageBackend{
+				CsvConfig: &conf.CsvConfig{Header: true, Order: []string{"id"}, CustomFileName: "people"}})
+			g.Assert(azStorage.StoreEntities([]*uda.Entity{{ID: "a:1"}})).IsNil()
+			g.Assert(azStorage.StoreEntities([]*uda.Entity{{ID: "a:2"}})).IsNil()
+			g.Assert(len(server.names("people/"))).Eql(2)
+
+			g.Assert(azStorage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, []*uda.Entity{{ID: "a:3"}})).IsNil()
+			g.Assert(azStorage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			g.Assert(server.blob("people/people.csv") != nil).IsTrue()
+		})
+		g.It("Should only commit the block list of fullsyncs that end", func() {
+			server := newAzureServer()
+			defer server.Close()
+			azStorage := server.storage("people", conf.StorageBackend{})
+			blobURL, err := azStorage.createURL(nil, true)
+			g.Assert(err).IsNil()
+			container, name := splitBlobPath(*blobURL)
+			g.Assert(container.Path).Eql("/devstoreaccount1/container")
+			credential, _ := azStorage.azureBlobCredentials()
+			blockBlobURL := azblob.NewBlockBlobURL(*blobURL, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+
+			reader, writer := io.Pipe()
+			go func() {
+				_, _ = writer.Write(make([]byte, azureBlockSize+10))
+				_ = writer.CloseWithError(errors.New("abandoned fullsync"))
+			}()
+			err = azStorage.stageBlocks(context.Background(), blockBlobURL, reader)
+			g.Assert(err.Error()).Eql("abandoned fullsync")
+			g.Assert(server.blockCount()).Eql(1, "the full block is staged")
+			g.Assert(server.blob(name) == nil).IsTrue("but the block list is not committed")
+
+			reader, writer = io.Pipe()
+			go func() {
+				_, _ = writer.Write([]byte(`[{"id":"@context"},{"id":"a:1"}]`))
+				_ = writer.Close()
+			}()
+			g.Assert(azStorage.stageBlocks(context.Background(), blockBlobURL, reader)).IsNil()
+			g.Assert(string(server.blob(name).data)).Eql(`[{"id":"@context"},{"id":"a:1"}]`)
+		})
+		g.It("Should not publish fullsyncs of closed storages", func() {
+			server := newAzureServer()
+			defer server.Close()
+			azStorage := server.storage("people", conf.StorageBackend{})
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}}}
+			g.Assert(azStorage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(azStorage.Close()).IsNil()
+			err := azStorage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+			g.Assert(err.Error()).Eql("fullsync is not initialized")
+			g.Assert(len(server.names(""))).Eql(0)
+
+			g.Assert(azStorage.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, entities)).IsNil()
+			g.Assert(azStorage.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+			g.Assert(len(server.names("people/"))).Eql(1)
+		})
+	})
+}
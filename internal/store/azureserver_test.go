@@ -0,0 +1,199 @@
+package store
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// azureServer is an in memory blob container, serving the emulator style requests used by the azure storage
+type azureServer struct {
+	*httptest.Server
+	mutex sync.Mutex
+	blobs map[string]*azureTestBlob
+	// blocks are the uncommitted blocks of each blob, by block id
+	blocks map[string]map[string][]byte
+	// clock is the last modified time of the latest write, every write is a second later than the one before
+	clock time.Time
+}
+
+type azureTestBlob struct {
+	data     []byte
+	modified time.Time
+}
+
+func newAzureServer() *azureServer {
+	server := &azureServer{
+		blobs:  map[string]*azureTestBlob{},
+		blocks: map[string]map[string][]byte{},
+		clock:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// storage returns an azure storage of the dataset in the container of the server
+func (s *azureServer) storage(dataset string, config conf.StorageBackend) *AzureStorage {
+	container, authType, sas := "container", "SAS", "sv=2020-10-02&sig=test"
+	config.Properties.ResourceName = &container
+	config.Properties.AuthType = &authType
+	config.Properties.Secret = &sas
+	config.Properties.Endpoint = s.URL + "/devstoreaccount1"
+	return NewAzureStorage(zap.NewNop().Sugar(), &conf.Env{Env: "test"}, config, &statsd.NoOpClient{}, dataset)
+}
+
+// put writes a blob directly into the container
+func (s *azureServer) put(name string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blobs[name] = &azureTestBlob{data: data, modified: s.tick()}
+}
+
+func (s *azureServer) blob(name string) *azureTestBlob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.blobs[name]
+}
+
+// names returns the names of the committed blobs with the prefix, in name order
+func (s *azureServer) names(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// blockCount returns the number of staged blocks that are not committed
+func (s *azureServer) blockCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, blocks := range s.blocks {
+		count += len(blocks)
+	}
+	return count
+}
+
+func (s *azureServer) tick() time.Time {
+	s.clock = s.clock.Add(time.Second)
+	return s.clock
+}
+
+func (s *azureServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// emulator style requests: /account/container/blob
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	name := ""
+	if len(parts) == 3 {
+		name = parts[2]
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && name == "" && query.Get("comp") == "list":
+		s.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s.blocks[name] == nil {
+			s.blocks[name] = map[string][]byte{}
+		}
+		s.blocks[name][query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		blockList := struct {
+			Latest []string `xml:"Latest"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, id := range blockList.Latest {
+			block, ok := s.blocks[name][id]
+			if !ok {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(s.blocks, name)
+		s.blobs[name] = &azureTestBlob{data: data, modified: s.tick()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.blobs[name] = &azureTestBlob{data: data, modified: s.tick()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		blob := s.blobs[name]
+		if blob == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob.data)))
+		w.Header().Set("Last-Modified", blob.modified.Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, blob.modified.Unix()))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(blob.data)
+		}
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (s *azureServer) list(w http.ResponseWriter, prefix string) {
+	type properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		Etag          string `xml:"Etag"`
+		ContentLength int    `xml:"Content-Length"`
+	}
+	type blob struct {
+		Name       string
+		Properties properties
+	}
+	result := struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string
+	}{}
+	var names []string
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := s.blobs[name]
+		result.Blobs = append(result.Blobs, blob{Name: name, Properties: properties{
+			LastModified:  b.modified.Format(http.TimeFormat),
+			Etag:          fmt.Sprintf(`"%d"`, b.modified.Unix()),
+			ContentLength: len(b.data),
+		}})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
@@ -49,3 +49,7 @@ func (consoleStorage *ConsoleStorage) StoreEntities(entities []*uda.Entity) erro
 func (consoleStorage *ConsoleStorage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
 	return errors.New("fullsync not supported to console")
 }
+
+func (consoleStorage *ConsoleStorage) Close() error {
+	return nil
+}
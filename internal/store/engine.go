@@ -1,84 +1,173 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"strings"
 	"sync"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
 type StorageEngine struct {
 	statsd   statsd.ClientInterface
 	logger   *zap.SugaredLogger
-	storages map[string]storageState
+	storages map[string]*storageState
 	mngr     *conf.ConfigurationManager
 	env      *conf.Env
-	lock     *sync.RWMutex
+	lock     *sync.Mutex
+	// version is the digest of the configuration the storages were checked against
+	version [16]byte
+	// pending are the storages being built outside the lock, which other requests for the dataset wait for
+	pending map[string]*pendingStorage
+	// build builds the storage of a dataset, and may do network calls
+	build func(backend conf.StorageBackend, auth conf.DatahubAuthConfig) (StorageInterface, error)
 }
 
+// storageState is the storage of a dataset, with the configuration it was built from
 type storageState struct {
-	isRunning bool
-	storage   StorageInterface
+	backend conf.StorageBackend
+	auth    conf.DatahubAuthConfig
+	storage StorageInterface
 }
 
-func NewStorageEngine(logger *zap.SugaredLogger, config *conf.ConfigurationManager, env *conf.Env, statsd statsd.ClientInterface) *StorageEngine {
-	return &StorageEngine{
+// pendingStorage is a storage being built, done is closed when the build has finished
+type pendingStorage struct {
+	done    chan struct{}
+	storage StorageInterface
+	err     error
+	// stale is set if the configuration of the dataset changed while the storage was built
+	stale bool
+}
+
+func NewStorageEngine(lc fx.Lifecycle, logger *zap.SugaredLogger, config *conf.ConfigurationManager, env *conf.Env, statsd statsd.ClientInterface) *StorageEngine {
+	engine := &StorageEngine{
 		statsd:   statsd,
 		mngr:     config,
 		logger:   logger.Named("storage"),
 		env:      env,
-		storages: make(map[string]storageState),
-		lock:     &sync.RWMutex{},
+		storages: make(map[string]*storageState),
+		lock:     &sync.Mutex{},
+		pending:  make(map[string]*pendingStorage),
 	}
+	engine.build = engine.initBackend
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			engine.Close()
+			return nil
+		},
+	})
+	return engine
 }
 
 // Storage returns a configured storage from the configured storages, or it returns an error
-// if not found
+// if not found. Storages are built once, and only rebuilt when the configuration of their dataset changes.
+// Storages are built outside the lock, so a slow backend does not hold up requests to other datasets.
 func (engine *StorageEngine) Storage(datasetName string) (StorageInterface, error) {
-	if _, ok := engine.mngr.Datalayer.StorageMapping[datasetName]; !ok {
-		return nil, errors.New("dataset not found")
-	}
+	for {
+		engine.lock.Lock()
+		datalayer := engine.mngr.Datalayer
+		if engine.version != engine.mngr.State.Digest {
+			engine.version = engine.mngr.State.Digest
+			engine.retire(datalayer)
+		}
 
-	var state storageState
-	engine.lock.Lock()
-	defer engine.lock.Unlock()
-	if s, ok := engine.storages[datasetName]; ok {
-		storage, err := engine.initBackend(engine.mngr.Datalayer.StorageMapping[datasetName], engine.mngr.Datalayer.DatahubAuthConfig)
-		engine.logger.Debug(storage)
-		if err != nil {
-			return nil, err
+		backend, ok := datalayer.StorageMapping[datasetName]
+		if !ok {
+			engine.lock.Unlock()
+			return nil, errors.New("dataset not found")
 		}
-		engine.storages[datasetName] = s
-		state = s
+		if s, ok := engine.storages[datasetName]; ok {
+			engine.lock.Unlock()
+			return s.storage, nil
+		}
+		if p, ok := engine.pending[datasetName]; ok {
+			engine.lock.Unlock()
+			<-p.done
+			if p.stale {
+				continue
+			}
+			return p.storage, p.err
+		}
+		p := &pendingStorage{done: make(chan struct{})}
+		engine.pending[datasetName] = p
+		engine.lock.Unlock()
+
+		storage, err := engine.build(backend, datalayer.DatahubAuthConfig)
 
-	} else {
-		storage, err := engine.initBackend(engine.mngr.Datalayer.StorageMapping[datasetName], engine.mngr.Datalayer.DatahubAuthConfig)
-		if err != nil {
-			return nil, err
+		engine.lock.Lock()
+		delete(engine.pending, datasetName)
+		p.storage, p.err = storage, err
+		if err == nil {
+			state := &storageState{backend: backend, auth: datalayer.DatahubAuthConfig, storage: storage}
+			if current(engine.mngr.Datalayer, datasetName, state) {
+				engine.storages[datasetName] = state
+			} else {
+				engine.closeStorage(datasetName, state)
+				p.stale = true
+			}
 		}
-		s := storageState{
-			isRunning: true,
-			storage:   storage,
+		close(p.done)
+		engine.lock.Unlock()
+		if !p.stale {
+			return storage, err
+		}
+	}
+}
+
+// current tells if a storage is built from the configuration of its dataset in the given configuration
+func current(datalayer *conf.StorageConfig, name string, s *storageState) bool {
+	backend, ok := datalayer.StorageMapping[name]
+	return ok && reflect.DeepEqual(backend, s.backend) && reflect.DeepEqual(datalayer.DatahubAuthConfig, s.auth)
+}
+
+// retire closes the storages of datasets that are removed or changed in a new configuration
+func (engine *StorageEngine) retire(datalayer *conf.StorageConfig) {
+	for name, s := range engine.storages {
+		if current(datalayer, name, s) {
+			continue
 		}
-		engine.storages[datasetName] = s
-		state = s
+		engine.logger.Infof("Dataset %s is changed or removed, closing its storage", name)
+		engine.closeStorage(name, s)
+		delete(engine.storages, name)
 	}
-	return state.storage, nil
 }
 
-// Close handles cleanup of storage engines, if needed
-func (engine *StorageEngine) Close(datasetName string) {
+// Close closes all storages, abandoning their ongoing fullsyncs
+func (engine *StorageEngine) Close() {
 	engine.lock.Lock()
 	defer engine.lock.Unlock()
-	if s, ok := engine.storages[datasetName]; ok {
-		s.isRunning = false
+	for name, s := range engine.storages {
+		engine.closeStorage(name, s)
+	}
+	engine.storages = make(map[string]*storageState)
+}
+
+func (engine *StorageEngine) closeStorage(name string, s *storageState) {
+	if err := s.storage.Close(); err != nil {
+		engine.logger.Warnf("Failed to close storage of dataset %s: %v", name, err)
 	}
 }
 
 func (engine *StorageEngine) initBackend(backend conf.StorageBackend, datahubAuthConfig conf.DatahubAuthConfig) (StorageInterface, error) {
+	if err := encoder.ValidateCompression(backend); err != nil {
+		return nil, err
+	}
+	if err := encoder.ValidatePartitioning(backend); err != nil {
+		return nil, err
+	}
+	if encoder.HasEntityPartitions(backend) && !strings.EqualFold(backend.StorageType, "s3") {
+		return nil, fmt.Errorf("dataset %s: only s3 datasets can be partitioned by entity properties", backend.Dataset)
+	}
+	if backend.FullSync != nil && backend.FullSync.Persistent && !encoder.SupportsSegments(backend) {
+		return nil, fmt.Errorf("dataset %s: fullSync.persistent is not supported for the file format of the dataset", backend.Dataset)
+	}
 	switch strings.ToLower(backend.StorageType) {
 	case "azure":
 		return NewAzureStorage(engine.logger, engine.env, backend, engine.statsd, backend.Dataset), nil
@@ -86,9 +175,15 @@ func (engine *StorageEngine) initBackend(backend conf.StorageBackend, datahubAut
 		return NewS3Storage(engine.logger, engine.env, backend, engine.statsd, backend.Dataset, datahubAuthConfig)
 	case "localstorage":
 		return NewLocalStorage(engine.logger, engine.env, engine.statsd, backend, backend.Dataset), nil
+	case "gcs":
+		return NewGCSStorage(engine.logger, engine.env, backend, engine.statsd, backend.Dataset)
+	case "sftp":
+		return NewSftpStorage(engine.logger, engine.env, backend, engine.statsd, backend.Dataset)
 	default:
 		return &ConsoleStorage{
 			Logger: engine.logger.Named("console-store"),
+			env:    engine.env,
+			config: backend,
 		}, nil
 	}
 }
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/franela/goblin"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestStorageEngine(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("The storage engine", func() {
+		var manager *conf.ConfigurationManager
+		var engine *StorageEngine
+		configure := func(digest byte, backends ...conf.StorageBackend) {
+			mapping := map[string]conf.StorageBackend{}
+			for _, backend := range backends {
+				mapping[backend.Dataset] = backend
+			}
+			manager.Datalayer = &conf.StorageConfig{StorageMapping: mapping}
+			manager.State = conf.State{Digest: [16]byte{digest}}
+		}
+		g.BeforeEach(func() {
+			manager = &conf.ConfigurationManager{}
+			engine = NewStorageEngine(fxtest.NewLifecycle(t), zap.NewNop().Sugar(), manager, &conf.Env{}, nil)
+		})
+
+		g.It("Should build storages once per configuration of their dataset", func() {
+			configure(1, conf.StorageBackend{Dataset: "a"}, conf.StorageBackend{Dataset: "b"})
+			a, err := engine.Storage("a")
+			g.Assert(err).IsNil()
+			b, _ := engine.Storage("b")
+			again, _ := engine.Storage("a")
+			g.Assert(again == a).IsTrue("storage is reused")
+
+			configure(2, conf.StorageBackend{Dataset: "a"}, conf.StorageBackend{Dataset: "b", StripProps: true})
+			again, _ = engine.Storage("a")
+			g.Assert(again == a).IsTrue("unchanged dataset keeps its storage")
+			again, _ = engine.Storage("b")
+			g.Assert(again == b).IsFalse("changed dataset gets a new storage")
+			g.Assert(again.GetConfig().StripProps).IsTrue()
+		})
+
+		g.It("Should close storages of removed datasets", func() {
+			configure(1, conf.StorageBackend{Dataset: "a"})
+			_, err := engine.Storage("a")
+			g.Assert(err).IsNil()
+			configure(2)
+			_, err = engine.Storage("a")
+			g.Assert(err.Error()).Eql("dataset not found")
+			g.Assert(len(engine.storages)).Eql(0)
+		})
+
+		g.It("Should only partition s3 datasets by entity properties", func() {
+			partitioned := func(dataset string, partitioning ...string) conf.StorageBackend {
+				return conf.StorageBackend{Dataset: dataset, StorageType: "localstorage",
+					ParquetConfig: &conf.ParquetConfig{Partitioning: partitioning}}
+			}
+			configure(1, partitioned("a", "year", "country"), partitioned("b", "year", "hour"))
+			_, err := engine.Storage("a")
+			g.Assert(err.Error()).Eql("dataset a: only s3 datasets can be partitioned by entity properties")
+			_, err = engine.Storage("b")
+			g.Assert(err).IsNil()
+		})
+
+		g.It("Should only keep fullsyncs of file formats written in segments", func() {
+			persistent := &conf.FullSyncConfig{Persistent: true}
+			configure(1, conf.StorageBackend{Dataset: "a", FullSync: persistent, AvroConfig: &conf.AvroConfig{}},
+				conf.StorageBackend{Dataset: "b", FullSync: persistent})
+			_, err := engine.Storage("a")
+			g.Assert(err.Error()).Eql("dataset a: fullSync.persistent is not supported for the file format of the dataset")
+			_, err = engine.Storage("b")
+			g.Assert(err).IsNil()
+		})
+
+		g.It("Should build storages of a dataset once, without holding up other datasets", func() {
+			configure(1, conf.StorageBackend{Dataset: "a"}, conf.StorageBackend{Dataset: "b"})
+			build := engine.build
+			started, release := make(chan struct{}), make(chan struct{})
+			builds := 0
+			engine.build = func(backend conf.StorageBackend, auth conf.DatahubAuthConfig) (StorageInterface, error) {
+				if backend.Dataset == "a" {
+					builds++
+					close(started)
+					<-release
+				}
+				return build(backend, auth)
+			}
+			storages := make([]StorageInterface, 2)
+			wg := sync.WaitGroup{}
+			for i := range storages {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					storages[i], _ = engine.Storage("a")
+				}(i)
+				if i == 0 {
+					<-started
+				}
+			}
+			_, err := engine.Storage("b")
+			g.Assert(err).IsNil("b is built while a is pending")
+			close(release)
+			wg.Wait()
+			g.Assert(builds).Eql(1)
+			g.Assert(storages[0] != nil && storages[0] == storages[1]).IsTrue("waiting requests get the same storage")
+		})
+
+		g.It("Should rebuild storages of datasets changed while they were built", func() {
+			configure(1, conf.StorageBackend{Dataset: "a"})
+			build := engine.build
+			engine.build = func(backend conf.StorageBackend, auth conf.DatahubAuthConfig) (StorageInterface, error) {
+				if !backend.StripProps {
+					configure(2, conf.StorageBackend{Dataset: "a", StripProps: true})
+				}
+				return build(backend, auth)
+			}
+			storage, err := engine.Storage("a")
+			g.Assert(err).IsNil()
+			g.Assert(storage.GetConfig().StripProps).IsTrue()
+			again, _ := engine.Storage("a")
+			g.Assert(again == storage).IsTrue()
+		})
+	})
+}
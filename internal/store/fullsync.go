@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+var fullsyncTimeoutDuration = 30 * time.Minute
+
+// ErrFullSyncNotInitialized and ErrInvalidFullSyncId are returned for batches of fullsyncs that are not ongoing
+var (
+	ErrFullSyncNotInitialized = errors.New("fullsync is not initialized")
+	ErrInvalidFullSyncId      = errors.New("Invalid fullsync ID")
+)
+
+// fullSyncSession is an ongoing fullsync. Batches are written through an encoder into a pipe, and the other end of
+// the pipe is uploaded by the backend in the background.
+type fullSyncSession struct {
+	id     string
+	writer encoder.EncodingEntityWriter
+	cancel context.CancelFunc
+	done   chan error
+	logger *zap.SugaredLogger
+	// writeTimeout bounds how long a batch waits for the upload to read it, without timeout if zero
+	writeTimeout time.Duration
+	// publish is called when the upload is done, with the number of entities in the fullsync
+	publish func(entities int) error
+	// mutex serializes the batches of the session
+	mutex    sync.Mutex
+	timeout  *time.Timer
+	entities int
+}
+
+// newFullSyncSession starts a fullsync encoding batches for the upload. The upload reads the pipe until it is closed
+// at the end of the fullsync, and is cancelled by the context if the fullsync is abandoned.
+func newFullSyncSession(id string, config conf.StorageBackend, logger *zap.SugaredLogger,
+	upload func(ctx context.Context, reader *io.PipeReader) error) *fullSyncSession {
+	reader, pipeWriter := io.Pipe()
+	writer := encoder.NewEntityEncoder(config, encoder.NewCompressingPipe(config, pipeWriter), logger)
+	return startFullSyncSession(id, writer, logger, func(ctx context.Context) error {
+		err := upload(ctx, reader)
+		if err != nil {
+			logger.Error("Failed to upload ", err)
+			_ = reader.CloseWithError(err)
+		}
+		return err
+	})
+}
+
+// startFullSyncSession starts a fullsync writing batches to writer, while run uploads what is written in the
+// background until the writer is closed
+func startFullSyncSession(id string, writer encoder.EncodingEntityWriter, logger *zap.SugaredLogger,
+	run func(ctx context.Context) error) *fullSyncSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &fullSyncSession{
+		id:     id,
+		writer: writer,
+		cancel: cancel,
+		done:   make(chan error, 1),
+		logger: logger,
+	}
+	go func() {
+		session.done <- run(ctx)
+	}()
+	return session
+}
+
+func (session *fullSyncSession) write(entities []*uda.Entity) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if len(entities) > 0 {
+		if session.writeTimeout > 0 {
+			// the write will block and hang indefinitely if the upload does not read in the other end for some reason
+			writeCtx, writecancel := context.WithTimeout(context.Background(), session.writeTimeout)
+			defer writecancel()
+			go func() {
+				<-writeCtx.Done()
+				if writeCtx.Err() == context.DeadlineExceeded {
+					session.logger.Errorf("Upload timed out, could not write into uploader within %v.", session.writeTimeout)
+					session.abandon(writeCtx.Err().Error())
+				}
+			}()
+		}
+		written, err := session.writer.Write(entities)
+		if err != nil {
+			return err
+		}
+		session.entities += len(entities)
+		session.logger.Debugf("piped %v entities into uploader. bytes written: %v", len(entities), written)
+	}
+	// refresh between-request timeout
+	session.timeout.Reset(fullsyncTimeoutDuration)
+	return nil
+}
+
+// end closes the encoder, waits for the upload and publishes the fullsync
+func (session *fullSyncSession) end() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	defer session.cancel()
+	session.timeout.Stop()
+	if err := session.writer.Close(); err != nil {
+		return err
+	}
+	session.logger.Debug("waiting for uploader")
+	if err := <-session.done; err != nil {
+		return err
+	}
+	session.logger.Debug("wait done")
+	if session.publish != nil {
+		return session.publish(session.entities)
+	}
+	return nil
+}
+
+// abandon stops a fullsync that is never published
+func (session *fullSyncSession) abandon(reason string) {
+	session.cancel()
+	_ = session.writer.CloseWithError(errors.New(reason))
+}
+
+// fullSyncSessions are the ongoing fullsyncs of a dataset. A new fullsync replaces the unfinished one, which is
+// abandoned.
+type fullSyncSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*fullSyncSession
+}
+
+// store writes a batch of a fullsync to its session, which is created by start if the batch starts the fullsync
+func (sessions *fullSyncSessions) store(state FullSyncState, entities []*uda.Entity, start func() (*fullSyncSession, error)) error {
+	if state.Start {
+		session, err := start()
+		if err != nil {
+			return err
+		}
+		sessions.add(session)
+	}
+	session, err := sessions.get(state.Id)
+	if err != nil {
+		return err
+	}
+	if err := session.write(entities); err != nil {
+		return err
+	}
+	if state.End {
+		sessions.remove(session)
+		return session.end()
+	}
+	return nil
+}
+
+func (sessions *fullSyncSessions) add(session *fullSyncSession) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	for _, previous := range sessions.sessions {
+		session.logger.Warnf("fullsync id %v is replaced by new fullsync id %v. abandoning.", previous.id, session.id)
+		previous.timeout.Stop()
+		previous.abandon("replaced fullsync")
+	}
+	sessions.sessions = map[string]*fullSyncSession{session.id: session}
+	session.timeout = time.AfterFunc(fullsyncTimeoutDuration, func() {
+		session.logger.Warnf("fullsync id %v has not received new data in %v. abandoning.", session.id, fullsyncTimeoutDuration)
+		sessions.remove(session)
+		session.abandon("abandoned fullsync")
+	})
+}
+
+func (sessions *fullSyncSessions) get(id string) (*fullSyncSession, error) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if session, ok := sessions.sessions[id]; ok {
+		return session, nil
+	}
+	for _, ongoing := range sessions.sessions {
+		ongoing.logger.Warnf("Invalid fullsync id. requester sent id %v, ongoing sync has id %v", id, ongoing.id)
+		return nil, ErrInvalidFullSyncId
+	}
+	return nil, ErrFullSyncNotInitialized
+}
+
+func (sessions *fullSyncSessions) remove(session *fullSyncSession) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if sessions.sessions[session.id] == session {
+		delete(sessions.sessions, session.id)
+	}
+}
+
+// close abandons all ongoing fullsyncs
+func (sessions *fullSyncSessions) close() {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	for _, session := range sessions.sessions {
+		session.timeout.Stop()
+		session.abandon("storage closed")
+	}
+	sessions.sessions = nil
+}
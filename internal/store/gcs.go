@@ -0,0 +1,356 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/mimiro-io/datahub-client-sdk-go"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+type GCSStorage struct {
+	logger    *zap.SugaredLogger
+	env       *conf.Env
+	config    conf.StorageBackend
+	dataset   string
+	statsd    statsd.ClientInterface
+	client    *storage.Client
+	bucket    *storage.BucketHandle
+	fullsyncs fullSyncSessions
+}
+
+func NewGCSStorage(logger *zap.SugaredLogger, env *conf.Env, config conf.StorageBackend, statsd statsd.ClientInterface, dataset string) (*GCSStorage, error) {
+	if config.Properties.Bucket == nil || *config.Properties.Bucket == "" {
+		return nil, errors.New("no bucket configured for gcs dataset " + dataset)
+	}
+	client, err := storage.NewClient(context.Background(), gcsClientOptions(config.Properties)...)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStorage{
+		logger:  logger.Named("gcs-store").With("dataset", dataset),
+		env:     env,
+		config:  config,
+		dataset: dataset,
+		statsd:  statsd,
+		client:  client,
+		bucket:  client.Bucket(*config.Properties.Bucket),
+	}, nil
+}
+
+// gcsClientOptions configures the gcs client. A custom endpoint, like a fake-gcs-server, is used without
+// authentication. Otherwise a service account key is taken from the secret, falling back to the default
+// application credentials of the environment.
+func gcsClientOptions(properties conf.PropertiesMapping) []option.ClientOption {
+	var opts []option.ClientOption
+	if properties.Endpoint != "" {
+		endpoint := strings.TrimSuffix(properties.Endpoint, "/")
+		if !strings.HasSuffix(endpoint, "/storage/v1") {
+			endpoint = endpoint + "/storage/v1"
+		}
+		return append(opts, option.WithEndpoint(endpoint+"/"), option.WithoutAuthentication())
+	}
+	if properties.Secret != nil && *properties.Secret != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(*properties.Secret)))
+	}
+	return opts
+}
+
+func (gcs *GCSStorage) GetConfig() conf.StorageBackend {
+	return gcs.config
+}
+
+func (gcs *GCSStorage) DeliverOnceClientInit() (datahub.Client, error) {
+	return datahub.Client{}, errors.New("DeliverOnceClientInit not supported for GCSStorage")
+}
+
+func (gcs *GCSStorage) DeliverOnceVariableCheck() error {
+	return errors.New("DeliverOnceVariableCheck not supported for GCSStorage")
+}
+
+func (gcs *GCSStorage) DeliverOnce(entities []*uda.Entity, client datahub.Client) error {
+	return errors.New("DeliverOnce not supported for GCSStorage")
+}
+
+func (gcs *GCSStorage) StoreEntities(entities []*uda.Entity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+	content, err := GenerateContent(entities, gcs.config, gcs.logger)
+	if err != nil {
+		gcs.logger.Error("Unable to create store content")
+		return err
+	}
+	if len(gcs.config.OrderBy) > 0 {
+		content, err = OrderContent(content, gcs.config, gcs.logger)
+		if err != nil {
+			gcs.logger.Error("Unable to order content")
+			return err
+		}
+	}
+	content, err = encoder.Compress(gcs.config, content)
+	if err != nil {
+		gcs.logger.Error("Unable to compress content")
+		return err
+	}
+	gcs.logger.Debugf("Encoded %d entities into %v bytes", len(entities), len(content))
+
+	ctx := context.Background()
+	if err := gcs.createBucketIfNotExist(ctx); err != nil {
+		return err
+	}
+	key := gcs.createKey(entities, false)
+	w := gcs.objectWriter(ctx, key)
+	// small batches are sent in a single request
+	w.ChunkSize = 0
+	if _, err := io.Copy(w, bytes.NewReader(content)); err != nil {
+		_ = w.Close()
+		gcs.logger.Error("Failed to upload ", err)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		gcs.logger.Error("Failed to upload ", err)
+		return err
+	}
+	gcs.logger.Info("Successfully uploaded to ", key)
+	return nil
+}
+
+func (gcs *GCSStorage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
+	return gcs.fullsyncs.store(state, entities, func() (*fullSyncSession, error) {
+		var key string
+		if gcs.config.Properties.ResourceName == nil {
+			key = gcs.createKey(entities, true)
+		} else {
+			key = fmt.Sprintf("datasets/%s/latest/%s", gcs.dataset, *gcs.config.Properties.ResourceName)
+		}
+		if err := gcs.createBucketIfNotExist(context.Background()); err != nil {
+			return nil, err
+		}
+		// the encoded fullsync is sent as a resumable upload, which is only finalized when the pipe is closed
+		session := newFullSyncSession(state.Id, gcs.config, gcs.logger, func(ctx context.Context, reader *io.PipeReader) error {
+			if err := gcs.upload(ctx, key, reader); err != nil {
+				return err
+			}
+			gcs.logger.Info("Successfully uploaded to ", key)
+			return nil
+		})
+		session.writeTimeout = time.Minute
+		return session, nil
+	})
+}
+
+// Close abandons the ongoing fullsync and releases the connections of the client
+func (gcs *GCSStorage) Close() error {
+	gcs.fullsyncs.close()
+	return gcs.client.Close()
+}
+
+// upload streams the reader into the object at key. The object is only created when the reader is closed
+// regularly; if the context is cancelled first, the resumable upload is discarded.
+func (gcs *GCSStorage) upload(ctx context.Context, key string, reader *io.PipeReader) error {
+	w := gcs.objectWriter(ctx, key)
+	if _, err := io.Copy(w, reader); err != nil {
+		_ = reader.CloseWithError(err)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = reader.CloseWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (gcs *GCSStorage) objectWriter(ctx context.Context, key string) *storage.Writer {
+	w := gcs.bucket.Object(key).NewWriter(ctx)
+	if gcs.config.FlatFileConfig != nil {
+		w.ContentType = "text/plain; charset=utf-8"
+	}
+	return w
+}
+
+func (gcs *GCSStorage) GetEntities() (io.Reader, error) {
+	var files []FileObject
+	if gcs.config.Properties.ResourceName != nil {
+		files = []FileObject{{FilePath: fmt.Sprintf("datasets/%s/latest/%s", gcs.dataset, *gcs.config.Properties.ResourceName)}}
+	} else {
+		found, err := gcs.findObjects("entities")
+		if err != nil {
+			return nil, err
+		}
+		// every fullsync is stored as a new object, the latest one holds the current dataset
+		files = found[len(found)-1:]
+	}
+	if encoder.UsesFileDecoder(gcs.config) {
+		return encoder.NewFileDecoder(gcs.config, objectKeys(files, ""), gcs.openStoredFile, "", gcs.logger, true)
+	}
+	reader, writer := io.Pipe()
+	go gcs.streamObjects(files, "", writer)
+	return encoder.NewEntityDecoder(gcs.config, reader, "", gcs.logger, true)
+}
+
+func (gcs *GCSStorage) GetChanges(since string) (io.Reader, error) {
+	files, err := gcs.findObjects("changes")
+	if err != nil {
+		return nil, err
+	}
+	gcs.logger.Debugf("Files found:\n%s", files)
+	latestLastModified := since
+	for _, file := range files {
+		if file.LastModified > latestLastModified {
+			latestLastModified = file.LastModified
+		}
+	}
+	if encoder.UsesFileDecoder(gcs.config) {
+		return encoder.NewFileDecoder(gcs.config, objectKeys(files, since), gcs.openStoredFile, latestLastModified, gcs.logger, false)
+	}
+	reader, writer := io.Pipe()
+	go gcs.streamObjects(files, since, writer)
+	return encoder.NewEntityDecoder(gcs.config, reader, latestLastModified, gcs.logger, false)
+}
+
+// streamObjects downloads all given objects modified after since into the writer, one after the other
+func (gcs *GCSStorage) streamObjects(files []FileObject, since string, writer *io.PipeWriter) {
+	defer func() {
+		_ = writer.Close()
+	}()
+	ctx := context.Background()
+	for _, fileObj := range files {
+		if fileObj.LastModified <= since && since != "" {
+			continue
+		}
+		r, err := gcs.bucket.Object(fileObj.FilePath).NewReader(ctx)
+		if err != nil {
+			gcs.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		dr, err := encoder.NewDecompressingReader(r)
+		if err != nil {
+			_ = r.Close()
+			gcs.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		readTotal, err := io.Copy(writer, dr)
+		_ = dr.Close()
+		_ = r.Close()
+		gcs.logger.Infof("read %v bytes total from gcs object %v", readTotal, fileObj.FilePath)
+		if err != nil {
+			gcs.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// openStoredFile opens an object for ranged reads of the generation it had when it was opened
+func (gcs *GCSStorage) openStoredFile(key string) (encoder.StoredFile, error) {
+	attrs, err := gcs.bucket.Object(key).Attrs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObject{object: gcs.bucket.Object(key).Generation(attrs.Generation), size: attrs.Size}, nil
+}
+
+// gcsObject reads a gcs object with range readers
+type gcsObject struct {
+	object *storage.ObjectHandle
+	size   int64
+}
+
+func (o *gcsObject) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	r, err := o.object.NewRangeReader(context.Background(), off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *gcsObject) Size() int64 {
+	return o.size
+}
+
+func (o *gcsObject) Close() error {
+	return nil
+}
+
+// findObjects lists all objects in the given folder of the dataset, ordered by last modified time
+func (gcs *GCSStorage) findObjects(folder string) ([]FileObject, error) {
+	prefix := "datasets/" + gcs.dataset + "/" + folder + "/"
+	it := gcs.bucket.Objects(context.Background(), &storage.Query{Prefix: prefix})
+	var files []FileObject
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lastModified := strconv.FormatInt(attrs.Updated.UnixNano(), 10)
+		files = append(files, FileObject{
+			FilePath:     attrs.Name,
+			SortKey:      fmt.Sprintf("%v-%v", lastModified, attrs.Name),
+			LastModified: lastModified,
+		})
+	}
+	if len(files) == 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"nothing found in folder %v of dataset %v", folder, gcs.dataset))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].SortKey < files[j].SortKey
+	})
+	return files, nil
+}
+
+// createBucketIfNotExist creates the configured bucket when running locally, typically against a fake-gcs-server
+func (gcs *GCSStorage) createBucketIfNotExist(ctx context.Context) error {
+	if gcs.env.Env != "local" {
+		return nil
+	}
+	_, err := gcs.bucket.Attrs(ctx)
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return gcs.bucket.Create(ctx, "local", nil)
+	}
+	return err
+}
+
+func (gcs *GCSStorage) createKey(entities []*uda.Entity, fullSync bool) string {
+	t := "changes"
+	if fullSync {
+		t = "entities"
+	}
+
+	if partition := writePartition(gcs.config, fullSync); partition != "" {
+		t = t + "/" + partition
+	}
+
+	return fmt.Sprintf("datasets/%s/%s/%s", gcs.dataset, t, objectName(gcs.config, entities))
+}
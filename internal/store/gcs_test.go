@@ -0,0 +1,109 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestGCS(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("The gcs backend", func() {
+		g.It("Should use the dataset key layout", func() {
+			gcs := GCSStorage{dataset: "people", config: conf.StorageBackend{CsvConfig: &conf.CsvConfig{}}}
+			entities := []*uda.Entity{{ID: "a:1", Recorded: "1234"}}
+
+			key := gcs.createKey(entities, false)
+			g.Assert(strings.HasPrefix(key, "datasets/people/changes/1234-")).IsTrue(key)
+			g.Assert(strings.HasSuffix(key, ".csv")).IsTrue(key)
+
+			key = gcs.createKey(nil, true)
+			g.Assert(strings.HasPrefix(key, "datasets/people/entities/")).IsTrue(key)
+		})
+		g.It("Should partition by the time of writing", func() {
+			gcs := GCSStorage{dataset: "people", config: conf.StorageBackend{
+				ParquetConfig: &conf.ParquetConfig{Partitioning: []string{"year", "written_month=month", "hour"}}}}
+			now := time.Now()
+			key := gcs.createKey(nil, false)
+			g.Assert(strings.HasPrefix(key, fmt.Sprintf("datasets/people/changes/year=%d/written_month=%d/hour=",
+				now.Year(), now.Month()))).IsTrue(key)
+			key = gcs.createKey(nil, true)
+			g.Assert(strings.Count(key, "/")).Eql(3, key)
+		})
+		g.It("Should not authenticate against custom endpoints", func() {
+			opts := gcsClientOptions(conf.PropertiesMapping{Endpoint: "http://localhost:4443"})
+			g.Assert(len(opts)).Eql(2)
+			opts = gcsClientOptions(conf.PropertiesMapping{})
+			g.Assert(len(opts)).Eql(0)
+		})
+		g.It("Should only return objects updated after the continuation token", func() {
+			server := newGCSServer()
+			defer server.Close()
+			gcs := server.storage("people", conf.StorageBackend{})
+			g.Assert(gcs.StoreEntities([]*uda.Entity{{ID: "a:1", Recorded: "1"}})).IsNil()
+			g.Assert(gcs.StoreEntities([]*uda.Entity{{ID: "a:2", Recorded: "2"}})).IsNil()
+			g.Assert(len(server.names("datasets/people/changes/"))).Eql(2)
+
+			changes := func(since string) []map[string]interface{} {
+				reader, err := gcs.GetChanges(since)
+				g.Assert(err).IsNil()
+				content, _ := io.ReadAll(reader)
+				var result []map[string]interface{}
+				g.Assert(json.Unmarshal(content, &result)).IsNil(string(content))
+				return result
+			}
+			// context, entities and continuation token
+			result := changes("")
+			g.Assert(len(result)).Eql(4)
+			token := result[3]["token"].(string)
+
+			result = changes(token)
+			g.Assert(len(result)).Eql(2, "only context and continuation are returned")
+			g.Assert(result[1]["token"]).Eql(token, "token is kept when nothing changed")
+
+			g.Assert(gcs.StoreEntities([]*uda.Entity{{ID: "a:3", Recorded: "3"}})).IsNil()
+			result = changes(token)
+			g.Assert(len(result)).Eql(3)
+			g.Assert(result[1]["id"]).Eql("a:3")
+			g.Assert(result[2]["token"] != token).IsTrue()
+		})
+		g.It("Should read the latest fullsync, and not publish fullsyncs of closed storages", func() {
+			server := newGCSServer()
+			defer server.Close()
+			gcs := server.storage("people", conf.StorageBackend{})
+			entities := func(ids ...string) []*uda.Entity {
+				var result []*uda.Entity
+				for _, id := range ids {
+					result = append(result, &uda.Entity{ID: id, Properties: map[string]interface{}{"a:key": "value"}})
+				}
+				return result
+			}
+			g.Assert(gcs.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities("a:1"))).IsNil()
+			g.Assert(gcs.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, entities("a:2"))).IsNil()
+			g.Assert(len(server.names("datasets/people/entities/"))).Eql(1)
+
+			g.Assert(gcs.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, entities("a:3"))).IsNil()
+			g.Assert(gcs.Close()).IsNil()
+			err := gcs.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)
+			g.Assert(err.Error()).Eql("fullsync is not initialized")
+			g.Assert(len(server.names("datasets/people/entities/"))).Eql(1)
+
+			// closed storages are not used again, the storage of a new configuration reads the dataset
+			reader, err := server.storage("people", conf.StorageBackend{}).GetEntities()
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var result []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &result)).IsNil(string(content))
+			g.Assert(result[1]["id"]).Eql("a:1")
+			g.Assert(result[2]["id"]).Eql("a:2")
+		})
+	})
+}
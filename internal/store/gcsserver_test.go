@@ -0,0 +1,154 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// gcsServer is an in memory gcs bucket, serving the json api listings and uploads, and the xml api reads used by the
+// gcs storage
+type gcsServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	objects map[string]*gcsTestObject
+	// clock is the update time of the latest write, every write is a second later than the one before
+	clock time.Time
+}
+
+type gcsTestObject struct {
+	data       []byte
+	updated    time.Time
+	generation int64
+}
+
+func newGCSServer() *gcsServer {
+	server := &gcsServer{objects: map[string]*gcsTestObject{}, clock: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// storage returns a gcs storage of the dataset in the bucket of the server
+func (s *gcsServer) storage(dataset string, config conf.StorageBackend) *GCSStorage {
+	bucket := "bucket"
+	config.Properties.Bucket = &bucket
+	config.Properties.Endpoint = s.URL
+	gcs, err := NewGCSStorage(zap.NewNop().Sugar(), &conf.Env{Env: "test"}, config, nil, dataset)
+	if err != nil {
+		panic(err)
+	}
+	return gcs
+}
+
+// names returns the names of the objects with the prefix, in name order
+func (s *gcsServer) names(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *gcsServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/bucket/o"):
+		s.upload(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket/o":
+		s.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		if s.objects[name] == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(s.resource(name))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/bucket/"):
+		object := s.objects[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if object == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("X-Goog-Generation", fmt.Sprint(object.generation))
+		_, _ = w.Write(object.data)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// upload stores the media of a multipart upload, whose first part is the object resource
+func (s *gcsServer) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		http.Error(w, "unsupported upload", http.StatusNotImplemented)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	resource := struct {
+		Name string `json:"name"`
+	}{}
+	part, err := parts.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&resource)
+	}
+	if err == nil {
+		part, err = parts.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(part)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.clock = s.clock.Add(time.Second)
+	s.objects[resource.Name] = &gcsTestObject{data: data, updated: s.clock, generation: s.clock.UnixNano()}
+	_ = json.NewEncoder(w).Encode(s.resource(resource.Name))
+}
+
+func (s *gcsServer) list(w http.ResponseWriter, prefix string) {
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := []map[string]string{}
+	for _, name := range names {
+		items = append(items, s.resource(name))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (s *gcsServer) resource(name string) map[string]string {
+	object := s.objects[name]
+	return map[string]string{
+		"kind":       "storage#object",
+		"bucket":     "bucket",
+		"name":       name,
+		"size":       fmt.Sprint(len(object.data)),
+		"updated":    object.updated.Format(time.RFC3339Nano),
+		"generation": fmt.Sprint(object.generation),
+	}
+}
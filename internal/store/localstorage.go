@@ -7,13 +7,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
-	"github.com/google/uuid"
 	"github.com/mimiro-io/datahub-client-sdk-go"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	_ "github.com/spf13/cast"
@@ -25,17 +22,12 @@ import (
 )
 
 type LocalStorage struct {
-	logger         *zap.SugaredLogger
-	env            *conf.Env
-	config         conf.StorageBackend
-	dataset        string
-	statsd         statsd.ClientInterface
-	writer         encoder.EncodingEntityWriter
-	reader         *io.PipeReader
-	fullsyncId     string
-	waitGroup      sync.WaitGroup
-	cancelFunc     context.CancelFunc
-	fullsyncTimout *time.Timer
+	logger    *zap.SugaredLogger
+	env       *conf.Env
+	config    conf.StorageBackend
+	dataset   string
+	statsd    statsd.ClientInterface
+	fullsyncs fullSyncSessions
 }
 
 func (ls *LocalStorage) DeliverOnceClientInit() (datahub.Client, error) {
@@ -56,12 +48,16 @@ type FileInfo struct {
 	LastModified time.Time
 }
 
-func GetAllFiles(path string) []FileInfo {
-
+// GetAllFiles returns the files below path. Files removed while the folder is walked, like the temp files of
+// concurrent writes renamed into place, are skipped. Other errors stop the walk and are returned, as a partial
+// listing would move the continuation token past files that were never read.
+func GetAllFiles(path string) ([]FileInfo, error) {
 	fileList := make([]FileInfo, 0)
 	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			fmt.Println(err)
+			if os.IsNotExist(err) {
+				return nil
+			}
 			return err
 		}
 		if !info.IsDir() {
@@ -71,9 +67,9 @@ func GetAllFiles(path string) []FileInfo {
 		return nil
 	})
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
-	return fileList
+	return fileList, nil
 }
 
 func NewLocalStorage(logger *zap.SugaredLogger, env *conf.Env, statsd statsd.ClientInterface, config conf.StorageBackend, dataset string) *LocalStorage {
@@ -98,206 +94,300 @@ func (ls *LocalStorage) StoreEntities(entities []*uda.Entity) error {
 	content, err := GenerateContent(entities, ls.config, ls.logger)
 	if err != nil {
 		ls.logger.Error("Unable to create store content")
+		return err
+	}
+	if len(ls.config.OrderBy) > 0 {
+		content, err = OrderContent(content, ls.config, ls.logger)
+		if err != nil {
+			ls.logger.Error("Unable to order content")
+			return err
+		}
 	}
-	ls.logger.Infof("Encoded %d entities into %v bytes", len(entities), len(content))
+	content, err = encoder.Compress(ls.config, content)
+	if err != nil {
+		ls.logger.Error("Unable to compress content")
+		return err
+	}
+	ls.logger.Debugf("Encoded %d entities into %v bytes", len(entities), len(content))
 
-	key := ls.createKey(entities, false)
-	properties := ls.config.Properties
-	//test logging
-	ls.logger.Debug(key, properties)
-	//result.Location should be in the info log down below.
-	ls.logger.Info("Successfully uploaded to testingnotworking")
+	path, err := ls.targetPath(ls.createKey(entities, false))
+	if err != nil {
+		return err
+	}
+	tmp, err := tempFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err != nil {
+		discard(tmp)
+		return err
+	}
+	if err = publish(tmp, path); err != nil {
+		ls.logger.Error("Failed to write ", err)
+		return err
+	}
+	ls.logger.Info("Successfully written to ", path)
 	return nil
 }
+
 func (ls *LocalStorage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
-	if len(entities) == 0 {
-		return nil
+	return ls.fullsyncs.store(state, entities, func() (*fullSyncSession, error) {
+		key := ls.createKey(entities, true)
+		if ls.config.Properties.ResourceName != nil && *ls.config.Properties.ResourceName != "" {
+			key = fmt.Sprintf("datasets/%s/latest/%s", ls.dataset, *ls.config.Properties.ResourceName)
+		}
+		path, err := ls.targetPath(key)
+		if err != nil {
+			return nil, err
+		}
+		tmp, err := tempFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// the encoded fullsync is copied into a temp file, which is renamed into place when the sync ends
+		return newFullSyncSession(state.Id, ls.config, ls.logger, func(ctx context.Context, reader *io.PipeReader) error {
+			if _, err := io.Copy(tmp, reader); err != nil {
+				discard(tmp)
+				return err
+			}
+			if err := publish(tmp, path); err != nil {
+				return err
+			}
+			ls.logger.Info("Successfully written to ", path)
+			return nil
+		}), nil
+	})
+}
+
+// Close abandons the ongoing fullsync
+func (ls *LocalStorage) Close() error {
+	ls.fullsyncs.close()
+	return nil
+}
+
+// targetPath resolves a storage key below the configured root folder, and makes sure its parent folders exist
+func (ls *LocalStorage) targetPath(key string) (string, error) {
+	path, err := ls.keyPath(key)
+	if err != nil {
+		return "", err
 	}
-	content, err := GenerateContent(entities, ls.config, ls.logger)
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// keyPath resolves a storage key below the configured root folder
+func (ls *LocalStorage) keyPath(key string) (string, error) {
+	if ls.config.LocalFileConfig == nil || ls.config.LocalFileConfig.RootFolder == "" {
+		return "", errors.New("localfileconfig.rootfolder is required for localstorage datasets")
+	}
+	return filepath.Join(ls.config.LocalFileConfig.RootFolder, filepath.FromSlash(key)), nil
+}
+
+// tempFile creates a hidden file next to the given path, so that it can be renamed into place atomically
+func tempFile(path string) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
-		ls.logger.Error("Unable to create store content")
+		return nil, err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		discard(tmp)
+		return nil, err
 	}
-	ls.logger.Infof("Encoded %d entities into %v bytes", len(entities), len(content))
+	return tmp, nil
+}
 
-	key := ls.createKey(entities, false)
-	properties := ls.config.Properties
-	//test logging
-	ls.logger.Debug(key, properties)
-	//result.Location should be in the info log down below.
-	ls.logger.Info("Successfully uploaded to testingnotworking")
+// publish flushes a temp file to disk and renames it to its final path
+func publish(tmp *os.File, path string) error {
+	if err := tmp.Sync(); err != nil {
+		discard(tmp)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
 	return nil
 }
 
+func discard(tmp *os.File) {
+	_ = tmp.Close()
+	_ = os.Remove(tmp.Name())
+}
+
 func (ls *LocalStorage) createKey(entities []*uda.Entity, fullSync bool) string {
 	t := "changes"
 	if fullSync {
 		t = "entities"
 	}
 
-	recorded := ""
-	if len(entities) > 0 {
-		recorded = entities[0].Recorded
-		if recorded != "" {
-			recorded = recorded + "-"
-		}
+	if partition := writePartition(ls.config, fullSync); partition != "" {
+		t = t + "/" + partition
 	}
 
-	ending := "json"
-	if ls.config.CsvConfig != nil {
-		ending = "csv"
-	}
-	if ls.config.FlatFileConfig != nil {
-		ending = "txt"
-	}
-	if ls.config.ParquetConfig != nil {
-		ending = "parquet"
-		if !fullSync {
-			for _, p := range ls.config.ParquetConfig.Partitioning {
-				year, month, day := time.Now().Date()
-				pVal := ""
-				if p == "year" {
-					pVal = strconv.Itoa(year)
-				} else if p == "month" {
-					pVal = strconv.Itoa(int(month))
-				} else if p == "day" {
-					pVal = strconv.Itoa(day)
-				}
-				if pVal != "" {
-					t = fmt.Sprintf("%v/%v=%v", t, p, pVal)
-				}
-			}
-		}
-	}
-
-	filename := fmt.Sprintf("%s%s.%s", recorded, uuid.New().String(), ending)
-	return fmt.Sprintf("datasets/%s/%s/%s", ls.dataset, t, filename)
+	return fmt.Sprintf("datasets/%s/%s/%s", ls.dataset, t, objectName(ls.config, entities))
 }
 
+// GetEntities streams the fullsync file props.resourceName, or else the latest fullsync below the entities folder of
+// the dataset
 func (ls *LocalStorage) GetEntities() (io.Reader, error) {
-	properties := ls.config.LocalFileConfig
-	if properties.RootFolder != "" {
-		//key = fmt.Sprintf("%s", *properties.ResourceName)
-		ls.logger.Info("Working on folder: " + properties.RootFolder)
+	var files []FileInfo
+	if ls.config.Properties.ResourceName != nil && *ls.config.Properties.ResourceName != "" {
+		path, err := ls.keyPath(fmt.Sprintf("datasets/%s/latest/%s", ls.dataset, *ls.config.Properties.ResourceName))
+		if err != nil {
+			return nil, err
+		}
+		files = []FileInfo{{FilePath: path}}
 	} else {
-		ls.logger.Error("No folder specified, exiting")
-		os.Exit(1)
+		found, _, err := ls.findFiles(fmt.Sprintf("datasets/%s/entities", ls.dataset), "", nil)
+		if err != nil {
+			return nil, err
+		}
+		// every fullsync is written to a new file, the latest one holds the current dataset
+		if len(found) > 0 {
+			files = found[len(found)-1:]
+		}
+	}
+	if encoder.UsesFileDecoder(ls.config) {
+		return encoder.NewFileDecoder(ls.config, filePaths(files), openLocalFile, "", ls.logger, true)
 	}
 	reader, writer := io.Pipe()
+	go ls.streamFiles(files, writer)
+	return encoder.NewEntityDecoder(ls.config, reader, "", ls.logger, true)
+}
 
-	files, err := ls.findObjects(properties.RootFolder)
+// GetChanges streams the files below the root folder that were modified after the since token.
+// Files are consumed in order of modification time and path, and the continuation token points at the last file
+// consumed, so files sharing a modification time are neither skipped nor replayed on the next request.
+func (ls *LocalStorage) GetChanges(since string) (io.Reader, error) {
+	files, token, err := ls.findChanges(since)
 	if err != nil {
 		return nil, err
 	}
-	go func() {
-		defer func() {
-			_ = writer.Close()
-		}()
-		for _, fileObj := range files {
-			if !strings.HasSuffix(fileObj.FilePath, ls.config.LocalFileConfig.FileSuffix) {
-				continue
-			}
+	ls.logger.Debugf("Found %d changed files since %q", len(files), since)
 
-			//file, err := os.OpenFile(fileObj.FilePath)
-			file, err := os.Open(fileObj.FilePath)
+	if encoder.UsesFileDecoder(ls.config) {
+		return encoder.NewFileDecoder(ls.config, filePaths(files), openLocalFile, token, ls.logger, false)
+	}
+	reader, writer := io.Pipe()
+	go ls.streamFiles(files, writer)
+	return encoder.NewEntityDecoder(ls.config, reader, token, ls.logger, false)
+}
 
-			if err != nil {
-				_ = reader.CloseWithError(err)
-			}
-			buf := make([]byte, 512)
-			for {
-				n, err := file.Read(buf)
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				if n > 0 {
-					writer.Write(buf[:n])
-				}
-			}
-			ls.logger.Infof("read bytes from local file %s", fileObj.FilePath)
-			if err != nil {
-				ls.logger.Error(err)
-				break
-			}
+// findChanges returns the files below the root folder that come after the since token, ordered by modification time
+// and path, together with the token of the last returned file. The root folder may be a drop folder shared with other
+// writers. Below the datasets folder written by this layer, only the changes of the dataset are read, leaving out its
+// fullsyncs and the files of other datasets.
+func (ls *LocalStorage) findChanges(since string) ([]FileInfo, string, error) {
+	changes := fmt.Sprintf("datasets/%s/changes/", ls.dataset)
+	return ls.findFiles("", since, func(key string) bool {
+		return !strings.HasPrefix(key, "datasets/") || strings.HasPrefix(key, changes)
+	})
+}
 
+// findFiles returns the files with the configured suffix below a folder of the root folder that come after the since
+// token, ordered by modification time and path, together with the token of the last file. Without include, all files
+// of the folder are returned, else the files whose path in the folder is included.
+func (ls *LocalStorage) findFiles(folder string, since string, include func(key string) bool) ([]FileInfo, string, error) {
+	root, err := ls.keyPath(folder)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		// nothing is written to the folder yet
+		return changesAfter(nil, since)
+	}
+	files, err := ls.findObjects(root)
+	if err != nil {
+		return nil, "", err
+	}
+	var changes []fileChange
+	for _, file := range files {
+		if !ls.isDatasetFile(file.FilePath) {
+			continue
 		}
-	}()
-	return encoder.NewEntityDecoder(ls.config, reader, "", ls.logger, true)
+		rel, err := filepath.Rel(root, file.FilePath)
+		if err != nil {
+			return nil, "", err
+		}
+		if include != nil && !include(filepath.ToSlash(rel)) {
+			continue
+		}
+		changes = append(changes, fileChange{LastModified: file.LastModified.UnixNano(), FilePath: filepath.ToSlash(rel), file: file})
+	}
+	return changesAfter(changes, since)
 }
 
-func (ls *LocalStorage) GetChanges(since string) (io.Reader, error) {
-	return nil, errors.New("GetChanges not supported for AzureStorage")
-	//TODO: Write check for lastmodified sample code below.
-	/*properties := ls.config.LocalFileConfig
-	if properties.RootFolder != "" {
-		//key = fmt.Sprintf("%s", *properties.ResourceName)
-		fmt.Sprintf("Working on folder: %s", properties.RootFolder)
-	} else {
-		ls.logger.Error("No folder specified, exiting")
-		os.Exit(1)
+// isDatasetFile tells if a file has the configured suffix, skipping hidden temp files of ongoing writes
+func (ls *LocalStorage) isDatasetFile(path string) bool {
+	return strings.HasSuffix(path, ls.config.LocalFileConfig.FileSuffix) && !strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// filePaths returns the paths of the files
+func filePaths(files []FileInfo) []string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.FilePath)
 	}
-	reader, writer := io.Pipe()
-	files, err := ls.findObjects(properties.RootFolder)
+	return paths
+}
+
+// localFile is a local file read with ReadAt
+type localFile struct {
+	*os.File
+	size int64
+}
+
+func (f localFile) Size() int64 {
+	return f.size
+}
+
+func openLocalFile(path string) (encoder.StoredFile, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	ls.logger.Debugf("Files found:\n%s", files)
+	info, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
-	var latestLastModified = time.Now()
-	for _, file := range files {
-		if strings.HasSuffix(file.FilePath, ls.config.LocalFileConfig.FileSuffix) {
-			if !file.LastModified.Before(latestLastModified) {
-				latestLastModified = file.LastModified
-			}
-		}
-	}
+	return localFile{File: file, size: info.Size()}, nil
+}
 
-	go func() {
-		defer func() {
-			_ = writer.Close()
-		}()
-		for _, fileObj := range files {
-			ls.logger.Debugf("Comparing since values - file lastmodified: %v , request since: %v", fileObj.LastModified, since)
-			if fileObj.LastModified.Before(cast.ToTime(since)) {
-				latestLastModified = fileObj.LastModified
-				//option 1
-				//readTotal, err := ioutil.ReadFile(fileObj.FilePath)
-				//option 2
-				file, err := os.Open(fileObj.FilePath)
-				defer file.Close()
-				//choose a chunk size
-				io.TeeReader(file, writer)
-
-				ls.logger.Infof("read bytes from local file %v", fileObj.FilePath)
-				if err != nil {
-					ls.logger.Error(err)
-					_ = reader.CloseWithError(err)
-					break
-				}
-			}
+// streamFiles copies the content of the given files into the writer, and closes it when done.
+func (ls *LocalStorage) streamFiles(files []FileInfo, writer *io.PipeWriter) {
+	for _, fileObj := range files {
+		file, err := os.Open(fileObj.FilePath)
+		if err != nil {
+			_ = writer.CloseWithError(err)
+			return
+		}
+		r, err := encoder.NewDecompressingReader(file)
+		if err != nil {
+			_ = file.Close()
+			_ = writer.CloseWithError(err)
+			return
 		}
-	}()
-	return encoder.NewEntityDecoder(ls.config, reader, cast.ToString(latestLastModified), ls.logger, false)*/
+		_, err = io.Copy(writer, r)
+		_ = r.Close()
+		_ = file.Close()
+		if err != nil {
+			ls.logger.Warnf("Failed to read local file %s: %v", fileObj.FilePath, err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+		ls.logger.Infof("read bytes from local file %s", fileObj.FilePath)
+	}
+	_ = writer.Close()
 }
 
 func (ls *LocalStorage) findObjects(folder string) ([]FileInfo, error) {
-	var path string
-	if folder == "" {
-		path = "/"
-	} else {
-		path = folder
-	}
-	//get file objects in here, format TBD
-	var err error
-	result := GetAllFiles(path)
+	files, err := GetAllFiles(folder)
 	if err != nil {
-		ls.logger.Info("could not find any files at" + path)
-		return nil, err
+		return nil, fmt.Errorf("failed to list files below %s: %w", folder, err)
 	}
-	return result, err
+	return files, nil
 }
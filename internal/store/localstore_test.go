@@ -1,9 +1,17 @@
 package store
 
 import (
-	"github.com/franela/goblin"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"go.uber.org/zap"
 
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
 )
@@ -29,6 +37,298 @@ func TestLocalstore(t *testing.T) {
 			expectedList := strings.Split(expected, ",")
 			g.Assert(resultList).Eql(expectedList)
 		})
+		g.It("Should return errors of listing files, skipping files removed meanwhile", func() {
+			root := t.TempDir()
+			ls := LocalStorage{dataset: "testds"}
+			files, err := ls.findObjects(filepath.Join(root, "missing"))
+			g.Assert(err).IsNil()
+			g.Assert(len(files)).Eql(0)
+
+			file := filepath.Join(root, "file.json")
+			g.Assert(os.WriteFile(file, []byte("[]"), 0644)).IsNil()
+			_, err = ls.findObjects(filepath.Join(file, "folder"))
+			g.Assert(err == nil).IsFalse("a file is not a folder")
+		})
+		g.It("Should write incremental batches as files below the root folder", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+			}, "testds")
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:key": "value 2"}},
+			}
+			err := ls.StoreEntities(entities)
+			g.Assert(err).IsNil()
+			err = ls.StoreEntities(entities)
+			g.Assert(err).IsNil()
+
+			files, _ := filepath.Glob(filepath.Join(root, "datasets", "testds", "changes", "*"))
+			g.Assert(len(files)).Eql(2)
+			g.Assert(strings.HasSuffix(files[0], ".json")).IsTrue()
+			content, _ := os.ReadFile(files[0])
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(2)
+		})
+		g.It("Should not read temp files of ongoing writes", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+			}, "testds")
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}}}
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			partial := filepath.Join(root, "datasets", "testds", "entities", ".latest.json.123.tmp")
+			g.Assert(os.WriteFile(partial, []byte(`[{"id":"a:`), 0644)).IsNil()
+
+			reader, err := ls.GetEntities()
+			g.Assert(err).IsNil()
+			content, err := io.ReadAll(reader)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(3, "context, continuation and 1 entity")
+		})
+		g.It("Should read changes dropped in the root folder, and the latest fullsync of the dataset only", func() {
+			root := t.TempDir()
+			newStorage := func(dataset string) *LocalStorage {
+				return NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+					LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+				}, dataset)
+			}
+			ls, other := newStorage("testds"), newStorage("other")
+			entity := func(id string) []*uda.Entity {
+				return []*uda.Entity{{ID: id, Properties: map[string]interface{}{"a:key": id}}}
+			}
+			read := func(reader io.Reader, err error) []string {
+				g.Assert(err).IsNil()
+				content, _ := io.ReadAll(reader)
+				var m []map[string]interface{}
+				g.Assert(json.Unmarshal(content, &m)).IsNil()
+				var ids []string
+				for _, e := range m[1 : len(m)-1] {
+					ids = append(ids, e["id"].(string))
+				}
+				return ids
+			}
+			g.Assert(ls.StoreEntities(entity("a:1"))).IsNil()
+			g.Assert(other.StoreEntities(entity("a:2"))).IsNil()
+			fullsync := func(id string) {
+				g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: id, Start: true}, entity(id))).IsNil()
+				g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: id, End: true}, nil)).IsNil()
+			}
+			fullsync("a:3")
+			previous, _ := filepath.Glob(filepath.Join(root, "datasets", "testds", "entities", "*"))
+			past := time.Now().Add(-time.Minute)
+			g.Assert(os.Chtimes(previous[0], past, past)).IsNil()
+			fullsync("a:4")
+			dropped := filepath.Join(root, "drop", "batch.json")
+			g.Assert(os.MkdirAll(filepath.Dir(dropped), 0755)).IsNil()
+			g.Assert(os.WriteFile(dropped, []byte(`[{"id":"a:5"}]`), 0644)).IsNil()
+
+			g.Assert(read(ls.GetChanges(""))).Eql([]string{"a:1", "a:5"})
+			g.Assert(read(ls.GetEntities())).Eql([]string{"a:4"})
+			g.Assert(read(other.GetEntities())).Eql([]string(nil))
+		})
+		g.It("Should require a root folder to read", func() {
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{}, "testds")
+			_, err := ls.GetEntities()
+			g.Assert(err.Error()).Eql("localfileconfig.rootfolder is required for localstorage datasets")
+		})
+		g.It("Should compress files and decompress them when reading", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				Compression:     "gzip",
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+			}, "testds")
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:key": "value 2"}},
+			}
+			g.Assert(ls.StoreEntities(entities)).IsNil()
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			files, _ := filepath.Glob(filepath.Join(root, "datasets", "testds", "*", "*.json.gz"))
+			g.Assert(len(files)).Eql(2)
+			// uncompressed files written before compression was enabled are still readable
+			g.Assert(os.WriteFile(filepath.Join(root, "plain.json"), []byte(`[{"id":"a:3"}]`), 0644)).IsNil()
+
+			reader, err := ls.GetChanges("")
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(5, "context, continuation and 3 entities")
+		})
+		g.It("Should only write fullsync files when the sync ends", func() {
+			root := t.TempDir()
+			resourceName := "latest.json"
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+				Properties:      conf.PropertiesMapping{ResourceName: &resourceName},
+			}, "testds")
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}},
+			}
+			target := filepath.Join(root, "datasets", "testds", "latest", "latest.json")
+			err := ls.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)
+			g.Assert(err).IsNil()
+			err = ls.StoreEntitiesFullSync(FullSyncState{Id: "1"}, entities)
+			g.Assert(err).IsNil()
+			_, err = os.Stat(target)
+			g.Assert(os.IsNotExist(err)).IsTrue("target must not exist before end")
+
+			err = ls.StoreEntitiesFullSync(FullSyncState{Id: "2"}, entities)
+			g.Assert(err == nil).IsFalse("unknown fullsync id must be rejected")
+
+			err = ls.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+			g.Assert(err).IsNil()
+			content, err := os.ReadFile(target)
+			g.Assert(err).IsNil()
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(2)
+			files, _ := os.ReadDir(filepath.Dir(target))
+			g.Assert(len(files)).Eql(1, "temp files are cleaned up")
+		})
+		g.It("Should abandon replaced fullsyncs and the fullsyncs of closed storages", func() {
+			root := t.TempDir()
+			resourceName := "latest.json"
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root},
+				Properties:      conf.PropertiesMapping{ResourceName: &resourceName},
+			}, "testds")
+			entities := []*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:key": "value 1"}},
+			}
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(ls.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, entities)).IsNil()
+			err := ls.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+			g.Assert(err.Error()).Eql("Invalid fullsync ID")
+
+			g.Assert(ls.Close()).IsNil()
+			err = ls.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)
+			g.Assert(err.Error()).Eql("fullsync is not initialized")
+			folder := filepath.Join(root, "datasets", "testds", "latest")
+			for i := 0; i < 100; i++ {
+				if files, _ := os.ReadDir(folder); len(files) == 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			files, _ := os.ReadDir(folder)
+			g.Assert(len(files)).Eql(0, "temp files are cleaned up")
+		})
+		g.It("Should return changed files in order of modification time and path", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root, FileSuffix: ".txt"},
+			}, "testds")
+			t1 := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+			t2 := t1.Add(time.Minute)
+			writeFile := func(name string, content string, mtime time.Time) {
+				path := filepath.Join(root, name)
+				g.Assert(os.MkdirAll(filepath.Dir(path), 0755)).IsNil()
+				g.Assert(os.WriteFile(path, []byte(content), 0644)).IsNil()
+				g.Assert(os.Chtimes(path, mtime, mtime)).IsNil()
+			}
+			writeFile("sub/c.txt", "10123\n", t2)
+			writeFile("b.txt", "11234\n", t2)
+			writeFile("a.txt", "12345\n", t1)
+			writeFile("ignored.json", "[]", t2)
+			writeFile(".hidden.txt", "13456\n", t2)
+
+			files, token, err := ls.findChanges("")
+			g.Assert(err).IsNil()
+			var names []string
+			for _, f := range files {
+				names = append(names, filepath.Base(f.FilePath))
+			}
+			g.Assert(names).Eql([]string{"a.txt", "b.txt", "c.txt"})
+
+			files, next, err := ls.findChanges(token)
+			g.Assert(err).IsNil()
+			g.Assert(len(files)).Eql(0)
+			g.Assert(next).Eql(token, "token is kept when nothing changed")
+
+			// same mtime as the last consumed file, but sorts after it
+			writeFile("sub/d.txt", "14567\n", t2)
+			files, next, err = ls.findChanges(token)
+			g.Assert(err).IsNil()
+			g.Assert(len(files)).Eql(1)
+			g.Assert(filepath.Base(files[0].FilePath)).Eql("d.txt")
+			g.Assert(next != token).IsTrue()
+
+			_, _, err = ls.findChanges("not a token")
+			g.Assert(err == nil).IsFalse("invalid tokens are rejected")
+		})
+		g.It("Should decode changed files with a continuation token", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root, FileSuffix: ".txt"},
+				FlatFileConfig: &conf.FlatFileConfig{Fields: map[string]conf.FlatFileField{
+					"foo": {Substring: [][]int{{0, 2}}},
+					"bar": {Substring: [][]int{{2, 5}}, Type: "integer"},
+				}},
+				DecodeConfig: &conf.DecodeConfig{
+					DefaultNamespace: "_",
+					Namespaces:       map[string]string{"_": "http://example.io/foo/"},
+					IdProperty:       "foo",
+				},
+			}, "testds")
+			content, _ := os.ReadFile("../../resources/test/data/flatfile-changes-1.txt")
+			g.Assert(os.WriteFile(filepath.Join(root, "changes-1.txt"), content, 0644)).IsNil()
+
+			reader, err := ls.GetChanges("")
+			g.Assert(err).IsNil()
+			content, _ = io.ReadAll(reader)
+			var result []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &result)).IsNil()
+			// context, entities and continuation token
+			g.Assert(len(result) > 2).IsTrue()
+			token := result[len(result)-1]["token"].(string)
+			g.Assert(token != "").IsTrue()
+
+			reader, err = ls.GetChanges(token)
+			g.Assert(err).IsNil()
+			content, _ = io.ReadAll(reader)
+			result = nil
+			g.Assert(json.Unmarshal(content, &result)).IsNil()
+			g.Assert(len(result)).Eql(2, "only context and continuation are returned")
+			g.Assert(result[1]["token"]).Eql(token)
+		})
+		g.It("Should read every parquet file of the changes", func() {
+			root := t.TempDir()
+			ls := NewLocalStorage(zap.NewNop().Sugar(), &conf.Env{}, nil, conf.StorageBackend{
+				LocalFileConfig: &conf.LocalFileConfig{RootFolder: root, FileSuffix: ".parquet"},
+				ParquetConfig: &conf.ParquetConfig{SchemaDefinition: `message entity {
+					required binary id (STRING);
+					optional binary name (STRING);
+				}`},
+				DecodeConfig: &conf.DecodeConfig{
+					DefaultNamespace: "_",
+					Namespaces:       map[string]string{"_": "http://example.io/foo/"},
+					IdProperty:       "id",
+				},
+			}, "testds")
+			g.Assert(ls.StoreEntities([]*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:name": "one"}},
+			})).IsNil()
+			g.Assert(ls.StoreEntities([]*uda.Entity{
+				{ID: "a:2", Properties: map[string]interface{}{"a:id": "2", "a:name": "two"}},
+			})).IsNil()
+
+			reader, err := ls.GetChanges("")
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var result []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &result)).IsNil()
+			g.Assert(len(result)).Eql(4)
+			// both files may share a modification time, so their order is not fixed
+			ids := map[interface{}]bool{result[1]["id"]: true, result[2]["id"]: true}
+			g.Assert(ids).Eql(map[interface{}]bool{"1": true, "2": true})
+		})
 		/*g.It("Should not return folders", func() {
 			ls := LocalStorage{dataset: "testfolder"}
 			ls.config = conf.StorageBackend{LocalFileConfig: &conf.LocalFileConfig{
@@ -7,19 +7,21 @@ import (
 	"fmt"
 	"io"
 	_ "net/http"
+	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/google/uuid"
 	datahub "github.com/mimiro-io/datahub-client-sdk-go"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
@@ -39,12 +41,19 @@ type S3Storage struct {
 	statsd            statsd.ClientInterface
 	uploader          *s3manager.Uploader
 	downloader        *s3manager.Downloader
-	writer            encoder.EncodingEntityWriter
-	reader            *io.PipeReader
-	fullsyncId        string
-	waitGroup         sync.WaitGroup
-	cancelFunc        context.CancelFunc
-	fullsyncTimout    *time.Timer
+	inferredSchema    string
+	// schemaLock serializes schema inference, configLock guards the inferred schema
+	schemaLock sync.Mutex
+	configLock sync.RWMutex
+	// fullsyncs written by a single encoder are kept by the instance that started them
+	fullsyncs fullSyncSessions
+	// the pending bytes of the last segment this instance wrote to a fullsync written in segments
+	pendingLock    sync.Mutex
+	pendingState   string
+	pendingVersion int
+	pending        []byte
+	// stopStaleCheck stops the periodic check for timed out persistent fullsyncs
+	stopStaleCheck context.CancelFunc
 }
 type sequentialWriter struct {
 	w io.Writer
@@ -60,7 +69,13 @@ func (s3s *S3Storage) GetEntities() (io.Reader, error) {
 	properties := s3s.config.Properties
 	//var key string
 	var files []string
-	if properties.ResourceName != nil {
+	if encoder.HasEntityPartitions(s3s.config) {
+		keys, err := s3s.partitionedFullSyncKeys()
+		if err != nil {
+			return nil, err
+		}
+		files = keys
+	} else if properties.ResourceName != nil {
 		if properties.CustomResourcePath != nil && *properties.CustomResourcePath {
 			//key = fmt.Sprintf("%s", *properties.ResourceName)
 			since := ""
@@ -83,17 +98,15 @@ func (s3s *S3Storage) GetEntities() (io.Reader, error) {
 		//key = *keyPointer
 		files = append(files, *keyPointer)
 	}
+	if encoder.UsesFileDecoder(s3s.config) {
+		return encoder.NewFileDecoder(s3s.config, files, s3s.openStoredFile, "", s3s.logger, true)
+	}
 	go func() {
 		defer func() {
 			_ = writer.Close()
 		}()
 		for _, file := range files {
-			readTotal, err := s3s.downloader.Download(
-				sequentialWriter{writer}, &s3.GetObjectInput{
-					Bucket: aws.String(*properties.Bucket),
-					Key:    aws.String(file),
-				},
-			)
+			readTotal, err := s3s.download(writer, *properties.Bucket, file)
 			s3s.logger.Infof("read %v bytes total from s3 file %v", readTotal, file)
 			if err != nil {
 				s3s.logger.Error(err)
@@ -120,21 +133,18 @@ func (s3s *S3Storage) GetChanges(since string) (io.Reader, error) {
 			latestLastModified = file.LastModified
 		}
 	}
+	if encoder.UsesFileDecoder(s3s.config) {
+		return encoder.NewFileDecoder(s3s.config, objectKeys(files, since), s3s.openStoredFile, latestLastModified, s3s.logger, false)
+	}
 	go func() {
 		defer func() {
 			_ = writer.Close()
 		}()
-		w := sequentialWriter{writer}
 		for _, fileObj := range files {
 			s3s.logger.Debugf("Comparing since values - file lastmodified: %v , request since: %v", fileObj.LastModified, since)
 			if fileObj.LastModified > since {
 				latestLastModified = fileObj.LastModified
-				readTotal, err := s3s.downloader.Download(
-					w, &s3.GetObjectInput{
-						Bucket: aws.String(*properties.Bucket),
-						Key:    aws.String(fileObj.FilePath),
-					},
-				)
+				readTotal, err := s3s.download(writer, *properties.Bucket, fileObj.FilePath)
 				s3s.logger.Infof("read %v bytes total from s3 file %v", readTotal, fileObj.FilePath)
 				if err != nil {
 					s3s.logger.Error(err)
@@ -147,31 +157,147 @@ func (s3s *S3Storage) GetChanges(since string) (io.Reader, error) {
 	return encoder.NewEntityDecoder(s3s.config, reader, latestLastModified, s3s.logger, false)
 }
 
+// download streams an object into writer, decompressing it if it is compressed
+func (s3s *S3Storage) download(writer io.Writer, bucket string, key string) (int64, error) {
+	reader, pipeWriter := io.Pipe()
+	go func() {
+		_, err := s3s.downloader.Download(sequentialWriter{pipeWriter}, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	r, err := encoder.NewDecompressingReader(reader)
+	if err != nil {
+		_ = reader.CloseWithError(err)
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	readTotal, err := io.Copy(writer, r)
+	if err != nil {
+		_ = reader.CloseWithError(err)
+	}
+	return readTotal, err
+}
+
+// openStoredFile opens an object for ranged GETs. Reads are pinned to the ETag the object had when it was opened,
+// so an object replaced while it is read fails the read instead of mixing two files.
+func (s3s *S3Storage) openStoredFile(key string) (encoder.StoredFile, error) {
+	head, err := s3s.downloader.S3.HeadObject(&s3.HeadObjectInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{client: s3s.downloader.S3, bucket: *s3s.config.Properties.Bucket, key: key,
+		size: aws.Int64Value(head.ContentLength), etag: head.ETag}, nil
+}
+
+// s3Object reads an s3 object with ranged GETs
+type s3Object struct {
+	client s3iface.S3API
+	bucket string
+	key    string
+	size   int64
+	etag   *string
+}
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= o.size {
+		end = o.size - 1
+	}
+	out, err := o.client.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(o.bucket),
+		Key:     aws.String(o.key),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+		IfMatch: o.etag,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = out.Body.Close()
+	}()
+	n, err := io.ReadFull(out.Body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+func (o *s3Object) Close() error {
+	return nil
+}
+
+// contentType returns the Content-Type of uploaded objects, or nil to leave it to s3
+func (s3s *S3Storage) contentType() *string {
+	if s3s.config.FlatFileConfig != nil {
+		if s3s.config.FlatFileConfig.Encoding != "" {
+			return aws.String("text/plain")
+		}
+		return aws.String("text/plain; charset=utf-8")
+	}
+	return nil
+}
+
+// contentEncoding returns the Content-Encoding of uploaded objects, or nil if the dataset is not compressed
+func (s3s *S3Storage) contentEncoding() *string {
+	if contentEncoding := encoder.ContentEncoding(s3s.config); contentEncoding != "" {
+		return aws.String(contentEncoding)
+	}
+	return nil
+}
+
 func (s3s *S3Storage) ExportSchema() error {
-	if s3s.config.ParquetConfig != nil {
+	config := s3s.GetConfig()
+	if config.ParquetConfig != nil && config.ParquetConfig.SchemaDefinition == "" {
+		// inferred schemas are exported once the first entities arrive
+		return nil
+	}
+	if config.ParquetConfig != nil {
+		partitions, err := encoder.ParquetPartitions(config)
+		if err != nil {
+			return err
+		}
 		for _, folder := range []string{"changes", "latest"} {
 			targetLocation := fmt.Sprintf("s3://%v/datasets/%v/%v/",
-				*s3s.config.Properties.Bucket,
-				s3s.config.Dataset,
+				*config.Properties.Bucket,
+				config.Dataset,
 				folder)
-			gen, err := schema.NewParquetAthenaSqlBuilder(s3s.config.Dataset,
-				s3s.config.ParquetConfig.SchemaDefinition,
+			gen, err := schema.NewParquetAthenaSqlBuilder(config.Dataset,
+				config.ParquetConfig.SchemaDefinition,
 				targetLocation)
 			if err != nil {
 				return err
 			}
 			gen.WithSnappyCompression()
-			if folder == "changes" {
-				gen.WithPartitioning(s3s.config.ParquetConfig.Partitioning...)
+			// fullsyncs in latest are only partitioned by entity properties
+			var projections []schema.PartitionProjection
+			for _, partition := range partitions {
+				if folder == "changes" || partition.Property != "" {
+					projections = append(projections, schema.PartitionProjection{Name: partition.Column, Range: partition.ProjectionRange()})
+				}
 			}
+			gen.WithPartitionProjection(projections...)
 			ddl, err := gen.Build()
 			if err != nil {
 				return err
 			}
-			schemaLocation := fmt.Sprintf("schemas/%v-%v.sql", s3s.config.Dataset, folder)
+			schemaLocation := fmt.Sprintf("schemas/%v-%v.sql", config.Dataset, folder)
 			uploadResult, err := s3s.uploader.Upload(&s3manager.UploadInput{
 				Body:   bytes.NewReader([]byte(ddl)),
-				Bucket: aws.String(*s3s.config.Properties.Bucket),
+				Bucket: aws.String(*config.Properties.Bucket),
 				Key:    aws.String(schemaLocation),
 			})
 			if err != nil {
@@ -184,12 +310,110 @@ func (s3s *S3Storage) ExportSchema() error {
 	return nil
 }
 
+// inferredSchemaKey is where the inferred parquet schema of the dataset is kept, next to the athena schemas
+func (s3s *S3Storage) inferredSchemaKey() string {
+	return fmt.Sprintf("schemas/%v.parquet-schema", s3s.config.Dataset)
+}
+
+// loadInferredSchema continues with the schema inferred before a restart, so the files of a dataset keep the same
+// schema until the next fullsync
+func (s3s *S3Storage) loadInferredSchema() error {
+	buf := aws.NewWriteAtBuffer([]byte{})
+	_, err := s3s.downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(s3s.inferredSchemaKey()),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil
+		}
+		return err
+	}
+	s3s.useInferredSchema(string(buf.Bytes()))
+	return nil
+}
+
+// infersSchema tells if the parquet schema of the dataset is inferred from its entities
+func (s3s *S3Storage) infersSchema() bool {
+	parquetConfig := s3s.config.ParquetConfig
+	return parquetConfig != nil && parquetConfig.InferSchema != nil && parquetConfig.SchemaDefinition == ""
+}
+
+// inferSchema infers the parquet schema of datasets configured with inferSchema from the first entities written, and
+// publishes it with the athena schemas. Later batches keep the schema until a fullsync infers a new one, so columns
+// that are not in the schema are left out of the files, with a warning.
+func (s3s *S3Storage) inferSchema(entities []*uda.Entity) error {
+	if !s3s.infersSchema() || len(entities) == 0 {
+		return nil
+	}
+	inference := s3s.config.ParquetConfig.InferSchema
+	s3s.schemaLock.Lock()
+	defer s3s.schemaLock.Unlock()
+	if s3s.inferredSchema != "" {
+		if missing := encoder.UninferredColumns(s3s.inferredSchema, entities, inference); len(missing) > 0 {
+			s3s.logger.Warnf("Columns %v are not in the inferred parquet schema of dataset %s, and are not written until a fullsync infers a new schema",
+				missing, s3s.dataset)
+		}
+		return nil
+	}
+	definition, err := encoder.InferParquetSchema(entities, inference)
+	if err != nil {
+		return err
+	}
+	return s3s.storeInferredSchema(definition)
+}
+
+// inferFullSyncSchema infers the parquet schema of a fullsync from its first batch. The schema is only published
+// when the fullsync is, until then other writes keep the current schema.
+func (s3s *S3Storage) inferFullSyncSchema(entities []*uda.Entity) (string, error) {
+	if !s3s.infersSchema() || len(entities) == 0 {
+		return "", nil
+	}
+	return encoder.InferParquetSchema(entities, s3s.config.ParquetConfig.InferSchema)
+}
+
+// publishFullSyncSchema replaces the inferred schema with the schema of a published fullsync
+func (s3s *S3Storage) publishFullSyncSchema(definition string) error {
+	if definition == "" {
+		return nil
+	}
+	s3s.schemaLock.Lock()
+	defer s3s.schemaLock.Unlock()
+	return s3s.storeInferredSchema(definition)
+}
+
+// storeInferredSchema uploads a new inferred schema and uses it for later writes. The caller holds the schema lock.
+func (s3s *S3Storage) storeInferredSchema(definition string) error {
+	if definition == s3s.inferredSchema {
+		return nil
+	}
+	_, err := s3s.uploader.Upload(&s3manager.UploadInput{
+		Body:   strings.NewReader(definition),
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(s3s.inferredSchemaKey()),
+	})
+	if err != nil {
+		s3s.logger.Error("Failed to upload inferred parquet schema ", err)
+		return err
+	}
+	s3s.useInferredSchema(definition)
+	s3s.logger.Infof("Inferred parquet schema for dataset %s:\n%s", s3s.dataset, definition)
+	return s3s.ExportSchema()
+}
+
+func (s3s *S3Storage) useInferredSchema(definition string) {
+	s3s.configLock.Lock()
+	defer s3s.configLock.Unlock()
+	s3s.inferredSchema = definition
+}
+
 func NewS3Storage(logger *zap.SugaredLogger, env *conf.Env, config conf.StorageBackend, statsd statsd.ClientInterface, dataset string, datahubAuthConfig conf.DatahubAuthConfig) (*S3Storage, error) {
-	uploader, downloader, err := initS3(config, env)
-	downloader.Concurrency = 1 // disable parallel download of chunks, we need sequential streaming
+	uploader, downloader, err := initS3(config)
 	if err != nil {
 		return nil, err
 	}
+	downloader.Concurrency = 1 // disable parallel download of chunks, we need sequential streaming
 
 	s := &S3Storage{
 		logger:            logger.Named("s3-store").With("dataset", dataset),
@@ -202,77 +426,158 @@ func NewS3Storage(logger *zap.SugaredLogger, env *conf.Env, config conf.StorageB
 		downloader:        downloader,
 	}
 
-	err = s.ExportSchema()
-	if err == nil {
-		logger.Debug("exported schema for dataset ", dataset)
+	if config.ParquetConfig != nil && config.ParquetConfig.SchemaDefinition == "" && config.ParquetConfig.InferSchema != nil {
+		if err = s.loadInferredSchema(); err != nil {
+			return s, err
+		}
+	}
+
+	if err = s.ExportSchema(); err != nil {
+		// the storage is not used, so it must not leave the check of stale fullsyncs running
+		return s, err
 	}
+	logger.Debug("exported schema for dataset ", dataset)
 
-	return s, err
+	if s.persistsFullSyncs() {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopStaleCheck = cancel
+		go s.checkStaleFullSyncs(ctx)
+	}
+
+	return s, nil
 }
 
-func initS3(config conf.StorageBackend, env *conf.Env) (*s3manager.Uploader, *s3manager.Downloader, error) {
-	if env.Env == "local" {
-		sess, err := session.NewSession(&aws.Config{
-			Credentials:      credentials.NewStaticCredentials(*config.Properties.Key, *config.Properties.Secret, ""),
-			S3ForcePathStyle: aws.Bool(true),
-			Region:           aws.String(*config.Properties.Region),
-			Endpoint:         aws.String(config.Properties.Endpoint),
-		})
-		if err != nil {
-			return nil, nil, err
+const defaultS3Region = "eu-west-1"
+
+func initS3(config conf.StorageBackend) (*s3manager.Uploader, *s3manager.Downloader, error) {
+	sess, err := newS3Session(config.Properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s3manager.NewUploader(sess), s3manager.NewDownloader(sess), nil
+}
+
+// newS3Session creates a session for the bucket of a dataset. Region, endpoint and credentials are taken from the
+// dataset properties, falling back to eu-west-1 and the ambient credentials of the service. When a role arn is
+// given, the credentials are used to assume that role, or with authType `webIdentity` the role is assumed with a
+// web identity token.
+func newS3Session(properties conf.PropertiesMapping) (*session.Session, error) {
+	baseConfig := aws.NewConfig().WithRegion(defaultS3Region)
+	if properties.Region != nil && *properties.Region != "" {
+		baseConfig.WithRegion(*properties.Region)
+	}
+	if properties.Key != nil && *properties.Key != "" && properties.Secret != nil && *properties.Secret != "" {
+		baseConfig.WithCredentials(credentials.NewStaticCredentials(*properties.Key, *properties.Secret, ""))
+	}
+
+	s3Config := baseConfig.Copy()
+	if properties.Endpoint != "" {
+		// alternative s3 providers (minio, ceph, localstack) generally only support path style addressing
+		s3Config.WithEndpoint(properties.Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	webIdentity := properties.AuthType != nil && strings.EqualFold(*properties.AuthType, "webIdentity")
+	if properties.RoleArn == nil || *properties.RoleArn == "" {
+		if webIdentity {
+			return nil, errors.New("roleArn must be set for webIdentity authentication")
 		}
-		return s3manager.NewUploader(sess), s3manager.NewDownloader(sess), nil
-	} else {
+		return session.NewSession(s3Config)
+	}
 
-		//TODO:: verify if key, secret, region is set.. If so it's an external bucket....
-		sess, err := session.NewSession(&aws.Config{
-			Region: aws.String("eu-west-1"),
-		})
-		if err != nil {
-			return nil, nil, err
+	// the sts client must not use the s3 endpoint, so it gets its own session
+	stsSession, err := session.NewSession(baseConfig)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := "objectstorage-datalayer"
+	if webIdentity {
+		tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if properties.WebIdentityTokenFile != nil && *properties.WebIdentityTokenFile != "" {
+			tokenFile = *properties.WebIdentityTokenFile
+		}
+		if tokenFile == "" {
+			return nil, errors.New("webIdentityTokenFile or AWS_WEB_IDENTITY_TOKEN_FILE must be set for webIdentity authentication")
 		}
-		return s3manager.NewUploader(sess), s3manager.NewDownloader(sess), nil
+		s3Config.WithCredentials(stscreds.NewWebIdentityCredentials(stsSession, *properties.RoleArn, sessionName, tokenFile))
+	} else {
+		s3Config.WithCredentials(stscreds.NewCredentials(stsSession, *properties.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if properties.ExternalId != nil && *properties.ExternalId != "" {
+				p.ExternalID = properties.ExternalId
+			}
+		}))
 	}
+	return session.NewSession(s3Config)
 }
 
+// GetConfig returns the configuration of the dataset, with the inferred parquet schema if there is one
 func (s3s *S3Storage) GetConfig() conf.StorageBackend {
-	return s3s.config
+	s3s.configLock.RLock()
+	defer s3s.configLock.RUnlock()
+	config := s3s.config
+	if s3s.inferredSchema != "" {
+		parquetConfig := *config.ParquetConfig
+		parquetConfig.SchemaDefinition = s3s.inferredSchema
+		config.ParquetConfig = &parquetConfig
+	}
+	return config
 }
 
 func (s3s *S3Storage) StoreEntities(entities []*uda.Entity) error {
 	if len(entities) == 0 {
 		return nil
 	}
-	content, err := GenerateContent(entities, s3s.config, s3s.logger)
+	if err := s3s.inferSchema(entities); err != nil {
+		return err
+	}
+	config := s3s.GetConfig()
+	if config.ParquetConfig == nil || len(config.ParquetConfig.Partitioning) == 0 {
+		return s3s.storeObject(config, entities, "")
+	}
+	// batches are split into an object per partition
+	partitions, err := encoder.PartitionEntities(config, entities, false, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err := s3s.storeObject(config, partition.Entities, partition.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeObject uploads a batch of entities as an object of its own, in the given partition folder
+func (s3s *S3Storage) storeObject(config conf.StorageBackend, entities []*uda.Entity, partition string) error {
+	content, err := GenerateContent(entities, config, s3s.logger)
 	if err != nil {
 		s3s.logger.Error("Unable to create store content")
+		return err
 	}
-	if len(s3s.config.OrderBy) > 0 {
-		content, err = OrderContent(content, s3s.config, s3s.logger)
+	if len(config.OrderBy) > 0 {
+		content, err = OrderContent(content, config, s3s.logger)
 		if err != nil {
 			s3s.logger.Error("Unable to order content")
+			return err
 		}
 	}
+	content, err = encoder.Compress(s3s.config, content)
+	if err != nil {
+		s3s.logger.Error("Unable to compress content")
+		return err
+	}
 
 	s3s.logger.Debugf("Encoded %d entities into %v bytes", len(entities), len(content))
 
-	key := s3s.createKey(entities, false)
+	key := s3s.createKey(entities, false, partition)
 	properties := s3s.config.Properties
 
-	var uploadInput *s3manager.UploadInput
-	if s3s.config.FlatFileConfig != nil {
-		uploadInput = &s3manager.UploadInput{
-			Body:        bytes.NewReader(content),
-			Bucket:      aws.String(*properties.Bucket),
-			Key:         aws.String(key),
-			ContentType: aws.String("text/plain; charset=utf-8"),
-		}
-	} else {
-		uploadInput = &s3manager.UploadInput{
-			Body:   bytes.NewReader(content),
-			Bucket: aws.String(*properties.Bucket),
-			Key:    aws.String(key),
-		}
+	uploadInput := &s3manager.UploadInput{
+		Body:            bytes.NewReader(content),
+		Bucket:          aws.String(*properties.Bucket),
+		Key:             aws.String(key),
+		ContentType:     s3s.contentType(),
+		ContentEncoding: s3s.contentEncoding(),
 	}
 
 	result, err := s3s.uploader.Upload(uploadInput)
@@ -284,168 +589,132 @@ func (s3s *S3Storage) StoreEntities(entities []*uda.Entity) error {
 	return nil
 }
 
-func (s3s *S3Storage) createKey(entities []*uda.Entity, fullSync bool) string {
+// createKey is the key of a new object of the dataset, placed in the given partition folder
+func (s3s *S3Storage) createKey(entities []*uda.Entity, fullSync bool, partition string) string {
 	t := "changes"
 	if fullSync {
 		t = "entities"
 	}
 
-	recorded := ""
-	if len(entities) > 0 {
-		recorded = entities[0].Recorded
-		if recorded != "" {
-			recorded = recorded + "-"
-		}
+	if partition != "" {
+		t = fmt.Sprintf("%v/%v", t, partition)
 	}
+	return fmt.Sprintf("datasets/%s/%s/%s", s3s.dataset, t, objectName(s3s.config, entities))
+}
 
-	filename := ""
-
-	ending := "json"
-	if s3s.config.CsvConfig != nil {
-		ending = "csv"
-		if s3s.config.FlatFileConfig.CustomFileName != "" {
-			filename = fmt.Sprintf("%s%s.%s", recorded, s3s.config.CsvConfig.CustomFileName, ending)
-		}
+func (s3s *S3Storage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
+	if s3s.persistsFullSyncs() {
+		return s3s.storeFullSyncSegment(state, entities)
 	}
-	if s3s.config.FlatFileConfig != nil {
-		ending = "txt"
-		if s3s.config.FlatFileConfig.CustomFileName != "" {
-			filename = fmt.Sprintf("%s%s.%s", recorded, s3s.config.FlatFileConfig.CustomFileName, ending)
-		}
-	}
-	if s3s.config.ParquetConfig != nil {
-		ending = "parquet"
-		if !fullSync {
-			for _, p := range s3s.config.ParquetConfig.Partitioning {
-				year, month, day := time.Now().Date()
-				pVal := ""
-				if p == "year" {
-					pVal = strconv.Itoa(year)
-				} else if p == "month" {
-					pVal = strconv.Itoa(int(month))
-				} else if p == "day" {
-					pVal = strconv.Itoa(day)
-				}
-				if pVal != "" {
-					t = fmt.Sprintf("%v/%v=%v", t, p, pVal)
-				}
+	spooled := s3s.env.FullsyncTempFolder != ""
+	return s3s.fullsyncs.store(state, entities, func() (*fullSyncSession, error) {
+		definition, err := s3s.inferFullSyncSchema(entities)
+		if err != nil {
+			return nil, err
+		}
+		if s3s.env.Env == "local" {
+			if _, err := s3s.CreateBucketIfNotExist(); err != nil {
+				return nil, err
 			}
 		}
-	}
-	if filename == "" {
-		filename = fmt.Sprintf("%s%s.%s", recorded, uuid.New().String(), ending)
-	}
-	return fmt.Sprintf("datasets/%s/%s/%s", s3s.dataset, t, filename)
-}
-
-var fullsyncTimeoutDuration = 30 * time.Minute
-
-func (s3s *S3Storage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
-	if state.Start {
-		s3s.fullsyncId = state.Id
-		var pipeWriter *io.PipeWriter
-		//each fullsync keeps a pipe in memory which we can write to for the duration of a fullsync
-		// amazons uploadmanager will read continuously from the pipe until closed.
-		s3s.reader, pipeWriter = io.Pipe()
-		s3s.writer = encoder.NewEntityEncoder(s3s.config, pipeWriter, s3s.logger)
-		ctx, cancel := context.WithCancel(aws.BackgroundContext())
-		s3s.cancelFunc = cancel
-		s3s.waitGroup = sync.WaitGroup{}
-		s3s.waitGroup.Add(1)
-		if s3s.fullsyncTimout != nil {
-			s3s.fullsyncTimout.Stop()
-		}
-		s3s.fullsyncTimout = time.AfterFunc(fullsyncTimeoutDuration, func() {
-			s3s.logger.Warnf("fullsync id %v has not received new data in %v. abandoning.", s3s.fullsyncId, fullsyncTimeoutDuration)
-			s3s.cancelFunc()
-			s3s.writer.CloseWithError(errors.New("abandoned fullsync"))
-		})
-
-		properties := s3s.config.Properties
-		var key string
-		if properties.ResourceName == nil {
-			key = s3s.createKey(entities, true)
+		config := s3s.fullSyncConfig(definition)
+		var session *fullSyncSession
+		if encoder.HasEntityPartitions(s3s.config) {
+			session = s3s.startPartitionedFullSync(state.Id, config, spooled)
 		} else {
-			if properties.CustomResourcePath != nil {
-				key = *properties.ResourceName
-			} else {
-				key = s3s.fullSyncFixedKey()
+			// the fullsync is uploaded to a staging key, readers see the previous fullsync until it is published
+			fullsync := &fullSyncState{Id: state.Id, StagingKey: s3s.fullSyncStagingKey(state.Id), FinalKey: s3s.fullSyncFinalKey(entities, "")}
+			session, err = s3s.startFullSyncUpload(fullsync, config, spooled)
+			if err != nil {
+				return nil, err
+			}
+			session.publish = func(entities int) error {
+				fullsync.Entities = entities
+				return s3s.publishFullSync(fullsync)
 			}
 		}
-
-		if s3s.env.Env == "local" {
-			_, err := s3s.CreateBucketIfNotExist()
-			if err != nil {
+		// the schema inferred for the fullsync replaces the current one together with the data
+		publish := session.publish
+		session.publish = func(entities int) error {
+			if err := publish(entities); err != nil {
 				return err
 			}
-			s3s.logger.Infof("Writing -> %s", key)
+			return s3s.publishFullSyncSchema(definition)
 		}
+		return session, nil
+	})
+}
 
-		go func() {
-			var uploadInput *s3manager.UploadInput
-			if s3s.config.FlatFileConfig != nil {
-				uploadInput = &s3manager.UploadInput{
-					Body:        s3s.reader,
-					Bucket:      aws.String(*properties.Bucket),
-					Key:         aws.String(key),
-					ContentType: aws.String("text/plain; charset=utf-8"),
-				}
-			} else {
-				uploadInput = &s3manager.UploadInput{
-					Body:   s3s.reader,
-					Bucket: aws.String(*properties.Bucket),
-					Key:    aws.String(key),
-				}
-			}
-			result, err := s3s.uploader.UploadWithContext(ctx, uploadInput)
-			s3s.waitGroup.Done()
-			if err != nil {
-				s3s.logger.Error("Failed to upload ", err)
-				return
-			}
-			s3s.logger.Info("Successfully uploaded to ", result.Location)
-		}()
+// fullSyncConfig is the configuration fullsyncs are encoded with, using the schema inferred for the fullsync if any
+func (s3s *S3Storage) fullSyncConfig(definition string) conf.StorageBackend {
+	config := s3s.GetConfig()
+	if definition != "" {
+		parquetConfig := *config.ParquetConfig
+		parquetConfig.SchemaDefinition = definition
+		config.ParquetConfig = &parquetConfig
 	}
+	return config
+}
 
-	if s3s.writer != nil {
-		if state.Id != s3s.fullsyncId {
-			s3s.logger.Warnf("Invalid fullsync id. requester sent id %v, ongoing sync has id %v", state.Id, s3s.fullsyncId)
-			return errors.New("Invalid fullsync ID")
-		}
-		// we wrap the writer.Write with a one minute timeout, because it will block and hang indefinitely if the
-		// aws upload manager does not read in the other end for some reason.
-		if len(entities) > 0 {
-			writeCtx, writecancel := context.WithTimeout(context.Background(), 1*time.Minute)
-			go func() {
-				<-writeCtx.Done()
-				if writeCtx.Err() == context.DeadlineExceeded {
-					s3s.logger.Errorf("Upload timed out, could not write into uploader withing 1 minute.")
-					s3s.cancelFunc()
-					_ = s3s.writer.CloseWithError(writeCtx.Err())
-				}
-			}()
-			written, err := s3s.writer.Write(entities)
-			writecancel()
-			if err != nil {
-				return err
-			}
-			s3s.logger.Debugf("piped %v entities into uploader. bytes written: %v", len(entities), written)
+// startFullSyncUpload starts a session uploading a fullsync to its staging key, spooled to a temp file or streamed
+func (s3s *S3Storage) startFullSyncUpload(fullsync *fullSyncState, config conf.StorageBackend, spooled bool) (*fullSyncSession, error) {
+	if spooled {
+		return s3s.startFullSyncSpool(fullsync, config)
+	}
+	// amazons uploadmanager will read continuously from the pipe until closed
+	s3s.logger.Infof("Writing -> %s", fullsync.StagingKey)
+	session := newFullSyncSession(fullsync.Id, config, s3s.logger, func(ctx context.Context, reader *io.PipeReader) error {
+		staged := &countingReader{reader: reader}
+		checksums := &uploadChecksums{}
+		result, err := s3s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Body:            staged,
+			Bucket:          s3s.config.Properties.Bucket,
+			Key:             aws.String(fullsync.StagingKey),
+			ContentType:     s3s.contentType(),
+			ContentEncoding: s3s.contentEncoding(),
+		}, s3manager.WithUploaderRequestOptions(checksums.add))
+		if err != nil {
+			return err
 		}
-		// refresh between-request timeout
-		s3s.fullsyncTimout.Reset(fullsyncTimeoutDuration)
-		if state.End {
-			err := s3s.writer.Close()
-			if err != nil {
-				return err
-			}
-			s3s.logger.Debug("waiting for uploader")
-			s3s.waitGroup.Wait()
-			s3s.logger.Debug("wait done")
-			s3s.fullsyncTimout.Stop()
+		fullsync.Bytes = staged.count
+		if fullsync.Checksum, err = checksums.checksum(); err != nil {
+			return err
 		}
+		s3s.logger.Info("Successfully staged fullsync at ", result.Location)
 		return nil
+	})
+	session.writeTimeout = time.Minute
+	return session, nil
+}
+
+// Close abandons the fullsyncs kept by this instance. Persistent fullsyncs are kept in the bucket, and can continue
+// on other instances.
+func (s3s *S3Storage) Close() error {
+	s3s.fullsyncs.close()
+	if s3s.stopStaleCheck != nil {
+		s3s.stopStaleCheck()
 	}
-	return errors.New("fullsync is not initialized")
+	return nil
+}
+
+// fullSyncFinalKey is the key a fullsync, or the given partition of it, is published to
+func (s3s *S3Storage) fullSyncFinalKey(entities []*uda.Entity, partition string) string {
+	if s3s.config.Properties.ResourceName == nil {
+		return s3s.createKey(entities, true, partition)
+	}
+	if !encoder.HasEntityPartitions(s3s.config) {
+		return s3s.fullSyncResourceKey()
+	}
+	// the key is listed with the other partitions, where s3 has no leading slash
+	return partitionedKey(strings.TrimPrefix(s3s.fullSyncResourceKey(), "/"), partition)
+}
+
+// fullSyncResourceKey is the key of fullsyncs of datasets with a resource name
+func (s3s *S3Storage) fullSyncResourceKey() string {
+	if s3s.config.Properties.CustomResourcePath != nil {
+		return *s3s.config.Properties.ResourceName
+	}
+	return s3s.fullSyncFixedKey()
 }
 
 func (s3s *S3Storage) fullSyncFixedKey() string {
@@ -488,20 +757,32 @@ func (s3s *S3Storage) CreateBucketIfNotExist() (bool, error) {
 
 }
 
+// findNewestKey returns the last modified object in a folder of the dataset, leaving out the fullsync history
 func (s3s *S3Storage) findNewestKey(folder string) (*string, error) {
 	params := &s3.ListObjectsV2Input{
 		Bucket: aws.String(*s3s.config.Properties.Bucket),
-		Prefix: aws.String("datasets/" + s3s.config.Dataset + "/" + folder),
+		Prefix: aws.String("datasets/" + s3s.dataset + "/" + folder),
 	}
-	resp, err := s3s.downloader.S3.ListObjectsV2(params)
+	var newest *s3.Object
+	err := s3s.downloader.S3.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if strings.Contains(*object.Key, "/_history/") {
+				continue
+			}
+			if newest == nil || !aws.TimeValue(object.LastModified).Before(aws.TimeValue(newest.LastModified)) {
+				newest = object
+			}
+		}
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, key := range resp.Contents {
-		return key.Key, nil
+	if newest == nil {
+		return nil, errors.New(fmt.Sprintf(
+			"nothing found in folder %v of dataset %v", folder, s3s.dataset))
 	}
-	return nil, errors.New(fmt.Sprintf(
-		"nothing found in folder %v of dataset %v", folder, s3s.config.Dataset))
+	return newest.Key, nil
 }
 
 type FileObject struct {
@@ -510,6 +791,17 @@ type FileObject struct {
 	LastModified string
 }
 
+// objectKeys returns the keys of the objects modified after since, or of all objects if since is empty
+func objectKeys(files []FileObject, since string) []string {
+	var keys []string
+	for _, fileObj := range files {
+		if since == "" || fileObj.LastModified > since {
+			keys = append(keys, fileObj.FilePath)
+		}
+	}
+	return keys
+}
+
 func (s3s *S3Storage) findObjects(folder string, since string) ([]FileObject, error) {
 	var path string
 	if s3s.config.Properties.CustomResourcePath != nil && *s3s.config.Properties.CustomResourcePath {
@@ -578,7 +870,7 @@ func (s3s *S3Storage) DeliverOnce(entities []*uda.Entity, client datahub.Client)
 	namespaceManager := egdm.NewNamespaceContext()
 	ec := egdm.NewEntityCollection(namespaceManager)
 
-	key := s3s.createKey(entities, false)
+	key := s3s.createKey(entities, false, s3s.partitionPath(entities, false))
 	for _, entity := range entities {
 		id := fmt.Sprintf("%v%v", s3s.config.DeliverOnceConfig.IdNamespace, strings.Split(entity.ID, ":")[1])
 		prefixedId, err := namespaceManager.AssertPrefixedIdentifierFromURI(id)
@@ -1,14 +1,23 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"io"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/franela/goblin"
 
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
 )
 
 func TestS3(t *testing.T) {
@@ -19,12 +28,12 @@ func TestS3(t *testing.T) {
 			s3.config = conf.StorageBackend{ParquetConfig: &conf.ParquetConfig{
 				Partitioning: []string{"year", "month", "day", "foo"},
 			}}
-			var entities []*uda.Entity
-			key := s3.createKey(entities, false)
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:foo": "bar"}}}
+			key := s3.createKey(entities, false, s3.partitionPath(entities, false))
 			g.Assert(key[24:28]).Eql("year")
 			year, month, day := time.Now().Date()
-			expected := fmt.Sprintf("datasets/testds/changes/year=%v/month=%v/day=%v", year, int(month), day)
-			g.Assert(key[:47]).Eql(expected[:47])
+			expected := fmt.Sprintf("datasets/testds/changes/year=%v/month=%v/day=%v/foo=bar/", year, int(month), day)
+			g.Assert(key[:len(expected)]).Eql(expected)
 		})
 		g.It("Should not apply partitions to fullsync keys", func() {
 			s3 := S3Storage{dataset: "testds"}
@@ -32,8 +41,558 @@ func TestS3(t *testing.T) {
 				Partitioning: []string{"year", "month", "day"},
 			}}
 			var entities []*uda.Entity
-			key := s3.createKey(entities, true)
+			key := s3.createKey(entities, true, s3.partitionPath(entities, true))
 			g.Assert(key[25:29] == "year").IsFalse("year not expected in path")
 		})
+		g.It("Should use dataset region, endpoint and keys in any environment", func() {
+			region := "us-east-2"
+			key := "AccessKeyId"
+			secret := "SecretAccessKey"
+			sess, err := newS3Session(conf.PropertiesMapping{
+				Region: &region, Endpoint: "https://minio.example.io", Key: &key, Secret: &secret,
+			})
+			g.Assert(err).IsNil()
+			g.Assert(*sess.Config.Region).Eql("us-east-2")
+			g.Assert(*sess.Config.Endpoint).Eql("https://minio.example.io")
+			g.Assert(*sess.Config.S3ForcePathStyle).IsTrue()
+			creds, err := sess.Config.Credentials.Get()
+			g.Assert(err).IsNil()
+			g.Assert(creds.AccessKeyID).Eql("AccessKeyId")
+			g.Assert(creds.ProviderName).Eql("StaticProvider")
+		})
+		g.It("Should default to eu-west-1 without endpoint", func() {
+			sess, err := newS3Session(conf.PropertiesMapping{})
+			g.Assert(err).IsNil()
+			g.Assert(*sess.Config.Region).Eql("eu-west-1")
+			g.Assert(sess.Config.Endpoint == nil).IsTrue("no endpoint expected")
+		})
+		g.It("Should require a role for web identity credentials", func() {
+			authType := "webIdentity"
+			_, err := newS3Session(conf.PropertiesMapping{AuthType: &authType})
+			g.Assert(err == nil).IsFalse()
+
+			roleArn := "arn:aws:iam::123456789012:role/delivery"
+			tokenFile := "/var/run/secrets/token"
+			sess, err := newS3Session(conf.PropertiesMapping{
+				AuthType: &authType, RoleArn: &roleArn, WebIdentityTokenFile: &tokenFile,
+			})
+			g.Assert(err).IsNil()
+			g.Assert(sess.Config.Credentials != nil).IsTrue()
+		})
+	})
+
+	g.Describe("Changes to s3", func() {
+		var server *s3Server
+		g.BeforeEach(func() {
+			server = newS3Server()
+		})
+		g.AfterEach(func() {
+			server.Close()
+		})
+
+		g.It("Should fail batches that can not be ordered, without storing them", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", OrderBy: [][]int{{0, 2}},
+				FlatFileConfig: &conf.FlatFileConfig{FieldOrder: []string{"name"},
+					Fields: map[string]conf.FlatFileField{"name": {Substring: [][]int{{0, 2}}}}}})
+			err := storage.StoreEntities([]*uda.Entity{
+				{ID: "a:1", Properties: map[string]interface{}{"a:name": "x"}},
+				{ID: "a:2", Properties: map[string]interface{}{"a:name": "y"}},
+			})
+			g.Assert(err == nil).IsFalse("names are not numbers")
+			g.Assert(server.keys("datasets/people/changes/")).Eql([]string(nil))
+		})
+	})
+
+	g.Describe("Fullsyncs to s3", func() {
+		var server *s3Server
+		g.BeforeEach(func() {
+			server = newS3Server()
+		})
+		g.AfterEach(func() {
+			server.Close()
+		})
+		resourceName, custom := "exports/people.json", true
+		fullsync := func(storage *S3Storage, id string, names ...string) error {
+			var entities []*uda.Entity
+			for i, name := range names {
+				entities = append(entities, &uda.Entity{ID: fmt.Sprintf("a:%v", i), Properties: map[string]interface{}{"a:name": name}})
+			}
+			if err := storage.StoreEntitiesFullSync(FullSyncState{Id: id, Start: true}, entities); err != nil {
+				return err
+			}
+			return storage.StoreEntitiesFullSync(FullSyncState{Id: id, End: true}, nil)
+		}
+
+		g.It("Should stage fullsyncs and publish them when they end", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true,
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+			err := storage.StoreEntitiesFullSync(FullSyncState{Id: "sync 1", Start: true}, entities)
+			g.Assert(err).IsNil()
+			err = storage.StoreEntitiesFullSync(FullSyncState{Id: "sync 1"}, entities)
+			g.Assert(err).IsNil()
+			g.Assert(server.object(resourceName) == nil).IsTrue("nothing published before the end")
+
+			err = storage.StoreEntitiesFullSync(FullSyncState{Id: "sync 1", End: true}, nil)
+			g.Assert(err).IsNil()
+			published := server.object(resourceName)
+			g.Assert(string(published.data)).Eql(`[{"name":"Bob"},{"name":"Bob"}]`)
+			g.Assert(published.metadata["Entity-Count"]).Eql("2")
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+		})
+
+		g.It("Should keep the configured number of previous generations", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{History: 2},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			for _, name := range []string{"first", "second", "third", "fourth"} {
+				g.Assert(fullsync(storage, name, name)).IsNil()
+			}
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"fourth"}]`)
+			history := server.keys("datasets/people/entities/_history/")
+			g.Assert(len(history)).Eql(2)
+			g.Assert(string(server.object(history[0]).data)).Eql(`[{"name":"second"}]`)
+			g.Assert(string(server.object(history[1]).data)).Eql(`[{"name":"third"}]`)
+			g.Assert(server.object(history[1]).metadata["Entity-Count"]).Eql("1")
+		})
+
+		g.It("Should move previous generations with keys of their own to the history", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{History: 1}})
+			g.Assert(fullsync(storage, "1", "first")).IsNil()
+			g.Assert(fullsync(storage, "2", "second")).IsNil()
+			history := server.keys("datasets/people/entities/_history/")
+			g.Assert(len(history)).Eql(1)
+			g.Assert(string(server.object(history[0]).data)).Eql(`[{"name":"first"}]`)
+			published := server.keys("datasets/people/entities/")
+			g.Assert(len(published)).Eql(2)
+			for _, key := range published {
+				if key != history[0] {
+					g.Assert(string(server.object(key).data)).Eql(`[{"name":"second"}]`)
+				}
+			}
+
+			g.Assert(fullsync(storage, "3", "third")).IsNil()
+			pruned := server.keys("datasets/people/entities/_history/")
+			g.Assert(len(pruned)).Eql(1)
+			g.Assert(string(server.object(pruned[0]).data)).Eql(`[{"name":"second"}]`)
+			g.Assert(historyTime(strings.TrimPrefix(pruned[0], storage.fullSyncHistoryFolder())) >
+				historyTime(strings.TrimPrefix(history[0], storage.fullSyncHistoryFolder()))).IsTrue()
+		})
+
+		g.It("Should replace previous fullsyncs with keys of their own without history", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true})
+			g.Assert(fullsync(storage, "1", "first")).IsNil()
+			g.Assert(fullsync(storage, "2", "second")).IsNil()
+			published := server.keys("datasets/people/entities/")
+			g.Assert(len(published)).Eql(1)
+			g.Assert(string(server.object(published[0]).data)).Eql(`[{"name":"second"}]`)
+		})
+
+		g.It("Should read the last modified fullsync with a key of its own", func() {
+			storage := server.storage("people", conf.StorageBackend{})
+			g.Assert(storage.putObject("datasets/people/entities/a", []byte("[]"))).IsNil()
+			time.Sleep(time.Millisecond)
+			g.Assert(storage.putObject("datasets/people/entities/b", []byte("[]"))).IsNil()
+			key, err := storage.findNewestKey("entities")
+			g.Assert(err).IsNil()
+			g.Assert(*key).Eql("datasets/people/entities/b")
+			time.Sleep(time.Millisecond)
+			g.Assert(storage.putObject("datasets/people/entities/a", []byte("[]"))).IsNil()
+			key, err = storage.findNewestKey("entities")
+			g.Assert(err).IsNil()
+			g.Assert(*key).Eql("datasets/people/entities/a")
+		})
+
+		g.It("Should not publish fullsyncs failing validation", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{MinEntities: 2},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			g.Assert(fullsync(storage, "1", "a", "b")).IsNil()
+			err := fullsync(storage, "2", "c")
+			g.Assert(err.Error()).Eql("fullsync 2 has 1 entities, expected at least 2")
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"a"},{"name":"b"}]`)
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+		})
+
+		g.It("Should not publish staged fullsyncs with other content than written", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true,
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			written := []byte(`[{"name":"a"},{"name":"b"}]`)
+			checksum, _ := sha256Checksum(bytes.NewReader(written))
+			fullsync := &fullSyncState{Id: "1", StagingKey: storage.fullSyncStagingKey("1"), FinalKey: resourceName,
+				Entities: 2, Bytes: int64(len(written)), Checksum: checksum}
+			// a batch is lost and another repeated, the staged object has the expected size
+			staged := []byte(`[{"name":"a"},{"name":"a"}]`)
+			stagedChecksum, _ := sha256Checksum(bytes.NewReader(staged))
+			_, err := storage.uploader.S3.PutObject(&s3.PutObjectInput{Bucket: storage.config.Properties.Bucket,
+				Key: aws.String(fullsync.StagingKey), Body: bytes.NewReader(staged), ChecksumSHA256: aws.String(stagedChecksum)})
+			g.Assert(err).IsNil()
+			err = storage.publishFullSync(fullsync)
+			g.Assert(err.Error()).Eql("staged fullsync 1 does not have the checksum of the written content")
+			g.Assert(server.object(resourceName) == nil).IsTrue()
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+		})
+
+		g.It("Should only publish schemas inferred by fullsyncs that are published", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", FullSync: &conf.FullSyncConfig{MinEntities: 2},
+				ParquetConfig: &conf.ParquetConfig{InferSchema: &conf.ParquetSchemaInference{}}})
+			person := func(id string, props map[string]interface{}) *uda.Entity {
+				return &uda.Entity{ID: id, Properties: props}
+			}
+			inferred := func() string {
+				return string(server.object("schemas/people.parquet-schema").data)
+			}
+			g.Assert(storage.StoreEntities([]*uda.Entity{person("a:1", map[string]interface{}{"a:name": "Bob"})})).IsNil()
+			g.Assert(strings.Contains(inferred(), "binary name (STRING);")).IsTrue()
+
+			err := storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true},
+				[]*uda.Entity{person("a:1", map[string]interface{}{"a:age": float64(42)})})
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(inferred(), "int64 age;")).IsFalse("the schema is kept while the fullsync runs")
+			err = storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+			g.Assert(err.Error()).Eql("fullsync 1 has 1 entities, expected at least 2")
+			g.Assert(strings.Contains(inferred(), "int64 age;")).IsFalse("the schema of failed fullsyncs is dropped")
+			g.Assert(strings.Contains(storage.GetConfig().ParquetConfig.SchemaDefinition, "int64 age;")).IsFalse()
+
+			err = storage.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, []*uda.Entity{
+				person("a:1", map[string]interface{}{"a:age": float64(42)}), person("a:2", map[string]interface{}{"a:age": float64(43)})})
+			g.Assert(err).IsNil()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+			g.Assert(strings.Contains(inferred(), "int64 age;")).IsTrue()
+			g.Assert(strings.Contains(inferred(), "binary name (STRING);")).IsFalse()
+			g.Assert(strings.Contains(storage.GetConfig().ParquetConfig.SchemaDefinition, "int64 age;")).IsTrue()
+			g.Assert(strings.Contains(string(server.object("schemas/people-latest.sql").data), "`age` bigint")).IsTrue()
+		})
+
+		g.It("Should continue fullsyncs on any instance", func() {
+			defer func(size int) { fullSyncPartSize = size }(fullSyncPartSize)
+			fullSyncPartSize = 40
+			config := conf.StorageBackend{StripProps: true, Compression: "gzip", FullSync: &conf.FullSyncConfig{Persistent: true},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}}
+			first, second := server.storage("people", config), server.storage("people", config)
+			batch := func(name string) []*uda.Entity {
+				return []*uda.Entity{{ID: "a:" + name, Properties: map[string]interface{}{"a:name": name}}}
+			}
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, batch("a"))).IsNil()
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "1"}, batch("b"))).IsNil()
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1"}, batch("c"))).IsNil()
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "1"}, batch("d"))).IsNil()
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+
+			reader, err := encoder.NewDecompressingReader(bytes.NewReader(server.object(resourceName).data))
+			g.Assert(err).IsNil()
+			published, _ := io.ReadAll(reader)
+			g.Assert(string(published)).Eql(`[{"name":"a"},{"name":"b"},{"name":"c"},{"name":"d"}]`)
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+			g.Assert(server.uploadCount()).Eql(0)
+		})
+
+		g.It("Should continue fullsyncs from the batch that failed", func() {
+			config := conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{Persistent: true},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}}
+			first, second := server.storage("people", config), server.storage("people", config)
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+			more := []*uda.Entity{{ID: "a:2", Properties: map[string]interface{}{"a:name": "Alice"}}}
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			server.failNextWrite(first.fullSyncStateKey())
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1"}, more) == nil).IsFalse()
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "1"}, more)).IsNil()
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"Bob"},{"name":"Alice"}]`)
+		})
+
+		g.It("Should store retried requests once", func() {
+			defer func(size int) { fullSyncPartSize = size }(fullSyncPartSize)
+			fullSyncPartSize = 20
+			config := conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{Persistent: true},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}}
+			storage := server.storage("people", config)
+			g.Assert(storage.StoresFullSyncRequests()).IsTrue()
+			request := func(names ...string) []*uda.Entity {
+				var entities []*uda.Entity
+				for _, name := range names {
+					entities = append(entities, &uda.Entity{ID: "a:" + name, Properties: map[string]interface{}{"a:name": name}})
+				}
+				return entities
+			}
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, request("a"))).IsNil()
+			// the request fails halfway, after its part is uploaded
+			server.failNextWrite(storage.fullSyncStateKey())
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, request("b", "c")) == nil).IsFalse()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, request("b", "c"))).IsNil()
+			// the request is stored, but the response is lost
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, request("b", "c"))).IsNil()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, request("d"))).IsNil()
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"a"},{"name":"b"},{"name":"c"},{"name":"d"}]`)
+			g.Assert(server.object(resourceName).metadata["Entity-Count"]).Eql("4")
+		})
+
+		g.It("Should abandon unfinished fullsyncs started on other instances", func() {
+			config := conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{Persistent: true}}
+			first, second := server.storage("people", config), server.storage("people", config)
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, nil)).IsNil()
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, nil)).IsNil()
+			g.Assert(server.uploadCount()).Eql(1)
+			err := first.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+			g.Assert(err.Error()).Eql("Invalid fullsync ID")
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+			g.Assert(server.uploadCount()).Eql(0)
+		})
+
+		g.It("Should not overwrite fullsync states changed by other instances", func() {
+			config := conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{Persistent: true},
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}}
+			first, second := server.storage("people", config), server.storage("people", config)
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			stale, err := first.loadFullSyncState("1")
+			g.Assert(err).IsNil()
+			more := []*uda.Entity{{ID: "a:2", Properties: map[string]interface{}{"a:name": "Carol"}}}
+			g.Assert(second.StoreEntitiesFullSync(FullSyncState{Id: "1"}, more)).IsNil()
+			err = first.saveFullSyncState(stale, []byte(`{"name":"Alice"}`))
+			g.Assert(errors.Is(err, ErrFullSyncChanged)).IsTrue()
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"Bob"},{"name":"Carol"}]`)
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+
+			// fullsyncs started at the same time can not both replace the state
+			started, _, err := second.startFullSyncSegments("3", entities)
+			g.Assert(err).IsNil()
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, entities)).IsNil()
+			err = second.saveFullSyncState(started, nil)
+			g.Assert(errors.Is(err, ErrFullSyncChanged)).IsTrue()
+			second.abortFullSyncUpload(started)
+			g.Assert(first.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+		})
+
+		g.It("Should abort timed out fullsyncs and uploads of stopped instances", func() {
+			config := conf.StorageBackend{StripProps: true, FullSync: &conf.FullSyncConfig{Persistent: true}}
+			storage := server.storage("people", config)
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, nil)).IsNil()
+			// an instance stopped before it saved the state of its fullsync
+			_, _, err := storage.startFullSyncSegments("2", nil)
+			g.Assert(err).IsNil()
+			g.Assert(server.uploadCount()).Eql(2)
+
+			g.Assert(storage.abortStaleFullSyncs()).IsNil()
+			g.Assert(server.uploadCount()).Eql(2)
+			server.ageUploads(fullsyncTimeoutDuration + time.Minute)
+			g.Assert(storage.abortStaleFullSyncs()).IsNil()
+			g.Assert(server.uploadCount()).Eql(1)
+			g.Assert(server.object(storage.fullSyncStateKey()) != nil).IsTrue("the fullsync is still written to")
+
+			defer func(d time.Duration) { fullsyncTimeoutDuration = d }(fullsyncTimeoutDuration)
+			fullsyncTimeoutDuration = 0
+			g.Assert(storage.abortStaleFullSyncs()).IsNil()
+			g.Assert(server.uploadCount()).Eql(0)
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+		})
+
+		g.It("Should stream fullsyncs that are not persistent", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true,
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(server.object(storage.fullSyncStateKey()) == nil).IsTrue()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			g.Assert(string(server.object(resourceName).data)).Eql(`[{"name":"Bob"}]`)
+		})
+
+		g.It("Should stream fullsyncs in parts with checksums s3 validates", func() {
+			storage := server.storage("people", conf.StorageBackend{StripProps: true,
+				Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+			var entities []*uda.Entity
+			for i := 0; i < 6000; i++ {
+				entities = append(entities, &uda.Entity{ID: fmt.Sprintf("a:%v", i),
+					Properties: map[string]interface{}{"a:name": strings.Repeat("x", 1024)}})
+			}
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			published := server.object(resourceName)
+			g.Assert(len(published.data) > fullSyncPartSize).IsTrue()
+			g.Assert(strings.HasSuffix(published.checksum, "-2")).IsTrue(published.checksum)
+		})
+
+		g.Describe("spooled to a temp folder", func() {
+			var folder string
+			var storage *S3Storage
+			g.BeforeEach(func() {
+				folder, _ = os.MkdirTemp("", "spool")
+				storage = server.storage("people", conf.StorageBackend{StripProps: true,
+					Properties: conf.PropertiesMapping{ResourceName: &resourceName, CustomResourcePath: &custom}})
+				storage.env.FullsyncTempFolder = folder
+			})
+			g.AfterEach(func() {
+				_ = os.RemoveAll(folder)
+			})
+			eventually := func(condition func() bool) bool {
+				for i := 0; i < 100 && !condition(); i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return condition()
+			}
+
+			g.It("Should upload parts while batches arrive", func() {
+				defer func(size int) { fullSyncPartSize = size }(fullSyncPartSize)
+				fullSyncPartSize = 10
+				entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, entities)).IsNil()
+				g.Assert(eventually(func() bool { return server.partCount() > 0 })).IsTrue("parts uploaded before the end")
+				g.Assert(server.object(resourceName) == nil).IsTrue("nothing published before the end")
+
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+				published := server.object(resourceName)
+				g.Assert(string(published.data)).Eql(`[{"name":"Bob"},{"name":"Bob"}]`)
+				g.Assert(published.metadata["Entity-Count"]).Eql("2")
+				files, _ := os.ReadDir(folder)
+				g.Assert(len(files)).Eql(0)
+			})
+
+			g.It("Should upload parts of the chunk size when the uploader falls behind", func() {
+				defer func(size int) { fullSyncPartSize = size }(fullSyncPartSize)
+				fullSyncPartSize = 10
+				release := server.holdParts()
+				entities := []*uda.Entity{{ID: "a:1", Properties: map[string]interface{}{"a:name": "Bob"}}}
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+				for i := 0; i < 4; i++ {
+					g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, entities)).IsNil()
+				}
+				// the spool is closed by the end of the fullsync, while the first part is still held
+				time.AfterFunc(100*time.Millisecond, release)
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+				g.Assert(string(server.object(resourceName).data)).
+					Eql(`[{"name":"Bob"},{"name":"Bob"},{"name":"Bob"},{"name":"Bob"},{"name":"Bob"}]`)
+				g.Assert(server.largestPart).Eql(10)
+				files, _ := os.ReadDir(folder)
+				g.Assert(len(files)).Eql(0)
+			})
+
+			g.It("Should abort replaced fullsyncs and remove their files", func() {
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, nil)).IsNil()
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, nil)).IsNil()
+				g.Assert(eventually(func() bool { return server.uploadCount() == 1 })).IsTrue("replaced upload aborted")
+				err := storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)
+				g.Assert(err.Error()).Eql("Invalid fullsync ID")
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+				g.Assert(string(server.object(resourceName).data)).Eql(`[]`)
+				g.Assert(eventually(func() bool {
+					files, _ := os.ReadDir(folder)
+					return len(files) == 0
+				})).IsTrue("spool files removed")
+			})
+		})
+	})
+
+	g.Describe("Partitioned parquet datasets in s3", func() {
+		var server *s3Server
+		g.BeforeEach(func() {
+			server = newS3Server()
+		})
+		g.AfterEach(func() {
+			server.Close()
+		})
+		parquetConfig := &conf.ParquetConfig{
+			SchemaDefinition: `message test_schema {
+					required binary id (STRING);
+					optional binary country (STRING);
+					optional binary created (STRING);
+				}`,
+			Partitioning: []string{"country", "year(created)"},
+		}
+		person := func(id string, country string) *uda.Entity {
+			return &uda.Entity{ID: id, Properties: map[string]interface{}{
+				"a:id": id, "a:country": country, "a:created": "2024-05-01T10:00:00Z"}}
+		}
+		stored := func(storage *S3Storage) []map[string]interface{} {
+			reader, err := storage.GetEntities()
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			return m[1 : len(m)-1]
+		}
+
+		g.It("Should write an object per partition of a batch", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: parquetConfig})
+			g.Assert(storage.StoreEntities([]*uda.Entity{person("a:1", "no"), person("a:2", "se"), person("a:3", "no")})).IsNil()
+			g.Assert(len(server.keys("datasets/people/changes/country=no/year=2024/"))).Eql(1)
+			g.Assert(len(server.keys("datasets/people/changes/country=se/year=2024/"))).Eql(1)
+			g.Assert(len(server.keys("datasets/people/changes/"))).Eql(2)
+		})
+
+		g.It("Should store objects in the partition their batch was split into", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: parquetConfig})
+			g.Assert(storage.storeObject(storage.GetConfig(), []*uda.Entity{person("a:1", "no")}, "country=no/year=2023")).IsNil()
+			g.Assert(len(server.keys("datasets/people/changes/country=no/year=2023/"))).Eql(1)
+			g.Assert(len(server.keys("datasets/people/changes/"))).Eql(1)
+		})
+
+		g.It("Should export athena schemas with partition projection", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: &conf.ParquetConfig{
+				SchemaDefinition: parquetConfig.SchemaDefinition,
+				Partitioning:     []string{"year", "country"},
+			}})
+			g.Assert(storage.ExportSchema()).IsNil()
+			changes := string(server.object("schemas/people-changes.sql").data)
+			g.Assert(strings.Contains(changes, "PARTITIONED BY (\n  year STRING,\n  country STRING)")).IsTrue(changes)
+			g.Assert(strings.Contains(changes, "`country`")).IsFalse("partition columns are not table columns")
+			g.Assert(strings.Contains(changes,
+				"'storage.location.template'='s3://bucket/datasets/people/changes/year=${year}/country=${country}/'")).IsTrue(changes)
+			latest := string(server.object("schemas/people-latest.sql").data)
+			g.Assert(strings.Contains(latest, "PARTITIONED BY (\n  country STRING)")).IsTrue(latest)
+			g.Assert(strings.Contains(latest, "'projection.country.type'='injected'")).IsTrue(latest)
+		})
+
+		g.It("Should publish fullsyncs with an object per partition, replacing all partitions", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: parquetConfig,
+				DecodeConfig: &conf.DecodeConfig{IdProperty: "id", DefaultNamespace: "_", Namespaces: map[string]string{"_": "http://example.io/"}}})
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, []*uda.Entity{person("a:1", "no"), person("a:2", "se")})).IsNil()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, []*uda.Entity{person("a:3", "no")})).IsNil()
+			g.Assert(server.keys("datasets/people/entities/")).Eql([]string(nil))
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			norway := server.keys("datasets/people/entities/country=no/year=2024/")
+			g.Assert(len(norway)).Eql(1)
+			g.Assert(server.object(norway[0]).metadata["Entity-Count"]).Eql("2")
+			g.Assert(len(server.keys("datasets/people/entities/country=se/year=2024/"))).Eql(1)
+			g.Assert(server.keys("datasets/people/_staging/")).Eql([]string(nil))
+			g.Assert(len(stored(storage))).Eql(3)
+
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "2", Start: true}, []*uda.Entity{person("a:4", "dk")})).IsNil()
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "2", End: true}, nil)).IsNil()
+			published := server.keys("datasets/people/entities/")
+			g.Assert(len(published)).Eql(1)
+			g.Assert(strings.HasPrefix(published[0], "datasets/people/entities/country=dk/year=2024/")).IsTrue(published[0])
+			entities := stored(storage)
+			g.Assert(len(entities)).Eql(1)
+			g.Assert(strings.HasSuffix(entities[0]["id"].(string), "a:4")).IsTrue(entities[0]["id"])
+		})
+
+		g.It("Should fail fullsyncs with more partitions than configured", func() {
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: parquetConfig,
+				FullSync: &conf.FullSyncConfig{MaxPartitions: 2}})
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, []*uda.Entity{person("a:1", "no"), person("a:2", "se")})).IsNil()
+			err := storage.StoreEntitiesFullSync(FullSyncState{Id: "1"}, []*uda.Entity{person("a:3", "dk")})
+			g.Assert(err.Error()).Eql("fullsync 1 of dataset people has more than 2 partitions, see fullSync.maxPartitions")
+			g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil) == nil).IsFalse()
+			g.Assert(server.keys("datasets/people/entities/")).Eql([]string(nil))
+		})
+
+		g.It("Should keep the partitions of previous generations together in the history", func() {
+			resourceName := "people.parquet"
+			storage := server.storage("people", conf.StorageBackend{Dataset: "people", ParquetConfig: parquetConfig,
+				FullSync: &conf.FullSyncConfig{History: 1}, Properties: conf.PropertiesMapping{ResourceName: &resourceName}})
+			for _, id := range []string{"1", "2", "3"} {
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: id, Start: true}, []*uda.Entity{person("a:"+id, "no"), person("a:"+id, "se")})).IsNil()
+				g.Assert(storage.StoreEntitiesFullSync(FullSyncState{Id: id, End: true}, nil)).IsNil()
+			}
+			g.Assert(server.keys("datasets/people/latest/")).Eql([]string{
+				"datasets/people/latest/country=no/year=2024/people.parquet",
+				"datasets/people/latest/country=se/year=2024/people.parquet",
+			})
+			history := server.keys("datasets/people/entities/_history/")
+			g.Assert(len(history)).Eql(2)
+			g.Assert(historyTime(strings.TrimPrefix(history[0], storage.fullSyncHistoryFolder()))).
+				Eql(historyTime(strings.TrimPrefix(history[1], storage.fullSyncHistoryFolder())))
+			g.Assert(strings.HasSuffix(history[0], "/country=no/year=2024/people.parquet")).IsTrue(history[0])
+		})
 	})
 }
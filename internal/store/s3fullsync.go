@@ -0,0 +1,924 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+const (
+	// maxCopyObjectSize is the largest object s3 copies in a single request, larger objects are copied in parts
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	copyPartSize      = 1024 * 1024 * 1024
+
+	// entityCountMetadata is the metadata of published fullsyncs with the number of entities in the object
+	entityCountMetadata = "Entity-Count"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// sha256Checksum is the base64 encoded sha256 of a body, as s3 takes it in checksums. The body is read from its
+// current position, and returned to it.
+func sha256Checksum(body io.ReadSeeker) (string, error) {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// compositeChecksum is the checksum s3 gives objects of multipart uploads with sha256 checksums of their parts: the
+// sha256 of the part checksums, followed by the number of parts
+func compositeChecksum(parts []string) (string, error) {
+	h := sha256.New()
+	for _, part := range parts {
+		digest, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return "", err
+		}
+		h.Write(digest)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(parts)), nil
+}
+
+// sameChecksum compares checksums, leaving out the number of parts s3 may add to checksums of multipart uploads
+func sameChecksum(a string, b string) bool {
+	return strings.SplitN(a, "-", 2)[0] == strings.SplitN(b, "-", 2)[0]
+}
+
+// uploadChecksums sends sha256 checksums with the requests of an upload through the s3 upload manager, which only
+// sends checksums given with the upload for objects uploaded in a single request. S3 rejects parts not matching
+// their checksum. The checksum of the uploaded object is kept, to validate the object before it is published.
+type uploadChecksums struct {
+	mutex     sync.Mutex
+	parts     map[int64]string
+	multipart bool
+}
+
+// add is a request option of the upload manager, setting the checksums before the requests are built
+func (c *uploadChecksums) add(r *request.Request) {
+	r.Handlers.Build.PushFront(func(r *request.Request) {
+		switch input := r.Params.(type) {
+		case *s3.PutObjectInput:
+			input.ChecksumSHA256, r.Error = c.part(1, input.Body)
+		case *s3.CreateMultipartUploadInput:
+			input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		case *s3.UploadPartInput:
+			input.ChecksumSHA256, r.Error = c.part(aws.Int64Value(input.PartNumber), input.Body)
+		case *s3.CompleteMultipartUploadInput:
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			c.multipart = true
+			for _, part := range input.MultipartUpload.Parts {
+				part.ChecksumSHA256 = aws.String(c.parts[aws.Int64Value(part.PartNumber)])
+			}
+		}
+	})
+}
+
+func (c *uploadChecksums) part(number int64, body io.ReadSeeker) (*string, error) {
+	checksum, err := sha256Checksum(body)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.parts == nil {
+		c.parts = make(map[int64]string)
+	}
+	c.parts[number] = checksum
+	return aws.String(checksum), nil
+}
+
+// checksum is the checksum s3 gives the uploaded object
+func (c *uploadChecksums) checksum() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.multipart {
+		return c.parts[1], nil
+	}
+	numbers := make([]int64, 0, len(c.parts))
+	for number := range c.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+	parts := make([]string, 0, len(numbers))
+	for _, number := range numbers {
+		parts = append(parts, c.parts[number])
+	}
+	return compositeChecksum(parts)
+}
+
+// fullSyncStagingKey is the key a fullsync is uploaded to until the end request publishes it
+func (s3s *S3Storage) fullSyncStagingKey(id string) string {
+	return fmt.Sprintf("datasets/%s/_staging/%s", s3s.dataset, url.PathEscape(id))
+}
+
+// fullSyncHistoryFolder holds the previous generations of published fullsyncs
+func (s3s *S3Storage) fullSyncHistoryFolder() string {
+	return fmt.Sprintf("datasets/%s/entities/_history/", s3s.dataset)
+}
+
+// publishFullSync validates the staged fullsync and copies it to its final key. With fullSync.history configured, the
+// previous generations are moved to the history folder first, keeping the newest generations only.
+func (s3s *S3Storage) publishFullSync(fullsync *fullSyncState) error {
+	return s3s.publishFullSyncObjects(fullsync.Id, []*fullSyncState{fullsync})
+}
+
+// publishFullSyncObjects publishes the staged objects of a fullsync, one per partition of datasets partitioned by
+// entity properties. Published partitions without entities in the fullsync are deleted.
+func (s3s *S3Storage) publishFullSyncObjects(id string, objects []*fullSyncState) error {
+	bucket := *s3s.config.Properties.Bucket
+	entities := 0
+	for _, fullsync := range objects {
+		head, err := s3s.uploader.S3.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(fullsync.StagingKey),
+			ChecksumMode: aws.String(s3.ChecksumModeEnabled)})
+		if err != nil {
+			return fmt.Errorf("staged fullsync %s not found: %w", fullsync.Id, err)
+		}
+		if err := validateStagedFullSync(fullsync, head); err != nil {
+			s3s.deleteStagedFullSync(objects)
+			return err
+		}
+		entities += fullsync.Entities
+	}
+	if s3s.config.FullSync != nil && entities < s3s.config.FullSync.MinEntities {
+		s3s.deleteStagedFullSync(objects)
+		return fmt.Errorf("fullsync %s has %v entities, expected at least %v", id, entities, s3s.config.FullSync.MinEntities)
+	}
+
+	history := 0
+	if s3s.config.FullSync != nil {
+		history = s3s.config.FullSync.History
+	}
+	// the objects replaced by the fullsync are deleted once it is published, also without history
+	partitioned := encoder.HasEntityPartitions(s3s.config)
+	var previous []string
+	var err error
+	if partitioned {
+		previous, err = s3s.partitionedFullSyncKeys()
+	} else {
+		previous, err = s3s.previousGenerations(objects[0].FinalKey)
+	}
+	if err != nil {
+		return err
+	}
+	if history > 0 {
+		// the objects replaced by the fullsync are kept as one generation, named by the time they were replaced
+		generation := time.Now().UnixNano()
+		for _, key := range previous {
+			historyKey := fmt.Sprintf("%s%d-%s", s3s.fullSyncHistoryFolder(), generation, path.Base(key))
+			if partitioned {
+				// the partitions of a generation are kept together in a folder
+				historyKey = fmt.Sprintf("%s%d/%s", s3s.fullSyncHistoryFolder(), generation, s3s.partitionedFullSyncPath(key))
+			}
+			if err := s3s.copyObject(key, historyKey, nil); err != nil {
+				return fmt.Errorf("failed to keep %s in history: %w", key, err)
+			}
+		}
+	}
+
+	published := make(map[string]bool)
+	for _, fullsync := range objects {
+		metadata := map[string]*string{entityCountMetadata: aws.String(strconv.Itoa(fullsync.Entities))}
+		if err := s3s.copyObject(fullsync.StagingKey, fullsync.FinalKey, metadata); err != nil {
+			return fmt.Errorf("failed to publish fullsync %s: %w", fullsync.Id, err)
+		}
+		published[fullsync.FinalKey] = true
+		s3s.logger.Infof("Published fullsync %s with %v entities to %s", fullsync.Id, fullsync.Entities, fullsync.FinalKey)
+	}
+	for _, key := range previous {
+		if !published[key] {
+			s3s.deleteObject(key)
+		}
+	}
+	s3s.deleteStagedFullSync(objects)
+	if history > 0 {
+		return s3s.pruneFullSyncHistory(history)
+	}
+	return nil
+}
+
+func (s3s *S3Storage) deleteStagedFullSync(objects []*fullSyncState) {
+	for _, fullsync := range objects {
+		s3s.deleteObject(fullsync.StagingKey)
+	}
+}
+
+// validateStagedFullSync checks that the staged object has all bytes written, and the checksum of the written parts.
+// S3 rejects parts with other content than their checksum, and combines the checksums of the parts into the checksum
+// of the object, so lost or repeated parts are found without reading the object.
+func validateStagedFullSync(fullsync *fullSyncState, head *s3.HeadObjectOutput) error {
+	if size := aws.Int64Value(head.ContentLength); size != fullsync.Bytes {
+		return fmt.Errorf("staged fullsync %s has %v bytes, expected %v", fullsync.Id, size, fullsync.Bytes)
+	}
+	if fullsync.Checksum == "" {
+		// persistent fullsyncs with parts uploaded before checksums were kept
+		return nil
+	}
+	if !sameChecksum(aws.StringValue(head.ChecksumSHA256), fullsync.Checksum) {
+		return fmt.Errorf("staged fullsync %s does not have the checksum of the written content", fullsync.Id)
+	}
+	return nil
+}
+
+// previousGenerations returns the published fullsyncs replaced by the staged fullsync: the object at the final key,
+// or the other objects in the entities folder if each fullsync gets a key of its own
+func (s3s *S3Storage) previousGenerations(finalKey string) ([]string, error) {
+	bucket := *s3s.config.Properties.Bucket
+	if s3s.config.Properties.ResourceName != nil {
+		_, err := s3s.uploader.S3.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(finalKey)})
+		if err != nil {
+			if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []string{finalKey}, nil
+	}
+	keys, err := s3s.listKeys(fmt.Sprintf("datasets/%s/entities/", s3s.dataset))
+	if err != nil {
+		return nil, err
+	}
+	var previous []string
+	for _, key := range keys {
+		if key != finalKey && !strings.HasPrefix(key, s3s.fullSyncHistoryFolder()) {
+			previous = append(previous, key)
+		}
+	}
+	return previous, nil
+}
+
+// pruneFullSyncHistory deletes all but the newest generations in the history folder
+func (s3s *S3Storage) pruneFullSyncHistory(keep int) error {
+	keys, err := s3s.listKeys(s3s.fullSyncHistoryFolder())
+	if err != nil {
+		return err
+	}
+	// history keys start with the time they were replaced, the partitions of a generation share the time
+	generations := make(map[int64][]string)
+	var times []int64
+	for _, key := range keys {
+		t := historyTime(strings.TrimPrefix(key, s3s.fullSyncHistoryFolder()))
+		if _, ok := generations[t]; !ok {
+			times = append(times, t)
+		}
+		generations[t] = append(generations[t], key)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	for len(times) > keep {
+		for _, key := range generations[times[0]] {
+			s3s.deleteObject(key)
+		}
+		times = times[1:]
+	}
+	return nil
+}
+
+func historyTime(key string) int64 {
+	folder := strings.SplitN(key, "/", 2)[0]
+	t, _ := strconv.ParseInt(strings.SplitN(folder, "-", 2)[0], 10, 64)
+	return t
+}
+
+func (s3s *S3Storage) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := s3s.uploader.S3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(*s3s.config.Properties.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// copyObject copies an object within the bucket, in parts if it is too large for a single copy. Without metadata,
+// the copy keeps the metadata of the object.
+func (s3s *S3Storage) copyObject(from string, to string, metadata map[string]*string) error {
+	bucket := *s3s.config.Properties.Bucket
+	head, err := s3s.uploader.S3.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(from)})
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	source := url.PathEscape(bucket + "/" + from)
+	if size <= maxCopyObjectSize {
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(to),
+			CopySource: aws.String(source),
+		}
+		if metadata != nil {
+			input.ContentType = s3s.contentType()
+			input.ContentEncoding = s3s.contentEncoding()
+			input.Metadata = metadata
+			input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		}
+		_, err := s3s.uploader.S3.CopyObject(input)
+		return err
+	}
+
+	if metadata == nil {
+		metadata = head.Metadata
+	}
+	upload, err := s3s.uploader.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(to),
+		ContentType:     s3s.contentType(),
+		ContentEncoding: s3s.contentEncoding(),
+		Metadata:        metadata,
+	})
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+copyPartSize, number+1 {
+		last := offset + copyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		part, err := s3s.uploader.S3.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(to),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+			PartNumber:      aws.Int64(number),
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			_, _ = s3s.uploader.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket: aws.String(bucket), Key: aws.String(to), UploadId: upload.UploadId})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+	_, err = s3s.uploader.S3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(to),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// deleteObject deletes an object, logging failures since the object is no longer needed
+func (s3s *S3Storage) deleteObject(key string) {
+	_, err := s3s.uploader.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(*s3s.config.Properties.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		s3s.logger.Warnf("Failed to delete %s: %v", key, err)
+	}
+}
+
+// fullSyncPartSize is the size pending segments must reach before they are uploaded as a part. S3 requires all parts
+// but the last to be at least 5MB.
+var fullSyncPartSize = 5 * 1024 * 1024
+
+// fullSyncState is the state of a fullsync written in segments. It is kept in the bucket, so the fullsync continues
+// on any instance: segments are uploaded as parts of a multipart upload to the staging key, and segments too small
+// for a part are kept in a pending object until the next batch.
+type fullSyncState struct {
+	Id         string         `json:"id"`
+	UploadId   string         `json:"uploadId"`
+	StagingKey string         `json:"stagingKey"`
+	FinalKey   string         `json:"finalKey"`
+	Parts      []fullSyncPart `json:"parts"`
+	PendingKey string         `json:"pendingKey,omitempty"`
+	Version    int            `json:"version"`
+	Entities   int            `json:"entities"`
+	Bytes      int64          `json:"bytes"`
+	Updated    time.Time      `json:"updated"`
+	// Request is the digest of the entities of the last stored request, to recognize retries of stored requests
+	Request string `json:"request,omitempty"`
+	// Checksum is the sha256 checksum s3 gives the staged object, set when the upload is completed
+	Checksum string `json:"checksum,omitempty"`
+	// etag is the ETag of the state in the bucket the fullsync was read from, empty if it was never saved
+	etag string
+}
+
+type fullSyncPart struct {
+	Number   int64  `json:"number"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// staleFullSyncInterval is how often persistent fullsyncs are checked for timeouts
+var staleFullSyncInterval = 5 * time.Minute
+
+// ErrFullSyncChanged is returned when another instance changed the state of a fullsync while a batch was written
+var ErrFullSyncChanged = errors.New("fullsync was changed by another instance")
+
+// persistsFullSyncs tells if fullsyncs of the dataset are written in segments with their state kept in the bucket.
+// Datasets opt in with fullSync.persistent, for formats that can be written in segments.
+func (s3s *S3Storage) persistsFullSyncs() bool {
+	return s3s.config.FullSync != nil && s3s.config.FullSync.Persistent && encoder.SupportsSegments(s3s.config)
+}
+
+// fullSyncStateKey is the key of the state of the ongoing fullsync of the dataset
+func (s3s *S3Storage) fullSyncStateKey() string {
+	return fmt.Sprintf("datasets/%s/_staging/_fullsync.json", s3s.dataset)
+}
+
+// storeFullSyncSegment writes a batch of a fullsync as a segment. The state in the bucket is written last, so a
+// batch that fails leaves the fullsync as it was before the batch, and the batch can be retried on any instance.
+func (s3s *S3Storage) storeFullSyncSegment(state FullSyncState, entities []*uda.Entity) error {
+	if !state.Start {
+		fullsync, err := s3s.loadFullSyncState(state.Id)
+		if err != nil {
+			return err
+		}
+		return s3s.writeFullSyncSegment(fullsync, state, entities)
+	}
+	fullsync, previous, err := s3s.startFullSyncSegments(state.Id, entities)
+	if err != nil {
+		return err
+	}
+	if err := s3s.writeFullSyncSegment(fullsync, state, entities); err != nil {
+		// the fullsync was never saved, it is restarted by retrying the start batch
+		s3s.abortFullSyncUpload(fullsync)
+		return err
+	}
+	if previous != nil {
+		// the replaced fullsync is only abandoned once the new one took over its state
+		s3s.logger.Infof("fullsync id %v replaces unfinished fullsync id %v", state.Id, previous.Id)
+		s3s.abortFullSyncUpload(previous)
+		if previous.PendingKey != "" {
+			s3s.deleteObject(previous.PendingKey)
+		}
+	}
+	return nil
+}
+
+func (s3s *S3Storage) writeFullSyncSegment(fullsync *fullSyncState, state FullSyncState, entities []*uda.Entity) error {
+	if len(entities) > 0 {
+		request, err := requestDigest(entities)
+		if err != nil {
+			return err
+		}
+		if request == fullsync.Request {
+			// the request was stored, but its response was lost
+			s3s.logger.Warnf("skipping retried request of fullsync %s with %v entities", fullsync.Id, len(entities))
+			if !state.End {
+				return nil
+			}
+			entities = nil
+		}
+		fullsync.Request = request
+	}
+	pending, err := s3s.pendingSegments(fullsync)
+	if err != nil {
+		return err
+	}
+	if len(entities) > 0 || state.End {
+		segment, err := encoder.EncodeSegment(s3s.config, entities, fullsync.Entities > 0, state.End, s3s.logger)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, segment...)
+		fullsync.Entities += len(entities)
+		fullsync.Bytes += int64(len(segment))
+		s3s.logger.Debugf("encoded %v entities into a segment of %v bytes", len(entities), len(segment))
+	}
+	if state.End {
+		return s3s.completeFullSyncSegments(fullsync, pending)
+	}
+	if len(pending) >= fullSyncPartSize {
+		if err := s3s.uploadFullSyncPart(fullsync, bytes.NewReader(pending), int64(len(pending))); err != nil {
+			return err
+		}
+		pending = nil
+	}
+	return s3s.saveFullSyncState(fullsync, pending)
+}
+
+// requestDigest identifies the entities of a request
+func requestDigest(entities []*uda.Entity) (string, error) {
+	data, err := json.Marshal(entities)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// StoresFullSyncRequests tells that persistent fullsyncs store each request as a single batch, so a request is stored
+// completely or not at all
+func (s3s *S3Storage) StoresFullSyncRequests() bool {
+	return s3s.persistsFullSyncs()
+}
+
+// startFullSyncSegments starts a multipart upload for a new fullsync, which replaces the state of the ongoing fullsync
+// of the dataset when it is saved. The ongoing fullsync is returned, to be abandoned once it is replaced.
+func (s3s *S3Storage) startFullSyncSegments(id string, entities []*uda.Entity) (*fullSyncState, *fullSyncState, error) {
+	if s3s.env.Env == "local" {
+		if _, err := s3s.CreateBucketIfNotExist(); err != nil {
+			return nil, nil, err
+		}
+	}
+	previous, err := s3s.readFullSyncState()
+	if err != nil {
+		return nil, nil, err
+	}
+	fullsync := &fullSyncState{Id: id, StagingKey: s3s.fullSyncStagingKey(id), FinalKey: s3s.fullSyncFinalKey(entities, "")}
+	if previous != nil {
+		fullsync.etag = previous.etag
+	}
+	if err := s3s.createFullSyncUpload(fullsync); err != nil {
+		return nil, nil, err
+	}
+	return fullsync, previous, nil
+}
+
+// loadFullSyncState reads the state of the ongoing fullsync, which must have the given id and not be timed out
+func (s3s *S3Storage) loadFullSyncState(id string) (*fullSyncState, error) {
+	fullsync, err := s3s.readFullSyncState()
+	if err != nil {
+		return nil, err
+	}
+	if fullsync == nil {
+		return nil, ErrFullSyncNotInitialized
+	}
+	if time.Since(fullsync.Updated) > fullsyncTimeoutDuration {
+		s3s.logger.Warnf("fullsync id %v has not received new data in %v. abandoning.", fullsync.Id, fullsyncTimeoutDuration)
+		s3s.abandonFullSyncSegments(fullsync)
+		return nil, ErrFullSyncNotInitialized
+	}
+	if fullsync.Id != id {
+		s3s.logger.Warnf("Invalid fullsync id. requester sent id %v, ongoing sync has id %v", id, fullsync.Id)
+		return nil, ErrInvalidFullSyncId
+	}
+	return fullsync, nil
+}
+
+// readFullSyncState reads the state of the ongoing fullsync, or nil if there is none
+func (s3s *S3Storage) readFullSyncState() (*fullSyncState, error) {
+	out, err := s3s.uploader.S3.GetObject(&s3.GetObjectInput{Bucket: s3s.config.Properties.Bucket, Key: aws.String(s3s.fullSyncStateKey())})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read fullsync state: %w", err)
+	}
+	defer func() {
+		_ = out.Body.Close()
+	}()
+	fullsync := &fullSyncState{etag: aws.StringValue(out.ETag)}
+	if err := json.NewDecoder(out.Body).Decode(fullsync); err != nil {
+		return nil, fmt.Errorf("failed to read fullsync state: %w", err)
+	}
+	return fullsync, nil
+}
+
+// saveFullSyncState writes the pending segments and the state of the fullsync with a new version. The state is only
+// written if it is unchanged since it was read, so instances writing batches of the same fullsync at the same time
+// can not overwrite each other. Pending objects get names of their own, as they are written before the state.
+func (s3s *S3Storage) saveFullSyncState(fullsync *fullSyncState, pending []byte) error {
+	previousPending := fullsync.PendingKey
+	fullsync.Version++
+	fullsync.PendingKey = ""
+	if len(pending) > 0 {
+		fullsync.PendingKey = fmt.Sprintf("%s.%d-%s.pending", fullsync.StagingKey, fullsync.Version, uuid.New().String())
+		if err := s3s.putObject(fullsync.PendingKey, pending); err != nil {
+			return fmt.Errorf("failed to write pending segments of fullsync %s: %w", fullsync.Id, err)
+		}
+	}
+	fullsync.Updated = time.Now()
+	data, err := json.Marshal(fullsync)
+	if err != nil {
+		return err
+	}
+	// new states must not replace a state saved meanwhile, known states must be unchanged
+	condition := map[string]string{"If-None-Match": "*"}
+	if fullsync.etag != "" {
+		condition = map[string]string{"If-Match": fullsync.etag}
+	}
+	out, err := s3s.uploader.S3.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(s3s.fullSyncStateKey()),
+		Body:   bytes.NewReader(data),
+	}, request.WithSetRequestHeaders(condition))
+	if err != nil {
+		if fullsync.PendingKey != "" {
+			s3s.deleteObject(fullsync.PendingKey)
+		}
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("%w: %s", ErrFullSyncChanged, fullsync.Id)
+		}
+		return fmt.Errorf("failed to write fullsync state: %w", err)
+	}
+	fullsync.etag = aws.StringValue(out.ETag)
+	if previousPending != "" && previousPending != fullsync.PendingKey {
+		s3s.deleteObject(previousPending)
+	}
+	s3s.pendingLock.Lock()
+	defer s3s.pendingLock.Unlock()
+	s3s.pendingState, s3s.pendingVersion, s3s.pending = fullsync.Id, fullsync.Version, pending
+	return nil
+}
+
+// pendingSegments returns the pending segments of the fullsync, from memory if this instance wrote the current
+// version of the fullsync
+func (s3s *S3Storage) pendingSegments(fullsync *fullSyncState) ([]byte, error) {
+	if fullsync.PendingKey == "" {
+		return nil, nil
+	}
+	s3s.pendingLock.Lock()
+	if s3s.pendingState == fullsync.Id && s3s.pendingVersion == fullsync.Version {
+		defer s3s.pendingLock.Unlock()
+		return append([]byte(nil), s3s.pending...), nil
+	}
+	s3s.pendingLock.Unlock()
+	pending, err := s3s.getObject(fullsync.PendingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending segments of fullsync %s: %w", fullsync.Id, err)
+	}
+	return pending, nil
+}
+
+// uploadFullSyncPart uploads the next part of a fullsync from the body of the given size, with its sha256 checksum
+func (s3s *S3Storage) uploadFullSyncPart(fullsync *fullSyncState, body io.ReadSeeker, size int64) error {
+	number := int64(len(fullsync.Parts) + 1)
+	checksum, err := sha256Checksum(body)
+	if err != nil {
+		return fmt.Errorf("failed to read part %v of fullsync %s: %w", number, fullsync.Id, err)
+	}
+	part, err := s3s.uploader.S3.UploadPart(&s3.UploadPartInput{
+		Bucket:         s3s.config.Properties.Bucket,
+		Key:            aws.String(fullsync.StagingKey),
+		UploadId:       aws.String(fullsync.UploadId),
+		PartNumber:     aws.Int64(number),
+		Body:           body,
+		ContentLength:  aws.Int64(size),
+		ChecksumSHA256: aws.String(checksum),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %v of fullsync %s: %w", number, fullsync.Id, err)
+	}
+	fullsync.Parts = append(fullsync.Parts, fullSyncPart{Number: number, ETag: aws.StringValue(part.ETag), Size: size,
+		Checksum: checksum})
+	s3s.logger.Debugf("uploaded part %v of fullsync %s with %v bytes", number, fullsync.Id, size)
+	return nil
+}
+
+// completeFullSyncSegments uploads the last part, completes the multipart upload and publishes the fullsync
+func (s3s *S3Storage) completeFullSyncSegments(fullsync *fullSyncState, pending []byte) error {
+	if len(pending) > 0 {
+		if err := s3s.uploadFullSyncPart(fullsync, bytes.NewReader(pending), int64(len(pending))); err != nil {
+			return err
+		}
+	}
+	if err := s3s.completeFullSyncUpload(fullsync); err != nil {
+		return err
+	}
+	// the fullsync is finished, also if it is not published, unless another instance took it over meanwhile
+	if err := s3s.deleteFullSyncState(fullsync); err != nil {
+		s3s.deleteObject(fullsync.StagingKey)
+		return err
+	}
+	if fullsync.PendingKey != "" {
+		s3s.deleteObject(fullsync.PendingKey)
+	}
+	s3s.pendingLock.Lock()
+	s3s.pendingState, s3s.pending = "", nil
+	s3s.pendingLock.Unlock()
+	return s3s.publishFullSync(fullsync)
+}
+
+// completeFullSyncUpload completes the multipart upload of the fullsync to its staging key, and keeps the checksum of
+// the staged object
+func (s3s *S3Storage) completeFullSyncUpload(fullsync *fullSyncState) error {
+	bucket := s3s.config.Properties.Bucket
+	if len(fullsync.Parts) == 0 {
+		// s3 does not complete multipart uploads without parts
+		_, _ = s3s.uploader.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket: bucket, Key: aws.String(fullsync.StagingKey), UploadId: aws.String(fullsync.UploadId)})
+		checksum, err := sha256Checksum(bytes.NewReader(nil))
+		if err != nil {
+			return err
+		}
+		if _, err := s3s.uploader.S3.PutObject(&s3.PutObjectInput{
+			Bucket:          bucket,
+			Key:             aws.String(fullsync.StagingKey),
+			Body:            bytes.NewReader(nil),
+			ContentType:     s3s.contentType(),
+			ContentEncoding: s3s.contentEncoding(),
+			ChecksumSHA256:  aws.String(checksum),
+		}); err != nil {
+			return err
+		}
+		fullsync.Checksum = checksum
+		return nil
+	}
+	var parts []*s3.CompletedPart
+	var checksums []string
+	for _, part := range fullsync.Parts {
+		completed := &s3.CompletedPart{ETag: aws.String(part.ETag), PartNumber: aws.Int64(part.Number)}
+		if part.Checksum != "" {
+			completed.ChecksumSHA256 = aws.String(part.Checksum)
+			checksums = append(checksums, part.Checksum)
+		}
+		parts = append(parts, completed)
+	}
+	fullsync.Checksum = ""
+	if len(checksums) == len(parts) {
+		checksum, err := compositeChecksum(checksums)
+		if err != nil {
+			return err
+		}
+		fullsync.Checksum = checksum
+	}
+	if _, err := s3s.uploader.S3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             aws.String(fullsync.StagingKey),
+		UploadId:        aws.String(fullsync.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return fmt.Errorf("failed to complete fullsync %s: %w", fullsync.Id, err)
+	}
+	s3s.logger.Info("Successfully staged fullsync at ", fullsync.StagingKey)
+	return nil
+}
+
+// createFullSyncUpload starts the multipart upload of a fullsync to its staging key
+func (s3s *S3Storage) createFullSyncUpload(fullsync *fullSyncState) error {
+	upload, err := s3s.uploader.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:            s3s.config.Properties.Bucket,
+		Key:               aws.String(fullsync.StagingKey),
+		ContentType:       s3s.contentType(),
+		ContentEncoding:   s3s.contentEncoding(),
+		ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+	})
+	if err != nil {
+		return err
+	}
+	fullsync.UploadId = aws.StringValue(upload.UploadId)
+	s3s.logger.Infof("Writing -> %s", fullsync.StagingKey)
+	return nil
+}
+
+// abortFullSyncUpload aborts the multipart upload of an unfinished fullsync
+func (s3s *S3Storage) abortFullSyncUpload(fullsync *fullSyncState) {
+	_, err := s3s.uploader.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   s3s.config.Properties.Bucket,
+		Key:      aws.String(fullsync.StagingKey),
+		UploadId: aws.String(fullsync.UploadId),
+	})
+	if err != nil {
+		s3s.logger.Warnf("Failed to abort fullsync %s: %v", fullsync.Id, err)
+	}
+}
+
+// abandonFullSyncSegments aborts the multipart upload of an unfinished fullsync and deletes its state
+func (s3s *S3Storage) abandonFullSyncSegments(fullsync *fullSyncState) {
+	s3s.abortFullSyncUpload(fullsync)
+	if fullsync.PendingKey != "" {
+		s3s.deleteObject(fullsync.PendingKey)
+	}
+	_ = s3s.deleteFullSyncState(fullsync)
+}
+
+// deleteFullSyncState deletes the saved state of a fullsync, unless another instance changed it since it was read
+func (s3s *S3Storage) deleteFullSyncState(fullsync *fullSyncState) error {
+	if fullsync.etag == "" {
+		return nil
+	}
+	_, err := s3s.uploader.S3.DeleteObjectWithContext(aws.BackgroundContext(), &s3.DeleteObjectInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(s3s.fullSyncStateKey()),
+	}, request.WithSetRequestHeaders(map[string]string{"If-Match": fullsync.etag}))
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("%w: %s", ErrFullSyncChanged, fullsync.Id)
+	}
+	if err != nil {
+		s3s.logger.Warnf("Failed to delete state of fullsync %s: %v", fullsync.Id, err)
+	}
+	return nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var aerr awserr.RequestFailure
+	return errors.As(err, &aerr) && aerr.StatusCode() == http.StatusPreconditionFailed
+}
+
+// checkStaleFullSyncs abandons timed out persistent fullsyncs until the context is done
+func (s3s *S3Storage) checkStaleFullSyncs(ctx context.Context) {
+	ticker := time.NewTicker(staleFullSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s3s.abortStaleFullSyncs(); err != nil {
+				s3s.logger.Warnf("Failed to check for stale fullsyncs: %v", err)
+			}
+		}
+	}
+}
+
+// abortStaleFullSyncs abandons the persistent fullsync of the dataset if it timed out, and aborts the other multipart
+// uploads to the staging folder started before the timeout, like the uploads of instances stopped before they saved
+// the state of a fullsync.
+func (s3s *S3Storage) abortStaleFullSyncs() error {
+	fullsync, err := s3s.readFullSyncState()
+	if err != nil {
+		return err
+	}
+	if fullsync != nil && time.Since(fullsync.Updated) > fullsyncTimeoutDuration {
+		s3s.logger.Warnf("fullsync id %v has not received new data in %v. abandoning.", fullsync.Id, fullsyncTimeoutDuration)
+		s3s.abandonFullSyncSegments(fullsync)
+		fullsync = nil
+	}
+	var stale []*fullSyncState
+	err = s3s.uploader.S3.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Prefix: aws.String(fmt.Sprintf("datasets/%s/_staging/", s3s.dataset)),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if fullsync != nil && aws.StringValue(upload.UploadId) == fullsync.UploadId {
+				continue
+			}
+			if time.Since(aws.TimeValue(upload.Initiated)) > fullsyncTimeoutDuration {
+				stale = append(stale, &fullSyncState{Id: path.Base(aws.StringValue(upload.Key)),
+					StagingKey: aws.StringValue(upload.Key), UploadId: aws.StringValue(upload.UploadId)})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, upload := range stale {
+		s3s.logger.Infof("aborting stale upload of fullsync %v", upload.Id)
+		s3s.abortFullSyncUpload(upload)
+	}
+	return nil
+}
+
+func (s3s *S3Storage) getObject(key string) ([]byte, error) {
+	out, err := s3s.uploader.S3.GetObject(&s3.GetObjectInput{Bucket: s3s.config.Properties.Bucket, Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = out.Body.Close()
+	}()
+	return io.ReadAll(out.Body)
+}
+
+func (s3s *S3Storage) putObject(key string, data []byte) error {
+	_, err := s3s.uploader.S3.PutObject(&s3.PutObjectInput{
+		Bucket: s3s.config.Properties.Bucket,
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
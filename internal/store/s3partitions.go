@@ -0,0 +1,250 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+// defaultMaxFullSyncPartitions is the number of partitions a fullsync may write to, unless the dataset configures it
+const defaultMaxFullSyncPartitions = 100
+
+// partitionPath is the partition of a batch of entities, which all belong to the partition of the first entity
+func (s3s *S3Storage) partitionPath(entities []*uda.Entity, fullSync bool) string {
+	entity := &uda.Entity{}
+	if len(entities) > 0 {
+		entity = entities[0]
+	}
+	partitions, err := encoder.PartitionEntities(s3s.config, []*uda.Entity{entity}, fullSync, time.Now())
+	if err != nil || len(partitions) == 0 {
+		return ""
+	}
+	return partitions[0].Path
+}
+
+// maxFullSyncPartitions is the number of partitions a fullsync of the dataset may write to
+func (s3s *S3Storage) maxFullSyncPartitions() int {
+	if s3s.config.FullSync != nil && s3s.config.FullSync.MaxPartitions > 0 {
+		return s3s.config.FullSync.MaxPartitions
+	}
+	return defaultMaxFullSyncPartitions
+}
+
+// partitionedKey places the object of a key in a partition folder next to it
+func partitionedKey(key string, partition string) string {
+	if partition == "" {
+		return key
+	}
+	dir, name := path.Split(key)
+	return dir + partition + "/" + name
+}
+
+// partitionedFullSyncRoot is the folder below which the partitions of fullsyncs are published, and the name of the
+// objects in the partitions, or an empty name if each fullsync gets names of its own
+func (s3s *S3Storage) partitionedFullSyncRoot() (string, string) {
+	if s3s.config.Properties.ResourceName == nil {
+		return fmt.Sprintf("datasets/%s/entities/", s3s.dataset), ""
+	}
+	dir, name := path.Split(strings.TrimPrefix(s3s.fullSyncResourceKey(), "/"))
+	return dir, name
+}
+
+// partitionedFullSyncPath is the path of a published partition object below the partition root
+func (s3s *S3Storage) partitionedFullSyncPath(key string) string {
+	root, _ := s3s.partitionedFullSyncRoot()
+	return strings.TrimPrefix(key, root)
+}
+
+// partitionedFullSyncKeys returns the published objects of fullsyncs partitioned by entity properties, and the
+// objects of fullsyncs published before the dataset was partitioned
+func (s3s *S3Storage) partitionedFullSyncKeys() ([]string, error) {
+	root, name := s3s.partitionedFullSyncRoot()
+	keys, err := s3s.listKeys(root)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, s3s.fullSyncHistoryFolder()) {
+			continue
+		}
+		dir, base := path.Split(strings.TrimPrefix(key, root))
+		if name != "" && (base != name || !isPartitionFolder(dir)) {
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// isPartitionFolder tells if all folders of a path are partition folders, like `country=no/`
+func isPartitionFolder(dir string) bool {
+	if dir == "" {
+		return true
+	}
+	for _, folder := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+		if !strings.Contains(folder, "=") {
+			return false
+		}
+	}
+	return true
+}
+
+// partitionedFullSync writes a fullsync of a dataset partitioned by entity properties, with a writer and upload per
+// partition. Partitions start when their first entity arrives, and are published together when the fullsync ends.
+type partitionedFullSync struct {
+	s3s     *S3Storage
+	id      string
+	config  conf.StorageBackend
+	spooled bool
+	// mutex guards the partitions, which are abandoned while a batch may be waiting for an upload
+	mutex      sync.Mutex
+	partitions map[string]*fullSyncPartition
+	order      []string
+	closed     bool
+	done       chan error
+}
+
+type fullSyncPartition struct {
+	fullsync *fullSyncState
+	session  *fullSyncSession
+}
+
+// startPartitionedFullSync starts a fullsync with a session writing each batch to the partitions of its entities
+func (s3s *S3Storage) startPartitionedFullSync(id string, config conf.StorageBackend, spooled bool) *fullSyncSession {
+	partitioned := &partitionedFullSync{
+		s3s:        s3s,
+		id:         id,
+		config:     config,
+		spooled:    spooled,
+		partitions: make(map[string]*fullSyncPartition),
+		done:       make(chan error, 1),
+	}
+	session := startFullSyncSession(id, partitioned, s3s.logger, func(ctx context.Context) error {
+		return <-partitioned.done
+	})
+	if !spooled {
+		session.writeTimeout = time.Minute
+	}
+	session.publish = func(entities int) error {
+		var objects []*fullSyncState
+		for _, p := range partitioned.order {
+			objects = append(objects, partitioned.partitions[p].fullsync)
+		}
+		return s3s.publishFullSyncObjects(id, objects)
+	}
+	return session
+}
+
+func (p *partitionedFullSync) Write(entities []*uda.Entity) (int, error) {
+	parts, err := encoder.PartitionEntities(p.s3s.config, entities, true, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for _, part := range parts {
+		partition, err := p.partition(part)
+		if err != nil {
+			// the entities of the partition can not be written, so the fullsync can not be published
+			_ = p.CloseWithError(err)
+			return written, err
+		}
+		n, err := partition.session.writer.Write(part.Entities)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		partition.fullsync.Entities += len(part.Entities)
+	}
+	return written, nil
+}
+
+// partition returns the partition of a part of a batch, which is started if it is the first part of the partition
+func (p *partitionedFullSync) partition(part encoder.Partition) (*fullSyncPartition, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, errors.New("abandoned fullsync")
+	}
+	if partition, ok := p.partitions[part.Path]; ok {
+		return partition, nil
+	}
+	if limit := p.s3s.maxFullSyncPartitions(); len(p.partitions) >= limit {
+		return nil, fmt.Errorf("fullsync %s of dataset %s has more than %d partitions, see fullSync.maxPartitions",
+			p.id, p.s3s.dataset, limit)
+	}
+	fullsync := &fullSyncState{
+		Id:         p.id,
+		StagingKey: p.s3s.fullSyncStagingKey(p.id) + "/" + part.Path,
+		FinalKey:   p.s3s.fullSyncFinalKey(part.Entities, part.Path),
+	}
+	session, err := p.s3s.startFullSyncUpload(fullsync, p.config, p.spooled)
+	if err != nil {
+		return nil, err
+	}
+	partition := &fullSyncPartition{fullsync: fullsync, session: session}
+	p.partitions[part.Path] = partition
+	p.order = append(p.order, part.Path)
+	return partition, nil
+}
+
+// Close ends the writers of all partitions and waits for their uploads. The partitions are abandoned if one of them
+// fails.
+func (p *partitionedFullSync) Close() error {
+	partitions, ok := p.stop()
+	if !ok {
+		return errors.New("abandoned fullsync")
+	}
+	var err error
+	for _, partition := range partitions {
+		if err != nil {
+			partition.session.abandon("failed fullsync")
+		} else if err = partition.session.writer.Close(); err != nil {
+			partition.session.abandon(err.Error())
+		}
+		if uploadErr := <-partition.session.done; err == nil {
+			err = uploadErr
+		}
+		partition.session.cancel()
+	}
+	p.done <- err
+	return err
+}
+
+// CloseWithError abandons all partitions
+func (p *partitionedFullSync) CloseWithError(err error) error {
+	partitions, ok := p.stop()
+	if !ok {
+		return nil
+	}
+	for _, partition := range partitions {
+		partition.session.abandon(err.Error())
+		<-partition.session.done
+	}
+	p.done <- err
+	return nil
+}
+
+// stop makes later batches fail, and returns the partitions that were started, unless the fullsync is stopped already
+func (p *partitionedFullSync) stop() ([]*fullSyncPartition, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, false
+	}
+	p.closed = true
+	partitions := make([]*fullSyncPartition, 0, len(p.order))
+	for _, path := range p.order {
+		partitions = append(partitions, p.partitions[path])
+	}
+	return partitions, true
+}
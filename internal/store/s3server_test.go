@@ -0,0 +1,378 @@
+package store
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// s3Server is an in memory s3 bucket, serving the path style requests used by the s3 storage
+type s3Server struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	objects map[string]*s3TestObject
+	uploads map[string]*s3TestUpload
+	// failing is a key whose next write is refused
+	failing string
+	// partGate holds part uploads until it is closed, largestPart is the size of the largest uploaded part
+	partGate    chan struct{}
+	largestPart int
+}
+
+// s3TestObject is an object, with the sha256 checksum it was written with, if any
+type s3TestObject struct {
+	data     []byte
+	metadata map[string]string
+	modified time.Time
+	checksum string
+}
+
+// s3TestUpload is a multipart upload, with its parts and their sha256 checksums by number
+type s3TestUpload struct {
+	key       string
+	metadata  map[string]string
+	parts     map[int][]byte
+	checksums map[int]string
+	initiated time.Time
+}
+
+func newS3Server() *s3Server {
+	server := &s3Server{objects: map[string]*s3TestObject{}, uploads: map[string]*s3TestUpload{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// storage returns an s3 storage of the dataset in the bucket of the server
+func (s *s3Server) storage(dataset string, config conf.StorageBackend) *S3Storage {
+	bucket, key, secret := "bucket", "key", "secret"
+	config.Properties.Bucket = &bucket
+	config.Properties.Key = &key
+	config.Properties.Secret = &secret
+	config.Properties.Endpoint = s.URL
+	uploader, downloader, err := initS3(config)
+	if err != nil {
+		panic(err)
+	}
+	return &S3Storage{logger: zap.NewNop().Sugar(), env: &conf.Env{Env: "test"}, config: config, dataset: dataset,
+		uploader: uploader, downloader: downloader}
+}
+
+func (s *s3Server) object(key string) *s3TestObject {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects[key]
+}
+
+// keys returns the keys of the objects with the prefix, in key order
+func (s *s3Server) keys(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// partCount returns the number of parts uploaded to multipart uploads neither completed nor aborted
+func (s *s3Server) partCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, upload := range s.uploads {
+		count += len(upload.parts)
+	}
+	return count
+}
+
+// failNextWrite makes the next write of the key fail
+func (s *s3Server) failNextWrite(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = key
+}
+
+// ageUploads makes the multipart uploads that are neither completed nor aborted look started earlier
+func (s *s3Server) ageUploads(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, upload := range s.uploads {
+		upload.initiated = upload.initiated.Add(-d)
+	}
+}
+
+// uploadCount returns the number of multipart uploads neither completed nor aborted
+func (s *s3Server) uploadCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.uploads)
+}
+
+// holdParts makes part uploads wait until the returned function is called
+func (s *s3Server) holdParts() func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	gate := make(chan struct{})
+	s.partGate = gate
+	return func() { close(gate) }
+}
+
+func (s *s3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	if gate := s.partGate; gate != nil && r.Method == http.MethodPut && r.URL.Query().Has("partNumber") {
+		s.mutex.Unlock()
+		<-gate
+		s.mutex.Lock()
+	}
+	defer s.mutex.Unlock()
+	// path style requests: /bucket/key
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	if key == s.failing && r.Method == http.MethodPut {
+		s.failing = ""
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !s.conditionsMet(r, key) {
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && query.Has("uploads") && !query.Has("uploadId"):
+		s.listUploads(w, query.Get("prefix"))
+	case query.Has("uploads") || query.Has("uploadId"):
+		s.multipart(w, r, key)
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		from := s.objects[strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)[1]]
+		if from == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		copied := &s3TestObject{data: from.data, metadata: from.metadata, modified: time.Now(), checksum: from.checksum}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			copied.metadata = requestMetadata(r)
+		}
+		s.objects[key] = copied
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>"%d"</ETag><LastModified>%s</LastModified></CopyObjectResult>`,
+			len(copied.data), copied.modified.UTC().Format(time.RFC3339))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !checksumMatches(r, data) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = &s3TestObject{data: data, metadata: requestMetadata(r), modified: time.Now(),
+			checksum: r.Header.Get("X-Amz-Checksum-Sha256")}
+		w.Header().Set("ETag", s.objects[key].etag())
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		object := s.objects[key]
+		if object == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		for name, value := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", object.etag())
+		if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" && object.checksum != "" {
+			w.Header().Set("X-Amz-Checksum-Sha256", object.checksum)
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (s *s3Server) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id = fmt.Sprint(time.Now().UnixNano())
+		s.uploads[id] = &s3TestUpload{key: key, metadata: requestMetadata(r), parts: map[int][]byte{}, initiated: time.Now()}
+		if r.Header.Get("X-Amz-Checksum-Algorithm") == "SHA256" {
+			s.uploads[id].checksums = map[int]string{}
+		}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`,
+			key, id)
+		return
+	case s.uploads[id] == nil:
+		http.Error(w, "", http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !checksumMatches(r, data) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[id].parts[number] = data
+		if s.uploads[id].checksums != nil {
+			s.uploads[id].checksums[number] = r.Header.Get("X-Amz-Checksum-Sha256")
+		}
+		if len(data) > s.largestPart {
+			s.largestPart = len(data)
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%d-%d"`, number, len(data)))
+	case r.Method == http.MethodPost:
+		completed := struct {
+			Parts []struct {
+				PartNumber     int
+				ETag           string
+				ChecksumSHA256 string
+			} `xml:"Part"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&completed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upload := s.uploads[id]
+		var data []byte
+		checksum := sha256.New()
+		for _, part := range completed.Parts {
+			if upload.checksums != nil && part.ChecksumSHA256 != upload.checksums[part.PartNumber] {
+				http.Error(w, "InvalidPart", http.StatusBadRequest)
+				return
+			}
+			data = append(data, upload.parts[part.PartNumber]...)
+			digest, _ := base64.StdEncoding.DecodeString(part.ChecksumSHA256)
+			checksum.Write(digest)
+		}
+		object := &s3TestObject{data: data, metadata: upload.metadata, modified: time.Now()}
+		if upload.checksums != nil {
+			// the checksum of multipart uploads is the checksum of the checksums of the parts
+			object.checksum = fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(checksum.Sum(nil)), len(completed.Parts))
+		}
+		s.objects[key] = object
+		delete(s.uploads, id)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"%d"</ETag></CompleteMultipartUploadResult>`,
+			key, len(data))
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// conditionsMet checks the If-Match and If-None-Match headers of a write against the object of the key
+func (s *s3Server) conditionsMet(r *http.Request, key string) bool {
+	object := s.objects[key]
+	if match := r.Header.Get("If-Match"); match != "" && (object == nil || object.etag() != match) {
+		return false
+	}
+	return r.Header.Get("If-None-Match") != "*" || object == nil
+}
+
+// checksumMatches checks the data of a write against its sha256 checksum, if it has one
+func checksumMatches(r *http.Request, data []byte) bool {
+	checksum := r.Header.Get("X-Amz-Checksum-Sha256")
+	digest := sha256.Sum256(data)
+	return checksum == "" || checksum == base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func (o *s3TestObject) etag() string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(o.data))
+}
+
+func (s *s3Server) listUploads(w http.ResponseWriter, prefix string) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{}
+	var ids []string
+	for id, u := range s.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		result.Uploads = append(result.Uploads, upload{Key: s.uploads[id].key, UploadId: id,
+			Initiated: s.uploads[id].initiated.UTC().Format(time.RFC3339Nano)})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (s *s3Server) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{}
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		object := s.objects[key]
+		result.Contents = append(result.Contents, content{Key: key,
+			LastModified: object.modified.UTC().Format(time.RFC3339Nano), Size: len(object.data)})
+	}
+	result.KeyCount = len(keys)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := map[string]string{}
+	for name := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = r.Header.Get(name)
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+// fullSyncSpool is a fullsync spooled to a local temp file. Batches are encoded to the file, while parts of the
+// chunk size are uploaded in the background, so batches only wait for the local disk.
+type fullSyncSpool struct {
+	fullsync  *fullSyncState
+	file      *os.File
+	chunkSize int64
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	// spooled is the number of bytes in the file, closed is set when the encoder has written all bytes
+	spooled int64
+	closed  bool
+	err     error
+}
+
+// fail stops the spool, the first error is kept
+func (spool *fullSyncSpool) fail(err error) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if spool.err == nil {
+		spool.err = err
+	}
+	spool.cond.Broadcast()
+}
+
+func (spool *fullSyncSpool) error() error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	return spool.err
+}
+
+// copy spools the encoded fullsync from the pipe to the file, until the pipe is closed or the upload fails
+func (spool *fullSyncSpool) copy(reader *io.PipeReader) {
+	buffer := make([]byte, 64*1024)
+	for spool.error() == nil {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			if _, werr := spool.file.Write(buffer[:n]); werr != nil {
+				_ = reader.CloseWithError(werr)
+				spool.fail(werr)
+				return
+			}
+			spool.mutex.Lock()
+			spool.spooled += int64(n)
+			spool.cond.Broadcast()
+			spool.mutex.Unlock()
+		}
+		if err == io.EOF {
+			spool.mutex.Lock()
+			spool.closed = true
+			spool.cond.Broadcast()
+			spool.mutex.Unlock()
+			return
+		}
+		if err != nil {
+			spool.fail(err)
+			return
+		}
+	}
+}
+
+// next waits for the part starting at offset to be spooled. Parts have the chunk size, but the last part which has
+// the rest of the file. The part is the last one when the spool is closed and it ends the file.
+func (spool *fullSyncSpool) next(offset int64) (int64, bool, error) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	for spool.err == nil && !spool.closed && spool.spooled-offset < spool.chunkSize {
+		spool.cond.Wait()
+	}
+	if spool.err != nil {
+		return 0, false, spool.err
+	}
+	size := spool.spooled - offset
+	if size > spool.chunkSize {
+		size = spool.chunkSize
+	}
+	return size, spool.closed && offset+size == spool.spooled, nil
+}
+
+// spoolChunkSize is FULLSYNC_CHUNK_SIZE, raised to the smallest part size s3 accepts
+func (s3s *S3Storage) spoolChunkSize() int64 {
+	if s3s.env.FullsyncChunkSize < int64(fullSyncPartSize) {
+		return int64(fullSyncPartSize)
+	}
+	return s3s.env.FullsyncChunkSize
+}
+
+// startFullSyncSpool creates the spool file and the multipart upload of a fullsync. The session spools the encoded
+// fullsync to the file, while the parts are uploaded.
+func (s3s *S3Storage) startFullSyncSpool(fullsync *fullSyncState, config conf.StorageBackend) (*fullSyncSession, error) {
+	if err := os.MkdirAll(s3s.env.FullsyncTempFolder, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(s3s.env.FullsyncTempFolder, fmt.Sprintf("fullsync-%s-*", s3s.dataset))
+	if err != nil {
+		return nil, err
+	}
+	if err := s3s.createFullSyncUpload(fullsync); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	spool := &fullSyncSpool{fullsync: fullsync, file: file, chunkSize: s3s.spoolChunkSize()}
+	spool.cond = sync.NewCond(&spool.mutex)
+	return newFullSyncSession(fullsync.Id, config, s3s.logger, func(ctx context.Context, reader *io.PipeReader) error {
+		uploaded := make(chan struct{})
+		go func() {
+			defer close(uploaded)
+			s3s.uploadFullSyncSpool(spool)
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				spool.fail(errors.New("abandoned fullsync"))
+			case <-uploaded:
+			}
+		}()
+		spool.copy(reader)
+		<-uploaded
+		return spool.error()
+	}), nil
+}
+
+// uploadFullSyncSpool uploads the parts of the spool file as they are spooled, and completes the multipart upload
+// when the whole fullsync is spooled. Parts are read from the file while they are uploaded. Failed and abandoned uploads are aborted. The file is removed when done.
+func (s3s *S3Storage) uploadFullSyncSpool(spool *fullSyncSpool) {
+	defer func() {
+		_ = spool.file.Close()
+		_ = os.Remove(spool.file.Name())
+	}()
+	var offset int64
+	for {
+		size, last, err := spool.next(offset)
+		if err != nil {
+			s3s.abortFullSyncUpload(spool.fullsync)
+			return
+		}
+		if size > 0 {
+			part := io.NewSectionReader(spool.file, offset, size)
+			if err := s3s.uploadFullSyncPart(spool.fullsync, part, size); err != nil {
+				s3s.logger.Error("Failed to upload ", err)
+				spool.fail(err)
+				continue
+			}
+			offset += size
+		}
+		if last {
+			break
+		}
+	}
+	spool.fullsync.Bytes = offset
+	if err := s3s.completeFullSyncUpload(spool.fullsync); err != nil {
+		spool.fail(err)
+	}
+}
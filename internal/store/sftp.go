@@ -0,0 +1,423 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/google/uuid"
+	"github.com/mimiro-io/datahub-client-sdk-go"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+	"github.com/mimiro-io/objectstorage-datalayer/internal/encoder"
+)
+
+type SftpStorage struct {
+	logger    *zap.SugaredLogger
+	env       *conf.Env
+	config    conf.StorageBackend
+	dataset   string
+	statsd    statsd.ClientInterface
+	fullsyncs fullSyncSessions
+}
+
+// sftpClient is a sftp session together with the ssh connection it runs on
+type sftpClient struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+func (c *sftpClient) Close() error {
+	_ = c.Client.Close()
+	return c.conn.Close()
+}
+
+func NewSftpStorage(logger *zap.SugaredLogger, env *conf.Env, config conf.StorageBackend, statsd statsd.ClientInterface, dataset string) (*SftpStorage, error) {
+	if config.Properties.Endpoint == "" {
+		return nil, errors.New("no endpoint configured for sftp dataset " + dataset)
+	}
+	if config.Properties.Key == nil || *config.Properties.Key == "" {
+		return nil, errors.New("no user configured for sftp dataset " + dataset)
+	}
+	return &SftpStorage{
+		logger:  logger.Named("sftp-store").With("dataset", dataset),
+		env:     env,
+		config:  config,
+		dataset: dataset,
+		statsd:  statsd,
+	}, nil
+}
+
+func (s *SftpStorage) GetConfig() conf.StorageBackend {
+	return s.config
+}
+
+func (s *SftpStorage) DeliverOnceClientInit() (datahub.Client, error) {
+	return datahub.Client{}, errors.New("DeliverOnceClientInit not supported for SftpStorage")
+}
+
+func (s *SftpStorage) DeliverOnceVariableCheck() error {
+	return errors.New("DeliverOnceVariableCheck not supported for SftpStorage")
+}
+
+func (s *SftpStorage) DeliverOnce(entities []*uda.Entity, client datahub.Client) error {
+	return errors.New("DeliverOnce not supported for SftpStorage")
+}
+
+// connect opens a new ssh connection to the configured server, and starts a sftp session on it
+func (s *SftpStorage) connect() (*sftpClient, error) {
+	sshConfig, err := s.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", sftpAddress(s.config.Properties.Endpoint), sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &sftpClient{Client: client, conn: conn}, nil
+}
+
+// clientConfig authenticates with the private key in the secret if authType is `key`, otherwise the secret is used
+// as password. The server is verified against the configured host key, unless insecureSkipHostKeyCheck is set.
+func (s *SftpStorage) clientConfig() (*ssh.ClientConfig, error) {
+	properties := s.config.Properties
+	secret := ""
+	if properties.Secret != nil {
+		secret = *properties.Secret
+	}
+	var auth ssh.AuthMethod
+	if properties.AuthType != nil && strings.ToLower(*properties.AuthType) == "key" {
+		signer, err := ssh.ParsePrivateKey([]byte(secret))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key for sftp dataset %s: %w", s.dataset, err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		auth = ssh.Password(secret)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if properties.HostKey != nil && *properties.HostKey != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(*properties.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key for sftp dataset %s: %w", s.dataset, err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(hostKey)
+	} else if properties.InsecureSkipHostKeyCheck != nil && *properties.InsecureSkipHostKeyCheck {
+		s.logger.Warn("insecureSkipHostKeyCheck is set, the identity of the sftp server is not verified")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		return nil, fmt.Errorf("hostKey is required for sftp dataset %s", s.dataset)
+	}
+
+	return &ssh.ClientConfig{
+		User:            *properties.Key,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// sftpAddress turns the endpoint into a dialable address, using the default ssh port if none is given
+func sftpAddress(endpoint string) string {
+	address := strings.TrimSuffix(strings.TrimPrefix(endpoint, "sftp://"), "/")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, "22")
+	}
+	return address
+}
+
+func (s *SftpStorage) StoreEntities(entities []*uda.Entity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+	content, err := GenerateContent(entities, s.config, s.logger)
+	if err != nil {
+		s.logger.Error("Unable to create store content")
+		return err
+	}
+	if len(s.config.OrderBy) > 0 {
+		content, err = OrderContent(content, s.config, s.logger)
+		if err != nil {
+			s.logger.Error("Unable to order content")
+			return err
+		}
+	}
+	content, err = encoder.Compress(s.config, content)
+	if err != nil {
+		s.logger.Error("Unable to compress content")
+		return err
+	}
+	s.logger.Debugf("Encoded %d entities into %v bytes", len(entities), len(content))
+
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	target := s.createPath(entities, false)
+	if err := s.writeAtomic(client, target, bytes.NewReader(content)); err != nil {
+		s.logger.Error("Failed to upload ", err)
+		return err
+	}
+	s.logger.Info("Successfully uploaded to ", target)
+	return nil
+}
+
+// StoreEntitiesFullSync writes fullsyncs to the file props.resourceName below the root folder. Without resourceName,
+// fullsync files would be read as changes, so fullsyncs are rejected.
+func (s *SftpStorage) StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error {
+	if s.fullSyncFile() == "" {
+		return fmt.Errorf("fullsync of sftp dataset %s requires props.resourceName", s.dataset)
+	}
+	return s.fullsyncs.store(state, entities, func() (*fullSyncSession, error) {
+		client, err := s.connect()
+		if err != nil {
+			return nil, err
+		}
+		target := s.createPath(entities, true)
+		// the encoded fullsync is uploaded into a temp file, which is renamed into place when the sync ends
+		session := newFullSyncSession(state.Id, s.config, s.logger, func(ctx context.Context, reader *io.PipeReader) error {
+			defer client.Close()
+			if err := s.writeAtomic(client, target, reader); err != nil {
+				return err
+			}
+			s.logger.Info("Successfully uploaded to ", target)
+			return nil
+		})
+		session.writeTimeout = time.Minute
+		return session, nil
+	})
+}
+
+// Close abandons the ongoing fullsync
+func (s *SftpStorage) Close() error {
+	s.fullsyncs.close()
+	return nil
+}
+
+// writeAtomic uploads the content of the reader into a hidden temp file next to the target, and renames it to the
+// target when complete. Partner systems polling the folder never pick up partially written files.
+func (s *SftpStorage) writeAtomic(client *sftpClient, target string, reader io.Reader) error {
+	dir := path.Dir(target)
+	if err := client.MkdirAll(dir); err != nil {
+		return err
+	}
+	tmp := path.Join(dir, fmt.Sprintf(".%s.%s.tmp", path.Base(target), uuid.New().String()))
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		if pr, ok := reader.(*io.PipeReader); ok {
+			_ = pr.CloseWithError(err)
+		}
+		_ = f.Close()
+		_ = client.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = client.Remove(tmp)
+		return err
+	}
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		err = client.PosixRename(tmp, target)
+	} else {
+		// plain sftp rename does not overwrite existing files
+		_ = client.Remove(target)
+		err = client.Rename(tmp, target)
+	}
+	if err != nil {
+		_ = client.Remove(tmp)
+	}
+	return err
+}
+
+func (s *SftpStorage) GetEntities() (io.Reader, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	if name := s.fullSyncFile(); name != "" {
+		files = []FileInfo{{FilePath: path.Join(s.rootFolder(), name)}}
+	} else {
+		changes, err := s.findFiles(client)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		files, _, _ = changesAfter(changes, "")
+	}
+	if encoder.UsesFileDecoder(s.config) {
+		_ = client.Close()
+		return encoder.NewFileDecoder(s.config, filePaths(files), s.openStoredFile, "", s.logger, true)
+	}
+	reader, writer := io.Pipe()
+	go s.streamFiles(client, files, writer)
+	return encoder.NewEntityDecoder(s.config, reader, "", s.logger, true)
+}
+
+// GetChanges streams the files below the root folder that were modified after the since token, except the fullsync
+// file. The continuation token points at the last file consumed, so files sharing a modification time are neither
+// skipped nor replayed.
+func (s *SftpStorage) GetChanges(since string) (io.Reader, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.findFiles(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	files, token, err := changesAfter(changes, since)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	s.logger.Debugf("Found %d changed files since %q", len(files), since)
+	if encoder.UsesFileDecoder(s.config) {
+		_ = client.Close()
+		return encoder.NewFileDecoder(s.config, filePaths(files), s.openStoredFile, token, s.logger, false)
+	}
+	reader, writer := io.Pipe()
+	go s.streamFiles(client, files, writer)
+	return encoder.NewEntityDecoder(s.config, reader, token, s.logger, false)
+}
+
+// findFiles lists all files below the root folder, skipping hidden temp files of ongoing uploads and the fullsync file
+func (s *SftpStorage) findFiles(client *sftpClient) ([]fileChange, error) {
+	root := s.rootFolder()
+	fullSyncFile := ""
+	if name := s.fullSyncFile(); name != "" {
+		fullSyncFile = path.Join(root, name)
+	}
+	var changes []fileChange
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || path.Clean(walker.Path()) == fullSyncFile {
+			continue
+		}
+		file := FileInfo{FilePath: walker.Path(), FileSize: info.Size(), LastModified: info.ModTime()}
+		changes = append(changes, fileChange{
+			LastModified: file.LastModified.UnixNano(),
+			FilePath:     strings.TrimPrefix(strings.TrimPrefix(file.FilePath, root), "/"),
+			file:         file,
+		})
+	}
+	return changes, nil
+}
+
+// streamFiles copies the content of the given remote files into the writer, and closes both writer and client when done
+func (s *SftpStorage) streamFiles(client *sftpClient, files []FileInfo, writer *io.PipeWriter) {
+	defer client.Close()
+	for _, fileObj := range files {
+		f, err := client.Open(fileObj.FilePath)
+		if err != nil {
+			_ = writer.CloseWithError(err)
+			return
+		}
+		r, err := encoder.NewDecompressingReader(f)
+		if err != nil {
+			_ = f.Close()
+			_ = writer.CloseWithError(err)
+			return
+		}
+		readTotal, err := io.Copy(writer, r)
+		_ = r.Close()
+		_ = f.Close()
+		s.logger.Infof("read %v bytes total from sftp file %v", readTotal, fileObj.FilePath)
+		if err != nil {
+			s.logger.Error(err)
+			_ = writer.CloseWithError(err)
+			return
+		}
+	}
+	_ = writer.Close()
+}
+
+// sftpFile is a remote file read with ReadAt, it holds its own connection
+type sftpFile struct {
+	*sftp.File
+	client *sftpClient
+	size   int64
+}
+
+func (f *sftpFile) Size() int64 {
+	return f.size
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	_ = f.client.Close()
+	return err
+}
+
+func (s *SftpStorage) openStoredFile(path string) (encoder.StoredFile, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(path)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		_ = client.Close()
+		return nil, err
+	}
+	return &sftpFile{File: f, client: client, size: info.Size()}, nil
+}
+
+func (s *SftpStorage) rootFolder() string {
+	properties := s.config.Properties
+	if properties.RootFolder != nil && *properties.RootFolder != "" {
+		return strings.TrimSuffix(*properties.RootFolder, "/")
+	}
+	return s.dataset
+}
+
+// fullSyncFile is the file fullsyncs are written to below the root folder, empty if fullsyncs are not supported
+func (s *SftpStorage) fullSyncFile() string {
+	if s.config.Properties.ResourceName == nil {
+		return ""
+	}
+	return *s.config.Properties.ResourceName
+}
+
+func (s *SftpStorage) createPath(entities []*uda.Entity, fullSync bool) string {
+	properties := s.config.Properties
+	if fullSync {
+		return path.Join(s.rootFolder(), s.fullSyncFile())
+	}
+
+	prefix := ""
+	if properties.FilePrefix != nil && *properties.FilePrefix != "" {
+		prefix = *properties.FilePrefix
+	}
+	return path.Join(s.rootFolder(), prefix+objectName(s.config, entities))
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/mimiro-io/internal-go-util/pkg/uda"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
+)
+
+func TestSftp(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("The sftp backend", func() {
+		var root string
+		var server *testSftpServer
+		newStorage := func(props conf.PropertiesMapping) *SftpStorage {
+			props.Endpoint = server.address
+			user := "partner"
+			props.Key = &user
+			if props.Secret == nil {
+				password := "secret"
+				props.Secret = &password
+			}
+			if props.HostKey == nil && props.InsecureSkipHostKeyCheck == nil {
+				hostKey := string(ssh.MarshalAuthorizedKey(server.hostKey))
+				props.HostKey = &hostKey
+			}
+			s, err := NewSftpStorage(zap.NewNop().Sugar(), &conf.Env{}, conf.StorageBackend{
+				StripProps: true,
+				CsvConfig:  &conf.CsvConfig{Separator: ",", Order: []string{"id", "key"}},
+				DecodeConfig: &conf.DecodeConfig{
+					DefaultNamespace: "a",
+					Namespaces:       map[string]string{"a": "http://example.io/a/"},
+					IdProperty:       "id",
+				},
+				Properties: props,
+			}, nil, "people")
+			g.Assert(err).IsNil()
+			return s
+		}
+		entities := []*uda.Entity{
+			{ID: "a:1", Properties: map[string]interface{}{"a:id": "1", "a:key": "value 1"}},
+			{ID: "a:2", Properties: map[string]interface{}{"a:id": "2", "a:key": "value 2"}},
+		}
+		g.BeforeEach(func() {
+			root = t.TempDir()
+			server = startTestSftpServer(t, root)
+		})
+		g.AfterEach(func() {
+			server.Close()
+		})
+
+		g.It("Should upload incremental batches with password auth", func() {
+			s := newStorage(conf.PropertiesMapping{})
+			g.Assert(s.StoreEntities(entities)).IsNil()
+			files, _ := filepath.Glob(filepath.Join(root, "people", "*.csv"))
+			g.Assert(len(files)).Eql(1)
+			content, _ := os.ReadFile(files[0])
+			g.Assert(string(content)).Eql("1,value 1\n2,value 2\n")
+		})
+
+		g.It("Should upload with private key auth", func() {
+			privateKey := string(pem.EncodeToMemory(server.clientKey))
+			authType := "key"
+			s := newStorage(conf.PropertiesMapping{AuthType: &authType, Secret: &privateKey})
+			g.Assert(s.StoreEntities(entities)).IsNil()
+			files, _ := filepath.Glob(filepath.Join(root, "people", "*.csv"))
+			g.Assert(len(files)).Eql(1)
+		})
+
+		g.It("Should reject servers with unexpected host keys", func() {
+			_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+			signer, _ := ssh.NewSignerFromKey(otherKey)
+			hostKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			s := newStorage(conf.PropertiesMapping{HostKey: &hostKey})
+			g.Assert(s.StoreEntities(entities) == nil).IsFalse()
+
+			hostKey = string(ssh.MarshalAuthorizedKey(server.hostKey))
+			s = newStorage(conf.PropertiesMapping{HostKey: &hostKey})
+			g.Assert(s.StoreEntities(entities)).IsNil()
+		})
+
+		g.It("Should require a host key unless the check is skipped explicitly", func() {
+			empty := ""
+			s := newStorage(conf.PropertiesMapping{HostKey: &empty})
+			err := s.StoreEntities(entities)
+			g.Assert(err.Error()).Eql("hostKey is required for sftp dataset people")
+
+			skip := true
+			s = newStorage(conf.PropertiesMapping{InsecureSkipHostKeyCheck: &skip})
+			g.Assert(s.StoreEntities(entities)).IsNil()
+		})
+
+		g.It("Should only publish fullsync files when the sync ends", func() {
+			resourceName := "people.csv"
+			s := newStorage(conf.PropertiesMapping{ResourceName: &resourceName})
+			target := filepath.Join(root, "people", "people.csv")
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "1"}, entities)).IsNil()
+			_, err := os.Stat(target)
+			g.Assert(os.IsNotExist(err)).IsTrue("target must not exist before end")
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "2"}, entities) == nil).IsFalse()
+
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+			content, err := os.ReadFile(target)
+			g.Assert(err).IsNil()
+			g.Assert(strings.Count(string(content), "\n")).Eql(4)
+			files, _ := os.ReadDir(filepath.Dir(target))
+			g.Assert(len(files)).Eql(1, "temp files are cleaned up")
+
+			// a second fullsync replaces the file
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "3", Start: true}, entities[:1])).IsNil()
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "3", End: true}, nil)).IsNil()
+			content, _ = os.ReadFile(target)
+			g.Assert(string(content)).Eql("1,value 1\n")
+
+			reader, err := s.GetEntities()
+			g.Assert(err).IsNil()
+			content, _ = io.ReadAll(reader)
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(3, "context, continuation and 1 entity")
+		})
+
+		g.It("Should keep fullsync files out of changes", func() {
+			g.Assert(newStorage(conf.PropertiesMapping{}).StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities).Error()).
+				Eql("fullsync of sftp dataset people requires props.resourceName")
+
+			resourceName := "people.csv"
+			s := newStorage(conf.PropertiesMapping{ResourceName: &resourceName})
+			g.Assert(s.StoreEntities(entities[:1])).IsNil()
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "1", Start: true}, entities)).IsNil()
+			g.Assert(s.StoreEntitiesFullSync(FullSyncState{Id: "1", End: true}, nil)).IsNil()
+
+			reader, err := s.GetChanges("")
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(3, "context, continuation and the entity of the change")
+		})
+
+		g.It("Should return changes since the last consumed file", func() {
+			s := newStorage(conf.PropertiesMapping{})
+			g.Assert(s.StoreEntities(entities)).IsNil()
+			g.Assert(s.StoreEntities(entities[:1])).IsNil()
+			// sftp transfers modification times in seconds, move existing files out of the current second
+			existing, _ := filepath.Glob(filepath.Join(root, "people", "*"))
+			for _, f := range existing {
+				past := time.Now().Add(-time.Hour)
+				g.Assert(os.Chtimes(f, past, past)).IsNil()
+			}
+
+			reader, err := s.GetChanges("")
+			g.Assert(err).IsNil()
+			content, _ := io.ReadAll(reader)
+			var m []map[string]interface{}
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(5, "context, continuation and 3 entities")
+			token := m[len(m)-1]["token"].(string)
+			g.Assert(token != "").IsTrue()
+
+			reader, err = s.GetChanges(token)
+			g.Assert(err).IsNil()
+			content, _ = io.ReadAll(reader)
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(2, "context and continuation")
+			g.Assert(m[1]["token"]).Eql(token)
+
+			g.Assert(s.StoreEntities(entities)).IsNil()
+			reader, err = s.GetChanges(token)
+			g.Assert(err).IsNil()
+			content, _ = io.ReadAll(reader)
+			g.Assert(json.Unmarshal(content, &m)).IsNil()
+			g.Assert(len(m)).Eql(4, "context, continuation and 2 entities")
+		})
+	})
+}
+
+// testSftpServer is an in-process sftp server serving a local folder, accepting the password `secret` and the
+// generated client key.
+type testSftpServer struct {
+	address   string
+	hostKey   ssh.PublicKey
+	clientKey *pem.Block
+	listener  net.Listener
+}
+
+func (s *testSftpServer) Close() {
+	_ = s.listener.Close()
+}
+
+func startTestSftpServer(t *testing.T, root string) *testSftpServer {
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, _ := ssh.NewSignerFromKey(clientPrivate)
+	clientKey, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSftpConn(conn, config, root)
+		}
+	}()
+	return &testSftpServer{
+		address:   listener.Addr().String(),
+		hostKey:   hostSigner.PublicKey(),
+		clientKey: clientKey,
+		listener:  listener,
+	}
+}
+
+func serveTestSftpConn(conn net.Conn, config *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+					if err != nil {
+						return
+					}
+					_ = server.Serve()
+					_ = server.Close()
+				}
+			}
+		}()
+	}
+}
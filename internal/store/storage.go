@@ -1,6 +1,7 @@
 package store
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,7 +9,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/mimiro-io/datahub-client-sdk-go"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/objectstorage-datalayer/internal/conf"
@@ -16,6 +19,61 @@ import (
 	"go.uber.org/zap"
 )
 
+// writePartition is the partition folder of files of storages that only partition by the time of writing, or empty if
+// the dataset is not partitioned
+func writePartition(config conf.StorageBackend, fullSync bool) string {
+	partitions, err := encoder.PartitionEntities(config, []*uda.Entity{{}}, fullSync, time.Now())
+	if err != nil || len(partitions) == 0 {
+		return ""
+	}
+	return partitions[0].Path
+}
+
+// objectName is the name of a file written by a batch or fullsync: the recorded time of the first entity, the custom
+// file name of the format or a new uuid, and the extensions of the format and the compression
+func objectName(config conf.StorageBackend, entities []*uda.Entity) string {
+	return fileName(config, entities, true)
+}
+
+// uniqueObjectName is the name of a file that must not replace another file, leaving out the custom file name
+func uniqueObjectName(config conf.StorageBackend, entities []*uda.Entity) string {
+	return fileName(config, entities, false)
+}
+
+func fileName(config conf.StorageBackend, entities []*uda.Entity, custom bool) string {
+	recorded := ""
+	if len(entities) > 0 && entities[0].Recorded != "" {
+		recorded = entities[0].Recorded + "-"
+	}
+	ending, customName := "json", ""
+	if config.CsvConfig != nil {
+		ending, customName = "csv", config.CsvConfig.CustomFileName
+	}
+	if config.FlatFileConfig != nil {
+		ending, customName = "txt", config.FlatFileConfig.CustomFileName
+	}
+	if config.RdfConfig != nil {
+		ending, customName = encoder.RdfFileExtension(config.RdfConfig), config.RdfConfig.CustomFileName
+	}
+	if config.XmlConfig != nil {
+		ending, customName = "xml", config.XmlConfig.CustomFileName
+	}
+	if config.XlsxConfig != nil {
+		ending, customName = "xlsx", config.XlsxConfig.CustomFileName
+	}
+	if config.AvroConfig != nil {
+		ending, customName = "avro", ""
+	}
+	if config.ParquetConfig != nil {
+		ending, customName = "parquet", ""
+	}
+	name := customName
+	if name == "" || !custom {
+		name = uuid.New().String()
+	}
+	return fmt.Sprintf("%s%s.%s%s", recorded, name, ending, encoder.CompressionExtension(config))
+}
+
 type FullSyncState struct {
 	Id    string
 	Start bool
@@ -31,6 +89,14 @@ type StorageInterface interface {
 	StoreEntitiesFullSync(state FullSyncState, entities []*uda.Entity) error
 	GetEntities() (io.Reader, error)
 	GetChanges(since string) (io.Reader, error)
+	// Close abandons the ongoing fullsyncs of the storage, it is not used after
+	Close() error
+}
+
+// FullSyncRequestStorage is implemented by storages that store a fullsync request as a single batch when
+// StoresFullSyncRequests is true, so requests that fail halfway can be retried without storing entities twice
+type FullSyncRequestStorage interface {
+	StoresFullSyncRequests() bool
 }
 
 func GenerateContent(entities []*uda.Entity, config conf.StorageBackend, logger *zap.SugaredLogger) ([]byte, error) {
@@ -101,3 +167,68 @@ func extractParts(s string, i []int) (int, error) {
 	}
 	return numPart, nil
 }
+
+// fileChange is the position of a file in the change order of datasets that are read from file systems. Files are
+// ordered by modification time and path, which keeps the order stable for files sharing a modification time.
+type fileChange struct {
+	LastModified int64
+	FilePath     string
+	file         FileInfo
+}
+
+func (c fileChange) before(other fileChange) bool {
+	if c.LastModified != other.LastModified {
+		return c.LastModified < other.LastModified
+	}
+	return c.FilePath < other.FilePath
+}
+
+// token encodes the position of the change as an opaque since token
+func (c fileChange) token() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.LastModified, 10) + ":" + c.FilePath))
+}
+
+func parseFileChangeToken(since string) (fileChange, error) {
+	if since == "" {
+		return fileChange{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(since)
+	if err != nil {
+		return fileChange{}, fmt.Errorf("invalid since token %q: %w", since, err)
+	}
+	nanos, path, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return fileChange{}, fmt.Errorf("invalid since token %q", since)
+	}
+	lastModified, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return fileChange{}, fmt.Errorf("invalid since token %q: %w", since, err)
+	}
+	return fileChange{LastModified: lastModified, FilePath: path}, nil
+}
+
+// changesAfter returns the files of all changes after the since token in change order, together with the token of
+// the last returned file. If nothing has changed, the since token is handed back unchanged.
+func changesAfter(changes []fileChange, since string) ([]FileInfo, string, error) {
+	after, err := parseFileChangeToken(since)
+	if err != nil {
+		return nil, "", err
+	}
+	var result []fileChange
+	for _, change := range changes {
+		if since == "" || after.before(change) {
+			result = append(result, change)
+		}
+	}
+	if len(result) == 0 {
+		return nil, since, nil
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].before(result[j])
+	})
+	files := make([]FileInfo, len(result))
+	for i, change := range result {
+		files[i] = change.file
+	}
+	return files, result[len(result)-1].token(), nil
+}
@@ -126,3 +126,15 @@ func TestDeliverOnceVariableCheckAllVariables(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestObjectName(t *testing.T) {
+	entities := []*uda.Entity{{ID: "a:1", Recorded: "1723634100068669184"}}
+	name := objectName(conf.StorageBackend{CsvConfig: &conf.CsvConfig{CustomFileName: "export"}, Compression: "gzip"}, entities)
+	if name != "1723634100068669184-export.csv.gz" {
+		t.Errorf("unexpected name %s", name)
+	}
+	name = objectName(conf.StorageBackend{CsvConfig: &conf.CsvConfig{CustomFileName: "export"}, ParquetConfig: &conf.ParquetConfig{}}, nil)
+	if !strings.HasSuffix(name, ".parquet") || strings.Contains(name, "export") {
+		t.Errorf("parquet takes precedence over csv, got %s", name)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -29,6 +30,9 @@ type datasetHandler struct {
 	env      *conf.Env
 }
 
+// fullsyncStorageTypes are the storage types besides s3 that support fullsync
+var fullsyncStorageTypes = []string{"azure", "localstorage", "gcs", "sftp"}
+
 type DatasetName struct {
 	Name string   `json:"name"`
 	Type []string `json:"type"`
@@ -150,7 +154,8 @@ func (dh *datasetHandler) datasetStoreFullSync(c echo.Context) error {
 		dh.logger.Errorf("full sync not supported with deliver once")
 		return echo.NewHTTPError(http.StatusBadRequest, errors.New("full sync not supported with deliver once").Error())
 	}
-	if !strings.HasPrefix(strings.ToLower(storeConfig.StorageType), "s3") {
+	storageType := strings.ToLower(storeConfig.StorageType)
+	if !strings.HasPrefix(storageType, "s3") && !slices.Contains(fullsyncStorageTypes, storageType) {
 		return echo.NewHTTPError(http.StatusBadRequest, errors.New("full sync not supported on dataset type").Error())
 	}
 
@@ -161,13 +166,37 @@ func (dh *datasetHandler) datasetStoreFullSync(c echo.Context) error {
 		batchSize, err = strconv.Atoi(requestedBatchSize)
 	}
 
-	err = entity.ParseStream(c.Request().Body, func(entities []*uda.Entity, entityContext *uda.Context) error {
-		if storeConfig.ResolveNamespace {
+	// storages storing whole requests get all entities of the request in a single batch
+	var request []*uda.Entity
+	wholeRequests := false
+	if s, ok := storage.(store.FullSyncRequestStorage); ok {
+		wholeRequests = s.StoresFullSyncRequests()
+	}
+
+	// whole requests are kept in memory until they are stored, so their size is limited
+	var body io.Reader = c.Request().Body
+	var limited *limitedBody
+	if wholeRequests && dh.env.FullsyncMaxRequestSize > 0 {
+		limited = &limitedBody{reader: http.MaxBytesReader(c.Response(), c.Request().Body, dh.env.FullsyncMaxRequestSize)}
+		body = limited
+	}
+
+	// failures of the storage are told apart from failures to parse the payload
+	var storeErr error
+	err = entity.ParseStream(body, func(entities []*uda.Entity, entityContext *uda.Context) error {
+		if storeConfig.RdfConfig != nil {
+			// rdf needs full uris everywhere, also in keys
+			entities = entity.ExpandAllUris(entities, entityContext)
+		} else if storeConfig.ResolveNamespace {
 			entities = uda.ExpandUris(entities, entityContext)
 		}
-		err2 := storage.StoreEntitiesFullSync(state, entities)
-		if err2 != nil {
-			return err2
+		if wholeRequests {
+			request = append(request, entities...)
+			return nil
+		}
+		storeErr = storage.StoreEntitiesFullSync(state, entities)
+		if storeErr != nil {
+			return storeErr
 		}
 		state.Start = false      //only start once
 		finalState.Start = false //only start once
@@ -175,22 +204,53 @@ func (dh *datasetHandler) datasetStoreFullSync(c echo.Context) error {
 		return nil
 	}, batchSize, storeConfig.StoreDeleted)
 
-	if err != nil {
+	if limited != nil && limited.exceeded {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("fullsync requests to dataset %s must not be larger than %v bytes", datasetName, dh.env.FullsyncMaxRequestSize))
+	}
+	if storeErr == nil && err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, errors.New(fmt.Sprintf("could not process the json payload: %s", err.Error())).Error())
 	}
 
-	if finalState.End {
-		defer dh.storages.Close(datasetName)
-		err := storage.StoreEntitiesFullSync(finalState, nil)
-		if err != nil {
-			dh.logger.Errorw(err.Error(), "err", err, "dataset", datasetName)
-			return echo.NewHTTPError(http.StatusBadRequest, errors.New("error in StoreEntitiesFullSync").Error())
-		}
+	if storeErr == nil && wholeRequests {
+		storeErr = storage.StoreEntitiesFullSync(finalState, request)
+	} else if storeErr == nil && finalState.End {
+		storeErr = storage.StoreEntitiesFullSync(finalState, nil)
+	}
+	if storeErr != nil {
+		dh.logger.Errorw(storeErr.Error(), "err", storeErr, "dataset", datasetName)
+		return storageError(storeErr, "error in StoreEntitiesFullSync")
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// limitedBody is a request body read through http.MaxBytesReader. The entity parser stops at read errors, so the body
+// tells if it was larger than the limit.
+type limitedBody struct {
+	reader   io.Reader
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// storageError is the response to a failed write to a storage. Batches that do not match the state of the ongoing
+// fullsync fail with 409 Conflict. Other failures are failures of the storage, which clients may retry.
+func storageError(err error, message string) *echo.HTTPError {
+	if errors.Is(err, store.ErrFullSyncChanged) || errors.Is(err, store.ErrFullSyncNotInitialized) ||
+		errors.Is(err, store.ErrInvalidFullSyncId) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
 func (dh *datasetHandler) datasetStore(c echo.Context) error {
 	datasetName, _ := url.QueryUnescape(c.Param("dataset"))
 
@@ -202,49 +262,62 @@ func (dh *datasetHandler) datasetStore(c echo.Context) error {
 		dh.logger.Warnw(err.Error(), "dataset", datasetName)
 		return echo.ErrNotFound
 	}
-	defer dh.storages.Close(datasetName)
 
 	storeConfig := storage.GetConfig()
 
 	// parse it
 	batchSize := 10000
 
+	var storeErr error
 	err = entity.ParseStream(c.Request().Body, func(entities []*uda.Entity, entityContext *uda.Context) error {
 		// filter if storeDeleted is false
-		if storeConfig.ResolveNamespace {
+		if storeConfig.RdfConfig != nil {
+			// rdf needs full uris everywhere, also in keys
+			entities = entity.ExpandAllUris(entities, entityContext)
+		} else if storeConfig.ResolveNamespace {
 			entities = uda.ExpandUris(entities, entityContext)
 		}
-		var deliverOnceClient datahub.Client
-		if storeConfig.DeliverOnceConfig.Enabled {
-			err := storage.DeliverOnceVariableCheck()
-
-			if err != nil {
-				return err
-			}
-			client, err := storage.DeliverOnceClientInit()
-			if err != nil {
-				return err
-			}
-			deliverOnceClient = client
-		}
-		err2 := storage.StoreEntities(entities)
-
-		if storeConfig.DeliverOnceConfig.Enabled {
-			err := storage.DeliverOnce(entities, deliverOnceClient)
-			if err != nil {
-				return err
-			}
-		}
-
-		if err2 != nil {
-			return err2
-		}
-		return nil
+		storeErr = dh.storeBatch(storage, storeConfig, entities)
+		return storeErr
 	}, batchSize, storeConfig.StoreDeleted)
 
+	if storeErr != nil {
+		dh.logger.Errorw(storeErr.Error(), "err", storeErr, "dataset", datasetName)
+		return storageError(storeErr, "error in StoreEntities")
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, errors.New("could not parse the json payload").Error())
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+// storeBatch stores a batch of entities, and delivers it to the datahub for datasets delivered once
+func (dh *datasetHandler) storeBatch(storage store.StorageInterface, storeConfig conf.StorageBackend, entities []*uda.Entity) error {
+	var deliverOnceClient datahub.Client
+	if storeConfig.DeliverOnceConfig.Enabled {
+		err := storage.DeliverOnceVariableCheck()
+
+		if err != nil {
+			return err
+		}
+		client, err := storage.DeliverOnceClientInit()
+		if err != nil {
+			return err
+		}
+		deliverOnceClient = client
+	}
+	err2 := storage.StoreEntities(entities)
+
+	if storeConfig.DeliverOnceConfig.Enabled {
+		err := storage.DeliverOnce(entities, deliverOnceClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
@@ -568,6 +568,32 @@ func TestS3(t *testing.T) {
 			g.Assert(int(*fileSizes[0])).Eql(220) // changes schema
 			g.Assert(int(*fileSizes[1])).Eql(219) // latest schema
 		})
+		g.It("Should publish inferred parquet schemas next to the athena schemas", func() {
+			fileBytes, _ := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
+			_, err := http.Post(layerUrl+"/s3-parquet-inferred/entities", "application/javascript", bytes.NewReader(fileBytes))
+			g.Assert(err).IsNil()
+
+			getRes, err := s3Service.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String("s3-test-bucket"),
+				Key:    aws.String("schemas/s3-parquet-inferred.parquet-schema"),
+			})
+			g.Assert(err).IsNil()
+			schema, _ := io.ReadAll(getRes.Body)
+			g.Assert(strings.Contains(string(schema), "optional binary firstname (STRING);")).IsTrue(string(schema))
+			g.Assert(strings.Contains(string(schema), "optional int64 age;")).IsTrue(string(schema))
+
+			getRes, err = s3Service.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String("s3-test-bucket"),
+				Key:    aws.String("schemas/s3-parquet-inferred-latest.sql"),
+			})
+			g.Assert(err).IsNil()
+			ddl, _ := io.ReadAll(getRes.Body)
+			g.Assert(strings.Contains(string(ddl), "`age` bigint")).IsTrue(string(ddl))
+
+			fileSizes, _ := retrieveFirstObjectFromS3(s3Service, "s3-parquet-inferred/changes")
+			g.Assert(len(fileSizes)).Eql(1)
+		})
+
 		g.It("Should return entities from an s3 ndjson fullsync (single file) dataset", func() {
 			fileBytes, _ := ioutil.ReadFile("./resources/test/data/s3-test-1.json")
 			var expected []map[string]interface{}